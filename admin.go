@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+var adminToken string
+
+// requireAdmin guards the admin endpoints only admins may use.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return requireRole(roleAdmin, h)
+}
+
+// requireOperator guards the admin endpoints operators may use as well.
+func requireOperator(h http.HandlerFunc) http.HandlerFunc {
+	return requireRole(roleOperator, h)
+}
+
+// requireRole guards admin endpoints. Accounts with role min or a higher
+// one, and API keys with the admin scope, are let through, and so are
+// requests presenting the admin token as a bearer token. Without a token,
+// role or key nobody is: behind a reverse proxy every client would look
+// like one on the loopback interface, so that is no credential.
+func requireRole(min string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v, perr := requestViewer(r); perr == nil && roleAtLeast(v.role, min) {
+			h(w, r)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(got), []byte(adminToken)) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "an admin account, an API key with the admin scope or the admin token is required")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func v1ListDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"dead_letters": deadLetters.list()})
+}
+
+// v1RedeliverDeadLetterHandler makes one fresh delivery attempt and drops
+// the dead letter when it succeeds.
+func v1RedeliverDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	dl, ok := deadLetters.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no dead letter with id "+r.PathValue("id"))
+		return
+	}
+	n, ok := webhookByURL[dl.Endpoint]
+	if !ok {
+		writeAPIError(w, http.StatusConflict, "unknown_endpoint", "endpoint "+dl.Endpoint+" is no longer configured")
+		return
+	}
+	if err := n.send(dl.Event.Event, dl.Event); err != nil {
+		writeAPIError(w, http.StatusBadGateway, "delivery_failed", err.Error())
+		return
+	}
+	if _, err := deadLetters.remove(dl.ID); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "delivered"})
+}
+
+func v1DeleteDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	ok, err := deadLetters.remove(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no dead letter with id "+r.PathValue("id"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiVersion is one generation of the JSON API. Each version owns its own
+// mux so v1 and v2 handlers can live side by side and a breaking change in
+// v2 never leaks into v1 routes.
+type apiVersion struct {
+	Name       string     `json:"version"`
+	Status     string     `json:"status"` // "current" or "deprecated"
+	Sunset     *time.Time `json:"sunset,omitempty"`
+	mux        *http.ServeMux
+	deprecated bool
+}
+
+var (
+	apiVersions = map[string]*apiVersion{}
+	apiDefault  string
+)
+
+// vendorMediaType matches Accept headers such as
+// "application/vnd.persianocr.v2+json".
+var vendorMediaType = regexp.MustCompile(`application/vnd\.persianocr\.(v\d+)\+json`)
+
+// registerAPIVersion adds a version whose routes are installed by routes.
+// Patterns are relative to the version root, e.g. "GET /jobs/{id}".
+func registerAPIVersion(name string, routes func(mux *http.ServeMux)) *apiVersion {
+	v := &apiVersion{Name: name, Status: "current", mux: http.NewServeMux()}
+	routes(v.mux)
+	apiVersions[name] = v
+	if apiDefault == "" {
+		apiDefault = name
+	}
+	return v
+}
+
+// deprecate marks the version as deprecated. Responses then carry the
+// Deprecation and Sunset headers so integrations get a warning well before
+// the version is removed.
+func (v *apiVersion) deprecate(sunset time.Time) {
+	v.deprecated = true
+	v.Status = "deprecated"
+	if !sunset.IsZero() {
+		v.Sunset = &sunset
+	}
+}
+
+func (v *apiVersion) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("API-Version", v.Name)
+	if v.deprecated {
+		w.Header().Set("Deprecation", "true")
+		if v.Sunset != nil {
+			w.Header().Set("Sunset", v.Sunset.UTC().Format(http.TimeFormat))
+		}
+		w.Header().Set("Link", `</api/versions>; rel="deprecation"`)
+	}
+	v.mux.ServeHTTP(w, r)
+}
+
+// apiHandler routes /api/... requests. An explicit /api/vN/ prefix wins;
+// otherwise the version is negotiated from the API-Version header or a
+// vendor media type in Accept, falling back to the default version.
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api")
+	if rest == "/versions" {
+		if perr := authorizeAPI(r, rest); perr != nil {
+			writeAPIError(w, perr.Status, perr.Code, perr.Error())
+			return
+		}
+		listAPIVersions(w, r)
+		return
+	}
+	if rest == "/openapi.json" && r.Method == http.MethodGet {
+		// Public like the hooks description, so client generators can
+		// fetch it without a key.
+		openAPIHandler(w, r)
+		return
+	}
+
+	name, sub := "", rest
+	if parts := strings.SplitN(strings.TrimPrefix(rest, "/"), "/", 2); len(parts) > 0 && isVersionName(parts[0]) {
+		name = parts[0]
+		sub = "/"
+		if len(parts) == 2 {
+			sub += parts[1]
+		}
+	} else {
+		name = negotiateAPIVersion(r)
+	}
+
+	v, ok := apiVersions[name]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "unknown_version", "API version "+name+" is not supported; see /api/versions")
+		return
+	}
+
+	if perr := authorizeAPI(r, sub); perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	if perr := checkAPICSRF(r, sub); perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = sub
+	r2.URL.RawPath = ""
+	v.ServeHTTP(w, r2)
+}
+
+func negotiateAPIVersion(r *http.Request) string {
+	if h := strings.TrimSpace(r.Header.Get("API-Version")); h != "" {
+		return h
+	}
+	if m := vendorMediaType.FindStringSubmatch(r.Header.Get("Accept")); m != nil {
+		return m[1]
+	}
+	return apiDefault
+}
+
+func isVersionName(s string) bool {
+	if len(s) < 2 || s[0] != 'v' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func listAPIVersions(w http.ResponseWriter, r *http.Request) {
+	list := make([]*apiVersion, 0, len(apiVersions))
+	for _, v := range apiVersions {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, map[string]any{
+		"default":  apiDefault,
+		"versions": list,
+	})
+}
+
+// APIError is the error body shared by every JSON endpoint.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]APIError{"error": {Code: code, Message: message}})
+}
@@ -0,0 +1,793 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxUploadSize bounds the documents accepted by the API, see
+// -max-upload-size. The web form and resumable uploads have limits of
+// their own, formMaxSize and tusMaxSize.
+var maxUploadSize = int64(32) << 20
+
+// multipartMemory is how much of a multipart upload is held in memory; the
+// rest is written to temporary files.
+const multipartMemory = 32 << 20
+
+// parseUploadForm parses the multipart form of r, refusing a body over
+// limit, and the form fields besides it, with an *http.MaxBytesError.
+func parseUploadForm(w http.ResponseWriter, r *http.Request, limit int64) error {
+	r.Body = http.MaxBytesReader(w, r.Body, limit+maxFormValues)
+	return r.ParseMultipartForm(multipartMemory)
+}
+
+// writeFormError answers a form parseUploadForm refused.
+func writeFormError(w http.ResponseWriter, err error, limit int64) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("the upload is larger than %d MB", limit>>20))
+		return
+	}
+	writeAPIError(w, http.StatusBadRequest, "invalid_form", "Error parsing form: "+err.Error())
+}
+
+// parseChecksum checks the SHA-256 a client sent with its upload, in hex,
+// and returns it in lower case.
+func parseChecksum(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "", nil
+	}
+	if b, err := hex.DecodeString(s); err != nil || len(b) != sha256.Size {
+		return "", errors.New("sha256 must be 64 hexadecimal digits")
+	}
+	return s, nil
+}
+
+// v1Routes installs the v1 JSON API.
+func v1Routes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{$}", v1IndexHandler)
+	mux.HandleFunc("GET /account", v1AccountHandler)
+	mux.HandleFunc("GET /account/usage", v1AccountUsageHandler)
+	mux.HandleFunc("GET /account/usage/monthly", v1AccountUsageMonthlyHandler)
+	mux.HandleFunc("GET /uploads/{id}/progress", v1UploadProgressHandler)
+	mux.HandleFunc("POST /quick", v1QuickHandler)
+	mux.HandleFunc("POST /ocr", v1OCRHandler)
+	mux.HandleFunc("POST /quote", v1QuoteHandler)
+	mux.HandleFunc("GET /extension", requireExtension(v1ExtensionHandler))
+	mux.HandleFunc("OPTIONS /extension", requireExtension(v1ExtensionHandler))
+	mux.HandleFunc("POST /extension/ocr", requireExtension(v1ExtensionOCRHandler))
+	mux.HandleFunc("OPTIONS /extension/ocr", requireExtension(v1ExtensionOCRHandler))
+	mux.HandleFunc("OPTIONS /tus", tusHeaders(v1TusOptionsHandler))
+	mux.HandleFunc("POST /tus", tusHeaders(v1TusCreateHandler))
+	mux.HandleFunc("HEAD /tus/{id}", tusHeaders(v1TusHeadHandler))
+	mux.HandleFunc("PATCH /tus/{id}", tusHeaders(v1TusPatchHandler))
+	mux.HandleFunc("DELETE /tus/{id}", tusHeaders(v1TusDeleteHandler))
+	mux.HandleFunc("POST /batches", v1SubmitBatchHandler)
+	mux.HandleFunc("GET /batches/{id}", v1GetBatchHandler)
+	mux.HandleFunc("GET /jobs", v1ListJobsHandler)
+	mux.HandleFunc("POST /jobs", v1SubmitJobHandler)
+	mux.HandleFunc("POST /jobs/validate", v1ValidateHandler)
+	mux.HandleFunc("GET /jobs/stats", v1JobStatsHandler)
+	mux.HandleFunc("GET /search", v1SearchHandler)
+	mux.HandleFunc("GET /feed.atom", v1FeedHandler)
+	mux.HandleFunc("GET /jobs/{id}", ownJob(v1GetJobHandler))
+	mux.HandleFunc("DELETE /jobs/{id}", ownJob(v1CancelJobHandler))
+	mux.HandleFunc("GET /jobs/{id}/wait", ownJob(v1WaitJobHandler))
+	mux.HandleFunc("GET /jobs/{id}/events", ownJob(v1JobEventsHandler))
+	mux.HandleFunc("GET /jobs/{id}/ws", ownJob(v1JobSocketHandler))
+	mux.HandleFunc("POST /jobs/{id}/resume", ownJob(v1ResumeJobHandler))
+	mux.HandleFunc("PUT /jobs/{id}/pin", ownJob(v1PinJobHandler))
+	mux.HandleFunc("DELETE /jobs/{id}/pin", ownJob(v1PinJobHandler))
+	mux.HandleFunc("GET /jobs/{id}/pages/{n}/text", ownJob(v1PageTextHandler))
+	mux.HandleFunc("GET /jobs/{id}/rescan", ownJob(v1RescanHandler))
+	mux.HandleFunc("POST /hooks/jobs", requireHookToken(v1HookSubmitHandler))
+	mux.HandleFunc("GET /hooks/jobs/{id}", requireHookToken(v1HookJobHandler))
+	mux.HandleFunc("GET /hooks/openapi.json", v1HookOpenAPIHandler)
+	mux.HandleFunc("GET /admin/usage", requireOperator(v1AdminUsageHandler))
+	mux.HandleFunc("GET /admin/usage/monthly", requireOperator(v1AdminUsageMonthlyHandler))
+	mux.HandleFunc("GET /admin/pinned", requireOperator(v1AdminPinnedHandler))
+	mux.HandleFunc("GET /admin/holds", requireAdmin(v1ListHoldsHandler))
+	mux.HandleFunc("PUT /admin/jobs/{id}/hold", requireAdmin(v1HoldJobHandler))
+	mux.HandleFunc("DELETE /admin/jobs/{id}/hold", requireAdmin(v1HoldJobHandler))
+	mux.HandleFunc("GET /admin/audit", requireAdmin(v1AuditHandler))
+	mux.HandleFunc("GET /admin/duplicates", requireOperator(v1DuplicatesHandler))
+	mux.HandleFunc("POST /admin/duplicates/{id}/merge", requireAdmin(v1MergeDuplicatesHandler))
+	mux.HandleFunc("DELETE /admin/duplicates/{id}", requireOperator(v1DismissDuplicateHandler))
+	mux.HandleFunc("GET /admin/schedules", requireOperator(v1ListSchedulesHandler))
+	mux.HandleFunc("POST /admin/schedules", requireAdmin(v1CreateScheduleHandler))
+	mux.HandleFunc("DELETE /admin/schedules/{name}", requireAdmin(v1DeleteScheduleHandler))
+	mux.HandleFunc("GET /admin/schedules/{name}/runs", requireOperator(v1ScheduleRunsHandler))
+	mux.HandleFunc("POST /admin/schedules/{name}/run", requireOperator(v1RunScheduleHandler))
+	mux.HandleFunc("GET /admin/keys", requireAdmin(v1ListKeysHandler))
+	mux.HandleFunc("POST /admin/keys", requireAdmin(v1CreateKeyHandler))
+	mux.HandleFunc("DELETE /admin/keys/{id}", requireAdmin(v1RevokeKeyHandler))
+	mux.HandleFunc("GET /admin/users", requireAdmin(v1ListUsersHandler))
+	mux.HandleFunc("POST /admin/users", requireAdmin(v1CreateUserHandler))
+	mux.HandleFunc("GET /admin/users/{name}", requireAdmin(v1GetUserHandler))
+	mux.HandleFunc("PATCH /admin/users/{name}", requireAdmin(v1UpdateUserHandler))
+	mux.HandleFunc("POST /admin/users/{name}/keys", requireAdmin(v1ResetUserKeysHandler))
+	mux.HandleFunc("GET /admin/users/{name}/jobs", requireOperator(v1UserJobsHandler))
+	mux.HandleFunc("GET /admin/webhooks/dead-letters", requireOperator(v1ListDeadLettersHandler))
+	mux.HandleFunc("POST /admin/webhooks/dead-letters/{id}/redeliver", requireOperator(v1RedeliverDeadLetterHandler))
+	mux.HandleFunc("DELETE /admin/webhooks/dead-letters/{id}", requireOperator(v1DeleteDeadLetterHandler))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no such endpoint: "+r.Method+" "+r.URL.Path)
+	})
+}
+
+func v1IndexHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"version": "v1",
+		"service": "persianOCR",
+	})
+}
+
+// v1SubmitJobHandler accepts a PDF, a Word or PowerPoint file of scans or an
+// image (see convertToPDF) in the "file" multipart field, or the URL of one
+// in a "url" field (see fetchDocument), or the ID of a finished resumable
+// upload in an "upload" field (see tus.go), and queues it, with
+// optional "tag" fields (see parseTags), an "output_name" template (see
+// renderOutputName), an "engine", "languages" plus "page_languages"
+// overrides (see parseLanguageMap), a "text_layout", a "mode" (see
+// ocrModes), a "dpi" (see dpiModes), "separate_notes", a "glossary" (see parseGlossary), a
+// "charset", template "regions" (see parseRegions), a "destination"
+// with an optional "destination_path" and
+// "destination_template" (see renderDeliveryPath) to push the results to
+// and a "notify_email" to mail them to (see sendResultMail). An
+// Idempotency-Key header makes retries safe: reusing the key for the same
+// upload returns the original job instead of creating a new one, and an
+// X-Upload-ID lets the client follow the upload itself (see trackUpload).
+// The caller's plan (see planSet.identify) bounds the file size, engines and
+// monthly pages, and sets the queue priority.
+func v1SubmitJobHandler(w http.ResponseWriter, r *http.Request) {
+	submitJob(w, r, func(job Job, replayed bool, err error) {
+		writeSubmitResult(w, job, replayed, err)
+	})
+}
+
+// submitJob validates and queues the upload in r as described at
+// v1SubmitJobHandler, answering bad requests itself, and hands the outcome
+// of the submission to respond. Besides a multipart form, the body may be
+// a raw PDF (Content-Type: application/pdf), with the options as query
+// parameters and the file name in ?filename= or Content-Disposition.
+func submitJob(w http.ResponseWriter, r *http.Request, respond func(job Job, replayed bool, err error)) {
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	up := trackUpload(r)
+	var jobID string
+	defer func() { up.finish(jobID) }()
+
+	var file io.Reader
+	var filename, sourceURL string
+	var size int64
+	var resumable *tusUpload // deleted once its job is queued
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/pdf" {
+		if r.ContentLength < 0 {
+			writeAPIError(w, http.StatusLengthRequired, "length_required", "a raw PDF upload needs a Content-Length")
+			return
+		}
+		if r.ContentLength > maxUploadSize {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("the document is larger than %d MB", maxUploadSize>>20))
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_form", "Error parsing query: "+err.Error())
+			return
+		}
+		// The rest of the handler reads its options from the form.
+		r.MultipartForm = &multipart.Form{Value: r.Form}
+		file, size = http.MaxBytesReader(w, r.Body, maxUploadSize), r.ContentLength
+		filename = r.Form.Get("filename")
+		if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil && filename == "" {
+			filename = params["filename"]
+		}
+		if filename == "" {
+			filename = "document.pdf"
+		}
+		if !strings.HasSuffix(strings.ToLower(filename), ".pdf") {
+			filename += ".pdf"
+		}
+	} else {
+		err := parseUploadForm(w, r, maxUploadSize)
+		if errors.Is(err, http.ErrNotMultipart) && (r.FormValue("url") != "" || r.FormValue("upload") != "") {
+			// A document URL or a resumable upload needs no multipart body.
+			r.MultipartForm, err = &multipart.Form{Value: r.Form}, nil
+		}
+		if err != nil {
+			writeFormError(w, err, maxUploadSize)
+			return
+		}
+		f, header, err := r.FormFile("file")
+		switch {
+		case errors.Is(err, http.ErrMissingFile) && r.FormValue("url") != "":
+			bf, ferr := fetchDocument(r.Context(), r.FormValue("url"))
+			if ferr != nil {
+				writeAPIError(w, ferr.Status, ferr.Code, ferr.Error())
+				return
+			}
+			defer os.Remove(bf.Spool)
+			body, err := bf.Open()
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+				return
+			}
+			defer body.Close()
+			file, filename, size, sourceURL = body, bf.Name, bf.Size, bf.Source
+		case errors.Is(err, http.ErrMissingFile) && r.FormValue("upload") != "":
+			u, bf, terr := tusUploadFile(account, r.FormValue("upload"))
+			if terr != nil {
+				writeAPIError(w, terr.Status, terr.Code, terr.Error())
+				return
+			}
+			body, err := bf.Open()
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+				return
+			}
+			defer body.Close()
+			file, filename, size, resumable = body, bf.Name, bf.Size, u
+		case err != nil:
+			writeAPIError(w, http.StatusBadRequest, "missing_file", "Error retrieving file: "+err.Error())
+			return
+		case header.Size > maxUploadSize:
+			f.Close()
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("the document is larger than %d MB", maxUploadSize>>20))
+			return
+		default:
+			defer f.Close()
+			file, filename, size = f, header.Filename, header.Size
+		}
+	}
+	up.parsed()
+
+	filename = cleanUploadName(filename)
+	if !isUploadType(filename) {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_type", errUnsupportedType.Error())
+		return
+	}
+
+	tags, err := parseTags(r.MultipartForm.Value["tag"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_tags", err.Error())
+		return
+	}
+
+	engine := r.FormValue("engine")
+	if engine == "" {
+		engine = defaultEngine
+	}
+	if perr := plan.checkUpload(size, engine); perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+
+	languages := strings.TrimSpace(r.FormValue("languages"))
+	if languages != "" {
+		if err := checkLanguages(languages); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_languages", err.Error())
+			return
+		}
+	}
+	pageLanguages, err := parseLanguageMap(r.FormValue("page_languages"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_languages", err.Error())
+		return
+	}
+
+	textLayout := r.FormValue("text_layout")
+	if textLayout != "" && !slices.Contains(textLayouts, textLayout) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_text_layout",
+			fmt.Sprintf("unknown text layout %q, use one of: %s", textLayout, strings.Join(textLayouts, ", ")))
+		return
+	}
+
+	mode := r.FormValue("mode")
+	if mode != "" && !slices.Contains(ocrModes, mode) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_mode",
+			fmt.Sprintf("unknown mode %q, use one of: %s", mode, strings.Join(ocrModes, ", ")))
+		return
+	}
+
+	dpi := r.FormValue("dpi")
+	switch {
+	case dpi != "" && !slices.Contains(dpiModes, dpi):
+		writeAPIError(w, http.StatusBadRequest, "invalid_dpi",
+			fmt.Sprintf("unknown dpi %q, use one of: %s", dpi, strings.Join(dpiModes, ", ")))
+		return
+	case dpi != "" && mode == "screenshot":
+		writeAPIError(w, http.StatusBadRequest, "invalid_dpi", "screenshots are upscaled by their mode; leave dpi out")
+		return
+	}
+
+	var separateNotes bool
+	if v := r.FormValue("separate_notes"); v != "" {
+		if separateNotes, err = strconv.ParseBool(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_form", "separate_notes must be true or false")
+			return
+		}
+	}
+
+	glossary, err := parseGlossary(r.MultipartForm)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_glossary", err.Error())
+		return
+	}
+
+	charset, err := parseCharset(r.FormValue("charset"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_charset", err.Error())
+		return
+	}
+	regions, err := parseRegions(r.FormValue("regions"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_regions", err.Error())
+		return
+	}
+
+	destination := r.FormValue("destination")
+	destinationPath := strings.Trim(r.FormValue("destination_path"), "/")
+	destinationTemplate := r.FormValue("destination_template")
+	if destination != "" {
+		err := checkDestination(destination, destinationPath, account)
+		if err == nil && destinationTemplate != "" {
+			err = validateDestinationTemplate(destinationTemplate)
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_destination", err.Error())
+			return
+		}
+	} else if destinationPath != "" || destinationTemplate != "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_destination", "destination_path and destination_template need a destination")
+		return
+	}
+
+	outputName := r.FormValue("output_name")
+	if outputName != "" {
+		if err := validateOutputName(outputName); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_output_name", err.Error())
+			return
+		}
+	}
+
+	checksum, err := parseChecksum(r.FormValue("sha256"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_checksum", err.Error())
+		return
+	}
+	notifyEmail, err := parseNotifyEmail(r.FormValue("notify_email"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_notify_email", err.Error())
+		return
+	}
+
+	spoolPath, fingerprint, err := spoolUpload(file)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("the document is larger than %d MB", maxUploadSize>>20))
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	if checksum != "" && checksum != fingerprint {
+		os.Remove(spoolPath)
+		writeAPIError(w, http.StatusUnprocessableEntity, "checksum_mismatch",
+			fmt.Sprintf("the document arrived with SHA-256 %s, not %s", fingerprint, checksum))
+		return
+	}
+
+	client := clientKey(r)
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if existing, ok, err := jobs.lookupKey(client, key, fingerprint); err != nil || ok {
+		os.Remove(spoolPath)
+		respond(existing, ok, err)
+		return
+	}
+
+	format := convertedFormat(filename)
+	if format != "" {
+		err = convertToPDF(spoolPath, format, plan.pageLimit())
+	}
+	var check pdfCheck
+	if err == nil {
+		check, err = checkPDF(spoolPath)
+	}
+	if err != nil {
+		os.Remove(spoolPath)
+		writePDFError(w, err)
+		return
+	}
+
+	maxDPI := renderDPI
+	if dpi == "auto" {
+		maxDPI = autoDPIMax
+	}
+	est, err := checkResourcesAt(spoolPath, maxDPI)
+	if err != nil {
+		os.Remove(spoolPath)
+		writeResourceError(w, err)
+		return
+	}
+
+	if !limiter.allowSubmission(w, r) {
+		os.Remove(spoolPath)
+		writeAPIError(w, http.StatusTooManyRequests, "quota_exceeded", "Daily submission quota exceeded")
+		return
+	}
+	if perr := checkPages(est.Pages, plan.pageLimit()); perr != nil {
+		os.Remove(spoolPath)
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	if perr := plan.chargePages(account, est.Pages); perr != nil {
+		os.Remove(spoolPath)
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+
+	job, replayed, err := jobs.submit(submission{
+		Client:        client,
+		Key:           key,
+		Filename:      filename,
+		SpoolPath:     spoolPath,
+		Fingerprint:   fingerprint,
+		Tags:          tags,
+		OutputName:    outputName,
+		Account:       account,
+		Priority:      plan.Priority,
+		Pages:         est.Pages,
+		MaxActive:     plan.activeJobLimit(),
+		Repaired:      check.Repaired,
+		ConvertedFrom: format,
+		SourceURL:     sourceURL,
+
+		Languages:     languages,
+		PageLanguages: pageLanguages,
+		TextLayout:    textLayout,
+		Mode:          mode,
+		DPI:           dpi,
+		Engine:        engine,
+		SeparateNotes: separateNotes,
+		Glossary:      glossary,
+		Charset:       charset,
+		Regions:       regions,
+
+		Destination:         destination,
+		DestinationPath:     destinationPath,
+		DestinationTemplate: destinationTemplate,
+		NotifyEmail:         notifyEmail,
+	})
+	if err != nil || replayed {
+		os.Remove(spoolPath)
+		usage.refund(account, est.Pages)
+	}
+	if err == nil {
+		jobID = job.ID
+		if resumable != nil {
+			resumable.remove()
+		}
+	}
+	respond(job, replayed, err)
+}
+
+// v1AccountHandler reports the caller's plan and this month's page usage.
+func v1AccountHandler(w http.ResponseWriter, r *http.Request) {
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"account":          account,
+		"plan":             plan,
+		"month":            usageMonth(time.Now()),
+		"pages_this_month": usage.month(account),
+	})
+}
+
+// writePDFError answers an upload that failed convertToPDF or checkPDF.
+func writePDFError(w http.ResponseWriter, err error) {
+	var pe *pdfError
+	var perr *planError
+	switch {
+	case errors.As(err, &pe):
+		writeAPIError(w, http.StatusUnprocessableEntity, pe.Code, err.Error())
+	case errors.As(err, &perr):
+		writeAPIError(w, perr.Status, perr.Code, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+	}
+}
+
+// writeResourceError answers a document that failed checkResources: 507
+// when the disk is too full for it, 503 for memory pressure.
+func writeResourceError(w http.ResponseWriter, err error) {
+	var re *resourceError
+	switch {
+	case errors.As(err, &re) && re.Storage:
+		writeAPIError(w, http.StatusInsufficientStorage, "insufficient_storage", err.Error())
+	case errors.As(err, &re):
+		writeAPIError(w, http.StatusServiceUnavailable, "insufficient_memory", err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+	}
+}
+
+func writeSubmitResult(w http.ResponseWriter, job Job, replayed bool, err error) {
+	switch {
+	case errors.Is(err, errIdempotencyMismatch):
+		writeAPIError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", err.Error())
+	case errors.Is(err, errTooManyJobs):
+		setRetryAfter(w, err)
+		writeAPIError(w, errTooManyJobs.Status, errTooManyJobs.Code, err.Error())
+	case err != nil:
+		writeAPIError(w, http.StatusServiceUnavailable, "submit_failed", err.Error())
+	case replayed:
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.Header().Set("Location", appPath("/api/v1/jobs/"+job.ID))
+		writeJSON(w, http.StatusOK, job)
+	default:
+		w.Header().Set("Location", appPath("/api/v1/jobs/"+job.ID))
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// v1ListJobsHandler lists jobs, newest first, narrowed by the metadata
+// filters described at parseJobFilter.
+func v1ListJobsHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := parseJobFilter(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+	v, perr := requestViewer(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": jobs.list(func(j *Job) bool { return v.sees(j) && f.match(j) })})
+}
+
+// v1JobStatsHandler counts jobs per status, optionally grouped by the values
+// of one tag key: GET /jobs/stats?by=department. It accepts the same filters
+// as the job list.
+func v1JobStatsHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := parseJobFilter(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+	v, perr := requestViewer(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	by := r.URL.Query().Get("by")
+	groups := map[string]map[JobStatus]int{}
+	for _, j := range jobs.list(func(j *Job) bool { return v.sees(j) && f.match(j) }) {
+		group := "all"
+		if by != "" {
+			v, ok := j.Tags[by]
+			if !ok {
+				continue
+			}
+			group = v
+		}
+		if groups[group] == nil {
+			groups[group] = map[JobStatus]int{}
+		}
+		groups[group][j.Status]++
+		groups[group]["total"]++
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"by": by, "groups": groups})
+}
+
+func v1GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+r.PathValue("id"))
+		return
+	}
+	writeJSONCached(w, r, http.StatusOK, job)
+}
+
+// v1ResumeJobHandler queues a failed job again, keeping the pages it had
+// already finished.
+func v1ResumeJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := jobs.resume(r.PathValue("id"))
+	switch {
+	case errors.Is(err, errJobNotFound):
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+r.PathValue("id"))
+	case errors.Is(err, errNotResumable), errors.Is(err, errLeaseHeld):
+		writeAPIError(w, http.StatusConflict, "not_resumable", err.Error())
+	case err != nil:
+		writeAPIError(w, http.StatusServiceUnavailable, "submit_failed", err.Error())
+	default:
+		w.Header().Set("Location", appPath("/api/v1/jobs/"+job.ID))
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// v1CancelJobHandler cancels a queued or processing job. A queued job is
+// returned canceled; a processing one answers 202 while its OCR run is
+// being stopped, and /wait returns once it is.
+func v1CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := jobs.cancel(r.PathValue("id"))
+	switch {
+	case errors.Is(err, errJobNotFound):
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+r.PathValue("id"))
+	case errors.Is(err, errLegalHold):
+		writeAPIError(w, http.StatusConflict, "legal_hold", "the job is under legal hold and cannot be canceled until an admin lifts it")
+	case err != nil:
+		writeAPIError(w, http.StatusConflict, "not_cancelable", err.Error())
+	case job.Status == JobCanceled:
+		writeJSON(w, http.StatusOK, job)
+	default:
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+// maxWaitTimeout caps how long a long-poll request may hold a connection.
+const maxWaitTimeout = 5 * time.Minute
+
+// v1WaitJobHandler long-polls a job: it blocks until the job is done or
+// failed, or until ?timeout= (default 30s) expires, then returns the job.
+// Callers check the status and simply call again if it is still running.
+func v1WaitJobHandler(w http.ResponseWriter, r *http.Request) {
+	timeout, ok := waitTimeout(w, r, 30*time.Second)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	job, ok := jobs.wait(ctx, r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+r.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// waitTimeout reads ?timeout= as a duration or a number of seconds, capped
+// at maxWaitTimeout. It answers an invalid value itself and returns false.
+func waitTimeout(w http.ResponseWriter, r *http.Request, def time.Duration) (time.Duration, bool) {
+	v := r.URL.Query().Get("timeout")
+	if v == "" {
+		return def, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, serr := strconv.Atoi(v)
+		if serr != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_timeout", "timeout must be a duration such as 60s")
+			return 0, false
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	return min(max(d, 0), maxWaitTimeout), true
+}
+
+// ocrResponse is the answer of POST /ocr: the job with absolute links and,
+// once it is done, its text.
+type ocrResponse struct {
+	JobID       string        `json:"job_id"`
+	Status      JobStatus     `json:"status"`
+	Filename    string        `json:"filename"`
+	Error       string        `json:"error,omitempty"`
+	JobURL      string        `json:"job_url"`
+	TextURL     string        `json:"text_url,omitempty"`
+	PDFURL      string        `json:"pdf_url,omitempty"`
+	Confidence  *float64      `json:"confidence,omitempty"`
+	FailedPages []PageFailure `json:"failed_pages,omitempty"`
+	Warnings    []PageWarning `json:"warnings,omitempty"`
+	Text        *string       `json:"text,omitempty"`
+}
+
+// v1OCRHandler submits a document like POST /jobs and waits for it, up to
+// ?timeout= (default 2m), so one request gets the text back. A job that
+// is still running when the timeout expires is answered with 202 and its
+// job_url to poll; a failed one with 200 and its error.
+func v1OCRHandler(w http.ResponseWriter, r *http.Request) {
+	timeout, ok := waitTimeout(w, r, 2*time.Minute)
+	if !ok {
+		return
+	}
+	submitJob(w, r, func(job Job, replayed bool, err error) {
+		if err != nil {
+			writeSubmitResult(w, job, replayed, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		job, _ = jobs.wait(ctx, job.ID)
+
+		resp, err := newOCRResponse(job)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+			return
+		}
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+		w.Header().Set("Location", appPath("/api/v1/jobs/"+job.ID))
+		if job.finished() {
+			writeJSON(w, http.StatusOK, resp)
+		} else {
+			writeJSON(w, http.StatusAccepted, resp)
+		}
+	})
+}
+
+// newOCRResponse builds the ocrResponse for job, reading its text if it is
+// done.
+func newOCRResponse(job Job) (ocrResponse, error) {
+	ev := jobEvent("", job)
+	resp := ocrResponse{
+		JobID: job.ID, Status: job.Status, Filename: job.Filename, Error: job.Error,
+		JobURL: ev.JobURL, TextURL: ev.TextURL, PDFURL: ev.PDFURL,
+		Confidence: job.Confidence, FailedPages: job.FailedPages, Warnings: job.Warnings,
+	}
+	if job.Status == JobDone {
+		text, err := readStored(filepath.Join(job.outputDir, job.prefix+".txt"))
+		if err != nil {
+			return resp, fmt.Errorf("Error reading text: %w", err)
+		}
+		s := string(text)
+		resp.Text = &s
+	}
+	return resp, nil
+}
+
+// v1PageTextHandler serves the text of a single page. Pages are published as
+// soon as the engine finishes them, so long documents can be consumed while
+// the job is still running; a page that is not ready yet answers 425.
+func v1PageTextHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+r.PathValue("id"))
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 1 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_page", "page number must be a positive integer")
+		return
+	}
+
+	f, err := openStored(pagePath(job.outputDir, n))
+	if err != nil {
+		if job.Status == JobQueued || job.Status == JobProcessing {
+			w.Header().Set("Retry-After", "5")
+			writeAPIError(w, http.StatusTooEarly, "page_not_ready", fmt.Sprintf("page %d has not been recognized yet", n))
+			return
+		}
+		writeAPIError(w, http.StatusNotFound, "page_not_found", fmt.Sprintf("job has no text for page %d", n))
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("ETag", fileETag(fi))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// API key scopes. GET requests need jobs:read, other requests jobs:write
+// and the admin endpoints admin.
+const (
+	scopeRead  = "jobs:read"
+	scopeWrite = "jobs:write"
+	scopeAdmin = "admin"
+)
+
+var knownScopes = []string{scopeRead, scopeWrite, scopeAdmin}
+
+// defaultScopes are given to keys created without scopes and to the keys of
+// the plans file, which predate scopes.
+var defaultScopes = []string{scopeRead, scopeWrite}
+
+// apiKeysRequired makes every /api/ request present a valid API key or a
+// web UI session, see authorizeAPI. It is cleared by -allow-anonymous-api;
+// requests without a key then use the default plan.
+var apiKeysRequired bool
+
+// StoredKey is an API key created with "persianOCR keys create" or the
+// admin API. Only a hash of the key is kept; the key itself is shown once,
+// when it is created.
+type StoredKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`           // account the usage is metered against
+	Plan    string    `json:"plan,omitempty"` // plan in the plans file
+	Email   string    `json:"email,omitempty"`
+	Scopes  []string  `json:"scopes"`
+	Hint    string    `json:"hint"`           // the last characters of the key, to tell keys apart
+	Hash    string    `json:"hash,omitempty"` // hex SHA-256 of the key, left out of API responses
+	Created time.Time `json:"created"`
+}
+
+// keyStore keeps the stored API keys in a JSON file under the data
+// directory. The file is read again when it changes, so keys created or
+// revoked on the command line take effect without a restart.
+type keyStore struct {
+	mu      sync.Mutex
+	path    string
+	keys    []StoredKey
+	byHash  map[[32]byte]int // index into keys
+	modTime time.Time
+}
+
+var apiKeys = &keyStore{}
+
+func openKeyStore(path string) (*keyStore, error) {
+	s := &keyStore{path: path}
+	if err := s.reloadLocked(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// reloadLocked reads the file if it changed since it was last read.
+func (s *keyStore) reloadLocked() error {
+	fi, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.keys, s.byHash, s.modTime = nil, nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modTime) && s.byHash != nil {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var keys []StoredKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	s.setLocked(keys)
+	s.modTime = fi.ModTime()
+	return nil
+}
+
+func (s *keyStore) setLocked(keys []StoredKey) {
+	s.keys = keys
+	s.byHash = make(map[[32]byte]int, len(keys))
+	for i, k := range keys {
+		var h [32]byte
+		if b, err := hex.DecodeString(k.Hash); err == nil && len(b) == len(h) {
+			copy(h[:], b)
+			s.byHash[h] = i
+		}
+	}
+}
+
+func (s *keyStore) saveLocked(keys []StoredKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.setLocked(keys)
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+// lookup returns the stored key matching key.
+func (s *keyStore) lookup(key string) (StoredKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return StoredKey{}, false
+	}
+	s.reloadLocked()
+	i, ok := s.byHash[sha256.Sum256([]byte(key))]
+	if !ok {
+		return StoredKey{}, false
+	}
+	return s.keys[i], true
+}
+
+// empty reports whether no keys are stored.
+func (s *keyStore) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return true
+	}
+	s.reloadLocked()
+	return len(s.keys) == 0
+}
+
+// list returns the stored keys without their hashes.
+func (s *keyStore) list() ([]StoredKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return nil, err
+	}
+	keys := make([]StoredKey, len(s.keys))
+	for i, k := range s.keys {
+		k.Hash = ""
+		keys[i] = k
+	}
+	return keys, nil
+}
+
+// create generates a new key and stores its hash. The key is returned once
+// and cannot be recovered later.
+func (s *keyStore) create(k StoredKey) (string, StoredKey, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", StoredKey{}, err
+	}
+	key := "pocr_" + base64.RawURLEncoding.EncodeToString(b[:])
+	sum := sha256.Sum256([]byte(key))
+	k.ID = randomHex(8)
+	k.Hint = key[len(key)-4:]
+	k.Hash = hex.EncodeToString(sum[:])
+	k.Created = time.Now().UTC()
+	if len(k.Scopes) == 0 {
+		k.Scopes = defaultScopes
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return "", StoredKey{}, err
+	}
+	if err := s.saveLocked(append(slices.Clone(s.keys), k)); err != nil {
+		return "", StoredKey{}, err
+	}
+	k.Hash = ""
+	return key, k, nil
+}
+
+// forAccount returns the stored keys of an account, without their hashes.
+func (s *keyStore) forAccount(name string) ([]StoredKey, error) {
+	keys, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(keys, func(k StoredKey) bool { return k.Name != name }), nil
+}
+
+// revokeAccount deletes every stored key of an account and returns them.
+func (s *keyStore) revokeAccount(name string) ([]StoredKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return nil, err
+	}
+	var revoked, kept []StoredKey
+	for _, k := range s.keys {
+		if k.Name == name {
+			revoked = append(revoked, k)
+		} else {
+			kept = append(kept, k)
+		}
+	}
+	if len(revoked) == 0 {
+		return nil, nil
+	}
+	return revoked, s.saveLocked(kept)
+}
+
+// revoke deletes the key with the given ID.
+func (s *keyStore) revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reloadLocked(); err != nil {
+		return false, err
+	}
+	i := slices.IndexFunc(s.keys, func(k StoredKey) bool { return k.ID == id })
+	if i < 0 {
+		return false, nil
+	}
+	return true, s.saveLocked(slices.Delete(slices.Clone(s.keys), i, i+1))
+}
+
+// checkKeyFields validates the fields of a key to be created against
+// knownScopes and the plans in ps.
+func checkKeyFields(k StoredKey, ps *planSet) error {
+	if strings.TrimSpace(k.Name) == "" {
+		return errors.New("a key needs a name, the account its usage is metered against")
+	}
+	if err := checkScopes(k.Scopes); err != nil {
+		return err
+	}
+	if _, err := ps.plan(k.Plan); err != nil {
+		return err
+	}
+	return nil
+}
+
+func checkScopes(scopes []string) error {
+	for _, sc := range scopes {
+		if !slices.Contains(knownScopes, sc) {
+			return fmt.Errorf("unknown scope %q: use %s", sc, strings.Join(knownScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// keyAccount returns the account and scopes of an API key from the plans
+// file or the key store, and whether the key is valid at all.
+func keyAccount(key string) (string, []string, bool) {
+	if a, ok := plans.byHash[sha256.Sum256([]byte(key))]; ok {
+		return a.name, a.scopes, true
+	}
+	if k, ok := apiKeys.lookup(key); ok {
+		return k.Name, k.Scopes, true
+	}
+	return "", nil, false
+}
+
+// ownCredentialRoutes are the API routes whose handlers check credentials
+// of their own.
+var ownCredentialRoutes = []string{"/hooks/", "/extension", "/admin/"}
+
+// authorizeAPI checks that a request to route, the path below /api and its
+// version, carries an API key with the scope the route needs. A key that is
+// sent is always checked; a request without one is only refused when keys
+// are required. Preflight requests and the routes with credentials of their
+// own are left to their handlers: the hooks API (hook token), browser
+// extensions (extension token) and the admin endpoints (see requireAdmin).
+// A user signed in to the web UI needs no key; the session has the default
+// scopes, so the pages' live features keep working.
+func authorizeAPI(r *http.Request, route string) *planError {
+	if r.Method == http.MethodOptions {
+		return nil
+	}
+	for _, own := range ownCredentialRoutes {
+		if strings.HasPrefix(route, own) {
+			return nil
+		}
+	}
+	account, scopes := "", defaultScopes
+	if key := requestAPIKey(r); key != "" {
+		var ok bool
+		if account, scopes, ok = keyAccount(key); !ok {
+			return &planError{http.StatusUnauthorized, "invalid_api_key", "the API key is not valid"}
+		}
+	} else if !apiKeysRequired {
+		return nil
+	} else if s, ok := currentSession(r); ok {
+		account = s.account()
+	} else {
+		return &planError{http.StatusUnauthorized, "api_key_required", "an API key is required"}
+	}
+	if u, ok := users.get(account); ok && u.Disabled {
+		return errAccountDisabled
+	}
+	need := scopeWrite
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		need = scopeRead
+	}
+	if !slices.Contains(scopes, need) {
+		return &planError{http.StatusForbidden, "insufficient_scope", "the API key lacks the " + need + " scope"}
+	}
+	return nil
+}
+
+func v1ListKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := apiKeys.list()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
+
+// v1CreateKeyHandler creates a key from a JSON body with its "name", and
+// optional "plan", "email" and "scopes". The key is in the response, the
+// only time it is shown.
+func v1CreateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var k StoredKey
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&k); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+	if err := checkKeyFields(k, plans); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_key", err.Error())
+		return
+	}
+	key, k, err := apiKeys.create(StoredKey{Name: k.Name, Plan: k.Plan, Email: k.Email, Scopes: k.Scopes})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"key": key, "api_key": k})
+}
+
+func v1RevokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	ok, err := apiKeys.revoke(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no API key with id "+r.PathValue("id"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keysCommand is "persianOCR keys", which manages the stored API keys of
+// the server with the same data directory:
+//
+//	persianOCR keys create -name finance [-plan internal] [-scopes jobs:read,jobs:write] [-email ...]
+//	persianOCR keys list
+//	persianOCR keys revoke <id>
+func keysCommand(args []string) int {
+	fs := flag.NewFlagSet("keys", flag.ExitOnError)
+	dataDir := fs.String("data-dir", envString("OCR_DATA_DIR", "data"), "directory for server state")
+	plansFile := fs.String("plans-file", envString("OCR_PLANS_FILE", ""), "JSON file with service plans, to check -plan against")
+	name := fs.String("name", "", "account the key's usage is metered against")
+	plan := fs.String("plan", "", "plan of the key, from the plans file")
+	email := fs.String("email", "", "address for the account's notices")
+	scopes := fs.String("scopes", strings.Join(defaultScopes, ","), "comma-separated scopes: "+strings.Join(knownScopes, ", "))
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: persianOCR keys create -name <account> [flags] | list | revoke <id>")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	cmd := args[0]
+	fs.Parse(args[1:])
+
+	store, err := openKeyStore(filepath.Join(*dataDir, "api_keys.json"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	switch cmd {
+	case "create":
+		ps := &planSet{}
+		if *plansFile != "" {
+			if ps, err = loadPlans(*plansFile); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		k := StoredKey{Name: *name, Plan: *plan, Email: *email, Scopes: strings.Split(*scopes, ",")}
+		if err := checkKeyFields(k, ps); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		key, k, err := store.create(k)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Created key %s for %s (%s).\n", k.ID, k.Name, strings.Join(k.Scopes, ", "))
+		fmt.Println("It is not stored and cannot be shown again:")
+		fmt.Println(key)
+	case "list":
+		keys, err := store.list()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPLAN\tSCOPES\tKEY\tCREATED")
+		for _, k := range keys {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t…%s\t%s\n", k.ID, k.Name, k.Plan, strings.Join(k.Scopes, ","), k.Hint, k.Created.Format(time.DateOnly))
+		}
+		tw.Flush()
+	case "revoke":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 2
+		}
+		ok, err := store.revoke(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !ok {
+			fmt.Fprintln(os.Stderr, "no API key with id "+fs.Arg(0))
+			return 1
+		}
+		fmt.Println("Revoked key " + fs.Arg(0) + ".")
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"path"
+	"slices"
+	"strings"
+)
+
+// A ZIP archive uploaded to a batch is unpacked into the batch: each PDF,
+// Office file or image in it becomes a job of its own, as if it had been
+// sent on its own. Entries are only ever read into spool files, never
+// extracted by their names, and their paths are checked before they are
+// recorded (Job.ArchiveEntry), so an archive cannot write outside its
+// workspace or smuggle in misleading names.
+
+// maxArchiveEntries bounds the entries read from one archive.
+const maxArchiveEntries = 1000
+
+// batchFile is one file of a batch: an upload, an entry of a ZIP archive
+// uploaded with it, or a document fetched by URL (see fetch.go).
+type batchFile struct {
+	Name   string // the uploaded file name, or the entry's path in the archive
+	Entry  bool   // Name is a path in an archive
+	Size   int64
+	Source string // the URL the file was fetched from
+	Open   func() (io.ReadCloser, error)
+
+	// Spool is set for a file already saved by spoolUpload, with the
+	// SHA-256 of its content, which admitUpload then takes over instead of
+	// copying it.
+	Spool       string
+	Fingerprint string
+}
+
+// isArchive reports whether filename is a ZIP archive to unpack, unless
+// -upload-types leaves archives out.
+func isArchive(filename string) bool {
+	return strings.HasSuffix(strings.ToLower(filename), ".zip") && slices.Contains(uploadTypes, ".zip")
+}
+
+// uploadedFile is a batchFile for a multipart upload.
+func uploadedFile(fh *multipart.FileHeader) batchFile {
+	return batchFile{Name: fh.Filename, Size: fh.Size, Open: func() (io.ReadCloser, error) { return fh.Open() }}
+}
+
+// archiveFiles lists the files in the ZIP archive uploaded as bf, whose
+// Open must return an io.ReaderAt. Entries that are not files to OCR, such
+// as directories and the metadata macOS adds, are skipped; entries that
+// cannot be taken are returned as refused. The returned closer must be
+// closed once the files have been read.
+func archiveFiles(bf batchFile) ([]batchFile, []rejectedUpload, io.Closer, error) {
+	f, err := bf.Open()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		f.Close()
+		return nil, nil, nil, errors.New("The ZIP archive cannot be read from this upload")
+	}
+	zr, err := zip.NewReader(ra, bf.Size)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, fmt.Errorf("The ZIP archive cannot be read: %w", err)
+	}
+	if len(zr.File) > maxArchiveEntries {
+		f.Close()
+		return nil, nil, nil, fmt.Errorf("The ZIP archive has %d entries; split it into archives of at most %d", len(zr.File), maxArchiveEntries)
+	}
+
+	var files []batchFile
+	var refused []rejectedUpload
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || archiveMetadata(zf.Name) {
+			continue
+		}
+		name, err := archiveEntryPath(zf.Name)
+		if err != nil {
+			refused = append(refused, rejectedUpload{zf.Name, uploadProblem{"unsafe_path", err.Error()}})
+			continue
+		}
+		if isArchive(name) {
+			refused = append(refused, rejectedUpload{name, uploadProblem{"unsupported_type", "ZIP archives inside an archive are not unpacked"}})
+			continue
+		}
+		if free, ok := diskFree("user_file"); ok && int64(zf.UncompressedSize64) > free-diskReserve {
+			refused = append(refused, rejectedUpload{name, uploadProblem{"insufficient_storage", fmt.Sprintf(
+				"Not enough disk space to unpack this file: it is %s but only %s is free",
+				formatBytes(int64(zf.UncompressedSize64)), formatBytes(max(free-diskReserve, 0)))}})
+			continue
+		}
+		// archive/zip fails an entry that decompresses to more than its
+		// header declares, which is what the checks go by.
+		files = append(files, batchFile{Name: name, Entry: true, Size: int64(zf.UncompressedSize64), Open: zf.Open})
+	}
+	return files, refused, f, nil
+}
+
+// archiveMetadata reports entries archivers add besides the files: macOS
+// resource forks and Finder files, and Windows thumbnail caches.
+func archiveMetadata(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, "._") ||
+		base == ".DS_Store" || strings.EqualFold(base, "Thumbs.db")
+}
+
+// archiveEntryPath returns the cleaned slash-separated path of a ZIP entry.
+// Absolute paths, drive letters and ".." components are refused.
+func archiveEntryPath(name string) (string, error) {
+	p := strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(p, "/") || (len(p) >= 2 && p[1] == ':') {
+		return "", errors.New("The entry has an absolute path")
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return "", errors.New("The entry's path leads out of the archive")
+		}
+	}
+	p = path.Clean(p)
+	if p == "." || strings.ContainsFunc(p, func(r rune) bool { return r < ' ' }) {
+		return "", errors.New("The entry has an invalid name")
+	}
+	return p, nil
+}
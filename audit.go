@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one administrative action in the audit log: who did what to
+// which job or account, and why.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target"` // a job ID or schedule name
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Audit actions.
+const (
+	AuditHoldPlaced = "hold.placed"
+	AuditHoldLifted = "hold.lifted"
+
+	AuditDuplicateMerged = "duplicate.merged" // a copy deleted by a merge, see duplicates.go
+
+	AuditScheduleCreated = "schedule.created"
+	AuditScheduleDeleted = "schedule.deleted"
+)
+
+// auditLog is an append-only file of AuditEntry values, one JSON object per
+// line, under the data directory. Entries are never rewritten or removed.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+var audit *auditLog
+
+func openAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path}, nil
+}
+
+func (l *auditLog) record(e AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// entries returns the log, oldest first, limited to target unless it is
+// empty.
+func (l *auditLog) entries(target string) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []AuditEntry{}
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue
+		}
+		if target == "" || e.Target == target {
+			out = append(out, e)
+		}
+	}
+	return out, sc.Err()
+}
+
+// auditActor names who made an admin request: the user whose role let it
+// through, or the admin token it came in with, see requireRole.
+func auditActor(r *http.Request) string {
+	if v, perr := requestViewer(r); perr == nil && roleAtLeast(v.role, roleOperator) {
+		return v.owner
+	}
+	return "admin token"
+}
+
+// v1AuditHandler lists the audit log, of one job with ?job=.
+func v1AuditHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := audit.entries(r.URL.Query().Get("job"))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": list})
+}
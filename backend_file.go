@@ -1,183 +1,569 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
-type OCRResult struct {
-	Success  bool   `json:"success"`
-	TextFile string `json:"text_file"`
-	PDFFile  string `json:"pdf_file"`
-	Error    string `json:"error"`
-}
-
 type PageData struct {
 	Message    string
 	Error      string
+	JobID      string // set on job pages, see jobPageHandler
+	FetchURLs  bool   // the form offers a document URL, see fetch.go
+	EmailMe    bool   // the form offers to mail the results, see resultmail.go
 	TextFile   string
 	PDFFile    string
+	BundleFile string // all the results in one ZIP archive
+	Summary    string // the document's summary, see summary.go
+	SummaryURL string
+	PartialPDF string // the pages a failed job finished
 	ShowResult bool
+	Warnings   []PageWarning // pages the engine had trouble with, on job pages
+	User       string        // the signed-in user, see oidc.go
+	Accept     string        // the upload types, for the file input
+	CSRF       string        // the forms' token, see csrf.go
 }
 
+var (
+	limiter *rateLimiter
+	jobs    *JobStore
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(keysCommand(os.Args[2:]))
+	}
+	cfg := loadConfig()
+
+	limiter = newRateLimiter(cfg.RateLimit, cfg.DailyQuota, accountKey)
+	go limiter.sweep(10 * time.Minute)
+
+	var err error
+	if basePath, err = parseBasePath(cfg.BasePath); err != nil {
+		log.Fatal(err)
+	}
+	// The public URL may be given with the base path or without it.
+	publicURL = strings.TrimSuffix(strings.TrimSuffix(cfg.PublicURL, "/"), basePath)
+	if err := validateOutputName(cfg.OutputName); err != nil {
+		log.Fatal(err)
+	}
+	outputNameTemplate = cfg.OutputName
+	if cfg.MQTTBroker != "" {
+		n, err := newMQTTNotifier(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		addNotifier(n)
+	}
+	if cfg.ChatWebhook != "" {
+		addNotifier(&chatNotifier{webhookURL: cfg.ChatWebhook, mattermost: cfg.ChatFormat == "mattermost"})
+	}
+	adminToken = cfg.AdminToken
+	hookToken, hookAllowPrivate = cfg.HookToken, cfg.HookAllowPrivate
+	fetchHosts, fetchTimeout = parseFetchHosts(cfg.FetchHosts), cfg.FetchTimeout
+	tusMaxSize, tusExpiry = int64(cfg.ResumableMaxSize)<<20, cfg.ResumableExpiry
+	formMaxSize = int64(cfg.FormMaxSize) << 20
+	if cfg.MaxUpload <= 0 {
+		log.Fatal("-max-upload-size must be positive")
+	}
+	maxUploadSize = int64(cfg.MaxUpload) << 20
+	if uploadTypes, err = parseUploadTypes(cfg.UploadTypes); err != nil {
+		log.Fatal(err)
+	}
+	errUnsupportedType = errors.New(uploadTypesMessage())
+	if accessRules, err = parseAccessRules(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if trustedProxies, err = parseNetworks(cfg.TrustedProxies); err != nil {
+		log.Fatalf("-trusted-proxies: %v", err)
+	}
+	if audit, err = openAuditLog(filepath.Join(cfg.DataDir, "audit.jsonl")); err != nil {
+		log.Fatal(err)
+	}
+	deadLetters, err = openDeadLetters(filepath.Join(cfg.DataDir, "webhook_dead_letters.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.WebhooksFile != "" {
+		eps, err := loadWebhooks(cfg.WebhooksFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, ep := range eps {
+			addWebhook(ep, cfg.WebhookAttempts)
+		}
+	}
+	if cfg.DestinationsFile != "" {
+		if destinations, err = loadDestinations(cfg.DestinationsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	deliveryAttempts = max(cfg.DeliveryAttempts, 1)
+	if cfg.RoutingFile != "" {
+		if routingRules, routingChannels, err = loadRouting(cfg.RoutingFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	diskReserve = int64(cfg.DiskReserve) << 20
+	ocrLimits = procLimits{Memory: int64(cfg.OCRMemory) << 20, CPU: cfg.OCRCPU, Timeout: cfg.OCRTimeout}
+	cgroupRoot = cfg.CgroupRoot
+	jobTempRoot = cfg.TempDir
+	scavengeTempDirs()
+	ocrSandbox = sandboxConfig{Mode: cfg.Sandbox, User: cfg.SandboxUser, Network: cfg.SandboxNetwork}
+	if err := ocrSandbox.init(); err != nil {
+		log.Fatal(err)
+	}
+	if !slices.Contains(rasterizers, cfg.Rasterizer) {
+		log.Fatalf("invalid rasterizer %q: use %s", cfg.Rasterizer, strings.Join(rasterizers, ", "))
+	}
+	pdfRasterizer = cfg.Rasterizer
+	if !slices.Contains(pageImageModes, cfg.PageImages) {
+		log.Fatalf("invalid page image mode %q: use %s", cfg.PageImages, strings.Join(pageImageModes, ", "))
+	}
+	pageImages = cfg.PageImages
+	if !slices.Contains(ocrPipelines, cfg.Pipeline) {
+		log.Fatalf("invalid OCR pipeline %q: use %s", cfg.Pipeline, strings.Join(ocrPipelines, ", "))
+	}
+	ocrPipeline, tesseractCommand, popplerDir, ocrPageTimeout = cfg.Pipeline, cfg.Tesseract, cfg.PopplerDir, cfg.PageTimeout
+	enhancePoorScans = cfg.Enhance
+	if engineProgram = cfg.EngineCommand; engineProgram != "" {
+		knownEngines = append(knownEngines, "command")
+	}
+	if cfg.AzureEndpoint != "" {
+		if cfg.AzureKey == "" {
+			log.Fatal("-azure-endpoint needs -azure-key")
+		}
+		azureEndpoint, azureKey = cfg.AzureEndpoint, cfg.AzureKey
+		knownEngines = append(knownEngines, "azure")
+	}
+	if !slices.Contains(knownEngines, cfg.Engine) {
+		log.Fatalf("invalid engine %q: use %s", cfg.Engine, strings.Join(knownEngines, ", "))
+	}
+	defaultEngine = cfg.Engine
+	if err := initPageCache(cfg.PageCache, cfg.CacheSize); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.WarmWorkers > 0 {
+		ocrWorkers = newEnginePool(cfg.WarmWorkers)
+	}
+	workerCount = cfg.Workers
+	if cfg.PlansFile != "" {
+		if plans, err = loadPlans(cfg.PlansFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if apiKeys, err = openKeyStore(filepath.Join(cfg.DataDir, "api_keys.json")); err != nil {
+		log.Fatal(err)
+	}
+	apiKeysRequired = !cfg.AllowAnonymousAPI
+	if users, err = openUsers(filepath.Join(cfg.DataDir, "users.json")); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.OIDCIssuer != "" && cfg.LDAPURL != "" {
+		log.Fatal("-ldap-url and -oidc-issuer cannot be used together")
+	}
+	if cfg.OIDCIssuer != "" {
+		if oidc, err = newOIDCProvider(cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.LDAPURL != "" {
+		if ldapDir, err = newLDAPDirectory(cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if loginEnabled() {
+		if sessionTTL = cfg.SessionTTL; sessionTTL <= 0 {
+			log.Fatal("-session-ttl must be positive")
+		}
+	}
+	// The key signs the forms' tokens with or without login.
+	if sessionKey, err = loadSessionKey(filepath.Join(cfg.DataDir, "session_key")); err != nil {
+		log.Fatal(err)
+	}
+	if usage, err = openUsage(filepath.Join(cfg.DataDir, "usage.json")); err != nil {
+		log.Fatal(err)
+	}
+	if keywordCount = cfg.Keywords; keywordCount > 0 {
+		if keywordStats, err = openKeywordIndex(filepath.Join(cfg.DataDir, "keywords.json")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if engineCosts, err = parseEngineCosts(cfg.EngineCosts); err != nil {
+		log.Fatal(err)
+	}
+	if meter, err = openMeter(filepath.Join(cfg.DataDir, "usage_records.jsonl")); err != nil {
+		log.Fatal(err)
+	}
+
+	if storageCipher, err = loadStorageKey(cfg.EncryptionKeyFile, cfg.EncryptionKeyCommand); err != nil {
+		log.Fatal(err)
+	}
+	if documentClassifier, err = newClassifier(cfg.Classifier, cfg.ClassRulesFile, cfg.ClassifierCommand); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.LLMURL != "" {
+		if languageModel, err = newLLMClient(cfg.LLMURL, cfg.LLMModel, cfg.LLMKey, cfg.LLMTimeout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.CorrectBelow < 0 || cfg.CorrectBelow > 100 {
+		log.Fatal("-llm-correct-below must be between 0 and 100")
+	}
+	correctBelow = cfg.CorrectBelow
+	if (correctBelow > 0 || cfg.Summarize) && languageModel == nil {
+		log.Fatal("-llm-correct-below and -llm-summarize need -llm-url")
+	}
+	summarizeDocuments = cfg.Summarize
+	embeddingURL, embeddingKey := cfg.EmbeddingURL, cfg.EmbeddingKey
+	if embeddingURL == "" {
+		embeddingURL = cfg.LLMURL
+	}
+	if embeddingKey == "" {
+		embeddingKey = cfg.LLMKey
+	}
+	if textEmbedder, err = newEmbedder(cfg.Embeddings, embeddingURL, cfg.EmbeddingModel, embeddingKey, cfg.EmbeddingCommand, cfg.LLMTimeout); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.DuplicateSimilarity < 0 || cfg.DuplicateSimilarity > 100 {
+		log.Fatal("-duplicate-similarity must be between 0 and 100")
+	}
+	duplicateSimilarity = float64(cfg.DuplicateSimilarity) / 100
+	if cfg.RescanConfidence < 0 || cfg.RescanConfidence > 100 {
+		log.Fatal("-rescan-confidence must be between 0 and 100")
+	}
+	rescanConfidence = float64(cfg.RescanConfidence)
+	jobs = newJobStore(cfg.QueueSize)
+	maxActiveJobs, maxPages = cfg.MaxActive, cfg.MaxPages
+	if err := jobs.load(); err != nil {
+		log.Fatal(err)
+	}
+	if textEmbedder != nil {
+		semantic.load(jobs)
+	}
+	if duplicateSimilarity > 0 {
+		duplicates.load(jobs)
+	}
+	if storageCipher != nil {
+		go sealFinishedJobs()
+	}
+	jobs.start(cfg.Workers)
+	go jobs.sweep(time.Hour)
+	go sweepTusUploads(time.Hour)
+	if pageCacheDir != "" {
+		go sweepPageCache(time.Hour)
+	}
+	resultRetention = time.Duration(cfg.RetentionDays) * 24 * time.Hour
+	expiryNotice = time.Duration(cfg.ExpiryNoticeDays) * 24 * time.Hour
+	smtpConfig = smtpSettings{Addr: cfg.SMTPAddr, From: cfg.SMTPFrom, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}
+	if smtpConfig.Addr != "" {
+		if notifyLinkTTL = cfg.NotifyLinkTTL; notifyLinkTTL <= 0 {
+			log.Fatal("-notify-link-ttl must be positive")
+		}
+		if linkKey, err = loadSessionKey(filepath.Join(cfg.DataDir, "link_key")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	quickMaxSize, quickTimeout = int64(cfg.QuickMaxSize)<<10, cfg.QuickTimeout
+	if cfg.QuickConcurrent > 0 {
+		quickSlots = make(chan struct{}, cfg.QuickConcurrent)
+	}
+	if cfg.ExtensionsFile != "" {
+		if extensions, err = loadExtensions(cfg.ExtensionsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go jobs.enforceRetention(time.Hour)
+	if cfg.NextcloudURL != "" {
+		nc, err := newNextcloudWatcher(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go nc.run()
+	}
+	var scheduled []*Schedule
+	if cfg.SchedulesFile != "" {
+		if scheduled, err = loadSchedules(cfg.SchedulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if schedules, err = openScheduler(filepath.Join(cfg.DataDir, "schedules.json"), scheduled); err != nil {
+		log.Fatal(err)
+	}
+	go schedules.run()
+
+	storageDirs = []string{"user_file", "user_file_searchable", cfg.DataDir, jobTempRoot}
+	http.HandleFunc("GET /healthz", healthzHandler)
+	http.HandleFunc("GET /readyz", readyzHandler)
+
 	// Serve static files (for downloads)
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/upload", uploadHandler)
-	http.Handle("/download/", http.StripPrefix("/download/", http.FileServer(http.Dir("."))))
+	http.HandleFunc("/", requireLogin(homeHandler))
+	http.HandleFunc("/upload", limiter.wrap(requireLogin(uploadHandler)))
+	http.HandleFunc("GET /jobs/{id}", limiter.wrap(requireLogin(jobPageHandler)))
+	http.HandleFunc("GET /batches/{id}", limiter.wrap(requireLogin(batchPageHandler)))
+	http.HandleFunc("/history", limiter.wrap(requireLogin(historyHandler)))
+	switch {
+	case oidc != nil:
+		http.HandleFunc("GET /auth/login", limiter.wrap(loginHandler))
+		http.HandleFunc("GET /auth/callback", limiter.wrap(callbackHandler))
+	case ldapDir != nil:
+		http.HandleFunc("GET /auth/login", ldapLoginPageHandler)
+		http.HandleFunc("POST /auth/login", limiter.wrap(ldapLoginHandler))
+	}
+	if loginEnabled() {
+		http.HandleFunc("POST /auth/logout", logoutHandler)
+	}
 
-	port := ":8080"
-	fmt.Printf("Server starting on http://localhost%s\n", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	registerAPIVersion("v1", v1Routes)
+	http.HandleFunc("/api/", limiter.wrap(apiHandler))
+	paperless := http.NewServeMux()
+	paperlessRoutes(paperless)
+	http.HandleFunc("/api/documents/", limiter.wrap(paperlessAuth(paperless.ServeHTTP)))
+	http.HandleFunc("/api/tasks/", limiter.wrap(paperlessAuth(paperless.ServeHTTP)))
+	http.Handle(webDAVPrefix, webDAVHandler())
+	http.Handle(webDAVPrefix+"/", webDAVHandler())
+	http.HandleFunc("GET /download/{id}/bundle.zip", bundleHandler)
+	http.Handle("/download/", http.StripPrefix("/download/", ownDownloads(downloadNames(fileETags(".", http.FileServer(storedDir(".")))))))
+
+	if cfg.GRPCAddr != "" {
+		go serveGRPC(cfg.GRPCAddr)
+	}
+
+	log.Fatal(serve(cfg, stripBasePath(networkPolicy(http.DefaultServeMux))))
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("templates/index.html"))
+	tmpl := template.Must(template.New("index.html").Funcs(pageFuncs).ParseFiles("templates/index.html"))
 	data := PageData{
-		Message: "Upload your PDF file for OCR processing",
+		Message:   "Upload your PDF file for OCR processing",
+		FetchURLs: len(fetchHosts) > 0,
+		EmailMe:   smtpConfig.Addr != "",
+		User:      sessionUser(r),
+		Accept:    strings.Join(uploadTypes, ","),
+		CSRF:      csrfToken(w, r),
 	}
 	tmpl.Execute(w, data)
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		http.Redirect(w, r, appPath("/"), http.StatusSeeOther)
 		return
 	}
 
-	// Parse multipart form (32 MB max)
-	err := r.ParseMultipartForm(32 << 20)
-	if err != nil {
-		renderError(w, "Error parsing form: "+err.Error())
+	// Report the bytes received while the form is parsed
+	up := trackUpload(r)
+	var doneID string
+	defer func() { up.finish(doneID) }()
+
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		w.WriteHeader(perr.Status)
+		renderError(w, r, perr.Error())
 		return
 	}
 
-	// Get the file from form
-	file, handler, err := r.FormFile("pdffile")
+	// Receive the form, streaming its files to disk
+	form, err := readUploadForm(w, r, "pdffile")
 	if err != nil {
-		renderError(w, "Error retrieving file: "+err.Error())
+		var tooLarge *http.MaxBytesError
+		var re *resourceError
+		switch {
+		case errors.As(err, &tooLarge):
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			renderError(w, r, fmt.Sprintf("The upload is larger than %d MB", formMaxSize>>20))
+		case errors.As(err, &re):
+			w.WriteHeader(http.StatusInsufficientStorage)
+			renderError(w, r, err.Error())
+		default:
+			renderError(w, r, "Error parsing form: "+err.Error())
+		}
 		return
 	}
-	defer file.Close()
-
-	// Validate file extension
-	if !strings.HasSuffix(strings.ToLower(handler.Filename), ".pdf") {
-		renderError(w, "Please upload a PDF file")
+	defer form.remove()
+	up.parsed()
+	if !validCSRFToken(r, form.Values.Get(csrfField)) && !validCSRFToken(r, r.Header.Get(csrfHeader)) {
+		w.WriteHeader(http.StatusForbidden)
+		renderError(w, r, "The form has expired; reload the page and submit it again")
 		return
 	}
 
-	// Extract filename without extension
-	filename := handler.Filename
-	baseFilename := strings.TrimSuffix(filename, filepath.Ext(filename))
-
-	// Create directories
-	userFileDir := filepath.Join("user_file", baseFilename)
-	userFileSearchableDir := filepath.Join("user_file_searchable", baseFilename)
-
-	err = os.MkdirAll(userFileDir, 0755)
-	if err != nil {
-		renderError(w, "Error creating user_file directory: "+err.Error())
+	files := form.Files
+	rawURL, resumableID := form.Values.Get("url"), form.Values.Get("upload")
+	if len(files) == 0 && rawURL == "" && resumableID == "" {
+		renderError(w, r, "Error retrieving file: "+http.ErrMissingFile.Error())
 		return
 	}
-
-	err = os.MkdirAll(userFileSearchableDir, 0755)
+	notifyEmail, err := parseNotifyEmail(form.Values.Get("notify_email"))
 	if err != nil {
-		renderError(w, "Error creating user_file_searchable directory: "+err.Error())
+		renderError(w, r, err.Error())
 		return
 	}
 
-	// Save uploaded file
-	uploadedFilePath := filepath.Join(userFileDir, filename)
-	dst, err := os.Create(uploadedFilePath)
-	if err != nil {
-		renderError(w, "Error saving file: "+err.Error())
+	// Several files, or a ZIP archive of them, become a batch with a summary
+	// page; a single one, a large one sent ahead as a resumable upload, or the
+	// document at the URL goes to its job page. The OCR runs in the background
+	// either way.
+	var upload batchFile
+	var resumable *tusUpload
+	switch {
+	case len(files) > 1 || len(files) == 1 && isArchive(files[0].Name):
+		b := admitBatch(w, r, account, plan, files, nil, notifyEmail)
+		if len(b.Jobs) > 0 {
+			doneID = b.Jobs[0].ID
+		}
+		renderBatch(w, r, b)
 		return
+	case len(files) == 1:
+		upload = files[0]
+	case resumableID != "":
+		var terr *tusError
+		if resumable, upload, terr = tusUploadFile(account, resumableID); terr != nil {
+			w.WriteHeader(terr.Status)
+			renderError(w, r, terr.Error())
+			return
+		}
+	default:
+		var ferr *fetchError
+		if upload, ferr = fetchDocument(r.Context(), rawURL); ferr != nil {
+			w.WriteHeader(ferr.Status)
+			renderError(w, r, ferr.Error())
+			return
+		}
+		defer os.Remove(upload.Spool) // moved into the job's workspace when admitted
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, file)
+	job, err := admitUpload(w, r, account, plan, upload, "", nil, notifyEmail)
 	if err != nil {
-		renderError(w, "Error writing file: "+err.Error())
+		var perr *planError
+		if errors.As(err, &perr) {
+			w.WriteHeader(perr.Status)
+		}
+		renderError(w, r, err.Error())
 		return
 	}
-
-	// Convert paths to absolute paths
-	absUploadedPath, _ := filepath.Abs(uploadedFilePath)
-	absSearchableDir, _ := filepath.Abs(userFileSearchableDir)
-
-	// Call Python OCR script
-	cmd := exec.Command("python", "ocr_python.py", absUploadedPath, absSearchableDir, baseFilename+"_searchable")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		renderError(w, fmt.Sprintf("Error running OCR: %s\nOutput: %s", err.Error(), string(output)))
-		return
+	doneID = job.ID
+	if resumable != nil {
+		resumable.remove()
 	}
+	http.Redirect(w, r, appPath("/jobs/"+job.ID), http.StatusSeeOther)
+}
 
-	// Extract JSON from output (in case there are warnings before the JSON)
-	jsonStr := string(output)
-	jsonStart := strings.Index(jsonStr, "{")
-	if jsonStart == -1 {
-		renderError(w, "No valid JSON found in OCR output:\n"+string(output))
+// jobPageHandler shows a job submitted through the web form. A finished
+// job gets its download links; for a queued or running one the page waits
+// for it through the API and shows the links once it is done.
+func jobPageHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok || !canAccess(r, job) {
+		w.WriteHeader(http.StatusNotFound)
+		renderError(w, r, "No job with this ID; it may have been deleted")
 		return
 	}
-	jsonStr = jsonStr[jsonStart:]
+	data := PageData{JobID: job.ID, Warnings: job.Warnings, User: sessionUser(r), CSRF: csrfToken(w, r)}
+	switch job.Status {
+	case JobDone:
+		data.ShowResult = true
+		data.TextFile = job.TextURL
+		data.PDFFile = job.PDFURL
+		data.BundleFile = job.BundleURL
+		if s := job.Summary; s != nil && s.URL != "" {
+			if text, err := readStored(filepath.Join(job.outputDir, job.prefix+"_summary.txt")); err == nil {
+				data.Summary, data.SummaryURL = strings.TrimSpace(string(text)), s.URL
+			}
+		}
+		data.Message = "OCR processing completed successfully!"
+		if len(job.FailedPages) > 0 {
+			nums := make([]string, len(job.FailedPages))
+			for i, f := range job.FailedPages {
+				nums[i] = strconv.Itoa(f.Page)
+			}
+			data.Message = "OCR processing completed, but these pages could not be processed: " + strings.Join(nums, ", ")
+		}
+		if c := job.Correction; c != nil && c.Changed > 0 {
+			data.Message += fmt.Sprintf(" A language model corrected %d of its %d low-confidence lines.", c.Changed, c.Lines)
+		}
+	case JobFailed:
+		data.Error = job.Error
+		data.PartialPDF = job.PartialPDFURL
+	case JobCanceled:
+		data.Error = job.Filename + " was canceled; its partial results were deleted"
+	default:
+		data.Message = job.Filename + " is " + string(job.Status) + ". This page updates when it is done; you can also close it and find the results under Job History."
+	}
+	tmpl := template.Must(template.New("index.html").Funcs(pageFuncs).ParseFiles("templates/index.html"))
+	tmpl.Execute(w, data)
+}
 
-	// Parse Python output
-	var result OCRResult
-	err = json.Unmarshal([]byte(jsonStr), &result)
-	if err != nil {
-		renderError(w, "Error parsing OCR result: "+err.Error()+"\nOutput: "+string(output))
-		return
+// prepareWorkspace creates the upload and result directories for job id of
+// account and returns the absolute path the upload should be saved to and
+// the absolute result directory. Workspaces are keyed by the job ID so two
+// uploads with the same name never share a directory, and kept in the
+// namespace of the job's owner (see ownerDir); the original file name is
+// only kept as metadata and the upload is stored as "original" plus its
+// extension.
+func prepareWorkspace(id, account, filename string) (string, string, error) {
+	ns := ownerDir(jobOwner(account))
+	userFileDir := filepath.Join("user_file", ns, id)
+	userFileSearchableDir := filepath.Join("user_file_searchable", ns, id)
+
+	if err := os.MkdirAll(userFileDir, 0755); err != nil {
+		return "", "", fmt.Errorf("Error creating user_file directory: %w", err)
+	}
+	if err := os.MkdirAll(userFileSearchableDir, 0755); err != nil {
+		return "", "", fmt.Errorf("Error creating user_file_searchable directory: %w", err)
 	}
 
-	if !result.Success {
-		renderError(w, "OCR processing failed: "+result.Error)
-		return
+	// Convert paths to absolute paths
+	absUploadedPath, _ := filepath.Abs(filepath.Join(userFileDir, inputFileName(filename)))
+	absSearchableDir, _ := filepath.Abs(userFileSearchableDir)
+	return absUploadedPath, absSearchableDir, nil
+}
+
+// inputFileName is the name an upload is stored under in its workspace.
+// Office files and images are stored as the PDF they are converted to.
+func inputFileName(filename string) string {
+	if convertedFormat(filename) != "" {
+		return "original.pdf"
 	}
+	return "original" + strings.ToLower(filepath.Ext(filename))
+}
 
+// downloadURL turns an absolute result path into a percent-encoded
+// /download/ link below the base path.
+func downloadURL(path string) string {
 	// Get current working directory
 	cwd, err := os.Getwd()
 	if err != nil {
 		cwd = ""
 	}
 
-	// Create relative download paths
-	textFileRel, err := filepath.Rel(cwd, result.TextFile)
+	// Create relative download path
+	rel, err := filepath.Rel(cwd, path)
 	if err != nil {
-		textFileRel = result.TextFile
-	}
-	pdfFileRel, err := filepath.Rel(cwd, result.PDFFile)
-	if err != nil {
-		pdfFileRel = result.PDFFile
+		rel = path
 	}
 
 	// Convert to forward slashes for URL
-	textFileRel = filepath.ToSlash(textFileRel)
-	pdfFileRel = filepath.ToSlash(pdfFileRel)
-
-	// Render success page with download links
-	tmpl := template.Must(template.ParseFiles("templates/index.html"))
-	data := PageData{
-		Message:    "OCR processing completed successfully!",
-		ShowResult: true,
-		TextFile:   "/download/" + textFileRel,
-		PDFFile:    "/download/" + pdfFileRel,
-	}
-	tmpl.Execute(w, data)
+	return appPath("/download/" + escapeURLPath(filepath.ToSlash(rel)))
 }
 
-func renderError(w http.ResponseWriter, errorMsg string) {
-	tmpl := template.Must(template.ParseFiles("templates/index.html"))
+func renderError(w http.ResponseWriter, r *http.Request, errorMsg string) {
+	tmpl := template.Must(template.New("index.html").Funcs(pageFuncs).ParseFiles("templates/index.html"))
 	data := PageData{
-		Error: errorMsg,
+		Error:  errorMsg,
+		Accept: strings.Join(uploadTypes, ","),
+		CSRF:   csrfToken(w, r),
 	}
 	tmpl.Execute(w, data)
 }
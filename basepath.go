@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The server can be reached below a path prefix, such as
+// https://example.com/ocr/, when a reverse proxy serves it next to other
+// applications. Requests may arrive with the prefix, or without it from
+// proxies that strip it; either way the handlers see paths from the root,
+// and every link, redirect and cookie the server hands out carries the
+// prefix.
+
+// basePath is the prefix, such as "/ocr", empty when served at the root.
+var basePath string
+
+// parseBasePath normalizes -base-path: "ocr", "/ocr" and "/ocr/" are all
+// "/ocr".
+func parseBasePath(s string) (string, error) {
+	s = strings.Trim(strings.TrimSpace(s), "/")
+	if s == "" {
+		return "", nil
+	}
+	p := "/" + s
+	if path.Clean(p) != p || strings.ContainsAny(p, "?#%\\\"'<> ") {
+		return "", fmt.Errorf("-base-path must be a URL path such as /ocr, got %q", s)
+	}
+	return p, nil
+}
+
+// appPath returns the public path of the server path p.
+func appPath(p string) string {
+	return basePath + p
+}
+
+// stripBasePath passes requests to h with the prefix removed from their
+// path. The prefix alone is redirected to the home page below it.
+func stripBasePath(h http.Handler) http.Handler {
+	if basePath == "" {
+		return h
+	}
+	strip := http.StripPrefix(basePath, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == basePath:
+			u := basePath + "/"
+			if r.URL.RawQuery != "" {
+				u += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, u, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, basePath+"/"):
+			strip.ServeHTTP(w, r)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// rebaseLinks points the result links of a job read from its record below
+// the current base path, which may have changed since the record was
+// written.
+func (j *Job) rebaseLinks() {
+	for _, u := range []*string{&j.TextURL, &j.PDFURL, &j.LogURL, &j.ArticlesURL, &j.NotesURL, &j.RegionsURL, &j.PartialPDFURL} {
+		*u = rebaseLink(*u)
+	}
+	if c := j.Correction; c != nil {
+		c.URL = rebaseLink(c.URL)
+	}
+	if s := j.Summary; s != nil {
+		s.URL = rebaseLink(s.URL)
+	}
+	if j.BundleURL != "" {
+		j.BundleURL = bundleURL(j.ID)
+	}
+}
+
+// rebaseLink points the download link u below the current base path.
+func rebaseLink(u string) string {
+	if i := strings.Index(u, "/download/user_file"); i >= 0 {
+		return appPath(u[i:])
+	}
+	return u
+}
+
+// pageFuncs gives the page templates {{base}}, which their links start with.
+var pageFuncs = template.FuncMap{"base": func() string { return basePath }}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A batch is the jobs queued from one upload of several files, such as an
+// archivist's folder of scans. Every file becomes a job of its own, checked
+// and charged on its own, and the jobs share a batch ID (Job.Batch) that
+// the summary page, GET /api/v1/batches/{id} and the job list's batch
+// filter follow them by. Files that are refused do not stop the others. ZIP
+// archives are unpacked into the batch, see archive.go.
+
+// errUnsupportedType refuses an upload by its file name. It names the
+// -upload-types once they are set.
+var errUnsupportedType = errors.New(uploadTypesMessage())
+
+// rejectedUpload is a file of a batch that was not queued.
+type rejectedUpload struct {
+	Filename string `json:"filename"`
+	uploadProblem
+}
+
+// BatchSummary is the answer of the batch endpoints.
+type BatchSummary struct {
+	ID       string            `json:"id"`
+	Jobs     []Job             `json:"jobs"`
+	Counts   map[JobStatus]int `json:"counts"`
+	Finished bool              `json:"finished"`           // every job is done, failed or canceled
+	Rejected []rejectedUpload  `json:"rejected,omitempty"` // only in the answer to the upload
+}
+
+// batchSummary collects the jobs of batch id that v may see, oldest first,
+// so they are listed in the order the files were sent. It returns false
+// when the batch has no such jobs.
+func batchSummary(id string, v viewer) (BatchSummary, bool) {
+	list := jobs.list(func(j *Job) bool { return j.Batch == id && v.sees(j) })
+	if len(list) == 0 {
+		return BatchSummary{}, false
+	}
+	b := BatchSummary{ID: id, Counts: map[JobStatus]int{}, Finished: true}
+	for i := len(list) - 1; i >= 0; i-- {
+		j := list[i]
+		b.Jobs = append(b.Jobs, j)
+		b.Counts[j.Status]++
+		b.Finished = b.Finished && j.finished()
+	}
+	return b, true
+}
+
+// admitUpload checks one file and queues it as a job of batch, which may be
+// empty for a single upload. Refusals are a *planError, a *pdfError, a
+// *resourceError or errUnsupportedType.
+func admitUpload(w http.ResponseWriter, r *http.Request, account string, plan *Plan, bf batchFile, batch string, tags map[string]string, notifyEmail string) (Job, error) {
+	if perr := plan.checkUpload(bf.Size, defaultEngine); perr != nil {
+		return Job{}, perr
+	}
+	filename := cleanUploadName(bf.Name)
+	if !isUploadType(filename) {
+		return Job{}, errUnsupportedType
+	}
+	if !limiter.allowSubmission(w, r) {
+		return Job{}, &planError{http.StatusTooManyRequests, "quota_exceeded", "Daily submission quota exceeded, please try again later"}
+	}
+
+	spoolPath, fingerprint := bf.Spool, bf.Fingerprint
+	if spoolPath == "" {
+		file, err := bf.Open()
+		if err != nil {
+			return Job{}, err
+		}
+		spoolPath, fingerprint, err = spoolUpload(file)
+		file.Close()
+		if err != nil {
+			return Job{}, err
+		}
+	}
+	var err error
+	var archiveEntry string
+	if bf.Entry {
+		archiveEntry = bf.Name
+	}
+	format := convertedFormat(filename)
+	if format != "" {
+		err = convertToPDF(spoolPath, format, plan.pageLimit())
+	}
+	var check pdfCheck
+	if err == nil {
+		check, err = checkPDF(spoolPath)
+	}
+	var est resourceEstimate
+	if err == nil {
+		est, err = checkResources(spoolPath)
+	}
+	if err == nil {
+		if perr := checkPages(est.Pages, plan.pageLimit()); perr != nil {
+			err = perr
+		}
+	}
+	if err == nil {
+		if perr := plan.chargePages(account, est.Pages); perr != nil {
+			err = perr
+		}
+	}
+	if err != nil {
+		os.Remove(spoolPath)
+		return Job{}, err
+	}
+
+	job, _, err := jobs.submit(submission{
+		Client:        clientKey(r),
+		Filename:      filename,
+		SpoolPath:     spoolPath,
+		Fingerprint:   fingerprint,
+		Tags:          tags,
+		Account:       account,
+		Priority:      plan.Priority,
+		Pages:         est.Pages,
+		MaxActive:     plan.activeJobLimit(),
+		Repaired:      check.Repaired,
+		ConvertedFrom: format,
+		Batch:         batch,
+		ArchiveEntry:  archiveEntry,
+		SourceURL:     bf.Source,
+		NotifyEmail:   notifyEmail,
+	})
+	if err != nil {
+		os.Remove(spoolPath)
+		usage.refund(account, est.Pages)
+		setRetryAfter(w, err)
+	}
+	return job, err
+}
+
+// admitBatch queues every uploaded file, and every file in the ZIP archives
+// among them, as a job of a new batch and returns its summary, with the
+// files that were refused and why.
+func admitBatch(w http.ResponseWriter, r *http.Request, account string, plan *Plan, uploads []batchFile, tags map[string]string, notifyEmail string) BatchSummary {
+	b := BatchSummary{ID: newID(), Jobs: []Job{}, Counts: map[JobStatus]int{}}
+	admit := func(bf batchFile) {
+		job, err := admitUpload(w, r, account, plan, bf, b.ID, tags, notifyEmail)
+		if err != nil {
+			name := bf.Name
+			if !bf.Entry {
+				name = cleanUploadName(name)
+			}
+			b.Rejected = append(b.Rejected, rejectedUpload{name, uploadProblemFor(err)})
+			return
+		}
+		b.Jobs = append(b.Jobs, job)
+		b.Counts[job.Status]++
+	}
+	for _, upload := range uploads {
+		if !isArchive(upload.Name) {
+			admit(upload)
+			continue
+		}
+		files, refused, closer, err := archiveFiles(upload)
+		if err != nil {
+			b.Rejected = append(b.Rejected, rejectedUpload{cleanUploadName(upload.Name), uploadProblem{"invalid_archive", err.Error()}})
+			continue
+		}
+		b.Rejected = append(b.Rejected, refused...)
+		for _, bf := range files {
+			admit(bf)
+		}
+		closer.Close()
+	}
+	return b
+}
+
+// uploadProblemFor turns a refusal of admitUpload into the error code POST
+// /jobs would answer with.
+func uploadProblemFor(err error) uploadProblem {
+	var perr *planError
+	var pe *pdfError
+	var re *resourceError
+	switch {
+	case errors.As(err, &perr):
+		return uploadProblem{perr.Code, err.Error()}
+	case errors.As(err, &pe):
+		return uploadProblem{pe.Code, err.Error()}
+	case errors.As(err, &re) && re.Storage:
+		return uploadProblem{"insufficient_storage", err.Error()}
+	case errors.As(err, &re):
+		return uploadProblem{"insufficient_memory", err.Error()}
+	case errors.Is(err, errUnsupportedType):
+		return uploadProblem{"unsupported_type", err.Error()}
+	}
+	return uploadProblem{"storage_error", err.Error()}
+}
+
+// v1SubmitBatchHandler queues every "file" multipart field, or every file
+// in it for a ZIP archive, as a job of a new batch, with optional "tag"
+// fields (see parseTags) applied to all of them. It answers 202 with the
+// batch summary, including the files that were refused, or 422 when none of
+// them could be queued.
+func v1SubmitBatchHandler(w http.ResponseWriter, r *http.Request) {
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	up := trackUpload(r)
+	var firstID string
+	defer func() { up.finish(firstID) }()
+	if err := parseUploadForm(w, r, formMaxSize); err != nil {
+		writeFormError(w, err, formMaxSize)
+		return
+	}
+	up.parsed()
+	var files []batchFile
+	for _, fh := range r.MultipartForm.File["file"] {
+		if fh.Size > maxUploadSize && !isArchive(fh.Filename) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("%s is larger than %d MB", cleanUploadName(fh.Filename), maxUploadSize>>20))
+			return
+		}
+		files = append(files, uploadedFile(fh))
+	}
+	if len(files) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "missing_file", "send each file of the batch as a \"file\" field")
+		return
+	}
+	tags, err := parseTags(r.MultipartForm.Value["tag"])
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_tags", err.Error())
+		return
+	}
+	notifyEmail, err := parseNotifyEmail(r.FormValue("notify_email"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_notify_email", err.Error())
+		return
+	}
+
+	b := admitBatch(w, r, account, plan, files, tags, notifyEmail)
+	if len(b.Jobs) == 0 {
+		msgs := make([]string, len(b.Rejected))
+		for i, rej := range b.Rejected {
+			msgs[i] = rej.Filename + ": " + rej.Message
+		}
+		writeAPIError(w, http.StatusUnprocessableEntity, "batch_rejected", "none of the files could be queued: "+strings.Join(msgs, "; "))
+		return
+	}
+	firstID = b.Jobs[0].ID
+	w.Header().Set("Location", appPath("/api/v1/batches/"+b.ID))
+	writeJSON(w, http.StatusAccepted, b)
+}
+
+// v1GetBatchHandler reports the jobs of a batch with their current status
+// and download links, as JSON or, with format=csv, as a manifest of one row
+// per file.
+func v1GetBatchHandler(w http.ResponseWriter, r *http.Request) {
+	v, perr := requestViewer(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	b, ok := batchSummary(r.PathValue("id"), v)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "batch_not_found", "no batch with id "+r.PathValue("id"))
+		return
+	}
+	if !wantsCSV(r) {
+		writeJSON(w, http.StatusOK, b)
+		return
+	}
+	rows := make([][]string, len(b.Jobs))
+	for i, j := range b.Jobs {
+		rows[i] = []string{cmp.Or(j.ArchiveEntry, j.Filename), j.ID, string(j.Status), strconv.Itoa(j.pages), j.Error, j.TextURL, j.PDFURL}
+	}
+	writeCSV(w, "batch-"+b.ID+".csv", []string{"file", "job_id", "status", "pages", "error", "text_url", "pdf_url"}, rows)
+}
+
+// batchPageHandler shows the summary page of a batch uploaded through the
+// web form.
+func batchPageHandler(w http.ResponseWriter, r *http.Request) {
+	v, perr := requestViewer(r)
+	if perr != nil {
+		w.WriteHeader(perr.Status)
+		renderError(w, r, perr.Error())
+		return
+	}
+	b, ok := batchSummary(r.PathValue("id"), v)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		renderError(w, r, "No batch with this ID; its jobs may have been deleted")
+		return
+	}
+	renderBatch(w, r, b)
+}
+
+// batchPage is what the batch page is rendered from.
+type batchPage struct {
+	BatchSummary
+	CSRF string // see csrf.go
+}
+
+func renderBatch(w http.ResponseWriter, r *http.Request, b BatchSummary) {
+	tmpl := template.Must(template.New("batch.html").Funcs(pageFuncs).Funcs(historyFuncs).ParseFiles("templates/batch.html"))
+	tmpl.Execute(w, batchPage{b, csrfToken(w, r)})
+}
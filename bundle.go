@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/zip"
+	"cmp"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// bundleURL is where the results of job id can be downloaded as one ZIP
+// archive, see bundleHandler.
+func bundleURL(id string) string {
+	return appPath("/download/" + id + "/bundle.zip")
+}
+
+// resultFiles returns the paths of the files a job's result links point
+// to, relative to the working directory like the /download/ file server.
+func (j *Job) resultFiles() []string {
+	var files []string
+	for _, u := range []string{j.PDFURL, j.TextURL, j.NotesURL, j.ArticlesURL, j.RegionsURL, j.LogURL, j.PartialPDFURL} {
+		if file, ok := downloadFile(u); ok {
+			files = append(files, file)
+		}
+	}
+	if j.Summary != nil {
+		if file, ok := downloadFile(j.Summary.URL); ok {
+			files = append(files, file)
+		}
+	}
+	if j.Correction != nil {
+		if file, ok := downloadFile(j.Correction.URL); ok {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// downloadFile returns the path of the file a /download/ link points to,
+// relative to the working directory. It returns false for an empty link.
+func downloadFile(u string) (string, bool) {
+	rel, err := url.PathUnescape(strings.TrimPrefix(u, appPath("/download/")))
+	if u == "" || err != nil {
+		return "", false
+	}
+	return filepath.FromSlash(path.Clean(rel)), true
+}
+
+// bundleHandler streams a ZIP archive of a job's searchable PDF, text and
+// whatever other results it has, so a job takes one download instead of a
+// link per file. The files are named as downloadNames names them.
+// PDFs are stored as they are; they are already compressed.
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(r.PathValue("id"))
+	if !ok || !canAccess(r, j) && !validLink(r, j.ID) {
+		http.Error(w, "no job with this ID; it may have been deleted", http.StatusNotFound)
+		return
+	}
+	files := j.resultFiles()
+	if len(files) == 0 {
+		http.Error(w, "the job has no results to download", http.StatusNotFound)
+		return
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			http.Error(w, "the job's results are no longer available", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", attachmentDisposition(cmp.Or(j.displayPrefix, "results")+".zip"))
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		name := filepath.Base(file)
+		if j.prefix != "" && strings.HasPrefix(name, j.prefix) {
+			name = j.displayPrefix + strings.TrimPrefix(name, j.prefix)
+		}
+		if err := addBundleFile(zw, file, name); err != nil {
+			// The response is under way; all that is left is to cut it off
+			// so the client sees a broken archive rather than a short one.
+			log.Printf("job %s: bundle: %v", j.ID, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	zw.Close()
+}
+
+func addBundleFile(zw *zip.Writer, path, name string) error {
+	f, err := openStored(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: fi.ModTime()}
+	if strings.EqualFold(filepath.Ext(name), ".pdf") {
+		hdr.Method = zip.Store
+	}
+	dst, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// charsetPresets are the named character sets a job or region can be
+// limited to.
+var charsetPresets = map[string]string{
+	"digits":         "0123456789",
+	"persian-digits": "۰۱۲۳۴۵۶۷۸۹",
+	"numbers":        "0123456789۰۱۲۳۴۵۶۷۸۹/-.,:",
+	"latin":          "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+	"persian":        "ابپتثجچحخدذرزژسشصضطظعغفقکگلمنوهیآءئ۰۱۲۳۴۵۶۷۸۹",
+}
+
+const maxCharset = 500 // characters
+
+// parseCharset resolves a character set given as a preset name or as the
+// literal characters to allow. The result is passed to Tesseract as
+// tessedit_char_whitelist.
+func parseCharset(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if chars, ok := charsetPresets[s]; ok {
+		return chars, nil
+	}
+	if !utf8.ValidString(s) || utf8.RuneCountInString(s) > maxCharset {
+		return "", fmt.Errorf("the character set must be a preset (%s) or up to %d characters", charsetPresetNames(), maxCharset)
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return "", fmt.Errorf("the character set must not contain spaces or control characters")
+		}
+	}
+	return s, nil
+}
+
+func charsetPresetNames() string {
+	names := make([]string, 0, len(charsetPresets))
+	for n := range charsetPresets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ocrRegion is a template region recognized on its own, such as a form
+// field. Box is [x0, y0, x1, y1] as fractions of the page width and height,
+// so a template works at any resolution.
+type ocrRegion struct {
+	Name    string     `json:"name"`
+	Page    int        `json:"page,omitempty"` // 0 for every page
+	Box     [4]float64 `json:"box"`
+	Charset string     `json:"charset,omitempty"` // preset name or characters, see parseCharset
+}
+
+const maxRegions = 100
+
+// parseRegions reads the JSON array of template regions submitted with a
+// job. Each region's charset is resolved so the OCR script receives the
+// literal characters.
+func parseRegions(s string) ([]ocrRegion, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var regions []ocrRegion
+	if err := json.Unmarshal([]byte(s), &regions); err != nil {
+		return nil, fmt.Errorf("regions must be a JSON array of {name, page, box, charset}: %v", err)
+	}
+	if len(regions) > maxRegions {
+		return nil, fmt.Errorf("at most %d regions are allowed per job", maxRegions)
+	}
+	for i := range regions {
+		r := &regions[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("region-%d", i+1)
+		}
+		b := r.Box
+		if r.Page < 0 || b[0] < 0 || b[1] < 0 || b[2] > 1 || b[3] > 1 || b[0] >= b[2] || b[1] >= b[3] {
+			return nil, fmt.Errorf("region %q: box must be [x0, y0, x1, y1] within the page, as fractions from 0 to 1", r.Name)
+		}
+		chars, err := parseCharset(r.Charset)
+		if err != nil {
+			return nil, fmt.Errorf("region %q: %v", r.Name, err)
+		}
+		r.Charset = chars
+	}
+	return regions, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// notifyHTTPClient is shared by notifiers that deliver over HTTP.
+var notifyHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// chatNotifier posts a short message to a Slack or Mattermost incoming
+// webhook when a job finishes. Mattermost accepts the same payload, but
+// renders Markdown links instead of Slack's <url|label> syntax.
+type chatNotifier struct {
+	webhookURL string
+	mattermost bool
+}
+
+func (c *chatNotifier) Name() string {
+	if c.mattermost {
+		return "mattermost"
+	}
+	return "slack"
+}
+
+func (c *chatNotifier) Notify(ev JobEvent) error {
+	var text string
+	switch ev.Event {
+	case EventJobDone:
+		text = fmt.Sprintf("✅ OCR finished: *%s* — %s · %s",
+			ev.Filename, c.link(ev.PDFURL, "Searchable PDF"), c.link(ev.TextURL, "Text"))
+	case EventJobFailed:
+		text = fmt.Sprintf("❌ OCR failed: *%s* — %s\n```%s```",
+			ev.Filename, c.link(ev.JobURL, "Job details"), truncate(ev.Error, 500))
+	default:
+		return nil
+	}
+	return c.post(text)
+}
+
+// post sends one message to the webhook.
+func (c *chatNotifier) post(text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	resp, err := notifyHTTPClient.Post(c.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *chatNotifier) link(url, label string) string {
+	if c.mattermost {
+		return "[" + label + "](" + url + ")"
+	}
+	return "<" + url + "|" + label + ">"
+}
+
+// truncate shortens s to at most n runes, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Classification is the kind of document a finished job's text was found
+// to be, such as an invoice or a letter. Destination templates file results
+// by it with {class}, and the job list filters by it with ?class=.
+type Classification struct {
+	Class      string   `json:"class"`             // e.g. invoice, or "other" when nothing matched
+	Confidence float64  `json:"confidence"`        // 0-1
+	Classifier string   `json:"classifier"`        // "rules" or "command"
+	Matched    []string `json:"matched,omitempty"` // keywords found, for the rules classifier
+}
+
+// unclassified is the class of documents no rule or model recognized.
+const unclassified = "other"
+
+// A classifier labels the recognized text of a document. The rules
+// classifier is built in; -classifier-command plugs in any other, such as
+// a trained model.
+type classifier interface {
+	Name() string
+	Classify(ctx context.Context, j Job, text string) (Classification, error)
+}
+
+// documentClassifier labels every finished job, nil when -classifier is off.
+var documentClassifier classifier
+
+// classifierTimeout bounds one run of -classifier-command.
+const classifierTimeout = 30 * time.Second
+
+// maxClassifiedText is how much of a document's text is classified; the
+// first pages say what kind of document it is.
+const maxClassifiedText = 64 << 10
+
+// ClassRule is one entry of the class rules file: a document is of Class
+// when at least MinMatches of the keywords occur in its text. Keywords are
+// compared with normalizePersian, so Arabic letter variants, digits and
+// ZWNJ do not matter.
+type ClassRule struct {
+	Class      string   `json:"class"`
+	Keywords   []string `json:"keywords"`
+	MinMatches int      `json:"min_matches"` // default 2
+}
+
+// defaultClassRules are used without -class-rules-file.
+var defaultClassRules = []ClassRule{
+	{Class: "invoice", Keywords: []string{"فاکتور", "صورتحساب", "صورت حساب", "شماره اقتصادی", "مبلغ کل", "جمع کل", "مالیات بر ارزش افزوده", "خریدار", "فروشنده", "invoice", "total amount", "bill to"}},
+	{Class: "contract", Keywords: []string{"قرارداد", "طرفین", "ماده ۱", "موضوع قرارداد", "مدت قرارداد", "متعهد", "فسخ", "امضای طرفین", "agreement", "contract", "hereinafter", "the parties"}},
+	{Class: "letter", Keywords: []string{"بسمه تعالی", "باسمه تعالی", "با سلام", "احتراما", "شماره نامه", "پیوست", "رونوشت", "با تشکر", "dear", "sincerely", "regards"}},
+	{Class: "id", Keywords: []string{"کارت ملی", "شماره ملی", "کد ملی", "شناسنامه", "نام پدر", "تاریخ تولد", "محل صدور", "تاریخ انقضا", "passport", "date of birth", "nationality"}, MinMatches: 3},
+	{Class: "book_page", Keywords: []string{"فصل", "فهرست مطالب", "فهرست", "مقدمه", "پانویس", "منابع", "chapter", "contents", "preface", "isbn"}, MinMatches: 3},
+}
+
+// loadClassRules reads a JSON array of class rules from path.
+func loadClassRules(path string) ([]ClassRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []ClassRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, r := range rules {
+		if !validTagKey(r.Class) {
+			return nil, fmt.Errorf("parsing %s: rule %d: invalid class %q: use letters, digits, '-', '_' or '.'", path, i, r.Class)
+		}
+		if len(r.Keywords) == 0 {
+			return nil, fmt.Errorf("parsing %s: rule %q has no keywords", path, r.Class)
+		}
+	}
+	return rules, nil
+}
+
+// ruleClassifier picks the class whose rule matches the most keywords.
+// Ties go to the rule listed first.
+type ruleClassifier struct {
+	rules []ClassRule
+}
+
+func newRuleClassifier(rules []ClassRule) *ruleClassifier {
+	c := &ruleClassifier{rules: make([]ClassRule, len(rules))}
+	for i, r := range rules {
+		if r.MinMatches <= 0 {
+			r.MinMatches = 2
+		}
+		kw := make([]string, len(r.Keywords))
+		for k, w := range r.Keywords {
+			kw[k] = normalizePersian(w)
+		}
+		r.Keywords = kw
+		c.rules[i] = r
+	}
+	return c
+}
+
+func (c *ruleClassifier) Name() string { return "rules" }
+
+func (c *ruleClassifier) Classify(_ context.Context, _ Job, text string) (Classification, error) {
+	text = normalizePersian(text)
+	best := Classification{Class: unclassified, Classifier: c.Name()}
+	var bestRule ClassRule
+	for _, r := range c.rules {
+		var matched []string
+		for _, w := range r.Keywords {
+			if w != "" && strings.Contains(text, w) {
+				matched = append(matched, w)
+			}
+		}
+		if len(matched) >= r.MinMatches && len(matched) > len(best.Matched) {
+			best.Class, best.Matched, bestRule = r.Class, matched, r
+		}
+	}
+	if best.Class != unclassified {
+		// Half the keywords is as sure as the rules get.
+		best.Confidence = min(1, float64(len(best.Matched))*2/float64(len(bestRule.Keywords)))
+	}
+	return best, nil
+}
+
+// commandClassifier runs -classifier-command with the document's text on
+// stdin and the job in OCR_JOB_ID and OCR_FILENAME. The command prints
+// {"class": "invoice", "confidence": 0.93}.
+type commandClassifier struct {
+	command  string
+	fallback classifier // used when the command fails
+}
+
+func (c *commandClassifier) Name() string { return "command" }
+
+func (c *commandClassifier) Classify(ctx context.Context, j Job, text string) (Classification, error) {
+	ctx, cancel := context.WithTimeout(ctx, classifierTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.command)
+	cmd.Env = append(os.Environ(), "OCR_JOB_ID="+j.ID, "OCR_FILENAME="+j.Filename)
+	cmd.Stdin = strings.NewReader(text)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := firstLine(stderr.Bytes(), ""); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return Classification{}, fmt.Errorf("running -classifier-command: %w", err)
+	}
+	var res struct {
+		Class      string  `json:"class"`
+		Confidence float64 `json:"confidence"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return Classification{}, fmt.Errorf("reading -classifier-command output: %w", err)
+	}
+	res.Class = strings.ToLower(strings.TrimSpace(res.Class))
+	if res.Class == "" {
+		res.Class = unclassified
+	}
+	if !validTagKey(res.Class) {
+		return Classification{}, fmt.Errorf("-classifier-command printed an invalid class %q", res.Class)
+	}
+	return Classification{Class: res.Class, Confidence: min(max(res.Confidence, 0), 1), Classifier: c.Name()}, nil
+}
+
+// className is the class of the job's document, empty when it was not
+// classified.
+func (j *Job) className() string {
+	if j.Class == nil {
+		return ""
+	}
+	return j.Class.Class
+}
+
+// classifyText labels the text file of a finished job. A failing command
+// falls back to the rules, so a job is never failed for its class.
+func classifyText(ctx context.Context, j Job, textFile string) *Classification {
+	if documentClassifier == nil || textFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(textFile)
+	if err != nil {
+		log.Printf("job %s: reading the text to classify: %v", j.ID, err)
+		return nil
+	}
+	if len(data) > maxClassifiedText {
+		data = data[:maxClassifiedText]
+	}
+	text := strings.ToValidUTF8(string(data), "")
+	c, err := documentClassifier.Classify(ctx, j, text)
+	if cc, ok := documentClassifier.(*commandClassifier); ok && err != nil {
+		log.Printf("job %s: classifier failed, using the rules: %v", j.ID, err)
+		c, err = cc.fallback.Classify(ctx, j, text)
+	}
+	if err != nil {
+		log.Printf("job %s: classifying: %v", j.ID, err)
+		return nil
+	}
+	return &c
+}
+
+// newClassifier returns the classifier selected by -classifier.
+func newClassifier(mode, rulesFile, command string) (classifier, error) {
+	rules := defaultClassRules
+	if rulesFile != "" {
+		var err error
+		if rules, err = loadClassRules(rulesFile); err != nil {
+			return nil, err
+		}
+	}
+	switch mode {
+	case "off":
+		return nil, nil
+	case "rules":
+		return newRuleClassifier(rules), nil
+	case "command":
+		if command == "" {
+			return nil, fmt.Errorf("-classifier command needs -classifier-command")
+		}
+		return &commandClassifier{command: command, fallback: newRuleClassifier(rules)}, nil
+	}
+	return nil, fmt.Errorf("unknown -classifier %q: use rules, command or off", mode)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings. Every option can be set with a
+// command-line flag or with the matching OCR_* environment variable.
+type Config struct {
+	RateLimit   int    // requests per client per minute, 0 disables
+	DailyQuota  int    // document submissions per client per day, 0 disables
+	Workers     int    // OCR jobs processed concurrently
+	WarmWorkers int    // OCR engine processes kept running between runs, 0 disables
+	QueueSize   int    // queued jobs accepted before submissions are refused
+	MaxActive   int    // jobs an account may have queued or processing, 0 disables
+	MaxUpload   int    // MB, largest document accepted by the API
+	MaxPages    int    // pages a document may have, 0 disables
+	UploadTypes string // comma-separated extensions accepted for upload
+	DiskReserve int    // MB of free disk kept back when admitting documents
+	Addr        string // HTTP listen address
+	GRPCAddr    string // gRPC listen address, empty disables the gRPC API
+	PublicURL   string // external base URL used for links in notifications
+	BasePath    string // URL path prefix the server is reached under behind a reverse proxy
+	OutputName  string // output file name template, see renderOutputName
+
+	HTTPSAddr     string // HTTPS listen address, used with a certificate
+	TLSCert       string // PEM certificate chain, empty serves plain HTTP only
+	TLSKey        string
+	ACMEDomains   string // comma-separated domains to obtain a certificate for over ACME instead
+	ACMEEmail     string // contact address of the ACME account
+	ACMEDirectory string // directory URL of the ACME CA
+	TLSRedirect   bool   // the HTTP listener redirects to HTTPS
+
+	OCRMemory  int           // MB for one OCR process tree, 0 disables
+	OCRCPU     int           // percent of one core per OCR process tree, 0 disables
+	OCRTimeout time.Duration // wall-clock limit per OCR run, 0 disables
+	CgroupRoot string        // Linux cgroup v2 directory job cgroups are created in
+	TempDir    string        // per-run scratch directories are created here
+	Rasterizer string        // how PDF pages become images, see rasterizers
+	PageImages string        // how page images reach Tesseract, see pageImageModes
+	PageCache  string        // directory recognized pages are kept in for reuse, empty disables it
+	CacheSize  int           // MB the page cache is trimmed to
+
+	Pipeline    string        // how pages are recognized: native (internal/ocr) or python (ocr_python.py)
+	Tesseract   string        // tesseract command of the native pipeline
+	PopplerDir  string        // directory of pdfinfo, pdftoppm and pdfunite, empty for PATH
+	PageTimeout time.Duration // time one page may take in the native pipeline, 0 disables
+	Enhance     bool          // sharpen or stretch the contrast of poor scans in the native pipeline
+
+	Engine        string // engine of jobs that do not name one, see knownEngines
+	EngineCommand string // program of the "command" engine, empty to leave it out
+	AzureEndpoint string // Document Intelligence resource of the "azure" engine, empty to leave it out
+	AzureKey      string // key of that resource
+
+	Sandbox        string // OCR sandbox mode: auto, require or off
+	SandboxUser    string // unprivileged user the OCR engine runs as
+	SandboxNetwork bool   // allow network access from the sandbox
+
+	MQTTBroker   string // e.g. tcp://localhost:1883, empty disables MQTT
+	MQTTTopic    string
+	MQTTUsername string
+	MQTTPassword string
+	MQTTQoS      int
+
+	ChatWebhook string // Slack or Mattermost incoming webhook URL
+	ChatFormat  string // "slack" or "mattermost"
+
+	WebhooksFile    string // JSON list of webhook endpoints
+	WebhookAttempts int    // delivery attempts before an event is dead-lettered
+
+	DestinationsFile string // JSON list of storage destinations results can be pushed to
+	DeliveryAttempts int    // attempts to push a job's results before giving up
+
+	NextcloudURL      string // WebDAV URL of a Nextcloud folder to watch, empty disables
+	NextcloudUser     string
+	NextcloudPassword string // an app password
+	NextcloudInterval time.Duration
+
+	SchedulesFile string // JSON list of recurring OCR tasks, see Schedule
+	RoutingFile   string // JSON rules run on every finished job, see RoutingRule
+
+	PlansFile         string // JSON file with service plans and API keys
+	AllowAnonymousAPI bool   // /api/ requests without a key or login are let through
+	EngineCosts       string // "engine=price,..." per page, for usage metering
+
+	OIDCIssuer       string // OpenID Connect provider the web UI signs in with, empty leaves it open
+	OIDCClientID     string
+	OIDCClientSecret string
+	SessionTTL       time.Duration // time a web UI login lasts
+
+	LDAPURL          string // ldap:// or ldaps:// directory the web UI signs in with, empty disables it
+	LDAPBindDN       string // service account users are looked up with, empty binds anonymously
+	LDAPBindPassword string
+	LDAPBaseDN       string // subtree users are searched in
+	LDAPUserAttr     string // attribute holding the user name signed in with
+	LDAPStartTLS     bool   // upgrade ldap:// connections with StartTLS
+	LDAPGroupRoles   string // "role=group DN;..." roles of the members of directory groups
+
+	HookToken        string // static token for the hooks API, empty disables it
+	HookAllowPrivate bool   // let hook URLs point at private networks
+
+	FetchHosts   string        // hosts documents may be fetched from by URL, "*" for any public host
+	FetchTimeout time.Duration // time a download may take
+
+	FormMaxSize      int           // MB, largest web form upload, all files together
+	ResumableMaxSize int           // MB, largest file taken as a resumable upload
+	ResumableExpiry  time.Duration // unfinished and unsubmitted uploads are deleted after this long idle
+
+	RetentionDays    int // finished jobs are deleted this many days after they finish, 0 keeps them
+	ExpiryNoticeDays int // days before deletion the owners are notified
+
+	SMTPAddr      string // mail server for notices, host:port, empty disables email
+	SMTPFrom      string
+	SMTPUsername  string
+	SMTPPassword  string
+	NotifyLinkTTL time.Duration // how long the download links of result emails work
+
+	QuickMaxSize    int           // KB, largest image accepted by /api/v1/quick
+	QuickTimeout    time.Duration // time a quick OCR request may take
+	QuickConcurrent int           // quick OCR runs at once, 0 disables the endpoint
+	ExtensionsFile  string        // JSON list of browser extensions and their tokens
+
+	Classifier        string // how finished documents are classified: rules, command or off
+	ClassRulesFile    string // JSON list of keyword rules, empty for the built-in ones
+	ClassifierCommand string // command classifying the text on its stdin, for -classifier command
+	Keywords          int    // keywords extracted from each document, 0 = off
+
+	LLMURL       string        // OpenAI-compatible API of a language model, empty for none
+	LLMModel     string        // model name sent with every request
+	LLMKey       string        // bearer token for the API
+	LLMTimeout   time.Duration // time one request may take
+	CorrectBelow int           // line confidence below which the model corrects lines, 0 = off
+	Summarize    bool          // the model summarizes every finished document
+
+	Embeddings       string // how page embeddings are made for semantic search: api, command or off
+	EmbeddingURL     string // OpenAI-compatible API with /embeddings, defaults to LLMURL
+	EmbeddingModel   string // embedding model name, stored with the vectors
+	EmbeddingKey     string // bearer token for EmbeddingURL, defaults to LLMKey
+	EmbeddingCommand string // command embedding the texts on its stdin, for -embeddings command
+
+	DuplicateSimilarity int // percent of text two documents share to be flagged as duplicates, 0 = off
+
+	RescanConfidence int // mean word confidence below which a page is to be scanned again, 0 = only poor scans and failures
+
+	DataDir    string // server state such as the webhook dead-letter list
+	AdminToken string // bearer token for /api/v1/admin, which is closed to tokenless requests when empty
+
+	EncryptionKeyFile    string // AES-256 key stored files are encrypted with, empty leaves them plain
+	EncryptionKeyCommand string // command printing the key instead, such as a KMS call
+
+	// Client networks each route group is restricted to, see netpolicy.go;
+	// comma-separated addresses and CIDR networks, empty for no rule.
+	AllowUI, DenyUI       string
+	AllowAPI, DenyAPI     string
+	AllowAdmin, DenyAdmin string
+
+	// Reverse proxies whose X-Forwarded-For names the client, for the rate
+	// limits, quotas and network rules; comma-separated, empty for none.
+	TrustedProxies string
+}
+
+func loadConfig() Config {
+	var c Config
+	flag.IntVar(&c.RateLimit, "rate-limit", envInt("OCR_RATE_LIMIT", 60), "requests per client per minute (0 = unlimited)")
+	flag.IntVar(&c.DailyQuota, "daily-quota", envInt("OCR_DAILY_QUOTA", 200), "document submissions per client per day (0 = unlimited)")
+	flag.IntVar(&c.Workers, "workers", envInt("OCR_WORKERS", 2), "number of OCR jobs processed concurrently")
+	flag.IntVar(&c.WarmWorkers, "warm-workers", envInt("OCR_WARM_WORKERS", 0), "OCR engine processes kept running and reused across jobs (0 = a fresh one per run)")
+	flag.IntVar(&c.QueueSize, "queue-size", envInt("OCR_QUEUE_SIZE", 100), "maximum number of queued jobs")
+	flag.IntVar(&c.MaxUpload, "max-upload-size", envInt("OCR_MAX_UPLOAD_SIZE", 32), "MB, largest document accepted by the API, and largest file of an API batch")
+	flag.IntVar(&c.MaxPages, "max-pages", envInt("OCR_MAX_PAGES", 0), "pages a document may have (0 = unlimited)")
+	flag.StringVar(&c.UploadTypes, "upload-types", envString("OCR_UPLOAD_TYPES", strings.Join(uploadTypes, ",")), "comma-separated file types accepted for upload; zip unpacks archives of the others")
+	flag.IntVar(&c.MaxActive, "max-active-jobs", envInt("OCR_MAX_ACTIVE_JOBS", 0), "jobs one account or client address may have queued or processing (0 = unlimited)")
+	flag.IntVar(&c.DiskReserve, "disk-reserve", envInt("OCR_DISK_RESERVE", 512), "MB of free disk space to keep when admitting documents")
+	flag.StringVar(&c.Addr, "addr", envString("OCR_ADDR", ":8080"), "HTTP listen address")
+	flag.StringVar(&c.HTTPSAddr, "https-addr", envString("OCR_HTTPS_ADDR", ":443"), "HTTPS listen address, used with -tls-cert or -acme-domains")
+	flag.StringVar(&c.TLSCert, "tls-cert", envString("OCR_TLS_CERT", ""), "PEM certificate chain to serve HTTPS with, reloaded when it changes")
+	flag.StringVar(&c.TLSKey, "tls-key", envString("OCR_TLS_KEY", ""), "PEM private key of -tls-cert")
+	flag.StringVar(&c.ACMEDomains, "acme-domains", envString("OCR_ACME_DOMAINS", ""), "comma-separated domains to obtain a certificate for automatically over ACME, e.g. Let's Encrypt")
+	flag.StringVar(&c.ACMEEmail, "acme-email", envString("OCR_ACME_EMAIL", ""), "contact address for the ACME account, told about expiring certificates")
+	flag.StringVar(&c.ACMEDirectory, "acme-directory", envString("OCR_ACME_DIRECTORY", letsEncryptDirectory), "directory URL of the ACME CA")
+	flag.BoolVar(&c.TLSRedirect, "tls-redirect", envBool("OCR_TLS_REDIRECT", true), "redirect HTTP requests to HTTPS when serving HTTPS")
+	flag.StringVar(&c.GRPCAddr, "grpc-addr", envString("OCR_GRPC_ADDR", ""), "gRPC listen address, e.g. :9090 (empty = disabled)")
+	flag.StringVar(&c.PublicURL, "public-url", envString("OCR_PUBLIC_URL", "http://localhost:8080"), "external base URL used for links in notifications")
+	flag.StringVar(&c.BasePath, "base-path", envString("OCR_BASE_PATH", ""), "URL path prefix the server is served under behind a reverse proxy, e.g. /ocr (empty = the root)")
+	flag.StringVar(&c.OutputName, "output-name", envString("OCR_OUTPUT_NAME", defaultOutputName), "output file name template, e.g. {date}_{original}_{lang}_searchable")
+	flag.IntVar(&c.OCRMemory, "ocr-memory", envInt("OCR_MEMORY", 4096), "MB of memory one OCR run may use (0 = unlimited)")
+	flag.IntVar(&c.OCRCPU, "ocr-cpu", envInt("OCR_CPU", 0), "CPU one OCR run may use, in percent of one core (0 = unlimited)")
+	flag.DurationVar(&c.OCRTimeout, "ocr-timeout", envDuration("OCR_TIMEOUT", 30*time.Minute), "time after which an OCR run is killed (0 = never)")
+	flag.StringVar(&c.CgroupRoot, "cgroup-root", envString("OCR_CGROUP_ROOT", "/sys/fs/cgroup/persianocr"), "cgroup v2 directory for per-job limits on Linux")
+	flag.StringVar(&c.Rasterizer, "rasterizer", envString("OCR_RASTERIZER", "auto"), "how PDF pages are rendered: auto, mupdf (in-process, needs PyMuPDF) or poppler")
+	flag.StringVar(&c.PageImages, "page-images", envString("OCR_PAGE_IMAGES", "pipe"), "how page images reach Tesseract: pipe (in memory) or file (PNGs in the temp directory)")
+	flag.StringVar(&c.Pipeline, "ocr-pipeline", envString("OCR_PIPELINE", "native"), "how documents are recognized: native (tesseract and Poppler run by the server) or python (ocr_python.py)")
+	flag.StringVar(&c.Tesseract, "tesseract", envString("OCR_TESSERACT", "tesseract"), "tesseract command of the native pipeline")
+	flag.StringVar(&c.PopplerDir, "poppler-dir", envString("OCR_POPPLER_DIR", ""), "directory of Poppler's pdfinfo, pdftoppm and pdfunite for the native pipeline (empty = PATH)")
+	flag.DurationVar(&c.PageTimeout, "ocr-page-timeout", envDuration("OCR_PAGE_TIMEOUT", 0), "time one page may take in the native pipeline before it is skipped (0 = no limit)")
+	flag.BoolVar(&c.Enhance, "enhance-poor-scans", envBool("OCR_ENHANCE_POOR_SCANS", false), "sharpen blurred pages and stretch the contrast of faded ones before recognizing them (native pipeline)")
+	flag.StringVar(&c.Engine, "engine", envString("OCR_ENGINE", "tesseract"), "OCR engine of jobs that do not ask for one: tesseract, command with -engine-command, or azure with -azure-endpoint and -azure-key")
+	flag.StringVar(&c.AzureEndpoint, "azure-endpoint", envString("OCR_AZURE_ENDPOINT", ""), "endpoint of the Azure AI Document Intelligence resource of the \"azure\" engine, e.g. https://<name>.cognitiveservices.azure.com (empty = no azure engine)")
+	flag.StringVar(&c.AzureKey, "azure-key", envString("OCR_AZURE_KEY", ""), "key of the Document Intelligence resource")
+	flag.StringVar(&c.EngineCommand, "engine-command", envString("OCR_ENGINE_COMMAND", ""), "shell command of the \"command\" engine, run per page with the image, page number and languages as $1 $2 $3 and printing JSON lines of words (empty = no command engine)")
+	flag.StringVar(&c.PageCache, "page-cache", envString("OCR_PAGE_CACHE", ""), "directory recognized pages are cached in, keyed by page image, so unchanged pages of a resubmitted document are reused (empty = disabled)")
+	flag.IntVar(&c.CacheSize, "page-cache-size", envInt("OCR_PAGE_CACHE_SIZE", 1024), "MB the page cache is kept under, removing the pages used least recently")
+	flag.StringVar(&c.TempDir, "temp-dir", envString("OCR_TEMP_DIR", jobTempRoot), "directory for per-job scratch files such as page images")
+	flag.StringVar(&c.Sandbox, "sandbox", envString("OCR_SANDBOX", sandboxAuto), "OCR sandbox: auto, require or off")
+	flag.StringVar(&c.SandboxUser, "sandbox-user", envString("OCR_SANDBOX_USER", ""), "run the OCR engine as this unprivileged user (Linux, server must run as root)")
+	flag.BoolVar(&c.SandboxNetwork, "sandbox-network", envBool("OCR_SANDBOX_NETWORK", false), "allow network access from the OCR sandbox")
+	flag.StringVar(&c.MQTTBroker, "mqtt-broker", envString("OCR_MQTT_BROKER", ""), "MQTT broker for job events, e.g. tcp://localhost:1883 (empty = disabled)")
+	flag.StringVar(&c.MQTTTopic, "mqtt-topic", envString("OCR_MQTT_TOPIC", "persianocr/jobs"), "MQTT topic job events are published to")
+	flag.StringVar(&c.MQTTUsername, "mqtt-username", envString("OCR_MQTT_USERNAME", ""), "MQTT username")
+	flag.StringVar(&c.MQTTPassword, "mqtt-password", envString("OCR_MQTT_PASSWORD", ""), "MQTT password")
+	flag.IntVar(&c.MQTTQoS, "mqtt-qos", envInt("OCR_MQTT_QOS", 1), "MQTT QoS level for job events (0, 1 or 2)")
+	flag.StringVar(&c.ChatWebhook, "chat-webhook", envString("OCR_CHAT_WEBHOOK", ""), "Slack or Mattermost incoming webhook URL for finished jobs")
+	flag.StringVar(&c.ChatFormat, "chat-format", envString("OCR_CHAT_FORMAT", "slack"), "chat message format: slack or mattermost")
+	flag.StringVar(&c.WebhooksFile, "webhooks-file", envString("OCR_WEBHOOKS_FILE", ""), "JSON file listing webhook endpoints for job events")
+	flag.IntVar(&c.WebhookAttempts, "webhook-attempts", envInt("OCR_WEBHOOK_ATTEMPTS", 6), "webhook delivery attempts before an event is dead-lettered")
+	flag.StringVar(&c.DestinationsFile, "destinations-file", envString("OCR_DESTINATIONS_FILE", ""), "JSON file listing storage destinations (S3, WebDAV, SMB, SFTP) for finished results")
+	flag.IntVar(&c.DeliveryAttempts, "delivery-attempts", envInt("OCR_DELIVERY_ATTEMPTS", 5), "attempts to push a job's results to its destination")
+	flag.StringVar(&c.NextcloudURL, "nextcloud-url", envString("OCR_NEXTCLOUD_URL", ""), "WebDAV URL of a Nextcloud/ownCloud folder to OCR new PDFs from (empty = disabled)")
+	flag.StringVar(&c.NextcloudUser, "nextcloud-user", envString("OCR_NEXTCLOUD_USER", ""), "Nextcloud user name")
+	flag.StringVar(&c.NextcloudPassword, "nextcloud-password", envString("OCR_NEXTCLOUD_PASSWORD", ""), "Nextcloud app password")
+	flag.DurationVar(&c.NextcloudInterval, "nextcloud-interval", envDuration("OCR_NEXTCLOUD_INTERVAL", time.Minute), "how often the Nextcloud folder is checked for new PDFs")
+	flag.StringVar(&c.SchedulesFile, "schedules-file", envString("OCR_SCHEDULES_FILE", ""), "JSON file listing recurring tasks that OCR new PDFs in a folder and export the results")
+	flag.StringVar(&c.RoutingFile, "routing-file", envString("OCR_ROUTING_FILE", ""), "JSON file of rules that export and announce finished jobs matching a filter, such as class=invoice&tag=finance")
+	flag.StringVar(&c.PlansFile, "plans-file", envString("OCR_PLANS_FILE", ""), "JSON file defining service plans and API keys (empty = no limits, no keys)")
+	flag.StringVar(&c.OIDCIssuer, "oidc-issuer", envString("OCR_OIDC_ISSUER", ""), "OpenID Connect issuer URL the web UI requires a login with, such as a Keycloak realm (empty = no login)")
+	flag.StringVar(&c.OIDCClientID, "oidc-client-id", envString("OCR_OIDC_CLIENT_ID", ""), "OpenID Connect client ID")
+	flag.StringVar(&c.OIDCClientSecret, "oidc-client-secret", envString("OCR_OIDC_CLIENT_SECRET", ""), "OpenID Connect client secret (empty for a public client)")
+	flag.StringVar(&c.LDAPURL, "ldap-url", envString("OCR_LDAP_URL", ""), "LDAP or Active Directory server the web UI requires a login with, ldap://host or ldaps://host (empty = no login)")
+	flag.StringVar(&c.LDAPBindDN, "ldap-bind-dn", envString("OCR_LDAP_BIND_DN", ""), "DN of the service account users are looked up with (empty = anonymous)")
+	flag.StringVar(&c.LDAPBindPassword, "ldap-bind-password", envString("OCR_LDAP_BIND_PASSWORD", ""), "password of the LDAP service account")
+	flag.StringVar(&c.LDAPBaseDN, "ldap-base-dn", envString("OCR_LDAP_BASE_DN", ""), "DN of the subtree users are searched in, e.g. DC=corp,DC=example")
+	flag.StringVar(&c.LDAPUserAttr, "ldap-user-attr", envString("OCR_LDAP_USER_ATTR", "sAMAccountName"), "LDAP attribute holding the user name (uid for OpenLDAP)")
+	flag.BoolVar(&c.LDAPStartTLS, "ldap-start-tls", envBool("OCR_LDAP_START_TLS", false), "upgrade ldap:// connections to TLS with StartTLS")
+	flag.StringVar(&c.LDAPGroupRoles, "ldap-group-roles", envString("OCR_LDAP_GROUP_ROLES", ""), "roles of LDAP group members, e.g. \"admin=CN=OCR Admins,OU=Groups,DC=corp,DC=example;reviewer=...\"")
+	flag.DurationVar(&c.SessionTTL, "session-ttl", envDuration("OCR_SESSION_TTL", 12*time.Hour), "time a web UI login lasts before signing in again")
+	flag.BoolVar(&c.AllowAnonymousAPI, "allow-anonymous-api", envBool("OCR_ALLOW_ANONYMOUS_API", false), "let /api/ requests without an API key or login through under the default plan, for a server only this machine can reach (see persianOCR keys)")
+	flag.StringVar(&c.EngineCosts, "engine-costs", envString("OCR_ENGINE_COSTS", ""), "price per page of billed engines for usage metering, e.g. google=0.0015")
+	flag.StringVar(&c.HookToken, "hook-token", envString("OCR_HOOK_TOKEN", ""), "token for the no-code hooks API at /api/v1/hooks (empty = disabled)")
+	flag.BoolVar(&c.HookAllowPrivate, "hook-allow-private", envBool("OCR_HOOK_ALLOW_PRIVATE", false), "allow hook document and callback URLs on loopback and private networks")
+	flag.StringVar(&c.FetchHosts, "fetch-hosts", envString("OCR_FETCH_HOSTS", ""), "comma-separated hosts documents may be submitted from by URL, * for any public host (empty = disabled)")
+	flag.DurationVar(&c.FetchTimeout, "fetch-timeout", envDuration("OCR_FETCH_TIMEOUT", 2*time.Minute), "time downloading a document submitted by URL may take")
+	flag.IntVar(&c.FormMaxSize, "form-max-size", envInt("OCR_FORM_MAX_SIZE", 1024), "MB, largest upload the web form accepts, all its files together; they are streamed to disk")
+	flag.IntVar(&c.ResumableMaxSize, "resumable-max-size", envInt("OCR_RESUMABLE_MAX_SIZE", 2048), "MB, largest file accepted as a resumable upload at /api/v1/tus")
+	flag.DurationVar(&c.ResumableExpiry, "resumable-expiry", envDuration("OCR_RESUMABLE_EXPIRY", 24*time.Hour), "time a resumable upload is kept after its last chunk before it is deleted")
+	flag.IntVar(&c.RetentionDays, "retention-days", envInt("OCR_RETENTION_DAYS", 0), "days after which finished jobs and their files are deleted (0 = keep forever)")
+	flag.IntVar(&c.ExpiryNoticeDays, "expiry-notice-days", envInt("OCR_EXPIRY_NOTICE_DAYS", 3), "days before deletion that owners are notified of expiring results")
+	flag.StringVar(&c.SMTPAddr, "smtp-addr", envString("OCR_SMTP_ADDR", ""), "mail server for email notices, e.g. smtp.example.com:587 (empty = no email)")
+	flag.StringVar(&c.SMTPFrom, "smtp-from", envString("OCR_SMTP_FROM", "persianocr@localhost"), "sender address of email notices")
+	flag.StringVar(&c.SMTPUsername, "smtp-username", envString("OCR_SMTP_USERNAME", ""), "SMTP user name")
+	flag.StringVar(&c.SMTPPassword, "smtp-password", envString("OCR_SMTP_PASSWORD", ""), "SMTP password")
+	flag.DurationVar(&c.NotifyLinkTTL, "notify-link-ttl", envDuration("OCR_NOTIFY_LINK_TTL", 72*time.Hour), "time the download links in result emails work")
+	flag.IntVar(&c.QuickMaxSize, "quick-max-size", envInt("OCR_QUICK_MAX_SIZE", 4096), "KB, largest image accepted by the synchronous /api/v1/quick endpoint")
+	flag.DurationVar(&c.QuickTimeout, "quick-timeout", envDuration("OCR_QUICK_TIMEOUT", 20*time.Second), "time a quick OCR request may take, including waiting for a free slot")
+	flag.IntVar(&c.QuickConcurrent, "quick-concurrency", envInt("OCR_QUICK_CONCURRENCY", 2), "quick OCR requests processed at once (0 = endpoint disabled)")
+	flag.StringVar(&c.ExtensionsFile, "extensions-file", envString("OCR_EXTENSIONS_FILE", ""), "JSON file listing browser extensions allowed to use /api/v1/extension (empty = disabled)")
+	flag.StringVar(&c.Classifier, "classifier", envString("OCR_CLASSIFIER", "rules"), "how finished documents are classified: rules, command or off")
+	flag.StringVar(&c.ClassRulesFile, "class-rules-file", envString("OCR_CLASS_RULES_FILE", ""), "JSON file listing the keyword rules of document classes (empty = built-in rules)")
+	flag.StringVar(&c.ClassifierCommand, "classifier-command", envString("OCR_CLASSIFIER_COMMAND", ""), "shell command reading a document's text on stdin and printing its class as JSON, for -classifier command")
+	flag.IntVar(&c.Keywords, "keywords", envInt("OCR_KEYWORDS", 8), "keywords extracted from each finished document's text and stored with the job (0 = off)")
+	flag.StringVar(&c.LLMURL, "llm-url", envString("OCR_LLM_URL", ""), "base URL of an OpenAI-compatible chat completions API, such as http://localhost:11434/v1 (empty = no language model)")
+	flag.StringVar(&c.LLMModel, "llm-model", envString("OCR_LLM_MODEL", ""), "language model name sent to -llm-url")
+	flag.StringVar(&c.LLMKey, "llm-key", envString("OCR_LLM_KEY", ""), "API key for -llm-url, sent as a bearer token")
+	flag.DurationVar(&c.LLMTimeout, "llm-timeout", envDuration("OCR_LLM_TIMEOUT", 60*time.Second), "time one language model request may take")
+	flag.IntVar(&c.CorrectBelow, "llm-correct-below", envInt("OCR_LLM_CORRECT_BELOW", 0), "line confidence (0-100) below which lines are corrected by the language model (0 = off)")
+	flag.BoolVar(&c.Summarize, "llm-summarize", envBool("OCR_LLM_SUMMARIZE", false), "have the language model write a Persian summary of every finished document")
+	flag.StringVar(&c.Embeddings, "embeddings", envString("OCR_EMBEDDINGS", "off"), "embed finished documents' pages for semantic search: api, command or off")
+	flag.StringVar(&c.EmbeddingURL, "embedding-url", envString("OCR_EMBEDDING_URL", ""), "base URL of an OpenAI-compatible embeddings API for -embeddings api (empty = -llm-url)")
+	flag.StringVar(&c.EmbeddingModel, "embedding-model", envString("OCR_EMBEDDING_MODEL", ""), "embedding model name sent to -embedding-url and stored with the vectors")
+	flag.StringVar(&c.EmbeddingKey, "embedding-key", envString("OCR_EMBEDDING_KEY", ""), "API key for -embedding-url (empty = -llm-key)")
+	flag.StringVar(&c.EmbeddingCommand, "embedding-command", envString("OCR_EMBEDDING_COMMAND", ""), "command for -embeddings command, run with sh -c: reads a JSON array of texts, prints a JSON array of vectors")
+	flag.IntVar(&c.RescanConfidence, "rescan-confidence", envInt("OCR_RESCAN_CONFIDENCE", 50), "mean word confidence (0-100) below which a page is listed to be scanned again (0 = only poorly rated scans and failed pages)")
+	flag.IntVar(&c.DuplicateSimilarity, "duplicate-similarity", envInt("OCR_DUPLICATE_SIMILARITY", 70), "percent of its text a finished document must share with an earlier one of its owner to be flagged as a duplicate (0 = off)")
+	flag.StringVar(&c.DataDir, "data-dir", envString("OCR_DATA_DIR", "data"), "directory for server state")
+	flag.StringVar(&c.EncryptionKeyFile, "encryption-key-file", envString("OCR_ENCRYPTION_KEY_FILE", ""), "file with a 32-byte key (raw, hex or base64) uploads and results are encrypted at rest with (empty = not encrypted)")
+	flag.StringVar(&c.EncryptionKeyCommand, "encryption-key-command", envString("OCR_ENCRYPTION_KEY_COMMAND", ""), "shell command printing the encryption key, e.g. a KMS or Vault call, instead of -encryption-key-file")
+	flag.StringVar(&c.AllowUI, "allow-ui", envString("OCR_ALLOW_UI", ""), "addresses and CIDR networks allowed to use the web UI, comma-separated (empty = all)")
+	flag.StringVar(&c.DenyUI, "deny-ui", envString("OCR_DENY_UI", ""), "addresses and CIDR networks refused the web UI, comma-separated")
+	flag.StringVar(&c.AllowAPI, "allow-api", envString("OCR_ALLOW_API", ""), "addresses and CIDR networks allowed to use the API, WebDAV and gRPC, comma-separated (empty = all)")
+	flag.StringVar(&c.DenyAPI, "deny-api", envString("OCR_DENY_API", ""), "addresses and CIDR networks refused the API, WebDAV and gRPC, comma-separated")
+	flag.StringVar(&c.AllowAdmin, "allow-admin", envString("OCR_ALLOW_ADMIN", ""), "addresses and CIDR networks allowed to use the admin endpoints, comma-separated (empty = all)")
+	flag.StringVar(&c.DenyAdmin, "deny-admin", envString("OCR_DENY_ADMIN", ""), "addresses and CIDR networks refused the admin endpoints, comma-separated")
+	flag.StringVar(&c.TrustedProxies, "trusted-proxies", envString("OCR_TRUSTED_PROXIES", ""), "addresses and CIDR networks of reverse proxies whose X-Forwarded-For names the client, comma-separated")
+	flag.StringVar(&c.AdminToken, "admin-token", envString("OCR_ADMIN_TOKEN", ""), "bearer token for admin endpoints (empty = only admin accounts and keys with the admin scope)")
+	flag.Parse()
+	return c
+}
+
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v, ok := os.LookupEnv(key); ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	if v, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Lines Tesseract recognized with little confidence, typically Persian
+// words broken by a missing or misplaced letter join, can be handed to a
+// language model with the text of their page as context. The model sends
+// back a corrected version of every line; plausible corrections replace
+// the lines in the text file and the page texts, and the corrections file
+// lists what was changed. The searchable PDF's text layer is left as the
+// engine made it.
+
+// correctBelow is the line confidence, 0-100, below which lines are sent
+// to the language model; 0 turns correction off.
+var correctBelow int
+
+const (
+	// maxCorrectionContext bounds the page text sent along with its lines.
+	maxCorrectionContext = 8000
+	// maxCorrectionLines is the most lines sent in one request.
+	maxCorrectionLines = 40
+)
+
+// LowLine is a line the engine recognized with a confidence below
+// -llm-correct-below.
+type LowLine struct {
+	Page       int     `json:"page"`
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"`
+}
+
+// TextCorrection is what the language model did to a finished job's text.
+type TextCorrection struct {
+	Model   string `json:"model"`
+	Lines   int    `json:"lines"`           // lines sent
+	Changed int    `json:"changed"`         // lines replaced in the text
+	URL     string `json:"url,omitempty"`   // the corrections file, when lines were changed
+	Error   string `json:"error,omitempty"` // why some or all lines went uncorrected
+}
+
+// LineCorrection is one entry of a job's corrections file.
+type LineCorrection struct {
+	Page       int     `json:"page"`
+	Original   string  `json:"original"`
+	Corrected  string  `json:"corrected"`
+	Confidence float64 `json:"confidence"`
+}
+
+const correctionPrompt = `You correct the output of OCR on Persian documents, which may also contain English.
+The user sends the text of a page, then a JSON array of lines from that page the OCR engine was unsure of.
+Fix words broken by OCR: wrong or missing letters, misplaced joins and spaces inside words, Arabic letter forms used for Persian ones (ي for ی, ك for ک).
+Do not rephrase, translate, reorder or complete the text, and do not fix the author's own spelling.
+Answer with only a JSON array holding one string per line, in the same order; repeat a line unchanged when it needs no fix.`
+
+// correctText sends the job's low-confidence lines to the language model
+// and applies its corrections to the text file and page texts. It returns
+// nil when there was nothing to correct.
+func correctText(ctx context.Context, j Job, result *OCRResult) *TextCorrection {
+	if languageModel == nil || correctBelow <= 0 || len(result.LowLines) == 0 || result.TextFile == "" {
+		return nil
+	}
+	c := &TextCorrection{Model: languageModel.model, Lines: len(result.LowLines)}
+	data, err := os.ReadFile(result.TextFile)
+	if err != nil {
+		log.Printf("job %s: reading the text to correct: %v", j.ID, err)
+		c.Error = "the text could not be read"
+		return c
+	}
+	pages := splitPages(string(data))
+	index := map[int]int{}
+	for i, sec := range pages {
+		index[sec.number] = i
+	}
+
+	var changes []LineCorrection
+	var failed []string
+	for start := 0; start < len(result.LowLines); {
+		page := result.LowLines[start].Page
+		end := start + 1
+		for end < len(result.LowLines) && end-start < maxCorrectionLines && result.LowLines[end].Page == page {
+			end++
+		}
+		lines := result.LowLines[start:end]
+		start = end
+
+		p, ok := index[page]
+		if !ok {
+			continue
+		}
+		sec := &pages[p]
+		fixed, err := askCorrections(ctx, sec.text, lines)
+		if err != nil {
+			log.Printf("job %s: correcting page %d: %v", j.ID, page, err)
+			failed = append(failed, strconv.Itoa(page))
+			continue
+		}
+		for i, l := range lines {
+			if !plausibleCorrection(l.Text, fixed[i]) || !strings.Contains(sec.text, l.Text) {
+				continue
+			}
+			sec.text = strings.Replace(sec.text, l.Text, fixed[i], 1)
+			if pt, err := os.ReadFile(pagePath(j.outputDir, page)); err == nil {
+				writeFileAtomic(pagePath(j.outputDir, page), []byte(strings.Replace(string(pt), l.Text, fixed[i], 1)))
+			}
+			changes = append(changes, LineCorrection{Page: page, Original: l.Text, Corrected: fixed[i], Confidence: l.Confidence})
+		}
+	}
+	if len(failed) > 0 {
+		c.Error = "the language model failed on page " + strings.Join(failed, ", ")
+	}
+	if len(changes) == 0 {
+		return c
+	}
+
+	var out strings.Builder
+	for _, sec := range pages {
+		out.WriteString(sec.head)
+		out.WriteString(sec.text)
+	}
+	if err := writeFileAtomic(result.TextFile, []byte(out.String())); err != nil {
+		log.Printf("job %s: writing the corrected text: %v", j.ID, err)
+		c.Error = "the corrected text could not be written"
+		return c
+	}
+	path := filepath.Join(j.outputDir, j.prefix+"_corrections.json")
+	body, _ := json.MarshalIndent(changes, "", "  ")
+	if err := writeFileAtomic(path, body); err != nil {
+		log.Printf("job %s: writing its corrections: %v", j.ID, err)
+	} else {
+		c.URL = downloadURL(path)
+	}
+	c.Changed = len(changes)
+	return c
+}
+
+// askCorrections returns the model's version of every line.
+func askCorrections(ctx context.Context, page string, lines []LowLine) ([]string, error) {
+	if r := []rune(page); len(r) > maxCorrectionContext {
+		page = string(r[:maxCorrectionContext])
+	}
+	texts := make([]string, len(lines))
+	for i, l := range lines {
+		texts[i] = l.Text
+	}
+	list, _ := json.Marshal(texts)
+	answer, err := languageModel.complete(ctx, correctionPrompt, "Page text:\n"+page+"\n\nLines:\n"+string(list))
+	if err != nil {
+		return nil, err
+	}
+	// Models like to wrap JSON in prose or code fences.
+	i, k := strings.Index(answer, "["), strings.LastIndex(answer, "]")
+	if i < 0 || k < i {
+		return nil, errors.New("the answer holds no JSON array")
+	}
+	var fixed []string
+	if err := json.Unmarshal([]byte(answer[i:k+1]), &fixed); err != nil {
+		return nil, fmt.Errorf("reading the answer: %w", err)
+	}
+	if len(fixed) != len(lines) {
+		return nil, fmt.Errorf("%d lines sent, %d returned", len(lines), len(fixed))
+	}
+	for i := range fixed {
+		fixed[i] = strings.TrimSpace(fixed[i])
+	}
+	return fixed, nil
+}
+
+// plausibleCorrection reports whether fixed can stand in for line: a
+// changed line of about the same length, not a rewrite or a paragraph.
+func plausibleCorrection(line, fixed string) bool {
+	if fixed == "" || fixed == line || strings.ContainsAny(fixed, "\r\n") {
+		return false
+	}
+	n, m := utf8.RuneCountInString(line), utf8.RuneCountInString(fixed)
+	return 2*m >= n && 2*m <= 3*n+10
+}
+
+// pageSection is one page of a text file: its header and its text.
+type pageSection struct {
+	number int
+	head   string // the "--- Page N ---" line and the blank lines around it
+	text   string
+}
+
+// splitPages splits a text file into its pages, in order. Text before the
+// first page header, as in single page files without one, is page 1.
+func splitPages(text string) []pageSection {
+	var pages []pageSection
+	cur := pageSection{number: 1}
+	inHead := false
+	sc := bufio.NewScanner(strings.NewReader(text))
+	sc.Buffer(nil, 1<<20)
+	sc.Split(scanLinesKeepEnd)
+	var b strings.Builder
+	for sc.Scan() {
+		line := sc.Text()
+		if m := pageHeader.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			next := pageSection{number: n, head: line}
+			if cur.head == "" && strings.TrimSpace(b.String()) == "" {
+				next.head = b.String() + line
+			} else {
+				cur.text = b.String()
+				pages = append(pages, cur)
+			}
+			cur = next
+			b.Reset()
+			inHead = true
+			continue
+		}
+		if inHead && strings.TrimSpace(line) == "" {
+			cur.head += line
+			continue
+		}
+		inHead = false
+		b.WriteString(line)
+	}
+	cur.text = b.String()
+	return append(pages, cur)
+}
+
+// scanLinesKeepEnd is bufio.ScanLines without dropping the line endings,
+// so the text can be put back together byte for byte.
+func scanLinesKeepEnd(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
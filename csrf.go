@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The web UI's forms, and the API requests its pages make with the
+// session cookie, carry a token another site cannot know, so a page on
+// the intranet cannot make a signed-in user's browser upload, cancel or
+// sign out behind their back. SameSite cookies alone do not stop this:
+// the other applications of an intranet are usually the same site.
+//
+// The token is an HMAC, made with the session key, of a random value in
+// the ocr_csrf cookie and the signed-in user's subject. A neighbouring host
+// can plant a cookie in the user's browser, along with the token the
+// server gave it for that cookie, but that token was made for another
+// session, or none, and does not match the user's.
+
+const (
+	csrfCookie = "ocr_csrf"
+	csrfField  = "csrf_token"   // the hidden form field
+	csrfHeader = "X-CSRF-Token" // the header the pages' scripts send
+	csrfTTL    = 30 * 24 * time.Hour
+)
+
+// csrfToken returns the token for the forms of the page being rendered,
+// setting the cookie it belongs to on the first visit.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	value := ""
+	if c, err := r.Cookie(csrfCookie); err == nil && validCSRFCookie(c.Value) {
+		value = c.Value
+	} else {
+		b := make([]byte, 32)
+		rand.Read(b)
+		value = base64.RawURLEncoding.EncodeToString(b)
+	}
+	// Sent again on every page, so the cookie lasts as long as it is used.
+	setCookie(w, r, csrfCookie, "/", value, csrfTTL)
+	return csrfSign(r, value)
+}
+
+// validCSRF reports whether r carries the token of its cookie, in the
+// form field or the header.
+func validCSRF(r *http.Request) bool {
+	return validCSRFToken(r, r.Header.Get(csrfHeader)) || validCSRFToken(r, r.PostFormValue(csrfField))
+}
+
+// validCSRFToken reports whether token is the one of r's cookie.
+func validCSRFToken(r *http.Request, token string) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || token == "" || !validCSRFCookie(c.Value) {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(csrfSign(r, c.Value)))
+}
+
+func validCSRFCookie(v string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	return err == nil && len(b) == 32
+}
+
+// csrfSign returns the token for the cookie value of r's session.
+func csrfSign(r *http.Request, value string) string {
+	subject := ""
+	if s, ok := currentSession(r); ok {
+		subject = s.Subject
+	}
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("csrf\x00" + subject + "\x00" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkAPICSRF refuses a request to route that changes something on the
+// strength of the session cookie alone. Requests with an API key, and
+// those to the routes with credentials of their own (see authorizeAPI)
+// that present them, need no token.
+func checkAPICSRF(r *http.Request, route string) *planError {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+	if requestAPIKey(r) != "" || ownCredential(r, route) {
+		return nil
+	}
+	if _, ok := currentSession(r); !ok {
+		return nil
+	}
+	if !validCSRFToken(r, r.Header.Get(csrfHeader)) {
+		return &planError{http.StatusForbidden, "csrf_failed", "requests made with the session cookie need the page's " + csrfHeader + " header"}
+	}
+	return nil
+}
+
+// ownCredential reports whether r presents the credential of route, one of
+// ownCredentialRoutes: the hook token, an extension's token or the admin
+// token. A route reached with the session cookie instead, such as the
+// admin endpoints by an administrator, needs the token.
+func ownCredential(r *http.Request, route string) bool {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	switch {
+	case strings.HasPrefix(route, "/hooks/"):
+		if bearer == "" {
+			bearer = r.URL.Query().Get("token")
+		}
+		return hookToken != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(hookToken)) == 1
+	case strings.HasPrefix(route, "/extension"):
+		got := r.Header.Get("X-Extension-Token")
+		return got != "" && slices.ContainsFunc(extensions, func(e *Extension) bool {
+			return subtle.ConstantTimeCompare([]byte(got), []byte(e.Token)) == 1
+		})
+	case strings.HasPrefix(route, "/admin/"):
+		return adminToken != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(adminToken)) == 1
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a webhook delivery that failed every retry.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	Endpoint  string    `json:"endpoint"`
+	Event     JobEvent  `json:"event"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// deadLetterStore keeps failed deliveries in a JSON file under the data
+// directory so they survive restarts until an admin redelivers or drops them.
+type deadLetterStore struct {
+	mu    sync.Mutex
+	path  string
+	items []DeadLetter
+}
+
+func openDeadLetters(path string) (*deadLetterStore, error) {
+	s := &deadLetterStore{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.items); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *deadLetterStore) add(dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = append(s.items, dl)
+	return s.saveLocked()
+}
+
+func (s *deadLetterStore) list() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]DeadLetter(nil), s.items...)
+}
+
+func (s *deadLetterStore) get(id string) (DeadLetter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, dl := range s.items {
+		if dl.ID == id {
+			return dl, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+func (s *deadLetterStore) remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, dl := range s.items {
+		if dl.ID == id {
+			s.items = append(s.items[:i], s.items[i+1:]...)
+			return true, s.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+func (s *deadLetterStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.items, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Destination is one entry of the destinations file: a place finished
+// results are pushed to. The URL scheme selects the protocol:
+//
+//	s3://bucket/prefix                  S3 or an S3-compatible store
+//	webdav://host/path, webdavs://...   WebDAV over HTTP or HTTPS
+//	smb://host/share/path               SMB share, via smbclient
+//	sftp://user@host:port/path          SFTP, via the OpenSSH client
+type Destination struct {
+	Name     string   `json:"name"`
+	URL      string   `json:"url"`
+	Accounts []string `json:"accounts"` // API key names allowed to use it, empty means everyone
+	Template string   `json:"template"` // default file layout, see renderDeliveryPath
+
+	Username string `json:"username"` // WebDAV and SMB
+	Password string `json:"password"`
+
+	Endpoint  string `json:"endpoint"` // S3 endpoint, default https://s3.<region>.amazonaws.com
+	Region    string `json:"region"`   // S3 region, default us-east-1
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+
+	IdentityFile string `json:"identity_file"` // SFTP private key
+	KnownHosts   string `json:"known_hosts"`   // SFTP known_hosts file, default the user's
+
+	u *url.URL
+}
+
+// Delivery is the state of pushing a job's results to its destination.
+type Delivery struct {
+	Status      string     `json:"status"` // pending, delivered or failed
+	Error       string     `json:"error,omitempty"`
+	Files       int        `json:"files,omitempty"`
+	Path        string     `json:"path,omitempty"` // folder below the destination the files went to
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+var errUnknownDestination = errors.New("unknown destination")
+
+var (
+	destinations     = map[string]*Destination{}
+	deliveryAttempts = 5
+)
+
+// deliveryBackoff is the delay before the first retry of a delivery; it
+// doubles after every further failure.
+const deliveryBackoff = 30 * time.Second
+
+// deliveryTimeout bounds one delivery attempt.
+const deliveryTimeout = 10 * time.Minute
+
+var deliveryHTTPClient = &http.Client{Timeout: deliveryTimeout}
+
+// loadDestinations reads a JSON array of destinations from path.
+func loadDestinations(path string) (map[string]*Destination, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ds []*Destination
+	if err := json.Unmarshal(data, &ds); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	m := map[string]*Destination{}
+	for i, d := range ds {
+		if d.Name == "" {
+			return nil, fmt.Errorf("parsing %s: destination %d has no name", path, i)
+		}
+		if m[d.Name] != nil {
+			return nil, fmt.Errorf("parsing %s: destination %q is listed twice", path, d.Name)
+		}
+		if d.u, err = url.Parse(d.URL); err != nil || d.u.Host == "" {
+			return nil, fmt.Errorf("parsing %s: destination %q: invalid url %q", path, d.Name, d.URL)
+		}
+		switch d.u.Scheme {
+		case "s3":
+			if d.AccessKey == "" || d.SecretKey == "" {
+				return nil, fmt.Errorf("parsing %s: destination %q needs access_key and secret_key", path, d.Name)
+			}
+		case "webdav", "webdavs", "sftp":
+		case "smb":
+			if share, _, _ := strings.Cut(strings.Trim(d.u.Path, "/"), "/"); share == "" {
+				return nil, fmt.Errorf("parsing %s: destination %q: the url has no share", path, d.Name)
+			}
+		default:
+			return nil, fmt.Errorf("parsing %s: destination %q: unsupported scheme %q, use s3, webdav, webdavs, smb or sftp", path, d.Name, d.u.Scheme)
+		}
+		if d.Template != "" {
+			if err := validateDestinationTemplate(d.Template); err != nil {
+				return nil, fmt.Errorf("parsing %s: destination %q: %v", path, d.Name, err)
+			}
+		}
+		m[d.Name] = d
+	}
+	return m, nil
+}
+
+// checkDestination validates a job's destination and the folder below it
+// the results go to. account is the submitting account, see Job.account.
+func checkDestination(name, dir, account string) error {
+	d := destinations[name]
+	if d == nil || len(d.Accounts) > 0 && !slices.Contains(d.Accounts, account) {
+		return fmt.Errorf("%w %q", errUnknownDestination, name)
+	}
+	return checkDestinationPath(dir)
+}
+
+// checkDestinationPath validates a folder below a destination. Its
+// folders may only hold letters, digits, spaces and -_.(), as the path ends
+// up in smbclient commands, which nothing can quote.
+func checkDestinationPath(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if len(dir) > 200 || path.IsAbs(dir) || path.Clean(dir) != dir || dir == ".." || strings.HasPrefix(dir, "../") || !plainPath(dir) {
+		return fmt.Errorf("destination_path must be a relative folder such as invoices/2024, got %q", dir)
+	}
+	return nil
+}
+
+// plainPath reports whether p is made of nothing but letters, digits,
+// spaces, -_.() and slashes.
+func plainPath(p string) bool {
+	for _, r := range p {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) && !strings.ContainsRune(" -_.()/", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// deliveryFile is a result file and the name it is uploaded under.
+type deliveryFile struct {
+	Path string
+	Name string
+}
+
+// deliveryLayout returns the folder below the destination path job j's
+// results go to and their names there. With a destination template the
+// files are filed by it and renamed from the job's prefix to its stem;
+// otherwise they keep their names in the job's destination_path.
+func deliveryLayout(j Job, d *Destination, files []string) (string, []deliveryFile, error) {
+	tmpl := j.DestinationTemplate
+	if tmpl == "" {
+		tmpl = d.Template
+	}
+	dir, stem := j.DestinationPath, ""
+	if tmpl != "" {
+		sub, s, err := renderDeliveryPath(tmpl, outputNameVars{
+			Original: safeFileStem(strings.TrimSuffix(j.Filename, filepath.Ext(j.Filename))),
+			JobID:    j.ID,
+			Lang:     j.Languages,
+			Time:     j.CreatedAt,
+			Tags:     j.Tags,
+			Fields:   regionFields(j),
+			Class:    j.className(),
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		dir, stem = path.Join(dir, sub), s
+	}
+	out := make([]deliveryFile, len(files))
+	for i, f := range files {
+		name := filepath.Base(f)
+		if rest, ok := strings.CutPrefix(name, j.prefix); ok && stem != "" {
+			name = stem + rest
+		}
+		out[i] = deliveryFile{Path: f, Name: name}
+	}
+	return dir, out, nil
+}
+
+// regionFields returns the text recognized in each named template region
+// of a done job, from the first page it was found on, with runs of white
+// space collapsed.
+func regionFields(j Job) map[string]string {
+	fields := map[string]string{}
+	data, err := readStored(filepath.Join(j.outputDir, j.prefix+"_regions.json"))
+	if err != nil {
+		return fields
+	}
+	var doc struct {
+		Pages []struct {
+			Regions []struct {
+				Name string `json:"name"`
+				Text string `json:"text"`
+			} `json:"regions"`
+		} `json:"pages"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fields
+	}
+	for _, p := range doc.Pages {
+		for _, r := range p.Regions {
+			if text := strings.Join(strings.Fields(r.Text), " "); text != "" && fields[r.Name] == "" {
+				fields[r.Name] = text
+			}
+		}
+	}
+	return fields
+}
+
+// resultFiles lists the files a job delivers: everything in its output
+// directory except the page checkpoints and temporary files.
+func resultFiles(outputDir string) ([]string, error) {
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			files = append(files, filepath.Join(outputDir, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+// deliver pushes the results of job id to its destination, retrying with
+// exponential backoff, and records the outcome on the job. It runs on its
+// own goroutine so a slow destination never holds up an OCR worker.
+func (s *JobStore) deliver(id string) {
+	j, ok := s.get(id)
+	if !ok {
+		return
+	}
+	files, err := resultFiles(j.outputDir)
+	d := destinations[j.Destination]
+	if err == nil && d == nil {
+		err = fmt.Errorf("destination %q is no longer configured", j.Destination)
+	}
+	var dir string
+	var uploads []deliveryFile
+	if err == nil {
+		dir, uploads, err = deliveryLayout(j, d, files)
+	}
+	if err == nil {
+		err = d.uploadRetrying(id, dir, uploads)
+	}
+
+	s.update(id, func(job *Job) {
+		if err != nil {
+			job.Delivery = &Delivery{Status: "failed", Error: err.Error()}
+			return
+		}
+		now := time.Now().UTC()
+		job.Delivery = &Delivery{Status: "delivered", Files: len(files), Path: dir, DeliveredAt: &now}
+	})
+	if err != nil {
+		log.Printf("delivering job %s to %s failed: %v", id, j.Destination, err)
+	} else {
+		log.Printf("delivered job %s to %s", id, j.Destination)
+	}
+}
+
+// uploadRetrying uploads the files of job id, retrying with exponential
+// backoff up to deliveryAttempts times.
+func (d *Destination) uploadRetrying(id, dir string, files []deliveryFile) error {
+	var err error
+	delay := deliveryBackoff
+	for attempt := 1; attempt <= deliveryAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+		err = d.upload(ctx, dir, files)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt < deliveryAttempts {
+			log.Printf("delivering job %s to %s failed (attempt %d), retrying in %s: %v", id, d.Name, attempt, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
+
+// upload copies files into the folder dir below the destination's path.
+func (d *Destination) upload(ctx context.Context, dir string, files []deliveryFile) error {
+	remote := path.Join(d.u.Path, dir)
+	switch d.u.Scheme {
+	case "s3":
+		return d.uploadS3(ctx, remote, files)
+	case "webdav", "webdavs":
+		return d.uploadWebDAV(ctx, remote, files)
+	case "smb":
+		return d.uploadSMB(ctx, remote, files)
+	case "sftp":
+		return d.uploadSFTP(ctx, remote, files)
+	}
+	return fmt.Errorf("unsupported scheme %q", d.u.Scheme)
+}
+
+func (d *Destination) uploadWebDAV(ctx context.Context, dir string, files []deliveryFile) error {
+	base := url.URL{Scheme: "http", Host: d.u.Host}
+	if d.u.Scheme == "webdavs" {
+		base.Scheme = "https"
+	}
+	// Create the folders one level at a time; existing ones answer 405.
+	var parts []string
+	for _, p := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if p == "" {
+			continue
+		}
+		parts = append(parts, p)
+		base.Path = "/" + strings.Join(parts, "/") + "/"
+		resp, err := d.webDAVRequest(ctx, "MKCOL", base.String(), nil, 0)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("creating folder %s: %s", base.Path, resp.Status)
+		}
+	}
+	for _, f := range files {
+		base.Path = path.Join("/", dir, f.Name)
+		if err := d.putFile(ctx, base.String(), f.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Destination) putFile(ctx context.Context, u, file string) error {
+	f, err := openStored(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	resp, err := d.webDAVRequest(ctx, http.MethodPut, u, f, fi.Size())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("uploading %s: %s", filepath.Base(file), resp.Status)
+	}
+	return nil
+}
+
+func (d *Destination) webDAVRequest(ctx context.Context, method, u string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if d.Username != "" {
+		req.SetBasicAuth(d.Username, d.Password)
+	}
+	return deliveryHTTPClient.Do(req)
+}
+
+// uploadS3 PUTs every file as an object, addressing the bucket path-style
+// so S3-compatible stores such as MinIO work too. Requests are signed with
+// AWS Signature Version 4.
+func (d *Destination) uploadS3(ctx context.Context, prefix string, files []deliveryFile) error {
+	region := d.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := d.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	for _, f := range files {
+		key := strings.TrimPrefix(path.Join(prefix, f.Name), "/")
+		if err := d.putS3Object(ctx, ep, region, key, f.Path); err != nil {
+			return fmt.Errorf("uploading %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (d *Destination) putS3Object(ctx context.Context, ep *url.URL, region, key, file string) error {
+	f, err := openStored(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(h.Sum(nil))
+
+	u := *ep
+	u.Path = path.Join("/", ep.Path, d.u.Host, key)
+	u.RawPath = awsEscapePath(u.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	scope := now.Format("20060102") + "/" + region + "/s3/aws4_request"
+	canonical := strings.Join([]string{
+		http.MethodPut,
+		u.RawPath,
+		"",
+		"host:" + u.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	k := hmacSHA256([]byte("AWS4"+d.SecretKey), now.Format("20060102"))
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		k = hmacSHA256(k, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		d.AccessKey, scope, hex.EncodeToString(hmacSHA256(k, toSign))))
+
+	resp, err := deliveryHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscapePath percent-encodes every byte of p except the unreserved
+// characters and '/', as Signature Version 4 requires.
+func awsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// uploadSMB copies files to the share with Samba's smbclient. The password
+// is passed in the environment rather than on the command line.
+//
+// smbclient splits its -c script at every ';', quotes or not, and runs
+// lines starting with '!' in a local shell, so a folder or file name from
+// a template, which may hold a document's own text, is refused unless it
+// is plain.
+func (d *Destination) uploadSMB(ctx context.Context, remote string, files []deliveryFile) error {
+	share, dir, _ := strings.Cut(strings.Trim(remote, "/"), "/")
+	if !smbSafe(remote) {
+		return fmt.Errorf("smbclient: the folder %q holds characters the upload cannot pass safely", remote)
+	}
+	for _, f := range files {
+		if !smbSafe(f.Name) || !smbSafe(f.Path) {
+			return fmt.Errorf("smbclient: the file name %q holds characters the upload cannot pass safely", f.Name)
+		}
+	}
+	var cmds []string
+	var parts []string
+	for _, p := range strings.Split(dir, "/") {
+		if p != "" {
+			parts = append(parts, p)
+			cmds = append(cmds, fmt.Sprintf(`mkdir "%s"`, strings.Join(parts, "/")))
+		}
+	}
+	if len(parts) > 0 {
+		cmds = append(cmds, fmt.Sprintf(`cd "%s"`, strings.Join(parts, "/")))
+	}
+	for _, f := range files {
+		cmds = append(cmds, fmt.Sprintf(`put "%s" "%s"`, f.Path, f.Name))
+	}
+
+	args := []string{"//" + d.u.Host + "/" + share, "-c", strings.Join(cmds, "; ")}
+	if d.Username != "" {
+		args = append(args, "-U", d.Username)
+	} else {
+		args = append(args, "-N")
+	}
+	cmd := exec.CommandContext(ctx, "smbclient", args...)
+	cmd.Env = append(os.Environ(), "PASSWD="+d.Password)
+	out, err := cmd.CombinedOutput()
+	// smbclient carries on after a failed command, so its output is checked
+	// too; mkdir of an existing folder is the one failure that is expected.
+	for _, l := range strings.Split(string(out), "\n") {
+		if strings.Contains(l, "NT_STATUS_") && !strings.Contains(l, "NT_STATUS_OBJECT_NAME_COLLISION") {
+			return fmt.Errorf("smbclient: %s", strings.TrimSpace(l))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("smbclient: %v: %s", err, firstLine(out, "no output"))
+	}
+	return nil
+}
+
+// smbSafe reports whether s can go into a quoted argument of an smbclient
+// -c script: no ';' to end the command, no '!' to start a shell command, no
+// quotes and no control characters.
+func smbSafe(s string) bool {
+	return !strings.ContainsFunc(s, func(r rune) bool {
+		return r == ';' || r == '!' || r == '"' || r == '\\' || unicode.IsControl(r)
+	})
+}
+
+// uploadSFTP copies files with OpenSSH's sftp in batch mode, so only key
+// authentication works.
+func (d *Destination) uploadSFTP(ctx context.Context, remote string, files []deliveryFile) error {
+	var batch strings.Builder
+	dir := ""
+	for _, p := range strings.Split(strings.Trim(remote, "/"), "/") {
+		if p != "" {
+			dir += "/" + p
+			fmt.Fprintf(&batch, "-mkdir \"%s\"\n", dir)
+		}
+	}
+	for _, f := range files {
+		fmt.Fprintf(&batch, "put \"%s\" \"%s\"\n", f.Path, path.Join(dir, f.Name))
+	}
+
+	args := []string{"-b", "-", "-o", "BatchMode=yes"}
+	if d.IdentityFile != "" {
+		args = append(args, "-i", d.IdentityFile)
+	}
+	if d.KnownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+d.KnownHosts)
+	}
+	if port := d.u.Port(); port != "" {
+		args = append(args, "-P", port)
+	}
+	host := d.u.Hostname()
+	if d.u.User != nil {
+		host = d.u.User.Username() + "@" + host
+	}
+	cmd := exec.CommandContext(ctx, "sftp", append(args, host)...)
+	cmd.Stdin = strings.NewReader(batch.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sftp: %v: %s", err, firstLine(out, "no output"))
+	}
+	return nil
+}
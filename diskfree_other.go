@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+// diskFree is not implemented on this platform, so the disk check is skipped.
+func diskFree(dir string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// diskFree reports the bytes available to unprivileged users on the
+// filesystem holding dir.
+func diskFree(dir string) (int64, bool) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, false
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, false
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), true
+}
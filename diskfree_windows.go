@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// diskFree reports the bytes available to the current user on the volume
+// holding dir.
+func diskFree(dir string) (int64, bool) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, false
+	}
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, false
+	}
+	var avail, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &avail, &total, &free); err != nil {
+		return 0, false
+	}
+	return int64(avail), true
+}
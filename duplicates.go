@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A finished document whose text nearly matches an earlier one, such as a
+// letter scanned twice at different quality, is flagged as its duplicate.
+// The normalized text is cut into overlapping runs of characters, which
+// survive a misread word better than whole words would, and condensed into
+// a MinHash signature: the share of equal minima of two signatures
+// estimates the share of the runs the texts have in common. Signatures are
+// kept next to the job's record and in memory. Only the jobs of one owner
+// are compared, so a flag never names another account's document. Admins
+// list the groups the flags make and merge each into its best copy.
+
+// duplicateSimilarity is -duplicate-similarity as a share, 0-1; 0 turns
+// detection off.
+var duplicateSimilarity float64
+
+const (
+	shingleSize = 5   // characters in a run
+	minhashSize = 128 // minima in a signature
+	// minShingles is the fewest distinct runs a text needs to be compared:
+	// a few lines, such as two blank forms, match too easily.
+	minShingles = 50
+	// signatureName is the file next to the job's record.
+	signatureName = "minhash.json"
+)
+
+// minhashSeeds are the hash functions of the signature, one per minimum.
+var minhashSeeds = func() []uint64 {
+	seeds := make([]uint64, minhashSize)
+	for i := range seeds {
+		seeds[i] = mix64(uint64(i) + 1)
+	}
+	return seeds
+}()
+
+// mix64 is the finalizer of SplitMix64.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// DuplicateMatch is the earlier document a job's text nearly repeats.
+type DuplicateMatch struct {
+	JobID      string  `json:"job_id"`
+	Filename   string  `json:"filename"`
+	Similarity float64 `json:"similarity"` // estimated share of the text in common, 0-1
+}
+
+// minhash returns the signature of a text file's pages, nil for a text too
+// short to compare.
+func minhash(text string) []uint32 {
+	var runes []rune
+	for _, sec := range splitPages(text) {
+		runes = append(runes, []rune(normalizePersian(sec.text))...)
+		runes = append(runes, ' ')
+	}
+	seen := map[uint64]bool{}
+	sig := make([]uint32, minhashSize)
+	for i := range sig {
+		sig[i] = math.MaxUint32
+	}
+	for i := 0; i+shingleSize <= len(runes); i++ {
+		h := uint64(14695981039346656037) // FNV-1a over the runes
+		for _, r := range runes[i : i+shingleSize] {
+			h = (h ^ uint64(r)) * 1099511628211
+		}
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		for k, seed := range minhashSeeds {
+			if v := uint32(mix64(h^seed) >> 32); v < sig[k] {
+				sig[k] = v
+			}
+		}
+	}
+	if len(seen) < minShingles {
+		return nil
+	}
+	return sig
+}
+
+// similarity estimates the share of runs two signatures' texts share.
+func similarity(a, b []uint32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a))
+}
+
+// jobSignature is the on-disk form of a job's signature. MinHash is nil
+// for a text too short to compare, so the job is not signed again.
+type jobSignature struct {
+	MinHash []uint32 `json:"minhash"`
+}
+
+func (j *Job) signaturePath() string {
+	return filepath.Join(filepath.Dir(j.inputPath), signatureName)
+}
+
+// duplicateIndex holds the signatures of the finished jobs by job ID.
+type duplicateIndex struct {
+	mu   sync.RWMutex
+	docs map[string]signedDoc
+}
+
+type signedDoc struct {
+	owner    string
+	filename string
+	minhash  []uint32
+}
+
+var duplicates = &duplicateIndex{docs: map[string]signedDoc{}}
+
+// load reads the signatures of the finished jobs in the store. Jobs that
+// finished while detection was off are signed, and flagged, afterwards in
+// the background, oldest first.
+func (x *duplicateIndex) load(s *JobStore) {
+	var unsigned []Job
+	n := 0
+	for _, j := range s.list(func(j *Job) bool { return j.Status == JobDone && j.TextURL != "" }) {
+		data, err := os.ReadFile(j.signaturePath())
+		if errors.Is(err, os.ErrNotExist) {
+			unsigned = append(unsigned, j)
+			continue
+		}
+		var sig jobSignature
+		if err == nil {
+			err = json.Unmarshal(data, &sig)
+		}
+		if err != nil {
+			log.Printf("job %s: reading its signature: %v", j.ID, err)
+			continue
+		}
+		if sig.MinHash != nil {
+			x.mu.Lock()
+			x.docs[j.ID] = signedDoc{owner: jobOwner(j.account), filename: j.Filename, minhash: sig.MinHash}
+			x.mu.Unlock()
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("loaded the signatures of %d documents", n)
+	}
+	if len(unsigned) == 0 {
+		return
+	}
+	slices.Reverse(unsigned) // the list is newest first
+	go func() {
+		for _, j := range unsigned {
+			text, err := readStored(filepath.Join(j.outputDir, j.prefix+".txt"))
+			if err != nil {
+				continue
+			}
+			if m := x.add(j, string(text)); m != nil {
+				s.update(j.ID, func(job *Job) { job.DuplicateOf = m })
+			}
+		}
+		log.Printf("signed %d documents finished before duplicate detection", len(unsigned))
+	}()
+}
+
+// checkDuplicate signs the text of a job that just finished and returns
+// the most similar document of its owner, if that is close enough.
+func checkDuplicate(j Job, textFile string) *DuplicateMatch {
+	if duplicateSimilarity <= 0 || textFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(textFile)
+	if err != nil {
+		log.Printf("job %s: reading the text to compare: %v", j.ID, err)
+		return nil
+	}
+	return duplicates.add(j, string(data))
+}
+
+// add signs j's text, keeps the signature and returns the best match.
+func (x *duplicateIndex) add(j Job, text string) *DuplicateMatch {
+	sig := minhash(text)
+	body, _ := json.Marshal(jobSignature{MinHash: sig})
+	if err := writeFileAtomic(j.signaturePath(), body); err != nil {
+		log.Printf("job %s: writing its signature: %v", j.ID, err)
+	}
+	if sig == nil {
+		return nil
+	}
+	owner := jobOwner(j.account)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var best *DuplicateMatch
+	for id, d := range x.docs {
+		if id == j.ID || d.owner != owner {
+			continue
+		}
+		if s := similarity(sig, d.minhash); s >= duplicateSimilarity && (best == nil || s > best.Similarity) {
+			best = &DuplicateMatch{JobID: id, Filename: d.filename, Similarity: s}
+		}
+	}
+	x.docs[j.ID] = signedDoc{owner: owner, filename: j.Filename, minhash: sig}
+	return best
+}
+
+// similarity returns the similarity of two signed jobs, 0 when either is
+// not signed.
+func (x *duplicateIndex) similarity(a, b string) float64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return similarity(x.docs[a].minhash, x.docs[b].minhash)
+}
+
+// remove forgets the signature of a deleted job.
+func (x *duplicateIndex) remove(id string) {
+	x.mu.Lock()
+	delete(x.docs, id)
+	x.mu.Unlock()
+}
+
+// DuplicateGroup is a set of finished jobs flagged as copies of each other.
+type DuplicateGroup struct {
+	Best string `json:"best"` // the copy a merge keeps unless told otherwise, see betterCopy
+	Jobs []Job  `json:"jobs"` // newest first
+}
+
+// duplicateGroups joins the finished jobs linked by their DuplicateOf
+// flags into groups, newest first.
+func (s *JobStore) duplicateGroups() []DuplicateGroup {
+	done := s.list(func(j *Job) bool { return j.Status == JobDone })
+	byID := map[string]int{}
+	for i, j := range done {
+		byID[j.ID] = i
+	}
+	parent := make([]int, len(done))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	for i, j := range done {
+		if j.DuplicateOf == nil {
+			continue
+		}
+		if k, ok := byID[j.DuplicateOf.JobID]; ok {
+			parent[root(i)] = root(k)
+		}
+	}
+	members := map[int][]Job{}
+	var order []int
+	for i, j := range done {
+		r := root(i)
+		if members[r] == nil {
+			order = append(order, r)
+		}
+		members[r] = append(members[r], j)
+	}
+	var groups []DuplicateGroup
+	for _, r := range order {
+		if m := members[r]; len(m) > 1 {
+			best := m[0]
+			for _, j := range m[1:] {
+				if betterCopy(j, best) {
+					best = j
+				}
+			}
+			groups = append(groups, DuplicateGroup{Best: best.ID, Jobs: m})
+		}
+	}
+	return groups
+}
+
+// betterCopy reports whether a is a better copy of a document than b: it
+// was recognized with higher confidence, or as well with fewer failed
+// pages, or is newer.
+func betterCopy(a, b Job) bool {
+	ca, cb := -1.0, -1.0
+	if a.Confidence != nil {
+		ca = *a.Confidence
+	}
+	if b.Confidence != nil {
+		cb = *b.Confidence
+	}
+	switch {
+	case ca != cb:
+		return ca > cb
+	case len(a.FailedPages) != len(b.FailedPages):
+		return len(a.FailedPages) < len(b.FailedPages)
+	}
+	return a.CreatedAt.After(b.CreatedAt)
+}
+
+// duplicateGroupOf returns the group job id is in.
+func (s *JobStore) duplicateGroupOf(id string) (DuplicateGroup, bool) {
+	for _, g := range s.duplicateGroups() {
+		for _, j := range g.Jobs {
+			if j.ID == id {
+				return g, true
+			}
+		}
+	}
+	return DuplicateGroup{}, false
+}
+
+// mergeDuplicates keeps job keep of group g and deletes the other copies,
+// except those under legal hold. The kept job takes on the tags it lacks
+// from the copies and stays pinned if any of them was; held copies are
+// flagged as duplicates of it.
+func (s *JobStore) mergeDuplicates(g DuplicateGroup, keep string) (kept Job, deleted, held []string, err error) {
+	var doomed []*Job
+	s.mu.Lock()
+	k, ok := s.jobs[keep]
+	if !ok {
+		s.mu.Unlock()
+		return Job{}, nil, nil, errJobNotFound
+	}
+	for _, c := range g.Jobs {
+		j, ok := s.jobs[c.ID]
+		if !ok || j == k {
+			continue
+		}
+		for t, v := range j.Tags {
+			if _, dup := k.Tags[t]; !dup {
+				if k.Tags == nil {
+					k.Tags = map[string]string{}
+				}
+				k.Tags[t] = v
+			}
+		}
+		k.Pinned = k.Pinned || j.Pinned
+		if j.LegalHold != nil {
+			j.DuplicateOf = &DuplicateMatch{JobID: k.ID, Filename: k.Filename, Similarity: duplicates.similarity(j.ID, k.ID)}
+			s.saveLocked(j)
+			held = append(held, j.ID)
+			continue
+		}
+		delete(s.jobs, j.ID)
+		doomed = append(doomed, j)
+		deleted = append(deleted, j.ID)
+	}
+	if k.DuplicateOf != nil {
+		if _, ok := s.jobs[k.DuplicateOf.JobID]; !ok {
+			k.DuplicateOf = nil
+		}
+	}
+	s.saveLocked(k)
+	kept = *k
+	s.mu.Unlock()
+
+	for _, j := range doomed {
+		removeJobFiles(j)
+		log.Printf("deleted job %s as a duplicate of %s", j.ID, keep)
+	}
+	return kept, deleted, held, nil
+}
+
+// dismissDuplicate clears the flags linking job id to other jobs.
+func (s *JobStore) dismissDuplicate(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	for _, o := range s.jobs {
+		if o.DuplicateOf != nil && (o == j || o.DuplicateOf.JobID == id) {
+			o.DuplicateOf = nil
+			s.saveLocked(o)
+		}
+	}
+	return *j, nil
+}
+
+// v1DuplicatesHandler lists the groups of near-duplicate documents.
+func v1DuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	groups := jobs.duplicateGroups()
+	if groups == nil {
+		groups = []DuplicateGroup{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"groups": groups})
+}
+
+// v1MergeDuplicatesHandler merges the group of job {id} into one copy: the
+// job named by "keep" in the optional JSON body, or the group's best one.
+// Every deletion is recorded in the audit log.
+func v1MergeDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Keep string `json:"keep"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_json", err.Error())
+			return
+		}
+	}
+	id := r.PathValue("id")
+	if _, ok := jobs.get(id); !ok {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+id)
+		return
+	}
+	g, ok := jobs.duplicateGroupOf(id)
+	if !ok {
+		writeAPIError(w, http.StatusConflict, "not_duplicate", "the job is not flagged as a duplicate of another")
+		return
+	}
+	keep := strings.TrimSpace(body.Keep)
+	if keep == "" {
+		keep = g.Best
+	} else if !slices.ContainsFunc(g.Jobs, func(j Job) bool { return j.ID == keep }) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_keep", fmt.Sprintf("job %s is not in the group of %s", keep, id))
+		return
+	}
+	kept, deleted, held, err := jobs.mergeDuplicates(g, keep)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+keep)
+		return
+	}
+	actor := auditActor(r)
+	for _, d := range deleted {
+		if err := audit.record(AuditEntry{Time: time.Now().UTC(), Actor: actor, Action: AuditDuplicateMerged, Target: d, Reason: "duplicate of " + keep}); err != nil {
+			log.Printf("job %s: recording %s in the audit log: %v", d, AuditDuplicateMerged, err)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"kept": kept, "deleted": nonNil(deleted), "held": nonNil(held)})
+}
+
+// v1DismissDuplicateHandler handles DELETE /admin/duplicates/{id}: the job
+// is not a copy of the others after all.
+func v1DismissDuplicateHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := jobs.dismissDuplicate(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+r.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
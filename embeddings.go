@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Finished documents can be embedded, each page as a vector of its
+// meaning, so GET /api/v1/search finds documents by what they are about
+// even where OCR errors break the words a keyword or file name filter
+// would need. The vectors come from a pluggable backend: an OpenAI
+// compatible /embeddings API, hosted or self-hosted, or a command. They
+// are kept next to the job's record, deleted with it, and held in memory
+// for searching.
+
+// embedder turns texts into vectors of one fixed length.
+type embedder interface {
+	Name() string // the model, stored with the vectors
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// textEmbedder is the configured backend, nil with -embeddings off.
+var textEmbedder embedder
+
+const (
+	// maxEmbeddedPage bounds the text of a page sent to the backend, about
+	// what the common models read.
+	maxEmbeddedPage = 6000
+	// embedBatch is the pages embedded in one request.
+	embedBatch = 16
+	// embeddingsName is the file next to the job's record.
+	embeddingsName = "embeddings.json"
+	// maxSearchResults bounds ?limit= of the search.
+	maxSearchResults = 100
+)
+
+// newEmbedder returns the backend selected by -embeddings.
+func newEmbedder(mode, url, model, key, command string, timeout time.Duration) (embedder, error) {
+	switch mode {
+	case "off":
+		return nil, nil
+	case "api":
+		if url == "" {
+			return nil, errors.New("-embeddings api needs -embedding-url or -llm-url")
+		}
+		if model == "" {
+			return nil, errors.New("-embeddings api needs -embedding-model")
+		}
+		c, err := newLLMClient(url, model, key, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &apiEmbedder{c}, nil
+	case "command":
+		if command == "" {
+			return nil, errors.New("-embeddings command needs -embedding-command")
+		}
+		if model == "" {
+			model = "command"
+		}
+		return &commandEmbedder{command: command, model: model, timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("unknown -embeddings %q: use api, command or off", mode)
+}
+
+// apiEmbedder calls the /embeddings endpoint of an OpenAI-compatible API.
+type apiEmbedder struct {
+	c *llmClient
+}
+
+func (e *apiEmbedder) Name() string { return e.c.model }
+
+func (e *apiEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]any{"model": e.c.model, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.c.url+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.c.apiKey)
+	}
+	resp, err := e.c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLLMResponse*4))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("the embedding API answered %s: %s", resp.Status, firstLine(data, ""))
+	}
+	var out struct {
+		Data []struct {
+			Index     *int      `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("reading the embedding API's answer: %w", err)
+	}
+	vecs := make([][]float32, len(texts))
+	for i, d := range out.Data {
+		k := i // servers that leave out the index answer in order
+		if d.Index != nil {
+			k = *d.Index
+		}
+		if k < 0 || k >= len(vecs) {
+			return nil, fmt.Errorf("the embedding API answered for input %d of %d", k, len(texts))
+		}
+		vecs[k] = d.Embedding
+	}
+	return vecs, nil
+}
+
+// commandEmbedder runs a command, with sh -c, that reads a JSON array of
+// texts on stdin and prints a JSON array of their vectors.
+type commandEmbedder struct {
+	command string
+	model   string // -embedding-model, to tell its vectors from another's
+	timeout time.Duration
+}
+
+func (e *commandEmbedder) Name() string { return e.model }
+
+func (e *commandEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	in, _ := json.Marshal(texts)
+	cmd := exec.CommandContext(ctx, "sh", "-c", e.command)
+	cmd.Stdin = bytes.NewReader(in)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := firstLine(stderr.Bytes(), ""); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("running -embedding-command: %w", err)
+	}
+	var vecs [][]float32
+	if err := json.Unmarshal(out, &vecs); err != nil {
+		return nil, fmt.Errorf("reading -embedding-command output: %w", err)
+	}
+	return vecs, nil
+}
+
+// jobEmbeddings are the vectors of a job's pages, normalized to length 1.
+type jobEmbeddings struct {
+	Model string          `json:"model"`
+	Pages []pageEmbedding `json:"pages"`
+}
+
+type pageEmbedding struct {
+	Page   int       `json:"page"`
+	Vector []float32 `json:"vector"`
+}
+
+// semanticIndex holds the embeddings of the finished jobs by job ID.
+type semanticIndex struct {
+	mu   sync.RWMutex
+	jobs map[string]*jobEmbeddings
+}
+
+var semantic = &semanticIndex{jobs: map[string]*jobEmbeddings{}}
+
+func (j *Job) embeddingsPath() string {
+	return filepath.Join(filepath.Dir(j.inputPath), embeddingsName)
+}
+
+// load reads the embeddings of the finished jobs in the store.
+func (x *semanticIndex) load(s *JobStore) {
+	n := 0
+	for _, j := range s.list(func(j *Job) bool { return j.Status == JobDone }) {
+		data, err := os.ReadFile(j.embeddingsPath())
+		if err != nil {
+			continue
+		}
+		var e jobEmbeddings
+		if err := json.Unmarshal(data, &e); err != nil {
+			log.Printf("job %s: reading its embeddings: %v", j.ID, err)
+			continue
+		}
+		x.mu.Lock()
+		x.jobs[j.ID] = &e
+		x.mu.Unlock()
+		n++
+	}
+	if n > 0 {
+		log.Printf("loaded the embeddings of %d documents", n)
+	}
+}
+
+// remove forgets the embeddings of a deleted job.
+func (x *semanticIndex) remove(id string) {
+	x.mu.Lock()
+	delete(x.jobs, id)
+	x.mu.Unlock()
+}
+
+// embedText embeds the pages of a finished job's text file and adds them
+// to the index. A failing backend is logged; the job is done regardless.
+func embedText(ctx context.Context, j Job, textFile string) {
+	if textEmbedder == nil || textFile == "" {
+		return
+	}
+	data, err := os.ReadFile(textFile)
+	if err != nil {
+		log.Printf("job %s: reading the text to embed: %v", j.ID, err)
+		return
+	}
+	var pages []int
+	var texts []string
+	for _, sec := range splitPages(string(data)) {
+		t := []rune(strings.TrimSpace(sec.text))
+		if len(t) == 0 {
+			continue
+		}
+		if len(t) > maxEmbeddedPage {
+			t = t[:maxEmbeddedPage]
+		}
+		pages = append(pages, sec.number)
+		texts = append(texts, string(t))
+	}
+	if len(texts) == 0 {
+		return
+	}
+	e := &jobEmbeddings{Model: textEmbedder.Name()}
+	for start := 0; start < len(texts); start += embedBatch {
+		end := min(start+embedBatch, len(texts))
+		vecs, err := textEmbedder.Embed(ctx, texts[start:end])
+		if err == nil && len(vecs) != end-start {
+			err = fmt.Errorf("%d texts sent, %d vectors returned", end-start, len(vecs))
+		}
+		if err != nil {
+			log.Printf("job %s: embedding its pages: %v", j.ID, err)
+			return
+		}
+		for i, v := range vecs {
+			if normalizeVector(v) {
+				e.Pages = append(e.Pages, pageEmbedding{Page: pages[start+i], Vector: v})
+			}
+		}
+	}
+	body, _ := json.Marshal(e)
+	if err := writeFileAtomic(j.embeddingsPath(), body); err != nil {
+		log.Printf("job %s: writing its embeddings: %v", j.ID, err)
+		return
+	}
+	semantic.mu.Lock()
+	semantic.jobs[j.ID] = e
+	semantic.mu.Unlock()
+}
+
+// normalizeVector scales v to length 1, reporting false for a zero or
+// broken vector.
+func normalizeVector(v []float32) bool {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 || math.IsNaN(sum) || math.IsInf(sum, 0) {
+		return false
+	}
+	n := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= n
+	}
+	return true
+}
+
+func dot(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var s float32
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return float64(s)
+}
+
+// SearchResult is a document found by GET /api/v1/search.
+type SearchResult struct {
+	Job     Job     `json:"job"`
+	Score   float64 `json:"score"`   // cosine similarity of the best page, -1 to 1
+	Page    int     `json:"page"`    // the page most like the query
+	Snippet string  `json:"snippet"` // the start of that page's text
+}
+
+// v1SearchHandler ranks the finished documents by how close the meaning of
+// their pages is to ?q=. It takes the job list's filters, so a search can
+// be narrowed by keyword, class, tag or date, and ?limit= (default 10).
+// Documents embedded with another model than the current one are not
+// searched.
+func v1SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if textEmbedder == nil {
+		writeAPIError(w, http.StatusNotImplemented, "search_disabled", "semantic search needs -embeddings")
+		return
+	}
+	q := r.URL.Query()
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_query", "q is required")
+		return
+	}
+	if r := []rune(query); len(r) > maxEmbeddedPage {
+		query = string(r[:maxEmbeddedPage])
+	}
+	limit := 10
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchResults {
+			writeAPIError(w, http.StatusBadRequest, "invalid_limit", fmt.Sprintf("limit must be between 1 and %d", maxSearchResults))
+			return
+		}
+		limit = n
+	}
+	f, err := parseJobFilter(q)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+	v, perr := requestViewer(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	vecs, err := textEmbedder.Embed(r.Context(), []string{query})
+	if err == nil && (len(vecs) != 1 || !normalizeVector(vecs[0])) {
+		err = errors.New("the backend returned no vector for the query")
+	}
+	if err != nil {
+		log.Printf("embedding a search query: %v", err)
+		writeAPIError(w, http.StatusBadGateway, "embedding_failed", "the query could not be embedded: "+err.Error())
+		return
+	}
+	qv, model := vecs[0], textEmbedder.Name()
+
+	var results []SearchResult
+	semantic.mu.RLock()
+	for _, j := range jobs.list(func(j *Job) bool { return j.Status == JobDone && v.sees(j) && f.match(j) }) {
+		e := semantic.jobs[j.ID]
+		if e == nil || e.Model != model {
+			continue
+		}
+		best := SearchResult{Job: j, Score: -2}
+		for _, p := range e.Pages {
+			if s := dot(qv, p.Vector); s > best.Score {
+				best.Score, best.Page = s, p.Page
+			}
+		}
+		if best.Page > 0 {
+			results = append(results, best)
+		}
+	}
+	semantic.mu.RUnlock()
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return strings.Compare(a.Job.ID, b.Job.ID)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	for i := range results {
+		res := &results[i]
+		res.Score = math.Round(res.Score*10000) / 10000
+		res.Snippet = pageSnippet(res.Job, res.Page)
+	}
+	if results == nil {
+		results = []SearchResult{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"model": model, "results": results})
+}
+
+// pageSnippet returns the start of the text of page n of job j.
+func pageSnippet(j Job, n int) string {
+	data, err := readStored(filepath.Join(j.outputDir, j.prefix+".txt"))
+	if err != nil {
+		return ""
+	}
+	for _, sec := range splitPages(string(data)) {
+		if sec.number == n {
+			return truncate(strings.Join(strings.Fields(sec.text), " "), 300)
+		}
+	}
+	return ""
+}
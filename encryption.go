@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Stored documents and results can be encrypted at rest with AES-256-GCM,
+// see -encryption-key-file and -encryption-key-command. A job's upload is
+// sealed when it is queued; the engine needs plain files, so the upload and
+// any pages of an earlier run are opened again while the job processes and
+// sealed with the results once the run ends. Everything that serves stored
+// files opens them with openStored, which decrypts on the fly, so files
+// written before encryption was turned on keep working.
+
+// sealedMagic starts every encrypted file. It is followed by the nonce and
+// the ciphertext with its tag.
+const sealedMagic = "OCRSEAL1"
+
+// storageCipher encrypts stored files; nil leaves them as they are.
+var storageCipher cipher.AEAD
+
+// sealedOverhead is how much larger a sealed file is than its content.
+const sealedOverhead = len(sealedMagic) + 12 + 16
+
+// keyCommandTimeout bounds -encryption-key-command.
+const keyCommandTimeout = 30 * time.Second
+
+// loadStorageKey returns the cipher of the key in keyFile, or the one
+// keyCommand prints, such as a KMS or Vault CLI call. Keys are 32 bytes,
+// raw or as hex or base64.
+func loadStorageKey(keyFile, keyCommand string) (cipher.AEAD, error) {
+	var data []byte
+	var err error
+	switch {
+	case keyFile != "" && keyCommand != "":
+		return nil, errors.New("-encryption-key-file and -encryption-key-command are exclusive")
+	case keyFile != "":
+		if data, err = os.ReadFile(keyFile); err != nil {
+			return nil, fmt.Errorf("reading encryption key: %w", err)
+		}
+	case keyCommand != "":
+		ctx, cancel := context.WithTimeout(context.Background(), keyCommandTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", keyCommand)
+		cmd.Stderr = os.Stderr
+		if data, err = cmd.Output(); err != nil {
+			return nil, fmt.Errorf("running -encryption-key-command: %w", err)
+		}
+	default:
+		return nil, nil
+	}
+	key, err := parseStorageKey(data)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parseStorageKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+	s := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("the encryption key must be 32 bytes, raw or as hex or base64")
+}
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealedMagic))
+}
+
+// seal encrypts data with storageCipher.
+func seal(data []byte) ([]byte, error) {
+	out := make([]byte, len(sealedMagic)+storageCipher.NonceSize(), len(data)+sealedOverhead)
+	copy(out, sealedMagic)
+	nonce := out[len(sealedMagic):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return storageCipher.Seal(out, nonce, data, []byte(sealedMagic)), nil
+}
+
+// unseal decrypts a sealed file's data.
+func unseal(data []byte) ([]byte, error) {
+	if storageCipher == nil {
+		return nil, errors.New("the file is encrypted and no -encryption-key-file or -encryption-key-command is configured")
+	}
+	n := len(sealedMagic) + storageCipher.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("the encrypted file is truncated")
+	}
+	plain, err := storageCipher.Open(nil, data[len(sealedMagic):n], data[n:], []byte(sealedMagic))
+	if err != nil {
+		return nil, errors.New("the encrypted file cannot be decrypted with the configured key")
+	}
+	return plain, nil
+}
+
+// sealFile encrypts the file at path in place, unless encryption is off or
+// the file already is.
+func sealFile(path string) error {
+	if storageCipher == nil {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || isSealed(data) {
+		return err
+	}
+	if data, err = seal(data); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// unsealFile decrypts the file at path in place if it is encrypted.
+func unsealFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil || !isSealed(data) {
+		return err
+	}
+	if data, err = unseal(data); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return writeFileAtomic(path, data)
+}
+
+// walkFiles calls fn for every regular file below dir.
+func walkFiles(dir string, fn func(path string) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		return fn(path)
+	})
+}
+
+// sealJob encrypts the upload and results of a job whose run has ended.
+func sealJob(j *Job) error {
+	if storageCipher == nil {
+		return nil
+	}
+	if err := sealFile(j.inputPath); err != nil {
+		return err
+	}
+	return walkFiles(j.outputDir, sealFile)
+}
+
+// sealFinishedJobs encrypts the files of finished jobs that are still
+// plain: those stored before encryption was turned on, and those of runs
+// cut off before they were sealed.
+func sealFinishedJobs() {
+	for _, j := range jobs.list((*Job).finished) {
+		if err := sealJob(&j); err != nil {
+			log.Printf("job %s: encrypting its files: %v", j.ID, err)
+		}
+	}
+}
+
+// unsealJob decrypts what the engine reads of a job before it runs: the
+// upload and the pages an earlier run finished.
+func unsealJob(j *Job) error {
+	if err := unsealFile(j.inputPath); err != nil {
+		return err
+	}
+	return walkFiles(j.outputDir, unsealFile)
+}
+
+// openStored opens a stored file for reading, decrypted if it is sealed.
+func openStored(path string) (http.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return unsealOpened(f)
+}
+
+// readStored reads a stored file, decrypted if it is sealed.
+func readStored(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !isSealed(data) {
+		return data, err
+	}
+	return unseal(data)
+}
+
+// storedSize is the size of the content of the file at path, fi its info.
+func storedSize(path string, fi os.FileInfo) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return fi.Size()
+	}
+	defer f.Close()
+	magic := make([]byte, len(sealedMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || !isSealed(magic) {
+		return fi.Size()
+	}
+	return fi.Size() - int64(sealedOverhead)
+}
+
+// unsealOpened returns f, or its decrypted content when it is sealed.
+func unsealOpened(f http.File) (http.File, error) {
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return f, nil
+	}
+	magic := make([]byte, len(sealedMagic))
+	n, _ := io.ReadFull(f, magic)
+	if !isSealed(magic[:n]) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	rest, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := unseal(append(magic, rest...))
+	if err != nil {
+		return nil, err
+	}
+	return &unsealedFile{Reader: bytes.NewReader(plain), info: sizedInfo{fi, int64(len(plain))}}, nil
+}
+
+// unsealedFile is the decrypted content of a sealed file, held in memory.
+type unsealedFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *unsealedFile) Close() error                       { return nil }
+func (f *unsealedFile) Stat() (os.FileInfo, error)         { return f.info, nil }
+func (f *unsealedFile) Readdir(int) ([]os.FileInfo, error) { return nil, errors.New("not a directory") }
+
+// sizedInfo is a file's info with the size of its decrypted content.
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi sizedInfo) Size() int64 { return fi.size }
+
+// storedDir is an http.FileSystem of the stored files below a directory,
+// decrypting sealed ones.
+type storedDir string
+
+func (d storedDir) Open(name string) (http.File, error) {
+	f, err := http.Dir(d).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return unsealOpened(f)
+}
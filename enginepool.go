@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Starting the OCR script costs seconds before the first page is touched:
+// the interpreter has to start and pdf2image, PIL, lxml and pikepdf have to
+// load. With -warm-workers the server keeps that many scripts running in
+// their serve mode (see serve in ocr_python.py) and hands runs to them one
+// after another over stdin.
+
+// workerRuns is how many runs one warm worker serves before it is replaced
+// by a fresh one, so whatever the script leaks, or a hostile document
+// leaves behind in it, lasts a bounded number of jobs.
+const workerRuns = 50
+
+// donePrefix ends the output of a run in a warm worker:
+// "OCR-DONE <exit status>".
+const donePrefix = "OCR-DONE "
+
+// ocrWorkers is nil when every run starts a process of its own.
+var ocrWorkers *enginePool
+
+// enginePool keeps idle warm workers. Runs beyond the pool's size start a
+// worker of their own, which is kept afterwards if the pool has room.
+type enginePool struct {
+	idle chan *engineWorker
+}
+
+// newEnginePool starts size workers in the background.
+func newEnginePool(size int) *enginePool {
+	p := &enginePool{idle: make(chan *engineWorker, size)}
+	for range size {
+		go p.replace()
+	}
+	return p
+}
+
+// run has a warm worker run the script with args and the OCR_* variables in
+// env, like runOCRProcess.
+func (p *enginePool) run(ctx context.Context, args, env []string, out io.Writer, pdfPath, outputDir, workDir string) (string, error) {
+	if err := shareWorkerRun(pdfPath, outputDir, workDir); err != nil {
+		return "", setupError{err}
+	}
+	w, err := p.get()
+	if err != nil {
+		return "", setupError{fmt.Errorf("Error starting OCR worker: %w", err)}
+	}
+	exceeded, err := w.run(ctx, args[1:], env, out) // the worker is the script already
+	p.put(w)
+	return exceeded, err
+}
+
+// get takes an idle worker, or starts one when there is none.
+func (p *enginePool) get() (*engineWorker, error) {
+	for {
+		select {
+		case w := <-p.idle:
+			if w.alive() {
+				return w, nil
+			}
+			w.stop()
+			go p.replace()
+		default:
+			return startEngineWorker()
+		}
+	}
+}
+
+// put returns a worker to the pool after a run. Workers that died, were
+// killed or have served workerRuns runs are replaced by a fresh one.
+func (p *enginePool) put(w *engineWorker) {
+	if !w.alive() || w.runs >= workerRuns {
+		w.stop()
+		go p.replace()
+		return
+	}
+	select {
+	case p.idle <- w:
+	default:
+		w.stop() // the pool is full
+	}
+}
+
+// replace starts a worker for the pool.
+func (p *enginePool) replace() {
+	w, err := startEngineWorker()
+	if err != nil {
+		log.Printf("starting OCR worker: %v", err)
+		return
+	}
+	select {
+	case p.idle <- w:
+	default:
+		w.stop()
+	}
+}
+
+// engineWorker is one OCR script in serve mode. Stdout and stderr share a
+// pipe, so the result JSON, the report lines and the end of a run arrive in
+// the order the script wrote them. The procLimits cover the worker as a
+// whole; a run that makes it exceed one kills it.
+type engineWorker struct {
+	cmd    *exec.Cmd
+	proc   *limitedProc
+	cancel context.CancelFunc // kills the process tree
+	stdin  io.WriteCloser
+	out    *os.File
+	lines  *bufio.Reader
+	runs   int
+
+	exited  chan struct{} // closed when the process is gone
+	waitErr error         // set before exited is closed
+
+	stopped  atomic.Bool
+	stopOnce sync.Once
+	exceeded string // set by stop
+}
+
+func startEngineWorker() (*engineWorker, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd, err := ocrWorkerCommand(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r, pw, err := os.Pipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	proc, err := newLimitedProc(cmd, ocrLimits, "")
+	if err != nil {
+		pw.Close()
+		r.Close()
+		cancel()
+		return nil, err
+	}
+	err = cmd.Start()
+	pw.Close() // the worker has its own copy
+	if err != nil {
+		proc.finish()
+		r.Close()
+		cancel()
+		return nil, err
+	}
+	if lerr := proc.started(); lerr != nil {
+		log.Printf("OCR resource limits not applied: %v", lerr)
+	}
+	w := &engineWorker{cmd: cmd, proc: proc, cancel: cancel, stdin: stdin, out: r, lines: bufio.NewReader(r), exited: make(chan struct{})}
+	go func() {
+		w.waitErr = cmd.Wait()
+		close(w.exited)
+	}()
+	return w, nil
+}
+
+// run sends the worker one run and copies its output to out until the
+// script says the run is over. Canceling ctx kills the worker. It returns
+// which resource limit the worker hit, if it died.
+func (w *engineWorker) run(ctx context.Context, args, env []string, out io.Writer) (string, error) {
+	req, err := json.Marshal(map[string][]string{"args": args, "env": env})
+	if err != nil {
+		return "", err
+	}
+	defer context.AfterFunc(ctx, func() { w.stop() })()
+	if _, err := w.stdin.Write(append(req, '\n')); err != nil {
+		return w.stop(), w.exitError(err)
+	}
+	for {
+		line, err := w.lines.ReadString('\n')
+		if rest, ok := strings.CutPrefix(line, donePrefix); ok && err == nil {
+			w.runs++
+			if code, _ := strconv.Atoi(strings.TrimSpace(rest)); code != 0 {
+				return "", fmt.Errorf("exit status %d", code)
+			}
+			return "", nil
+		}
+		out.Write([]byte(line))
+		if err != nil {
+			return w.stop(), w.exitError(err)
+		}
+	}
+}
+
+// exitError explains why the worker stopped answering.
+func (w *engineWorker) exitError(err error) error {
+	select {
+	case <-w.exited:
+		if w.waitErr != nil {
+			return w.waitErr
+		}
+	case <-time.After(5 * time.Second):
+	}
+	return fmt.Errorf("OCR worker stopped: %w", err)
+}
+
+func (w *engineWorker) alive() bool {
+	select {
+	case <-w.exited:
+		return false
+	default:
+		return !w.stopped.Load()
+	}
+}
+
+// stop kills the worker with everything it started, and reports which
+// resource limit it hit, if any.
+func (w *engineWorker) stop() string {
+	w.stopOnce.Do(func() {
+		w.stopped.Store(true)
+		w.cancel()
+		w.exceeded = w.proc.finish()
+		w.out.Close()
+	})
+	return w.exceeded
+}
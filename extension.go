@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Browser extensions get their own small API under /extension: OCR of an
+// image on the page, given by URL or as a data URI, answered with the text.
+// Each extension is registered with a token in the extensions file; the
+// endpoints answer CORS preflights for the extension's origins and limit
+// every browser using it separately.
+
+// Extension is one entry of the extensions file.
+type Extension struct {
+	Name      string   `json:"name"`
+	Token     string   `json:"token"`
+	Origins   []string `json:"origins"`    // e.g. chrome-extension://<id>; empty allows any extension origin
+	RateLimit int      `json:"rate_limit"` // requests per browser per minute, 0 for defaultExtensionRate
+
+	limiter *rateLimiter
+}
+
+// defaultExtensionRate is the per-browser request budget of extensions
+// that do not set one.
+const defaultExtensionRate = 20
+
+// extensionSchemes are the origins browsers give extension pages.
+var extensionSchemes = []string{"chrome-extension://", "moz-extension://", "safari-web-extension://"}
+
+var extensions []*Extension
+
+// loadExtensions reads a JSON array of extensions from path.
+func loadExtensions(path string) ([]*Extension, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var exts []*Extension
+	if err := json.Unmarshal(data, &exts); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	tokens := map[string]bool{}
+	for i, e := range exts {
+		if e.Name == "" || e.Token == "" {
+			return nil, fmt.Errorf("parsing %s: extension %d needs a name and a token", path, i)
+		}
+		if tokens[e.Token] {
+			return nil, fmt.Errorf("parsing %s: extension %q reuses another extension's token", path, e.Name)
+		}
+		tokens[e.Token] = true
+		rate := e.RateLimit
+		if rate <= 0 {
+			rate = defaultExtensionRate
+		}
+		e.limiter = newRateLimiter(rate, 0, clientKey)
+		go e.limiter.sweep(time.Hour)
+	}
+	return exts, nil
+}
+
+// allowsOrigin reports whether a page at origin may call the API with the
+// extension's token.
+func (e *Extension) allowsOrigin(origin string) bool {
+	if len(e.Origins) > 0 {
+		return slices.Contains(e.Origins, origin)
+	}
+	for _, s := range extensionSchemes {
+		if strings.HasPrefix(origin, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireExtension guards an extension endpoint. It answers preflights for
+// any registered extension's origin, then checks the X-Extension-Token
+// header, the request's origin and the extension's rate limit before
+// calling h.
+func requireExtension(h func(w http.ResponseWriter, r *http.Request, ext *Extension)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && slices.ContainsFunc(extensions, func(e *Extension) bool { return e.allowsOrigin(origin) }) {
+			hdr := w.Header()
+			hdr.Set("Access-Control-Allow-Origin", origin)
+			hdr.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			hdr.Set("Access-Control-Allow-Headers", "Content-Type, X-Extension-Token, X-API-Key")
+			hdr.Set("Access-Control-Expose-Headers", "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset")
+			hdr.Set("Access-Control-Max-Age", "600")
+			hdr.Add("Vary", "Origin")
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if len(extensions) == 0 {
+			writeAPIError(w, http.StatusNotFound, "extensions_disabled", "no browser extensions are registered on this server")
+			return
+		}
+
+		got := r.Header.Get("X-Extension-Token")
+		var ext *Extension
+		for _, e := range extensions {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(e.Token)) == 1 {
+				ext = e
+			}
+		}
+		if ext == nil {
+			writeAPIError(w, http.StatusUnauthorized, "invalid_extension_token", "a valid X-Extension-Token is required")
+			return
+		}
+		if origin != "" && !ext.allowsOrigin(origin) {
+			writeAPIError(w, http.StatusForbidden, "origin_not_allowed", "this extension token is not valid for "+origin)
+			return
+		}
+		ext.limiter.wrap(func(w http.ResponseWriter, r *http.Request) { h(w, r, ext) })(w, r)
+	}
+}
+
+// v1ExtensionHandler lets an extension's settings page check its token and
+// learn the limits it has to respect.
+func v1ExtensionHandler(w http.ResponseWriter, r *http.Request, ext *Extension) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"extension":       ext.Name,
+		"max_image_bytes": quickMaxSize,
+		"modes":           ocrModes,
+		"timeout_seconds": int(quickTimeout.Seconds()),
+	})
+}
+
+// extensionRequest is the body of POST /extension/ocr. Exactly one of
+// Image, a data: URI, and URL is set.
+type extensionRequest struct {
+	Image     string `json:"image"`
+	URL       string `json:"url"`
+	Languages string `json:"languages"`
+	Mode      string `json:"mode"`
+}
+
+// v1ExtensionOCRHandler OCRs one image like POST /quick and answers with
+// {"text", "confidence"}. Images given by URL are fetched by the server
+// with the hooks client, so private addresses are refused the same way.
+func v1ExtensionOCRHandler(w http.ResponseWriter, r *http.Request, ext *Extension) {
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	// Base64 takes four bytes for every three.
+	r.Body = http.MaxBytesReader(w, r.Body, quickMaxSize*4/3+16<<10)
+	var req extensionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeQuickBodyError(w, err)
+		return
+	}
+
+	var data []byte
+	switch {
+	case req.Image != "" && req.URL != "":
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "send either image or url, not both")
+		return
+	case req.Image != "":
+		var err error
+		if data, err = decodeDataURI(req.Image); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_image", err.Error())
+			return
+		}
+	case req.URL != "":
+		var ok bool
+		if data, ok = fetchExtensionImage(r.Context(), w, req.URL); !ok {
+			return
+		}
+	default:
+		writeAPIError(w, http.StatusBadRequest, "missing_file", "send the image as a data: URI in image or by url")
+		return
+	}
+
+	text, confidence, ok := quickOCR(w, r, account, plan, data, strings.TrimSpace(req.Languages), req.Mode)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{"text": text, "confidence": confidence})
+}
+
+// decodeDataURI returns the bytes of a base64 data: URI.
+func decodeDataURI(uri string) ([]byte, error) {
+	meta, payload, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok || !strings.HasPrefix(uri, "data:") || !strings.HasSuffix(meta, ";base64") {
+		return nil, fmt.Errorf("image must be a base64 data: URI such as data:image/png;base64,...")
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding image: %w", err)
+	}
+	return data, nil
+}
+
+// fetchExtensionImage downloads the image at rawURL, up to one byte more
+// than quickMaxSize so quickOCR can refuse larger ones. It answers
+// failures itself and then returns false.
+func fetchExtensionImage(ctx context.Context, w http.ResponseWriter, rawURL string) ([]byte, bool) {
+	src, err := url.Parse(rawURL)
+	if err != nil || (src.Scheme != "http" && src.Scheme != "https") || src.Host == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_url", "url must be an http or https URL of an image")
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, quickTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.String(), nil)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_url", err.Error())
+		return nil, false
+	}
+	resp, err := hookHTTPClient.Do(req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "download_failed", "Error downloading image: "+err.Error())
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		writeAPIError(w, http.StatusBadGateway, "download_failed", "Error downloading image: the server returned "+resp.Status)
+		return nil, false
+	}
+	if resp.ContentLength > quickMaxSize {
+		writeQuickBodyError(w, &http.MaxBytesError{Limit: quickMaxSize})
+		return nil, false
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, quickMaxSize+1))
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "download_failed", "Error downloading image: "+err.Error())
+		return nil, false
+	}
+	return data, true
+}
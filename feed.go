@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// GET /api/v1/feed.atom is an Atom feed of the newest finished documents
+// the caller may see, with the job list filters, so a digitization
+// project's output can be followed in a feed reader: ?tag=project=letters
+// for one project, ?account= for one user's from the reviewer role up.
+// Feed readers cannot send headers, so the feed also takes its API key as
+// ?key=, see requestAPIKey.
+
+const (
+	atomEntries    = 50  // entries in a feed by default
+	maxAtomEntries = 200 // the most ?limit= may ask for
+	atomSummaryLen = 280 // characters of the text in an entry's summary
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Summary    string         `xml:"summary,omitempty"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// isFeedRequest reports whether r is a GET of the feed, at /api/feed.atom
+// or below a version, which may carry its API key in the URL.
+func isFeedRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/api")
+	if v, rest, ok := strings.Cut(strings.TrimPrefix(p, "/"), "/"); ok && isVersionName(v) {
+		p = "/" + rest
+	}
+	return p == "/feed.atom"
+}
+
+func v1FeedHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseJobFilter(q)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+	limit := atomEntries
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxAtomEntries {
+			writeAPIError(w, http.StatusBadRequest, "invalid_filter", "limit must be a number from 1 to "+strconv.Itoa(maxAtomEntries))
+			return
+		}
+	}
+	v, perr := requestViewer(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	list := jobs.list(func(j *Job) bool { return j.Status == JobDone && v.sees(j) && f.match(j) })
+	sort.Slice(list, func(a, b int) bool { return list[a].FinishedAt.After(*list[b].FinishedAt) })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+
+	// The feed is named by its filters; the key stays out of it.
+	q.Del("key")
+	self := appPath("/api/v1/feed.atom")
+	if len(q) > 0 {
+		self += "?" + q.Encode()
+	}
+	feed := atomFeed{
+		ID:      absoluteURL(self),
+		Title:   atomFeedTitle(f),
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: "persianOCR"},
+		Links:   []atomLink{{Rel: "self", Href: absoluteURL(self), Type: "application/atom+xml"}},
+		Entries: []atomEntry{},
+	}
+	if len(list) > 0 {
+		feed.Updated = list[0].FinishedAt.UTC().Format(time.RFC3339)
+	}
+	for _, j := range list {
+		feed.Entries = append(feed.Entries, atomFeedEntry(j))
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(feed)
+}
+
+func atomFeedTitle(f jobFilter) string {
+	title := "persianOCR: finished documents"
+	var tags []string
+	for k, v := range f.Tags {
+		if v != "" {
+			k += "=" + v
+		}
+		tags = append(tags, k)
+	}
+	sort.Strings(tags)
+	if len(tags) > 0 {
+		title += " tagged " + strings.Join(tags, ", ")
+	}
+	if f.Account != "" {
+		title += " of " + f.Account
+	}
+	return title
+}
+
+func atomFeedEntry(j Job) atomEntry {
+	e := atomEntry{
+		ID:        "urn:uuid:" + j.ID,
+		Title:     j.Filename,
+		Updated:   j.FinishedAt.UTC().Format(time.RFC3339),
+		Published: j.CreatedAt.UTC().Format(time.RFC3339),
+		Links:     []atomLink{{Href: absoluteURL(appPath("/jobs/" + j.ID)), Type: "text/html"}},
+		Summary:   textSnippet(j),
+	}
+	if j.PDFURL != "" {
+		e.Links = append(e.Links, atomLink{Rel: "enclosure", Href: absoluteURL(j.PDFURL), Type: "application/pdf"})
+	}
+	if j.TextURL != "" {
+		e.Links = append(e.Links, atomLink{Rel: "alternate", Href: absoluteURL(j.TextURL), Type: "text/plain"})
+	}
+	for k, v := range j.Tags {
+		if v != "" {
+			k += "=" + v
+		}
+		e.Categories = append(e.Categories, atomCategory{Term: k})
+	}
+	sort.Slice(e.Categories, func(a, b int) bool { return e.Categories[a].Term < e.Categories[b].Term })
+	return e
+}
+
+// textSnippet is the start of the job's text, with its whitespace
+// collapsed, for an entry's summary.
+func textSnippet(j Job) string {
+	file, ok := downloadFile(j.TextURL)
+	if !ok {
+		return ""
+	}
+	data, err := readStored(file)
+	if err != nil {
+		return ""
+	}
+	if len(data) > 4*atomSummaryLen {
+		data = data[:4*atomSummaryLen]
+	}
+	text := strings.Join(strings.Fields(strings.ToValidUTF8(string(data), "")), " ")
+	if utf8.RuneCountInString(text) <= atomSummaryLen {
+		return text
+	}
+	r := []rune(text)
+	return string(r[:atomSummaryLen]) + "…"
+}
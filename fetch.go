@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Documents that already live on a file server can be submitted by URL
+// instead of uploaded: the server downloads the file and queues it like an
+// upload, from the web form or with a "url" field to POST /api/v1/jobs. The
+// operator names the hosts that may be fetched from (-fetch-hosts); by
+// default there are none, so the server cannot be made to reach into its
+// network unless that was asked for.
+
+var (
+	fetchHosts   []string // lower-case host names; "*" allows any host on a public address
+	fetchTimeout = 2 * time.Minute
+)
+
+// fetchTypes maps the content types a fetched document may be served with
+// to the extension its name gets when it has none of the upload types.
+// Servers that do not know the type, and answer application/octet-stream,
+// are taken at the file name.
+var fetchTypes = map[string]string{
+	"application/pdf": ".pdf",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+}
+
+// fetchError refuses a document URL. The API answers it with Status and
+// Code.
+type fetchError struct {
+	Status int
+	Code   string
+	msg    string
+}
+
+func (e *fetchError) Error() string { return e.msg }
+
+// fetchHTTPClient downloads documents. Hosts named in fetchHosts are
+// connected to wherever they are, which is what makes an internal file
+// server reachable; any other host, allowed by "*", only on a public
+// address (see checkPublicAddress). Redirects must stay on allowed hosts.
+var fetchHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := &net.Dialer{Timeout: 30 * time.Second}
+			if host, _, _ := net.SplitHostPort(addr); !slices.Contains(fetchHosts, strings.ToLower(host)) {
+				d.Control = func(network, address string, c syscall.RawConn) error { return checkPublicAddress(address) }
+			}
+			return d.DialContext(ctx, network, addr)
+		},
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !fetchAllowed(req.URL.Hostname()) {
+			return fmt.Errorf("redirected to %s, which documents may not be fetched from", req.URL.Hostname())
+		}
+		return nil
+	},
+}
+
+// parseFetchHosts reads the -fetch-hosts list: comma-separated host names,
+// or "*".
+func parseFetchHosts(s string) []string {
+	var hosts []string
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+func fetchAllowed(host string) bool {
+	return slices.Contains(fetchHosts, "*") || slices.Contains(fetchHosts, strings.ToLower(host))
+}
+
+// fetchDocument downloads the document at rawURL, up to maxUploadSize and
+// within fetchTimeout, into a spool file to admit like an upload. The
+// caller removes the spool file when it is not admitted.
+func fetchDocument(ctx context.Context, rawURL string) (batchFile, *fetchError) {
+	if len(fetchHosts) == 0 {
+		return batchFile{}, &fetchError{http.StatusForbidden, "fetch_disabled", "this server does not fetch documents by URL"}
+	}
+	src, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (src.Scheme != "http" && src.Scheme != "https") || src.Host == "" {
+		return batchFile{}, &fetchError{http.StatusBadRequest, "invalid_url", "url must be an http or https URL of a document"}
+	}
+	if !fetchAllowed(src.Hostname()) {
+		return batchFile{}, &fetchError{http.StatusForbidden, "url_not_allowed", "documents may not be fetched from " + src.Hostname()}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.String(), nil)
+	if err != nil {
+		return batchFile{}, &fetchError{http.StatusBadRequest, "invalid_url", err.Error()}
+	}
+	resp, err := fetchHTTPClient.Do(req)
+	if err != nil {
+		return batchFile{}, &fetchError{http.StatusBadGateway, "download_failed", "Error downloading document: " + err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return batchFile{}, &fetchError{http.StatusBadGateway, "download_failed", "Error downloading document: the server returned " + resp.Status}
+	}
+	tooLarge := &fetchError{http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("the document is larger than %d MB", maxUploadSize>>20)}
+	if resp.ContentLength > maxUploadSize {
+		return batchFile{}, tooLarge
+	}
+	name := hookFilename(resp)
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if ext, ok := fetchTypes[mt]; ok {
+		if !isUploadType(name) {
+			name += ext
+		}
+	} else if mt != "" && mt != "application/octet-stream" {
+		// Typically a login or error page of the file server.
+		return batchFile{}, &fetchError{http.StatusUnsupportedMediaType, "unsupported_type",
+			fmt.Sprintf("the URL returned %s, not a PDF, Word, PowerPoint, PNG or JPEG file", mt)}
+	}
+
+	spoolPath, fingerprint, err := spoolUpload(io.LimitReader(resp.Body, maxUploadSize+1))
+	if err != nil {
+		return batchFile{}, &fetchError{http.StatusBadGateway, "download_failed", "Error downloading document: " + err.Error()}
+	}
+	fi, err := os.Stat(spoolPath)
+	if err != nil {
+		os.Remove(spoolPath)
+		return batchFile{}, &fetchError{http.StatusInternalServerError, "storage_error", err.Error()}
+	}
+	if fi.Size() > maxUploadSize {
+		os.Remove(spoolPath)
+		return batchFile{}, tooLarge
+	}
+	src.User = nil // credentials for the file server are not kept with the job
+	return batchFile{
+		Name:        name,
+		Size:        fi.Size(),
+		Source:      src.String(),
+		Spool:       spoolPath,
+		Fingerprint: fingerprint,
+		Open:        func() (io.ReadCloser, error) { return os.Open(spoolPath) },
+	}, nil
+}
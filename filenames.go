@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// cleanUploadName turns the client-supplied file name into the display name
+// kept in job metadata: NFC-normalized, without any directory part (browsers
+// on Windows may send "C:\scans\a.pdf") and without control characters.
+func cleanUploadName(raw string) string {
+	name := norm.NFC.String(raw)
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "document.pdf"
+	}
+	return name
+}
+
+// safeFileStem reduces a display name to characters that are safe in file
+// names and URLs on every platform: letters and digits of any script plus
+// '-', '_' and '.'. Spaces, ZWNJ and other separators become '_', combining
+// marks (harakat) are dropped and runs of '_' collapse.
+func safeFileStem(name string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range norm.NFC.String(name) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '.':
+			b.WriteRune(r)
+			underscore = false
+		default:
+			if !underscore && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			underscore = true
+		}
+	}
+	stem := strings.Trim(b.String(), "_.")
+	if stem == "" {
+		return "document"
+	}
+	return stem
+}
+
+// escapeURLPath percent-encodes each element of a slash-separated path.
+func escapeURLPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// attachmentDisposition builds a Content-Disposition header that carries the
+// UTF-8 display name (RFC 6266 filename*) with an ASCII fallback for old
+// clients.
+func attachmentDisposition(name string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || r == '"' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	ext := filepath.Ext(fallback)
+	if strings.Trim(strings.TrimSuffix(fallback, ext), "_ ") == "" {
+		fallback = "download" + ext
+	}
+	encoded := strings.ReplaceAll(url.QueryEscape(name), "+", "%20")
+	return `attachment; filename="` + fallback + `"; filename*=UTF-8''` + encoded
+}
+
+// downloadNames sets Content-Disposition on result downloads so browsers
+// save them under the original, unsanitized name.
+func downloadNames(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if j, file, ok := downloadJob(r.URL.Path); ok && j.prefix != "" && !strings.Contains(file, "/") && strings.HasPrefix(file, j.prefix) {
+			w.Header().Set("Content-Disposition", attachmentDisposition(j.displayPrefix+strings.TrimPrefix(file, j.prefix)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// downloadJob returns the job a result download belongs to and the path of
+// the file in the job's result directory. Paths look like
+// "user_file_searchable/<owner>/<job id>/<prefix>.<ext>" once /download/ is
+// stripped, or have no owner for jobs stored before there were namespaces
+// (see ownerDir).
+func downloadJob(p string) (Job, string, bool) {
+	parts := strings.Split(p, "/")
+	if parts[0] != "user_file_searchable" || jobs == nil {
+		return Job{}, "", false
+	}
+	for n := 1; n <= 2 && n+1 < len(parts); n++ {
+		if j, ok := jobs.get(parts[n]); ok {
+			return j, strings.Join(parts[n+1:], "/"), true
+		}
+	}
+	return Job{}, "", false
+}
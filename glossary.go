@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// glossaryName is the file a job's glossary is kept in, next to its upload.
+const glossaryName = "glossary.txt"
+
+const (
+	maxGlossaryTerms  = 5000
+	maxGlossaryTerm   = 100     // characters
+	maxGlossaryUpload = 1 << 20 // bytes
+)
+
+// glossarySeparators splits a plain glossary value at commas, Latin or
+// Persian.
+var glossarySeparators = strings.NewReplacer(",", "\n", "،", "\n")
+
+// parseGlossary reads a job's glossary from the "glossary" form field: an
+// uploaded text file or a plain value, with one term per line. Terms may
+// also be separated by commas in a plain value. Terms are NFC-normalized and
+// duplicates dropped; nil is returned when there are none.
+func parseGlossary(form *multipart.Form) ([]string, error) {
+	var sources []io.Reader
+	for _, fh := range form.File["glossary"] {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading glossary: %w", err)
+		}
+		defer f.Close()
+		sources = append(sources, io.LimitReader(f, maxGlossaryUpload))
+	}
+	for _, v := range form.Value["glossary"] {
+		sources = append(sources, strings.NewReader(glossarySeparators.Replace(v)))
+	}
+
+	var terms []string
+	seen := map[string]bool{}
+	for _, src := range sources {
+		sc := bufio.NewScanner(src)
+		for sc.Scan() {
+			if !utf8.ValidString(sc.Text()) {
+				return nil, fmt.Errorf("the glossary must be UTF-8 text")
+			}
+			term := strings.Join(strings.Fields(norm.NFC.String(sc.Text())), " ")
+			if term == "" || seen[term] {
+				continue
+			}
+			if utf8.RuneCountInString(term) > maxGlossaryTerm {
+				return nil, fmt.Errorf("glossary term %q is longer than %d characters", term, maxGlossaryTerm)
+			}
+			seen[term] = true
+			terms = append(terms, term)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("Error reading glossary: %w", err)
+		}
+	}
+	if len(terms) > maxGlossaryTerms {
+		return nil, fmt.Errorf("at most %d glossary terms are allowed per job", maxGlossaryTerms)
+	}
+	return terms, nil
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/mosaeedv/persianOCR/proto/ocrv1"
+)
+
+// resultChunkSize is how much of a result file FetchResult sends per
+// message.
+const resultChunkSize = 64 << 10
+
+// ocrGRPCServer implements ocrv1.OCRServiceServer on top of the job store.
+type ocrGRPCServer struct {
+	ocrv1.UnimplementedOCRServiceServer
+}
+
+// serveGRPC listens on addr and serves the gRPC API until the process exits.
+// Server reflection is on so grpcurl and similar tools need no .proto.
+func serveGRPC(addr string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("gRPC listen on %s: %v", addr, err)
+	}
+	opts := append(grpcNetworkPolicy(), grpcAuthorization()...)
+	opts = append(opts, grpc.MaxRecvMsgSize(int(maxUploadSize)+1<<20))
+	srv := grpc.NewServer(opts...)
+	ocrv1.RegisterOCRServiceServer(srv, &ocrGRPCServer{})
+	reflection.Register(srv)
+	log.Printf("gRPC server listening on %s", addr)
+	log.Fatal(srv.Serve(lis))
+}
+
+// grpcRequest makes an HTTP request of a call's metadata and peer address,
+// so the call is identified and rate-limited like the HTTP API.
+func grpcRequest(ctx context.Context) *http.Request {
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, name := range []string{"Authorization", "X-API-Key"} {
+			if v := md.Get(name); len(v) > 0 {
+				r.Header.Set(name, v[0])
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	return r
+}
+
+// grpcRoutes are the HTTP API routes the calls stand for, whose key and
+// scope checks (see authorizeAPI) they get.
+var grpcRoutes = map[string]struct{ method, route string }{
+	ocrv1.OCRService_SubmitDocument_FullMethodName: {http.MethodPost, "/jobs"},
+	ocrv1.OCRService_GetJob_FullMethodName:         {http.MethodGet, "/jobs/{id}"},
+	ocrv1.OCRService_StreamProgress_FullMethodName: {http.MethodGet, "/jobs/{id}/events"},
+	ocrv1.OCRService_FetchResult_FullMethodName:    {http.MethodGet, "/jobs/{id}"},
+	ocrv1.OCRService_StreamPages_FullMethodName:    {http.MethodGet, "/jobs/{id}/pages/{n}/text"},
+}
+
+// grpcAuthorize checks the key of a call to method like authorizeAPI does
+// for its HTTP route. A call with no route yet needs the write scope; the
+// reflection service is open, like /api/openapi.json.
+func grpcAuthorize(ctx context.Context, method string) error {
+	if strings.HasPrefix(method, "/grpc.reflection.") {
+		return nil
+	}
+	rt, ok := grpcRoutes[method]
+	if !ok {
+		rt.method, rt.route = http.MethodPost, method
+	}
+	r := grpcRequest(ctx)
+	r.Method = rt.method
+	if perr := authorizeAPI(r, rt.route); perr != nil {
+		return grpcPlanError(perr)
+	}
+	return nil
+}
+
+// grpcAuthorization has every call checked by grpcAuthorize before its
+// handler runs, after the network policy.
+func grpcAuthorization() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, h grpc.UnaryHandler) (any, error) {
+			if err := grpcAuthorize(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return h(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, h grpc.StreamHandler) error {
+			if err := grpcAuthorize(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return h(srv, ss)
+		}),
+	}
+}
+
+// grpcResponse collects the headers the HTTP helpers set, such as the rate
+// limit headers, to be sent back as metadata.
+type grpcResponse struct {
+	header http.Header
+}
+
+func (g *grpcResponse) Header() http.Header         { return g.header }
+func (g *grpcResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (g *grpcResponse) WriteHeader(int)             {}
+
+// sendHeader sends the collected headers as the call's header metadata.
+func (g *grpcResponse) sendHeader(ctx context.Context) {
+	md := metadata.MD{}
+	for name, v := range g.header {
+		md.Set(name, v...)
+	}
+	grpc.SetHeader(ctx, md)
+}
+
+// grpcCode is the status code of an HTTP API error status.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusPaymentRequired, http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// grpcPlanError turns a refusal of the plans into a status error.
+func grpcPlanError(perr *planError) error {
+	return status.Error(grpcCode(perr.Status), perr.Error())
+}
+
+// grpcSubmitError turns a refusal of a document, as POST /api/v1/jobs
+// would answer it, into a status error.
+func grpcSubmitError(err error) error {
+	var perr *planError
+	var pe *pdfError
+	var re *resourceError
+	switch {
+	case errors.As(err, &perr):
+		return grpcPlanError(perr)
+	case errors.As(err, &pe), errors.Is(err, errUnsupportedType):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.As(err, &re) && re.Storage:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.As(err, &re):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// grpcJob returns the job of a call, answering a job the caller may not
+// see as if it did not exist, like ownJob.
+func grpcJob(ctx context.Context, id string) (Job, error) {
+	if id == "" {
+		return Job{}, status.Error(codes.InvalidArgument, "job_id is required")
+	}
+	v, perr := requestViewer(grpcRequest(ctx))
+	if perr != nil {
+		return Job{}, grpcPlanError(perr)
+	}
+	j, ok := jobs.get(id)
+	if !ok || !v.sees(&j) {
+		return Job{}, status.Errorf(codes.NotFound, "no job with id %s", id)
+	}
+	return j, nil
+}
+
+var grpcStatuses = map[JobStatus]ocrv1.JobStatus{
+	JobQueued:     ocrv1.JobStatus_JOB_STATUS_QUEUED,
+	JobProcessing: ocrv1.JobStatus_JOB_STATUS_PROCESSING,
+	JobDone:       ocrv1.JobStatus_JOB_STATUS_DONE,
+	JobFailed:     ocrv1.JobStatus_JOB_STATUS_FAILED,
+	JobCanceled:   ocrv1.JobStatus_JOB_STATUS_CANCELED,
+}
+
+// resultLinks are the result files FetchResult serves, by the link of the
+// job they are downloaded from.
+var resultLinks = map[ocrv1.ResultKind]func(j *Job) string{
+	ocrv1.ResultKind_RESULT_KIND_TEXT: func(j *Job) string { return j.TextURL },
+	ocrv1.ResultKind_RESULT_KIND_PDF:  func(j *Job) string { return j.PDFURL },
+	ocrv1.ResultKind_RESULT_KIND_LOG:  func(j *Job) string { return j.LogURL },
+}
+
+// jobMessage is the gRPC view of a job.
+func jobMessage(j Job) *ocrv1.Job {
+	m := &ocrv1.Job{
+		Id:         j.ID,
+		Filename:   j.Filename,
+		Status:     grpcStatuses[j.Status],
+		Error:      j.Error,
+		CreatedAt:  timestamppb.New(j.CreatedAt),
+		Confidence: j.Confidence,
+		Sha256:     j.SHA256,
+		Tags:       j.Tags,
+	}
+	if j.StartedAt != nil {
+		m.StartedAt = timestamppb.New(*j.StartedAt)
+	}
+	if j.FinishedAt != nil {
+		m.FinishedAt = timestamppb.New(*j.FinishedAt)
+	}
+	if j.Progress != nil {
+		m.PagesDone, m.Pages = int32(j.Progress.PagesDone), int32(j.Progress.Pages)
+	}
+	for _, kind := range []ocrv1.ResultKind{ocrv1.ResultKind_RESULT_KIND_TEXT, ocrv1.ResultKind_RESULT_KIND_PDF, ocrv1.ResultKind_RESULT_KIND_LOG} {
+		if resultLinks[kind](&j) != "" {
+			m.Results = append(m.Results, kind)
+		}
+	}
+	return m
+}
+
+func (s *ocrGRPCServer) SubmitDocument(ctx context.Context, req *ocrv1.SubmitDocumentRequest) (*ocrv1.Job, error) {
+	r := grpcRequest(ctx)
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		return nil, grpcPlanError(perr)
+	}
+	size := int64(len(req.GetContent()))
+	switch {
+	case size == 0:
+		return nil, status.Error(codes.InvalidArgument, "content is required")
+	case size > maxUploadSize:
+		return nil, status.Errorf(codes.InvalidArgument, "the document is larger than %d MB", maxUploadSize>>20)
+	}
+	filename := cleanUploadName(req.GetFilename())
+	if !isUploadType(filename) {
+		return nil, status.Error(codes.InvalidArgument, errUnsupportedType.Error())
+	}
+	if perr := plan.checkUpload(size, defaultEngine); perr != nil {
+		return nil, grpcPlanError(perr)
+	}
+	checksum, err := parseChecksum(req.GetSha256())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.GetLanguages() != "" {
+		if err := checkLanguages(req.GetLanguages()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	tags, err := parseTags(tagItems(req.GetTags()))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	spoolPath, fingerprint, err := spoolUpload(bytes.NewReader(req.GetContent()))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if checksum != "" && checksum != fingerprint {
+		os.Remove(spoolPath)
+		return nil, status.Errorf(codes.InvalidArgument, "the document arrived with SHA-256 %s, not %s", fingerprint, checksum)
+	}
+	format := convertedFormat(filename)
+	if format != "" {
+		err = convertToPDF(spoolPath, format, plan.pageLimit())
+	}
+	var check pdfCheck
+	if err == nil {
+		check, err = checkPDF(spoolPath)
+	}
+	var est resourceEstimate
+	if err == nil {
+		est, err = checkResources(spoolPath)
+	}
+	if err == nil {
+		if perr := checkPages(est.Pages, plan.pageLimit()); perr != nil {
+			err = perr
+		}
+	}
+	if err != nil {
+		os.Remove(spoolPath)
+		return nil, grpcSubmitError(err)
+	}
+
+	w := &grpcResponse{header: http.Header{}}
+	defer w.sendHeader(ctx)
+	if !limiter.allowSubmission(w, r) {
+		os.Remove(spoolPath)
+		return nil, status.Error(codes.ResourceExhausted, "Daily submission quota exceeded")
+	}
+	if perr := plan.chargePages(account, est.Pages); perr != nil {
+		os.Remove(spoolPath)
+		return nil, grpcPlanError(perr)
+	}
+	job, _, err := jobs.submit(submission{
+		Client:        clientKey(r),
+		Filename:      filename,
+		SpoolPath:     spoolPath,
+		Fingerprint:   fingerprint,
+		Tags:          tags,
+		Account:       account,
+		Priority:      plan.Priority,
+		Pages:         est.Pages,
+		MaxActive:     plan.activeJobLimit(),
+		Repaired:      check.Repaired,
+		ConvertedFrom: format,
+		Languages:     req.GetLanguages(),
+	})
+	if err != nil {
+		os.Remove(spoolPath)
+		usage.refund(account, est.Pages)
+		setRetryAfter(w, err)
+		return nil, grpcSubmitError(err)
+	}
+	return jobMessage(job), nil
+}
+
+func (s *ocrGRPCServer) GetJob(ctx context.Context, req *ocrv1.GetJobRequest) (*ocrv1.Job, error) {
+	j, err := grpcJob(ctx, req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	return jobMessage(j), nil
+}
+
+func (s *ocrGRPCServer) StreamProgress(req *ocrv1.GetJobRequest, stream grpc.ServerStreamingServer[ocrv1.Job]) error {
+	ctx := stream.Context()
+	j, err := grpcJob(ctx, req.GetJobId())
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(pagePollInterval)
+	defer ticker.Stop()
+
+	var last *ocrv1.Job
+	for {
+		m := jobMessage(j)
+		if last == nil || m.Status != last.Status || m.PagesDone != last.PagesDone || m.Pages != last.Pages {
+			if err := stream.Send(m); err != nil {
+				return err
+			}
+			last = m
+		}
+		if j.finished() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-ticker.C:
+		case <-j.done:
+		}
+		var ok bool
+		if j, ok = jobs.get(j.ID); !ok {
+			return status.Errorf(codes.NotFound, "job %s was deleted", req.GetJobId())
+		}
+	}
+}
+
+func (s *ocrGRPCServer) FetchResult(req *ocrv1.FetchResultRequest, stream grpc.ServerStreamingServer[ocrv1.ResultChunk]) error {
+	j, err := grpcJob(stream.Context(), req.GetJobId())
+	if err != nil {
+		return err
+	}
+	link, ok := resultLinks[req.GetKind()]
+	if !ok {
+		return status.Error(codes.InvalidArgument, "kind must be RESULT_KIND_TEXT, RESULT_KIND_PDF or RESULT_KIND_LOG")
+	}
+	file, ok := downloadFile(link(&j))
+	if !ok {
+		return status.Errorf(codes.FailedPrecondition, "the job has no %s result", strings.ToLower(strings.TrimPrefix(req.GetKind().String(), "RESULT_KIND_")))
+	}
+	f, err := openStored(file)
+	if err != nil {
+		return status.Error(codes.NotFound, "the job's results are no longer available")
+	}
+	defer f.Close()
+
+	first := &ocrv1.ResultChunk{
+		Filename:    j.displayPrefix + strings.TrimPrefix(filepath.Base(file), j.prefix),
+		ContentType: "text/plain; charset=utf-8",
+	}
+	if req.GetKind() == ocrv1.ResultKind_RESULT_KIND_PDF {
+		first.ContentType = "application/pdf"
+	}
+	buf := make([]byte, resultChunkSize)
+	chunk := first
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 || chunk == first {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+			chunk = &ocrv1.ResultChunk{}
+		}
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return nil
+		case err != nil:
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+}
+
+func (s *ocrGRPCServer) StreamPages(req *ocrv1.StreamPagesRequest, stream grpc.ServerStreamingServer[ocrv1.PageResult]) error {
+	if _, err := grpcJob(stream.Context(), req.GetJobId()); err != nil {
+		return err
+	}
+
+	err := watchPages(stream.Context(), req.GetJobId(), int(req.GetFromPage()), func(n int, path string) error {
+		data, err := readStored(path)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		text := string(data)
+		return stream.Send(&ocrv1.PageResult{
+			JobId:        req.GetJobId(),
+			Page:         int32(n),
+			Text:         text,
+			WordCount:    int32(len(strings.Fields(text))),
+			RecognizedAt: timestamppb.New(fi.ModTime()),
+		})
+	})
+	switch {
+	case errors.Is(err, errJobNotFound):
+		return status.Errorf(codes.NotFound, "no job with id %s", req.GetJobId())
+	case err != nil:
+		return status.FromContextError(err).Err()
+	}
+
+	if job, ok := jobs.get(req.GetJobId()); ok {
+		switch job.Status {
+		case JobFailed:
+			return status.Error(codes.Aborted, job.Error)
+		case JobCanceled:
+			return status.Error(codes.Canceled, "the job was canceled")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Probes for Kubernetes and load balancers. GET /healthz is the liveness
+// probe: it fails only when the job store is stuck, which a restart
+// fixes. GET /readyz is the readiness probe and also fails when the engine
+// cannot run or the storage cannot be written, so traffic goes to other
+// instances until that is repaired. Both answer 200 or 503 with the result
+// of each check, need no credentials and are left out of the access rules.
+
+// healthTimeout bounds how long the job store may take to answer a probe.
+const healthTimeout = 2 * time.Second
+
+// storageDirs are the directories readiness checks can be written to.
+var storageDirs []string
+
+type healthCheck struct {
+	name string
+	run  func() error
+}
+
+var (
+	livenessChecks  = []healthCheck{{"queue", checkQueue}}
+	readinessChecks = []healthCheck{{"queue", checkQueue}, {"engine", checkEngine}, {"storage", checkStorage}}
+)
+
+func isHealthPath(p string) bool {
+	return p == "/healthz" || p == "/readyz"
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, livenessChecks)
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, readinessChecks)
+}
+
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	results := map[string]string{}
+	status, code := "ok", http.StatusOK
+	for _, c := range checks {
+		results[c.name] = "ok"
+		if err := c.run(); err != nil {
+			results[c.name] = err.Error()
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, map[string]any{"status": status, "checks": results})
+}
+
+// checkQueue fails when the job store's lock cannot be taken in time, as
+// when a bug has left it held.
+func checkQueue() error {
+	if jobs == nil {
+		return errors.New("the job store is not loaded")
+	}
+	done := make(chan struct{})
+	go func() {
+		jobs.mu.Lock()
+		jobs.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(healthTimeout):
+		return fmt.Errorf("the job store did not answer within %s", healthTimeout)
+	}
+}
+
+// checkEngine looks for what an OCR run starts: Tesseract and Poppler's
+// tools for the native pipeline, Python, the engine script and Tesseract
+// for the script, and bubblewrap when runs must be sandboxed.
+func checkEngine() error {
+	var missing []string
+	bins := []string{tesseractCommand, popplerTool("pdfinfo"), popplerTool("pdftoppm"), popplerTool("pdfunite")}
+	if engineProgram != "" {
+		bins = append(bins, "sh")
+	}
+	if ocrPipeline == "python" {
+		bins = []string{"python", "tesseract"}
+		if pdfRasterizer == "poppler" {
+			bins = append(bins, "pdftoppm")
+		}
+	}
+	for _, bin := range bins {
+		if _, err := exec.LookPath(bin); err != nil {
+			missing = append(missing, bin)
+		}
+	}
+	if ocrPipeline == "python" {
+		if _, err := os.Stat("ocr_python.py"); err != nil {
+			missing = append(missing, "ocr_python.py")
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("not found: " + strings.Join(missing, ", "))
+	}
+	if ocrSandbox.Mode == sandboxRequire {
+		if reason := sandboxUnsupported(); reason != "" {
+			return errors.New(reason)
+		}
+	}
+	return nil
+}
+
+// checkStorage writes and removes a file in each of storageDirs, and fails
+// when the uploads volume is down to its -disk-reserve.
+func checkStorage() error {
+	for _, dir := range storageDirs {
+		f, err := os.CreateTemp(dir, ".healthz-*")
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %w", filepath.Base(dir), errors.Unwrap(err))
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if free, ok := diskFree("user_file"); ok && free <= diskReserve {
+		return fmt.Errorf("only %s free, -disk-reserve is %s", formatBytes(max(free, 0)), formatBytes(diskReserve))
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// HistoryData feeds templates/history.html.
+type HistoryData struct {
+	Error  string
+	Query  map[string]string // current filter values, echoed back into the form
+	Jobs   []Job
+	Status []JobStatus
+	CSRF   string // see csrf.go
+	Admin  bool   // the viewer may merge duplicates, see duplicates.go
+}
+
+var historyFuncs = template.FuncMap{
+	"confidence": func(c *float64) string {
+		if c == nil {
+			return "—"
+		}
+		return strconv.FormatFloat(*c, 'f', 1, 64) + "%"
+	},
+	"percent": func(share float64) string {
+		return strconv.FormatFloat(100*share, 'f', 0, 64) + "%"
+	},
+	"tagList": func(tags map[string]string) []string {
+		var out []string
+		for k, v := range tags {
+			if v == "" {
+				out = append(out, k)
+			} else {
+				out = append(out, k+"="+v)
+			}
+		}
+		sort.Strings(out)
+		return out
+	},
+}
+
+// historyHandler lists past jobs with the same filters as GET /api/v1/jobs.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data := HistoryData{
+		Query:  map[string]string{},
+		Status: []JobStatus{JobQueued, JobProcessing, JobDone, JobFailed, JobCanceled},
+		CSRF:   csrfToken(w, r),
+	}
+	for _, k := range []string{"filename", "tag", "keyword", "status", "engine", "from", "to", "min_confidence"} {
+		data.Query[k] = q.Get(k)
+	}
+
+	f, err := parseJobFilter(q)
+	v, perr := requestViewer(r)
+	switch {
+	case err != nil:
+		data.Error = err.Error()
+	case perr != nil:
+		data.Error = perr.Error()
+	default:
+		data.Jobs = jobs.list(func(j *Job) bool { return v.sees(j) && f.match(j) })
+		data.Admin = roleAtLeast(v.role, roleAdmin)
+	}
+
+	tmpl := template.Must(template.New("history.html").Funcs(pageFuncs).Funcs(historyFuncs).ParseFiles("templates/history.html"))
+	tmpl.Execute(w, data)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// The hooks API is a minimal "submit by URL, get a callback" shape for
+// no-code automation tools such as Zapier, n8n and Make: one JSON request
+// with a document URL, one flat JSON callback with the text when the job
+// finishes. It is a thin layer over the job system and disabled unless a
+// hook token is configured.
+var (
+	hookToken        string
+	hookAllowPrivate bool // documents and callbacks may be on private networks
+)
+
+// hookAccount is the account hook submissions are metered against.
+const hookAccount = "hooks"
+
+// maxHookText bounds the text included in a hook result.
+const maxHookText = 256 << 10
+
+// hookAttempts is how often a callback is tried before it is given up.
+const hookAttempts = 4
+
+// hookHTTPClient fetches documents and posts callbacks. Unless
+// hookAllowPrivate is set it refuses to connect to loopback, private and
+// link-local addresses, so a hook cannot be used to reach services behind
+// the server.
+var hookHTTPClient = &http.Client{
+	Timeout: 2 * time.Minute,
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				if hookAllowPrivate {
+					return nil
+				}
+				return checkPublicAddress(address)
+			},
+		}).DialContext,
+	},
+}
+
+// checkPublicAddress refuses to connect to address when it is a loopback,
+// private, link-local or unspecified IP address.
+func checkPublicAddress(address string) error {
+	host, _, _ := net.SplitHostPort(address)
+	if ip := net.ParseIP(host); ip != nil &&
+		(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()) {
+		return fmt.Errorf("connecting to %s is not allowed", ip)
+	}
+	return nil
+}
+
+// hookRequest is the body of POST /hooks/jobs.
+type hookRequest struct {
+	URL         string            `json:"url"`
+	CallbackURL string            `json:"callback_url"`
+	Filename    string            `json:"filename"`
+	Languages   string            `json:"languages"`
+	Tags        map[string]string `json:"tags"`
+}
+
+// hookResult is the flat job view the hooks API returns and posts to the
+// callback URL. Automation tools map its fields directly to later steps.
+type hookResult struct {
+	Event         string            `json:"event,omitempty"`
+	JobID         string            `json:"job_id"`
+	Status        JobStatus         `json:"status"`
+	Filename      string            `json:"filename"`
+	Error         string            `json:"error,omitempty"`
+	StatusURL     string            `json:"status_url"`
+	TextURL       string            `json:"text_url,omitempty"`
+	PDFURL        string            `json:"pdf_url,omitempty"`
+	Text          string            `json:"text,omitempty"`
+	TextTruncated bool              `json:"text_truncated,omitempty"`
+	Confidence    *float64          `json:"confidence,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// requireHookToken guards the hooks API. The token is accepted as a bearer
+// token or, for tools that can only configure a URL, as ?token=.
+func requireHookToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if hookToken == "" {
+			writeAPIError(w, http.StatusNotFound, "hooks_disabled", "the hooks API is not enabled on this server")
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if got == "" {
+			got = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(hookToken)) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "a valid hook token is required")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// v1HookSubmitHandler downloads the document at the request's URL and
+// queues it. The body is JSON or a plain form with the same fields. Its
+// pages are charged to the hooks account under the default plan, or the
+// plan of a user record of that name.
+func v1HookSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	p, err := plans.plan("")
+	if err != nil {
+		writeAPIError(w, http.StatusForbidden, "invalid_plan", "the hooks account's "+err.Error())
+		return
+	}
+	account, plan, perr := plans.forAccount(hookAccount, p)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+
+	var req hookRequest
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_json", "Error parsing request: "+err.Error())
+			return
+		}
+	} else {
+		req = hookRequest{URL: r.FormValue("url"), CallbackURL: r.FormValue("callback_url"),
+			Filename: r.FormValue("filename"), Languages: r.FormValue("languages")}
+		if vals := r.Form["tag"]; len(vals) > 0 {
+			tags, err := parseTags(vals)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_tags", err.Error())
+				return
+			}
+			req.Tags = tags
+		}
+	}
+
+	src, err := url.Parse(req.URL)
+	if err != nil || (src.Scheme != "http" && src.Scheme != "https") || src.Host == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_url", "url must be an http or https URL of a PDF")
+		return
+	}
+	if req.CallbackURL != "" {
+		if cb, err := url.Parse(req.CallbackURL); err != nil || (cb.Scheme != "http" && cb.Scheme != "https") || cb.Host == "" {
+			writeAPIError(w, http.StatusBadRequest, "invalid_callback_url", "callback_url must be an http or https URL")
+			return
+		}
+	}
+	if req.Languages != "" {
+		if err := checkLanguages(req.Languages); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_languages", err.Error())
+			return
+		}
+	}
+	tags, err := parseTags(tagItems(req.Tags))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_tags", err.Error())
+		return
+	}
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	tags["source"] = "hook"
+
+	get, err := http.NewRequestWithContext(r.Context(), http.MethodGet, src.String(), nil)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_url", "url must be an http or https URL of a PDF")
+		return
+	}
+	resp, err := hookHTTPClient.Do(get)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "download_failed", "Error downloading document: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		writeAPIError(w, http.StatusBadGateway, "download_failed", "Error downloading document: the server returned "+resp.Status)
+		return
+	}
+	if resp.ContentLength > maxUploadSize {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("the document is larger than %d MB", maxUploadSize>>20))
+		return
+	}
+	filename := req.Filename
+	if filename == "" {
+		filename = hookFilename(resp)
+	}
+	filename = cleanUploadName(filename)
+	if !strings.HasSuffix(strings.ToLower(filename), ".pdf") {
+		filename += ".pdf"
+	}
+	if !isUploadType(filename) {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_type", errUnsupportedType.Error())
+		return
+	}
+
+	spoolPath, fingerprint, err := spoolUpload(io.LimitReader(resp.Body, maxUploadSize+1))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	fi, err := os.Stat(spoolPath)
+	if err != nil {
+		os.Remove(spoolPath)
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	if fi.Size() > maxUploadSize {
+		// A chunked response cut off at the limit could pass for a whole
+		// document once checkPDF has repaired it.
+		os.Remove(spoolPath)
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("the document is larger than %d MB", maxUploadSize>>20))
+		return
+	}
+	if perr := plan.checkUpload(fi.Size(), defaultEngine); perr != nil {
+		os.Remove(spoolPath)
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	check, err := checkPDF(spoolPath)
+	if err != nil {
+		os.Remove(spoolPath)
+		writePDFError(w, err)
+		return
+	}
+	est, err := checkResourcesAt(spoolPath, renderDPI)
+	if err != nil {
+		os.Remove(spoolPath)
+		writeResourceError(w, err)
+		return
+	}
+	if !limiter.allowSubmission(w, r) {
+		os.Remove(spoolPath)
+		writeAPIError(w, http.StatusTooManyRequests, "quota_exceeded", "Daily submission quota exceeded")
+		return
+	}
+	if perr := checkPages(est.Pages, plan.pageLimit()); perr != nil {
+		os.Remove(spoolPath)
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	if perr := plan.chargePages(account, est.Pages); perr != nil {
+		os.Remove(spoolPath)
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+
+	job, _, err := jobs.submit(submission{
+		Client:      clientKey(r),
+		Filename:    filename,
+		SpoolPath:   spoolPath,
+		Fingerprint: fingerprint,
+		Tags:        tags,
+		Account:     account,
+		Priority:    plan.Priority,
+		Pages:       est.Pages,
+		MaxActive:   plan.activeJobLimit(),
+		Repaired:    check.Repaired,
+		Languages:   req.Languages,
+		CallbackURL: req.CallbackURL,
+	})
+	if err != nil {
+		os.Remove(spoolPath)
+		usage.refund(account, est.Pages)
+		writeSubmitResult(w, job, false, err)
+		return
+	}
+	w.Header().Set("Location", appPath("/api/v1/hooks/jobs/"+job.ID))
+	writeJSON(w, http.StatusAccepted, newHookResult("", job))
+}
+
+// v1HookJobHandler returns a job in the flat hook shape, for tools that
+// poll instead of receiving a callback.
+func v1HookJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok || !job.visibleTo(hookAccount) {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+r.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, newHookResult("", job))
+}
+
+// v1HookOpenAPIHandler serves the OpenAPI description of the hooks API,
+// which automation tools import to build their actions. Its server URL is
+// set to this server's public URL.
+func v1HookOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := os.ReadFile("openapi.json")
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "spec_unavailable", "Error reading openapi.json: "+err.Error())
+		return
+	}
+	var spec map[string]any
+	if err := json.Unmarshal(data, &spec); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "spec_unavailable", "Error parsing openapi.json: "+err.Error())
+		return
+	}
+	spec["servers"] = []map[string]string{{"url": absoluteURL(appPath("/api/v1"))}}
+	writeJSON(w, http.StatusOK, spec)
+}
+
+// newHookResult builds the hook view of j. The text of a finished job is
+// included up to maxHookText bytes.
+func newHookResult(event string, j Job) hookResult {
+	ev := jobEvent(event, j)
+	res := hookResult{
+		Event:      event,
+		JobID:      j.ID,
+		Status:     j.Status,
+		Filename:   j.Filename,
+		Error:      j.Error,
+		StatusURL:  absoluteURL(appPath("/api/v1/hooks/jobs/" + j.ID)),
+		TextURL:    ev.TextURL,
+		PDFURL:     ev.PDFURL,
+		Confidence: j.Confidence,
+		Tags:       j.Tags,
+	}
+	if j.Status == JobDone {
+		text, err := readStored(filepath.Join(j.outputDir, j.prefix+".txt"))
+		if err == nil {
+			if len(text) > maxHookText {
+				text = text[:maxHookText]
+				for len(text) > 0 && !utf8.Valid(text) {
+					text = text[:len(text)-1]
+				}
+				res.TextTruncated = true
+			}
+			res.Text = string(text)
+		}
+	}
+	return res
+}
+
+// sendHookCallback posts the finished job to its callback URL, retrying
+// with exponential backoff. The body is signed with the hook token like
+// webhook deliveries (see signWebhook).
+func sendHookCallback(event string, j Job) {
+	n := &webhookNotifier{ep: WebhookEndpoint{URL: j.callbackURL, Secret: hookToken}, client: hookHTTPClient}
+	res := newHookResult(event, j)
+	var err error
+	delay := webhookBackoff
+	for attempt := 1; attempt <= hookAttempts; attempt++ {
+		if err = n.send(event, res); err == nil {
+			return
+		}
+		if attempt < hookAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	log.Printf("callback for job %s failed after %d attempts: %v", j.ID, hookAttempts, err)
+}
+
+// hookFilename names a downloaded document after its Content-Disposition
+// or the last element of its URL.
+func hookFilename(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return "document.pdf"
+}
+
+// tagItems turns a tag map back into items parseTags validates.
+func tagItems(tags map[string]string) []string {
+	items := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v == "" {
+			items = append(items, k)
+		} else {
+			items = append(items, k+"="+v)
+		}
+	}
+	return items
+}
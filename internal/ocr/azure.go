@@ -0,0 +1,251 @@
+package ocr
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AzureAPIVersion is the Document Intelligence REST API version Azure
+// calls use unless told otherwise.
+const AzureAPIVersion = "2024-11-30"
+
+// AzureTimeout is the time Azure may take for one page, from the upload to
+// the result, unless told otherwise. An analysis that is never done, or a
+// rate limit that never lifts, fails the page rather than the job hanging.
+const AzureTimeout = 2 * time.Minute
+
+// azureRetries is how often a request Azure refuses with 429 is retried.
+const azureRetries = 5
+
+// Azure is an engine that sends each page image to the prebuilt-read
+// model of Azure AI Document Intelligence and polls the analysis until it
+// is done. Azure finds the languages itself, so Page.Languages is unused.
+type Azure struct {
+	Endpoint   string        // of the resource, such as https://<name>.cognitiveservices.azure.com
+	Key        string        // one of the resource's keys
+	APIVersion string        // AzureAPIVersion if empty
+	Client     *http.Client  // http.DefaultClient if nil
+	Poll       time.Duration // between status checks when Azure does not say, a second if 0
+	Timeout    time.Duration // for one page, AzureTimeout if 0
+}
+
+func (a *Azure) Name() string { return "azure" }
+
+func (a *Azure) Capabilities() Capabilities { return Capabilities{Confidence: true} }
+
+// Version names the model and API version, which is all of Azure's
+// recognition the page cache can tell apart.
+func (a *Azure) Version(context.Context) string {
+	return "prebuilt-read " + cmp.Or(a.APIVersion, AzureAPIVersion)
+}
+
+// azureAnalysis is the state of an analysis, as the operation reports it.
+type azureAnalysis struct {
+	Status string      `json:"status"` // notStarted, running, succeeded, failed or canceled
+	Error  *azureError `json:"error"`
+	Result struct {
+		Pages []struct {
+			Unit  string `json:"unit"` // pixel for images, inch for PDFs
+			Words []struct {
+				Content    string    `json:"content"`
+				Polygon    []float64 `json:"polygon"`
+				Confidence float64   `json:"confidence"` // 0-1
+				Span       azureSpan `json:"span"`
+			} `json:"words"`
+			Lines []struct {
+				Spans []azureSpan `json:"spans"`
+			} `json:"lines"`
+		} `json:"pages"`
+	} `json:"analyzeResult"`
+}
+
+type azureSpan struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+type azureError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (a *Azure) Recognize(ctx context.Context, page Page) (*Recognition, error) {
+	timeout := cmp.Or(a.Timeout, AzureTimeout)
+	pageCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	rec, err := a.analyze(pageCtx, page)
+	if err != nil && errors.Is(pageCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, &ToolError{Tool: "azure", Page: page.Number, Err: fmt.Errorf("no result within %s", timeout)}
+	}
+	return rec, err
+}
+
+// analyze uploads the page and polls its analysis until it is done.
+func (a *Azure) analyze(ctx context.Context, page Page) (*Recognition, error) {
+	png, err := os.ReadFile(page.Image)
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimSuffix(a.Endpoint, "/") + "/documentintelligence/documentModels/prebuilt-read:analyze?api-version=" + cmp.Or(a.APIVersion, AzureAPIVersion)
+	resp, err := a.send(ctx, page.Number, http.MethodPost, url, png)
+	if err != nil {
+		return nil, err
+	}
+	operation := resp.Header.Get("Operation-Location")
+	resp.Body.Close()
+	if operation == "" {
+		return nil, &ToolError{Tool: "azure", Page: page.Number, Err: errors.New("the analysis was accepted without an Operation-Location")}
+	}
+
+	for {
+		if err := sleep(ctx, a.retryAfter(resp)); err != nil {
+			return nil, err
+		}
+		if resp, err = a.send(ctx, page.Number, http.MethodGet, operation, nil); err != nil {
+			return nil, err
+		}
+		var an azureAnalysis
+		err = json.NewDecoder(resp.Body).Decode(&an)
+		resp.Body.Close()
+		if err != nil {
+			return nil, &ToolError{Tool: "azure", Page: page.Number, Err: fmt.Errorf("reading the analysis: %w", err)}
+		}
+		switch an.Status {
+		case "succeeded":
+			return an.recognition(page.DPI), nil
+		case "failed", "canceled":
+			msg := "the analysis " + an.Status
+			if an.Error != nil {
+				msg = an.Error.Message
+			}
+			return nil, &ToolError{Tool: "azure", Page: page.Number, Stderr: msg, Err: errors.New(an.Status)}
+		}
+	}
+}
+
+// send makes one request of the analysis, waiting out Azure's rate limit
+// up to azureRetries times, and returns the response of a 2xx status.
+func (a *Azure) send(ctx context.Context, page int, method, url string, body []byte) (*http.Response, error) {
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Ocp-Apim-Subscription-Key", a.Key)
+		if body != nil {
+			req.Header.Set("Content-Type", "image/png")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, &ToolError{Tool: "azure", Page: page, Err: err}
+		}
+		if resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < azureRetries {
+			if err := sleep(ctx, a.retryAfter(resp)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var e struct {
+			Error azureError `json:"error"`
+		}
+		json.Unmarshal(data, &e)
+		return nil, &ToolError{Tool: "azure", Page: page, Stderr: e.Error.Message, Err: fmt.Errorf("HTTP %s", resp.Status)}
+	}
+}
+
+// retryAfter is how long Azure asks to be left alone after resp.
+func (a *Azure) retryAfter(resp *http.Response) time.Duration {
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	if a.Poll > 0 {
+		return a.Poll
+	}
+	return time.Second
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// recognition maps the words of the analysed page onto its lines by their
+// spans in the document's content, which runs in reading order. Positions
+// in inches are converted to pixels of an image rendered at dpi.
+func (an *azureAnalysis) recognition(dpi int) *Recognition {
+	rec := &Recognition{}
+	if len(an.Result.Pages) == 0 {
+		return rec
+	}
+	p := an.Result.Pages[0]
+	scale := 1.0
+	if p.Unit == "inch" {
+		scale = float64(dpi)
+	}
+	for _, l := range p.Lines {
+		var line Line
+		for _, w := range p.Words {
+			if !inSpans(w.Span.Offset, l.Spans) || w.Content == "" {
+				continue
+			}
+			line = append(line, Word{
+				Text:       w.Content,
+				Confidence: int(math.Round(100 * min(max(w.Confidence, 0), 1))),
+				Box:        polygonBox(w.Polygon, scale),
+			})
+		}
+		if len(line) > 0 {
+			rec.Lines = append(rec.Lines, line)
+		}
+	}
+	return rec
+}
+
+func inSpans(offset int, spans []azureSpan) bool {
+	for _, s := range spans {
+		if offset >= s.Offset && offset < s.Offset+s.Length {
+			return true
+		}
+	}
+	return false
+}
+
+// polygonBox is the bounding box of a polygon given as x1, y1, x2, y2, …
+func polygonBox(polygon []float64, scale float64) image.Rectangle {
+	if len(polygon) < 4 {
+		return image.Rectangle{}
+	}
+	x0, y0, x1, y1 := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for i := 0; i+1 < len(polygon); i += 2 {
+		x0, x1 = min(x0, polygon[i]), max(x1, polygon[i])
+		y0, y1 = min(y0, polygon[i+1]), max(y1, polygon[i+1])
+	}
+	return image.Rect(int(math.Floor(x0*scale)), int(math.Floor(y0*scale)), int(math.Ceil(x1*scale)), int(math.Ceil(y1*scale)))
+}
@@ -0,0 +1,108 @@
+package ocr
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pageCacheVersion is bumped whenever recognition changes in a way that
+// makes cached pages stale.
+const pageCacheVersion = 1
+
+// pageCache keeps recognized pages across jobs, keyed by a hash of the
+// rendered page image and the settings it was recognized with. Its entries
+// are laid out like ocr_python.py's, <key[:2]>/<key> with the text, page
+// PDF and stats of a checkpoint, and are trimmed by the server; the keys
+// of the two never match, as the images are not hashed the same way.
+type pageCache struct {
+	root     string
+	settings map[string]any
+	hits     int
+}
+
+func (r *run) openPageCache(ctx context.Context) *pageCache {
+	version := ""
+	if v, ok := r.opts.Engine.(versioner); ok {
+		version = v.Version(ctx)
+	}
+	glossary := ""
+	if r.opts.Glossary != "" {
+		if data, err := os.ReadFile(r.opts.Glossary); err == nil {
+			sum := sha256.Sum256(data)
+			glossary = hex.EncodeToString(sum[:])
+		}
+	}
+	return &pageCache{root: r.opts.PageCache, settings: map[string]any{
+		"pipeline": "native",
+		"engine":   r.opts.Engine.Name(),
+		"version":  version,
+		"glossary": glossary,
+		"charset":  r.opts.Charset,
+		"dpi":      r.opts.DPI,
+		"enhance":  r.opts.Enhance,
+	}}
+}
+
+// key hashes a page's PNG with the settings it is recognized with.
+func (c *pageCache) key(png []byte, languages string) string {
+	h := sha256.New()
+	settings, _ := json.Marshal([]any{pageCacheVersion, c.settings, map[string]string{"languages": languages}})
+	h.Write(settings)
+	h.Write(png)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *pageCache) base(key string) string {
+	return filepath.Join(c.root, key[:2], key)
+}
+
+// load returns the cached page as page n, or nil when it is not cached.
+func (c *pageCache) load(key string, n int) *pageResult {
+	base := c.base(key)
+	data, err := os.ReadFile(base + ".json")
+	if err != nil {
+		return nil
+	}
+	p := &pageResult{source: "reused from the page cache"}
+	if json.Unmarshal(data, &p.stats) != nil {
+		return nil
+	}
+	if p.pdf, err = os.ReadFile(base + ".pdf"); err != nil {
+		return nil
+	}
+	text, err := os.ReadFile(base + ".txt")
+	if err != nil {
+		return nil
+	}
+	p.text = string(text)
+	now := time.Now()
+	for _, ext := range []string{".txt", ".pdf", ".json"} {
+		os.Chtimes(base+ext, now, now) // recently used, see the server's sweep
+	}
+	p.stats.Page = n
+	for i := range p.stats.LowLines {
+		p.stats.LowLines[i].Page = n
+	}
+	if p.stats.Quality != nil {
+		p.stats.Quality.Page = n
+	}
+	c.hits++
+	return p
+}
+
+// store adds a page; a full or read-only cache only costs the reuse.
+func (c *pageCache) store(key string, p *pageResult) {
+	base := c.base(key)
+	stats, err := json.Marshal(p.stats)
+	if err != nil || os.MkdirAll(filepath.Dir(base), 0755) != nil {
+		return
+	}
+	if writeAtomic(base+".pdf", p.pdf) == nil && writeAtomic(base+".json", stats) == nil {
+		writeAtomic(base+".txt", []byte(p.text))
+	}
+}
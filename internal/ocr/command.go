@@ -0,0 +1,72 @@
+package ocr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+)
+
+// Command is an engine that is any program: a shell command run once per
+// page as `sh -c Program sh <image> <page> <languages>`, which prints what
+// it read as JSON,
+//
+//	{"lines": [{"words": [{"text": "…", "confidence": 93.5, "box": [x0, y0, x1, y1]}]}]}
+//
+// with the lines top to bottom and the words of each in reading order, the
+// boxes in pixels of the image. Confidence (0-100) and box may be left out.
+// It is how an engine the server has no support for is tried out, and a
+// stand-in engine for tests.
+type Command struct {
+	Program string
+	Exec    Runner // runs sh, as Options.Exec
+}
+
+func (c *Command) Name() string { return "command" }
+
+func (c *Command) Capabilities() Capabilities { return Capabilities{Confidence: true} }
+
+// commandOutput is what the program prints.
+type commandOutput struct {
+	Lines []struct {
+		Words []struct {
+			Text       string   `json:"text"`
+			Confidence *float64 `json:"confidence"`
+			Box        []int    `json:"box"`
+		} `json:"words"`
+	} `json:"lines"`
+}
+
+func (c *Command) Recognize(ctx context.Context, page Page) (*Recognition, error) {
+	args := []string{"-c", c.Program, "sh", page.Image, strconv.Itoa(page.Number), page.Languages}
+	out, err := runTool(ctx, c.Exec, "engine command", page.Number, "sh", args)
+	if err != nil {
+		return nil, err
+	}
+	var parsed commandOutput
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return nil, fmt.Errorf("reading the engine command's output: %w", err)
+	}
+	rec := &Recognition{}
+	for _, l := range parsed.Lines {
+		var line Line
+		for _, w := range l.Words {
+			word := Word{Text: w.Text, Confidence: -1}
+			if w.Confidence != nil {
+				word.Confidence = int(math.Round(min(max(*w.Confidence, 0), 100)))
+			}
+			if len(w.Box) == 4 {
+				word.Box = image.Rect(w.Box[0], w.Box[1], w.Box[2], w.Box[3])
+			}
+			if word.Text != "" {
+				line = append(line, word)
+			}
+		}
+		if len(line) > 0 {
+			rec.Lines = append(rec.Lines, line)
+		}
+	}
+	return rec, nil
+}
@@ -0,0 +1,60 @@
+package ocr
+
+import (
+	"context"
+	"image"
+)
+
+// Engine recognizes the pages of a run one rendered page image at a time.
+// The run does everything around it: counting and rendering the pages,
+// checkpoints and the page cache, glossary corrections, right-to-left
+// ordering and the result files.
+type Engine interface {
+	// Name is the engine as jobs record it, such as "tesseract".
+	Name() string
+	Capabilities() Capabilities
+	Recognize(ctx context.Context, page Page) (*Recognition, error)
+}
+
+// Capabilities say what an engine does beyond recognizing the words of a
+// page. The run leaves out of Page what the engine would ignore.
+type Capabilities struct {
+	PDF        bool // Recognition.PDF is the page with its text layer; otherwise the run makes it
+	Confidence bool // words come with a confidence
+	Words      bool // recognition can be biased toward the glossary in Page.Words
+	Charset    bool // recognition can be limited to Page.Charset
+}
+
+// Page is one page to recognize.
+type Page struct {
+	Number    int
+	Image     string // PNG of the page
+	DPI       int    // resolution Image was rendered at
+	Languages string // Tesseract language string, such as "eng+fas"
+	Words     string // file of words to bias recognition toward, one per line, or ""
+	Charset   string // characters recognition is limited to, or ""
+	Base      string // path without extension for files of the engine's own; they are removed after the page
+}
+
+// Recognition is what an engine read on a page.
+type Recognition struct {
+	Lines []Line // top to bottom
+	PDF   []byte // with Capabilities.PDF, the one-page PDF with the page's text layer
+}
+
+// Line is a line of text, its words in reading order as Tesseract's hOCR
+// has them; the run reverses those of right-to-left lines for the text.
+type Line []Word
+
+// Word is one recognized word.
+type Word struct {
+	Text       string
+	Confidence int             // 0-100, or -1 without Capabilities.Confidence
+	Box        image.Rectangle // in pixels of the page image, empty when unknown
+}
+
+// versioner is an Engine that can name the version it runs, so the page
+// cache does not hand out pages recognized by another.
+type versioner interface {
+	Version(ctx context.Context) string
+}
@@ -0,0 +1,131 @@
+package ocr
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// glossary is a job's word list: names, technical terms, transliterations.
+// The words are handed to Tesseract as user words to bias recognition, and
+// recognized words are corrected toward them afterwards: a word matching a
+// glossary word once Arabic letter variants and diacritics are folded gets
+// the glossary spelling, and so does a word of four or more letters one
+// edit away from exactly one glossary word.
+type glossary struct {
+	words       map[string]bool
+	path        string              // the words for --user-words
+	exact       map[string]string   // folded key -> word
+	near        map[string][]string // single deletions of keys -> words
+	corrections int
+}
+
+func loadGlossary(path, workDir string) (*glossary, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &glossary{
+		words: map[string]bool{},
+		path:  filepath.Join(workDir, "glossary_words.txt"),
+		exact: map[string]string{},
+		near:  map[string][]string{},
+	}
+	for _, w := range strings.Fields(string(data)) {
+		g.words[w] = true
+	}
+	sorted := make([]string, 0, len(g.words))
+	for w := range g.words {
+		sorted = append(sorted, w)
+	}
+	slices.Sort(sorted)
+	if err := writeAtomic(g.path, []byte(strings.Join(sorted, "\n")+"\n")); err != nil {
+		return nil, err
+	}
+	for _, w := range sorted {
+		g.exact[glossaryKey(w)] = w
+	}
+	for key, w := range g.exact {
+		if utf8.RuneCountInString(key) < 4 {
+			continue
+		}
+		for _, d := range append(deletions(key), key) {
+			if !slices.Contains(g.near[d], w) {
+				g.near[d] = append(g.near[d], w)
+			}
+		}
+	}
+	return g, nil
+}
+
+// correct returns token with its word replaced by the glossary spelling,
+// if there is one, keeping the punctuation around it.
+func (g *glossary) correct(token string) string {
+	lead, word, trail := wordEdges(token)
+	if word == "" || g.words[word] {
+		return token
+	}
+	key := glossaryKey(word)
+	fixed, ok := g.exact[key]
+	if !ok && utf8.RuneCountInString(key) >= 4 {
+		var candidates []string
+		for _, d := range append(deletions(key), key) {
+			for _, w := range g.near[d] {
+				if !slices.Contains(candidates, w) {
+					candidates = append(candidates, w)
+				}
+			}
+		}
+		if len(candidates) == 1 {
+			fixed, ok = candidates[0], true
+		}
+	}
+	if !ok || fixed == word {
+		return token
+	}
+	g.corrections++
+	return lead + fixed + trail
+}
+
+// glossaryFold replaces the Arabic letters commonly typed or recognized in
+// place of Persian ones and drops the marks that do not change a word for
+// matching.
+var glossaryFold = strings.NewReplacer("ي", "ی", "ى", "ی", "ك", "ک", "ة", "ه", "ۀ", "ه",
+	"\u200c", "", "\u200d", "", "\u0640", "")
+
+func glossaryKey(w string) string {
+	w = strings.Map(func(r rune) rune {
+		if 0x064B <= r && r <= 0x065F || r == 0x0670 {
+			return -1
+		}
+		return r
+	}, glossaryFold.Replace(w))
+	return strings.ToLower(w)
+}
+
+// deletions returns w with each of its letters left out in turn.
+func deletions(w string) []string {
+	r := []rune(w)
+	out := make([]string, len(r))
+	for i := range r {
+		out[i] = string(r[:i]) + string(r[i+1:])
+	}
+	return out
+}
+
+// wordEdges splits the punctuation off both ends of a token.
+func wordEdges(token string) (lead, word, trail string) {
+	isWord := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || r == '_'
+	}
+	start := strings.IndexFunc(token, isWord)
+	if start < 0 {
+		return token, "", ""
+	}
+	end := strings.LastIndexFunc(token, isWord)
+	_, size := utf8.DecodeRuneInString(token[end:])
+	return token[:start], token[start : end+size], token[end+size:]
+}
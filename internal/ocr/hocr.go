@@ -0,0 +1,129 @@
+package ocr
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// hocrLineClasses are the hOCR elements holding one line of words.
+var hocrLineClasses = map[string]bool{"ocr_line": true, "ocr_header": true, "ocr_caption": true, "ocr_textfloat": true}
+
+var (
+	wconf = regexp.MustCompile(`x_wconf\s+(\d+)`)
+	bbox  = regexp.MustCompile(`bbox\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)`)
+)
+
+// parseHOCR returns the lines of a page of Tesseract's hOCR, with the
+// words in the order Tesseract gives them, x_wconf as their confidence and
+// their bounding boxes.
+func parseHOCR(data []byte) ([]Line, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	var lines []Line
+	var line Line
+	var word Word
+	var text strings.Builder
+	depth, lineDepth, wordDepth := 0, 0, 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			class, title := "", ""
+			for _, a := range t.Attr {
+				switch a.Name.Local {
+				case "class":
+					class = a.Value
+				case "title":
+					title = a.Value
+				}
+			}
+			switch {
+			case lineDepth == 0 && hocrLineClasses[class]:
+				lineDepth, line = depth, nil
+			case lineDepth > 0 && wordDepth == 0 && (class == "ocrx_word" || class == "ocr_word"):
+				wordDepth, word = depth, Word{Confidence: -1}
+				text.Reset()
+				if m := wconf.FindStringSubmatch(title); m != nil {
+					word.Confidence, _ = strconv.Atoi(m[1])
+				}
+				if m := bbox.FindStringSubmatch(title); m != nil {
+					var c [4]int
+					for i := range c {
+						c[i], _ = strconv.Atoi(m[i+1])
+					}
+					word.Box = image.Rect(c[0], c[1], c[2], c[3])
+				}
+			}
+		case xml.CharData:
+			if wordDepth > 0 {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if depth == wordDepth {
+				if word.Text = strings.TrimSpace(text.String()); word.Text != "" {
+					line = append(line, word)
+				}
+				wordDepth = 0
+			}
+			if depth == lineDepth {
+				if len(line) > 0 {
+					lines = append(lines, line)
+				}
+				lineDepth = 0
+			}
+			depth--
+		}
+	}
+}
+
+// isRTL reports whether r is an Arabic, Persian or Hebrew letter.
+func isRTL(r rune) bool {
+	return 0x0600 <= r && r <= 0x06FF || // Arabic
+		0x0750 <= r && r <= 0x077F || // Arabic Supplement
+		0xFB50 <= r && r <= 0xFDFF || // Arabic Presentation Forms-A
+		0xFE70 <= r && r <= 0xFEFF || // Arabic Presentation Forms-B
+		0x0590 <= r && r <= 0x05FF || // Hebrew
+		0xFB00 <= r && r <= 0xFB4F // Hebrew Presentation Forms
+}
+
+// isRTLWord reports whether most of a word's characters are right to left.
+func isRTLWord(w string) bool {
+	rtl, n := 0, 0
+	for _, r := range w {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		n++
+		if isRTL(r) {
+			rtl++
+		}
+	}
+	return n > 0 && 2*rtl > n
+}
+
+// isRTLLine reports whether most of a line's words are right to left.
+func isRTLLine(words []string) bool {
+	rtl := 0
+	for _, w := range words {
+		if isRTLWord(w) {
+			rtl++
+		}
+	}
+	return len(words) > 0 && 2*rtl > len(words)
+}
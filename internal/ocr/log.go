@@ -0,0 +1,74 @@
+package ocr
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// runLog is the run's log, reported line by line as it is written and
+// saved as <prefix>_rtl_log.txt, with the word counts of the pages.
+type runLog struct {
+	report  func(string)
+	entries []string
+	pages   []pageStats
+
+	totalWords, rtlWords, linesReversed int
+	confidenceSum, confidenceCount      int
+}
+
+func (l *runLog) add(msg string) {
+	entry := "[" + time.Now().Format("15:04:05") + "] " + msg
+	l.entries = append(l.entries, entry)
+	if l.report != nil {
+		l.report(strings.ReplaceAll(entry, "\n", " "))
+	}
+}
+
+// stats counts a finished page; source says where a page not recognized
+// by this run came from.
+func (l *runLog) stats(s pageStats, source string) {
+	l.pages = append(l.pages, s)
+	l.totalWords += s.TotalWords
+	l.rtlWords += s.RTLWords
+	l.linesReversed += s.LinesReversed
+	l.confidenceSum += s.ConfidenceSum
+	l.confidenceCount += s.ConfidenceCount
+	if source != "" {
+		l.add(fmt.Sprintf("Page %d: %s", s.Page, source))
+	} else {
+		l.add(fmt.Sprintf("Page %d: %d words (%d RTL), %d lines reversed", s.Page, s.TotalWords, s.RTLWords, s.LinesReversed))
+	}
+}
+
+// meanConfidence is the mean word confidence of the document.
+func (l *runLog) meanConfidence() *float64 {
+	if l.confidenceCount == 0 {
+		return nil
+	}
+	m := round1(float64(l.confidenceSum) / float64(l.confidenceCount))
+	return &m
+}
+
+func (l *runLog) write(path string) error {
+	var b strings.Builder
+	rule := strings.Repeat("=", 60)
+	fmt.Fprintf(&b, "%s\nOCR RTL LOG\nGenerated: %s\n%s\n\n", rule, time.Now().Format("2006-01-02T15:04:05.000000"), rule)
+	sub := strings.Repeat("-", 40)
+	fmt.Fprintf(&b, "SUMMARY\n%s\n", sub)
+	fmt.Fprintf(&b, "Total words processed: %d\n", l.totalWords)
+	fmt.Fprintf(&b, "RTL words detected: %d\n", l.rtlWords)
+	fmt.Fprintf(&b, "RTL lines reversed: %d\n", l.linesReversed)
+	if l.totalWords > 0 {
+		fmt.Fprintf(&b, "RTL percentage: %.1f%%\n", 100*float64(l.rtlWords)/float64(l.totalWords))
+	}
+	fmt.Fprintf(&b, "\nPAGE DETAILS\n%s\n", sub)
+	for _, s := range l.pages {
+		fmt.Fprintf(&b, "Page %3d: %5d words, %5d RTL, %3d lines reversed\n", s.Page, s.TotalWords, s.RTLWords, s.LinesReversed)
+	}
+	fmt.Fprintf(&b, "\nPROCESSING LOG\n%s\n", sub)
+	for _, e := range l.entries {
+		b.WriteString(e + "\n")
+	}
+	return writeAtomic(path, []byte(b.String()))
+}
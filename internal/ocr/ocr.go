@@ -0,0 +1,542 @@
+// Package ocr makes searchable PDFs and text files out of scanned PDFs, in
+// Go rather than through ocr_python.py: pdfinfo counts the pages, pdftoppm
+// renders them one at a time, an Engine recognizes each, by default one
+// tesseract run per page that makes its hOCR and a one-page PDF, and
+// pdfunite puts the pages together. It writes the files the script writes
+// in its default layout, checkpoints included, so a job interrupted under
+// one can be resumed under the other.
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDPI is the resolution pages are rendered at.
+const DefaultDPI = 300
+
+// LowConfidence is the mean word confidence below which a page is
+// reported: the scan is usually skewed, blurred or too small.
+const LowConfidence = 50
+
+// Options configure one run.
+type Options struct {
+	Languages      string          // Tesseract language string, such as "eng+fas"
+	PageLanguages  []PageLanguages // overrides for ranges of pages
+	Glossary       string          // file of words to bias recognition toward and correct to, optional
+	Charset        string          // characters recognition is limited to, empty for no limit
+	LineConfidence float64         // lines below it are returned in Result.LowLines, 0 for none
+	DPI            int             // DefaultDPI if 0
+	PageTimeout    time.Duration   // time one page may take before it is skipped, 0 for no limit
+	WorkDir        string          // scratch directory for page images, removed by the caller
+	PageCache      string          // directory recognized pages are reused from, empty for none
+	Enhance        bool            // sharpen or stretch the contrast of poor pages before they are recognized, see PageQuality
+
+	Engine     Engine // recognizes the pages, Tesseract if nil
+	PopplerDir string // directory of pdfinfo, pdftoppm and pdfunite, empty to find them in PATH
+
+	// Exec runs Poppler's tools, and the default Tesseract. Nil runs them as
+	// they are; the server sandboxes and limits them.
+	Exec Runner
+
+	// Reports as the run goes; any of them may be nil.
+	Progress func(done, total int)      // pages finished so far
+	Warning  func(page int, msg string) // a page that failed or whose text looks doubtful
+	Log      func(line string)          // each line of the run's log as it is written
+	Event    func(typ, msg string)      // "engine", "resumed" or "cache", for the job's timeline
+}
+
+// PageLanguages overrides the languages of pages First to Last; Last is 0
+// for every page from First on.
+type PageLanguages struct {
+	First, Last int
+	Languages   string
+}
+
+// Result is what a run wrote.
+type Result struct {
+	TextFile string
+	PDFFile  string
+	LogFile  string
+
+	Pages          int
+	MeanConfidence *float64 // 0-100, nil when no words were found
+	FailedPages    []PageFailure
+	LowLines       []LowLine
+	Quality        []PageQuality    // of the pages with ink to rate, in order
+	PageConfidence []PageConfidence // of the pages with words, in order
+}
+
+// PageConfidence is the mean word confidence of a page.
+type PageConfidence struct {
+	Page       int     `json:"page"`
+	Confidence float64 `json:"confidence"`
+}
+
+// PageFailure is a page that could not be rendered or recognized. The rest
+// of the document is still processed.
+type PageFailure struct {
+	Page int
+	Err  error
+}
+
+// LowLine is a line recognized with a mean word confidence below
+// Options.LineConfidence, as it appears in the text.
+type LowLine struct {
+	Page       int     `json:"page"`
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Runner runs one program to the end, its output going to stdout and
+// stderr.
+type Runner func(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error
+
+// ToolError is a tool of the pipeline that failed or could not be started.
+type ToolError struct {
+	Tool   string // "pdfinfo", "pdftoppm", "pdfunite" or the engine's, such as "tesseract"
+	Page   int    // 0 for the document as a whole
+	Stderr string // the last line of its error output
+	Err    error
+}
+
+func (e *ToolError) Error() string {
+	if e.Stderr != "" {
+		return e.Tool + " failed: " + e.Stderr
+	}
+	return e.Tool + " failed: " + e.Err.Error()
+}
+
+func (e *ToolError) Unwrap() error { return e.Err }
+
+// ErrNoPages is returned, wrapped with the failures, when not a single page
+// of the document could be processed.
+var ErrNoPages = errors.New("no page could be processed")
+
+// Run recognizes pdfPath into outputDir, naming the files after prefix:
+// <prefix>.txt, <prefix>.pdf, <prefix>_rtl_log.txt and pages/<n>.txt. A run
+// that fails after some pages leaves them as <prefix>.partial.pdf.
+func Run(ctx context.Context, pdfPath, outputDir, prefix string, opts Options) (*Result, error) {
+	r := &run{opts: opts, log: &runLog{report: opts.Log}}
+	if r.opts.DPI == 0 {
+		r.opts.DPI = DefaultDPI
+	}
+	if r.opts.Engine == nil {
+		r.opts.Engine = &Tesseract{Exec: opts.Exec}
+	}
+	if r.opts.WorkDir == "" {
+		r.opts.WorkDir = outputDir
+	}
+	res, err := r.run(ctx, pdfPath, outputDir, prefix)
+	if err != nil {
+		r.log.add("ERROR: " + err.Error())
+	}
+	return res, err
+}
+
+type run struct {
+	opts        Options
+	caps        Capabilities
+	log         *runLog
+	glossary    *glossary
+	cache       *pageCache
+	resolutions map[int]int // scan DPI by page, see scanResolutions
+}
+
+func (r *run) run(ctx context.Context, pdfPath, outputDir, prefix string) (*Result, error) {
+	o := &r.opts
+	r.caps = o.Engine.Capabilities()
+	r.log.add("OCR process started")
+	r.log.add("Input PDF: " + pdfPath)
+	r.log.add("Engine: " + o.Engine.Name())
+	r.log.add("Languages: " + o.Languages)
+	if len(o.PageLanguages) > 0 {
+		var ranges []string
+		for _, p := range o.PageLanguages {
+			last := ""
+			if p.Last > 0 {
+				last = strconv.Itoa(p.Last)
+			}
+			ranges = append(ranges, fmt.Sprintf("%d-%s=%s", p.First, last, p.Languages))
+		}
+		r.log.add("Page languages: " + strings.Join(ranges, ", "))
+	}
+	r.log.add(fmt.Sprintf("DPI: %d", o.DPI))
+	if o.Glossary != "" {
+		g, err := loadGlossary(o.Glossary, o.WorkDir)
+		if err != nil {
+			return nil, fmt.Errorf("reading the glossary: %w", err)
+		}
+		r.glossary = g
+		r.log.add(fmt.Sprintf("Glossary: %d words", len(g.words)))
+	}
+	if o.Charset != "" {
+		if r.caps.Charset {
+			r.log.add("Character set: " + o.Charset)
+		} else {
+			r.log.add("Character set: " + o.Charset + " (not supported by the engine, the text is not limited to it)")
+		}
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, err
+	}
+	if o.PageCache != "" {
+		r.cache = r.openPageCache(ctx)
+	}
+
+	total, err := r.pageCount(ctx, pdfPath)
+	if err != nil {
+		return nil, err
+	}
+	r.log.add(fmt.Sprintf("PDF has %d pages", total))
+	if r.resolutions, err = r.scanResolutions(ctx, pdfPath); err != nil {
+		r.log.add("Scan resolution unknown: " + err.Error())
+	}
+	r.log.add("Rasterizer: pdftoppm")
+	r.event("engine", o.Engine.Name()+", pages rendered with pdftoppm")
+
+	pagesDir := filepath.Join(outputDir, "pages")
+	if err := os.MkdirAll(pagesDir, 0755); err != nil {
+		return nil, err
+	}
+	r.log.add("Starting HOCR text extraction...")
+
+	var text strings.Builder
+	var failed []PageFailure
+	var lowLines []LowLine
+	var quality []PageQuality
+	var confidence []PageConfidence
+	var finished []string // the page PDFs, in order
+	resumed := 0
+	for n := 1; n <= total; n++ {
+		r.progress(n-1, total)
+		page := checkpoint(pagesDir, n)
+		if page != nil {
+			resumed++
+		} else {
+			page, err = r.page(ctx, pdfPath, n)
+			if err != nil {
+				if ctx.Err() != nil {
+					r.assemblePartial(ctx, finished, filepath.Join(outputDir, prefix+".partial.pdf"))
+					return nil, ctx.Err()
+				}
+				r.log.add(fmt.Sprintf("Page %d could not be processed: %v", n, err))
+				r.warn(n, "the page could not be processed: "+err.Error())
+				failed = append(failed, PageFailure{Page: n, Err: err})
+				fmt.Fprintf(&text, "\n\n--- Page %d ---\n\n[page could not be processed]", n)
+				continue
+			}
+			r.checkPage(page.stats)
+			if err := page.save(pagesDir, n); err != nil {
+				return nil, err
+			}
+		}
+		r.log.stats(page.stats, page.source)
+		for _, l := range page.stats.LowLines {
+			lowLines = append(lowLines, LowLine{Page: n, Text: l.Text, Confidence: l.Confidence})
+		}
+		if q := page.stats.Quality; q != nil {
+			quality = append(quality, *q)
+		}
+		if m := page.stats.MeanConfidence; m != nil {
+			confidence = append(confidence, PageConfidence{Page: n, Confidence: *m})
+		}
+		finished = append(finished, filepath.Join(pagesDir, strconv.Itoa(n)+".pdf"))
+		fmt.Fprintf(&text, "\n\n--- Page %d ---\n\n%s", n, page.text)
+	}
+	r.progress(total, total)
+	if resumed > 0 {
+		r.log.add(fmt.Sprintf("Resumed: %d of %d pages were already done", resumed, total))
+		r.event("resumed", fmt.Sprintf("%d of %d pages were done by an earlier run", resumed, total))
+	}
+	if r.cache != nil && r.cache.hits > 0 {
+		r.log.add(fmt.Sprintf("Page cache: %d of %d pages were reused", r.cache.hits, total))
+		r.event("cache", fmt.Sprintf("%d of %d pages were reused from the page cache", r.cache.hits, total))
+	}
+	if len(failed) == total {
+		var why []string
+		for _, f := range failed {
+			why = append(why, fmt.Sprintf("page %d: %v", f.Page, f.Err))
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNoPages, strings.Join(why, "; "))
+	}
+	r.log.add(fmt.Sprintf("Text extraction complete. %d lines reversed", r.log.linesReversed))
+	if r.glossary != nil {
+		r.log.add(fmt.Sprintf("Glossary corrections: %d", r.glossary.corrections))
+	}
+
+	res := &Result{
+		TextFile:    filepath.Join(outputDir, prefix+".txt"),
+		PDFFile:     filepath.Join(outputDir, prefix+".pdf"),
+		LogFile:     filepath.Join(outputDir, prefix+"_rtl_log.txt"),
+		Pages:       total,
+		FailedPages: failed,
+		LowLines:    lowLines,
+		Quality:     quality,
+
+		PageConfidence: confidence,
+	}
+	if err := writeAtomic(res.TextFile, []byte(text.String())); err != nil {
+		return nil, err
+	}
+	r.log.add("Text saved to: " + res.TextFile)
+
+	partial := filepath.Join(outputDir, prefix+".partial.pdf")
+	if err := r.assemble(ctx, finished, partial); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(partial, res.PDFFile); err != nil {
+		return nil, err
+	}
+	r.log.add("PDF saved to: " + res.PDFFile)
+	if err := r.log.write(res.LogFile); err != nil {
+		return nil, err
+	}
+
+	// The page texts stay for the API; page PDFs and stats were only needed
+	// to resume.
+	for n := 1; n <= total; n++ {
+		os.Remove(filepath.Join(pagesDir, strconv.Itoa(n)+".pdf"))
+		os.Remove(filepath.Join(pagesDir, strconv.Itoa(n)+".json"))
+	}
+	res.MeanConfidence = r.log.meanConfidence()
+	return res, nil
+}
+
+// pageCount asks pdfinfo how many pages the document has.
+func (r *run) pageCount(ctx context.Context, pdfPath string) (int, error) {
+	out, err := r.exec(ctx, "pdfinfo", 0, r.poppler("pdfinfo"), []string{pdfPath})
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if rest, ok := strings.CutPrefix(line, "Pages:"); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(rest))
+			if err != nil || n < 1 {
+				break
+			}
+			return n, nil
+		}
+	}
+	return 0, &ToolError{Tool: "pdfinfo", Err: errors.New("it reported no page count")}
+}
+
+// page renders and recognizes page n, or takes it from the page cache.
+func (r *run) page(ctx context.Context, pdfPath string, n int) (*pageResult, error) {
+	if r.opts.PageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.opts.PageTimeout)
+		defer cancel()
+	}
+	base := filepath.Join(r.opts.WorkDir, "page")
+	image := base + ".png"
+	defer removeFiles(base) // a page image is tens of megabytes
+
+	args := []string{"-r", strconv.Itoa(r.opts.DPI), "-f", strconv.Itoa(n), "-l", strconv.Itoa(n), "-png", "-singlefile", pdfPath, base}
+	if _, err := r.exec(ctx, "pdftoppm", n, r.poppler("pdftoppm"), args); err != nil {
+		return nil, r.pageTimedOut(ctx, err)
+	}
+	languages := r.languages(n)
+	var key string
+	if r.cache != nil {
+		png, err := os.ReadFile(image)
+		if err != nil {
+			return nil, err
+		}
+		key = r.cache.key(png, languages)
+		if p := r.cache.load(key, n); p != nil {
+			return p, nil
+		}
+	}
+
+	quality, err := r.quality(n, image)
+	if err != nil {
+		return nil, err
+	}
+	page := Page{Number: n, Image: image, DPI: r.opts.DPI, Languages: languages, Base: base}
+	if r.glossary != nil && r.caps.Words {
+		page.Words = r.glossary.path
+	}
+	if r.caps.Charset {
+		page.Charset = r.opts.Charset
+	}
+	rec, err := r.opts.Engine.Recognize(ctx, page)
+	if err != nil {
+		return nil, r.pageTimedOut(ctx, err)
+	}
+	if r.glossary != nil {
+		for _, line := range rec.Lines {
+			for i := range line {
+				line[i].Text = r.glossary.correct(line[i].Text)
+			}
+		}
+	}
+	p := &pageResult{pdf: rec.PDF}
+	if !r.caps.PDF || p.pdf == nil {
+		if p.pdf, err = textPDF(image, r.opts.DPI, rec.Lines); err != nil {
+			return nil, fmt.Errorf("making the page's PDF: %w", err)
+		}
+	}
+	p.text, p.stats = r.pageText(n, rec.Lines)
+	p.stats.Quality = quality
+	if r.cache != nil {
+		r.cache.store(key, p)
+	}
+	return p, nil
+}
+
+// quality scores the rendered page n, and enhances a poor one if the run
+// is to. A page image that cannot be decoded is left unscored; the engine
+// may still read it.
+func (r *run) quality(n int, image string) (*PageQuality, error) {
+	g, err := readGrayPage(image)
+	if err != nil {
+		return nil, nil
+	}
+	q := scoreQuality(g, r.opts.DPI, r.resolutions[n])
+	if q == nil {
+		return nil, nil
+	}
+	q.Page = n
+	scan := ""
+	if q.Resolution > 0 {
+		scan = fmt.Sprintf(", scanned at %d DPI", q.Resolution)
+	}
+	r.log.add(fmt.Sprintf("Page %d scan: sharpness %g, contrast %g%s", n, q.Sharpness, q.Contrast, scan))
+	if q.Poor() && r.opts.Enhance {
+		if q.Enhanced, err = g.enhance(q, image); err != nil {
+			return nil, fmt.Errorf("enhancing the page: %w", err)
+		}
+	}
+	return q, nil
+}
+
+// removeFiles removes the files of a page, base and an extension.
+func removeFiles(base string) {
+	files, _ := filepath.Glob(base + ".*")
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// pageTimedOut names the page timeout as the reason a tool was killed.
+func (r *run) pageTimedOut(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && r.opts.PageTimeout > 0 {
+		return fmt.Errorf("the page took longer than %s", r.opts.PageTimeout)
+	}
+	return err
+}
+
+// languages returns the language string for page n.
+func (r *run) languages(n int) string {
+	for _, p := range r.opts.PageLanguages {
+		if p.First <= n && (p.Last == 0 || n <= p.Last) {
+			return p.Languages
+		}
+	}
+	return r.opts.Languages
+}
+
+// checkPage reports a page whose recognition looks doubtful.
+func (r *run) checkPage(s pageStats) {
+	if s.Quality != nil && s.Quality.Poor() {
+		r.warn(s.Page, s.Quality.describe())
+	}
+	switch {
+	case s.TotalWords == 0:
+		r.warn(s.Page, "no text was found on this page")
+	case s.MeanConfidence != nil && *s.MeanConfidence < LowConfidence:
+		r.warn(s.Page, fmt.Sprintf("low recognition confidence (%g%%); the scan may be skewed, blurred or too small", *s.MeanConfidence))
+	}
+}
+
+// assemble joins the page PDFs into dest.
+func (r *run) assemble(ctx context.Context, pages []string, dest string) error {
+	_, err := r.exec(ctx, "pdfunite", 0, r.poppler("pdfunite"), append(append([]string{}, pages...), dest))
+	return err
+}
+
+// assemblePartial leaves the pages a stopped run finished in dest. The
+// run's context is done by then, so pdfunite gets a little time of its own.
+func (r *run) assemblePartial(ctx context.Context, pages []string, dest string) {
+	if len(pages) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	if err := r.assemble(ctx, pages, dest); err != nil {
+		os.Remove(dest)
+	}
+}
+
+func (r *run) poppler(tool string) string {
+	if r.opts.PopplerDir == "" {
+		return tool
+	}
+	return filepath.Join(r.opts.PopplerDir, tool)
+}
+
+// exec runs one of Poppler's tools and returns its standard output.
+func (r *run) exec(ctx context.Context, tool string, page int, name string, args []string) ([]byte, error) {
+	return runTool(ctx, r.opts.Exec, tool, page, name, args)
+}
+
+// runTool runs a program with run, or as it is when run is nil, and
+// returns its standard output. A failure is a ToolError naming tool.
+func runTool(ctx context.Context, run Runner, tool string, page int, name string, args []string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	var err error
+	if run != nil {
+		err = run(ctx, name, args, &stdout, &stderr)
+	} else {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err = cmd.Run()
+	}
+	if err != nil {
+		return nil, &ToolError{Tool: tool, Page: page, Stderr: lastLine(stderr.String()), Err: err}
+	}
+	return stdout.Bytes(), nil
+}
+
+func (r *run) progress(done, total int) {
+	if r.opts.Progress != nil {
+		r.opts.Progress(done, total)
+	}
+}
+
+func (r *run) warn(page int, msg string) {
+	if r.opts.Warning != nil {
+		r.opts.Warning(page, msg)
+	}
+}
+
+func (r *run) event(typ, msg string) {
+	if r.opts.Event != nil {
+		r.opts.Event(typ, msg)
+	}
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// writeAtomic writes data to path through a temporary file, so readers
+// never see half of it. The files stay readable by the sandbox user.
+func writeAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
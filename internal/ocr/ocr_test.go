@@ -0,0 +1,165 @@
+package ocr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// stubEngine reads the same two lines on every page, one of them
+// right-to-left, and fails the pages in fail.
+type stubEngine struct {
+	fail  map[int]error
+	pages []Page
+}
+
+func (e *stubEngine) Name() string               { return "stub" }
+func (e *stubEngine) Capabilities() Capabilities { return Capabilities{Confidence: true} }
+
+func (e *stubEngine) Recognize(ctx context.Context, page Page) (*Recognition, error) {
+	e.pages = append(e.pages, page)
+	if err := e.fail[page.Number]; err != nil {
+		return nil, err
+	}
+	return &Recognition{Lines: []Line{
+		{{Text: "hello", Confidence: 90}, {Text: "page", Confidence: 80}},
+		{{Text: "سلام", Confidence: 70}, {Text: "دنیا", Confidence: 70}},
+	}}, nil
+}
+
+// fakePoppler stands in for Poppler's tools on a document of blank pages,
+// as many as pages: pdftoppm renders a small white PNG and pdfunite
+// concatenates.
+func fakePoppler(pages int) Runner {
+	return func(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error {
+		switch filepath.Base(name) {
+		case "pdfinfo":
+			fmt.Fprintf(stdout, "Title: test\nPages: %d\n", pages)
+		case "pdfimages":
+		case "pdftoppm":
+			img := image.NewGray(image.Rect(0, 0, 40, 40))
+			for i := range img.Pix {
+				img.Pix[i] = 0xff
+			}
+			f, err := os.Create(args[len(args)-1] + ".png")
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return png.Encode(f, img)
+		case "pdfunite":
+			var out []byte
+			for _, p := range args[:len(args)-1] {
+				data, err := os.ReadFile(p)
+				if err != nil {
+					return err
+				}
+				out = append(out, data...)
+			}
+			return os.WriteFile(args[len(args)-1], out, 0644)
+		default:
+			return fmt.Errorf("unexpected tool %s", name)
+		}
+		return nil
+	}
+}
+
+func runStub(t *testing.T, pages int, e *stubEngine, warnings *[]int) (*Result, string, error) {
+	t.Helper()
+	out := t.TempDir()
+	res, err := Run(context.Background(), "in.pdf", out, "doc", Options{
+		Languages: "eng+fas",
+		Charset:   "0123456789",
+		Engine:    e,
+		Exec:      fakePoppler(pages),
+		WorkDir:   t.TempDir(),
+		Warning:   func(page int, msg string) { *warnings = append(*warnings, page) },
+	})
+	return res, out, err
+}
+
+func TestRunEngine(t *testing.T) {
+	e := &stubEngine{}
+	var warnings []int
+	res, out, err := runStub(t, 2, e, &warnings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Pages != 2 || len(res.FailedPages) != 0 || len(warnings) != 0 {
+		t.Errorf("Run = %d pages, failed %v, warnings on %v; want 2 pages without failures", res.Pages, res.FailedPages, warnings)
+	}
+	if res.MeanConfidence == nil || *res.MeanConfidence != 77.5 {
+		t.Errorf("MeanConfidence = %v, want 77.5", res.MeanConfidence)
+	}
+	if len(e.pages) != 2 {
+		t.Fatalf("engine saw %d pages, want 2", len(e.pages))
+	}
+	for i, p := range e.pages {
+		if p.Number != i+1 || p.DPI != DefaultDPI || p.Languages != "eng+fas" || p.Charset != "" || p.Image == "" {
+			t.Errorf("engine got %+v for page %d; the charset should be left out for an engine without it", p, i+1)
+		}
+	}
+
+	text, err := os.ReadFile(res.TextFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"--- Page 1 ---", "--- Page 2 ---", "hello page", "دنیا سلام"} {
+		if !strings.Contains(string(text), want) {
+			t.Errorf("text %q lacks %q", text, want)
+		}
+	}
+	if _, err := os.Stat(res.PDFFile); err != nil {
+		t.Errorf("searchable PDF: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "pages", "2.txt")); err != nil {
+		t.Errorf("page text: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "pages", "2.pdf")); !os.IsNotExist(err) {
+		t.Errorf("page PDF left behind after the run: %v", err)
+	}
+}
+
+var errStub = errors.New("stub engine failed")
+
+func TestRunEngineError(t *testing.T) {
+	e := &stubEngine{fail: map[int]error{2: errStub}}
+	var warnings []int
+	res, _, err := runStub(t, 3, e, &warnings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.FailedPages) != 1 || res.FailedPages[0].Page != 2 || !errors.Is(res.FailedPages[0].Err, errStub) {
+		t.Errorf("FailedPages = %v, want page 2 with the engine's error", res.FailedPages)
+	}
+	if !slices.Equal(warnings, []int{2}) {
+		t.Errorf("warnings on pages %v, want [2]", warnings)
+	}
+	text, err := os.ReadFile(res.TextFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(text), "--- Page 2 ---\n\n[page could not be processed]") || !strings.Contains(string(text), "--- Page 3 ---") {
+		t.Errorf("text %q does not mark page 2 as failed and go on", text)
+	}
+}
+
+func TestRunEngineErrorEveryPage(t *testing.T) {
+	e := &stubEngine{fail: map[int]error{1: errStub, 2: errStub}}
+	var warnings []int
+	res, _, err := runStub(t, 2, e, &warnings)
+	if !errors.Is(err, ErrNoPages) || res != nil {
+		t.Errorf("Run = %v, %v; want ErrNoPages", res, err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "page 2: "+errStub.Error()) {
+		t.Errorf("error %q does not name the pages' failures", err)
+	}
+}
@@ -0,0 +1,137 @@
+package ocr
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// pageResult is one recognized page.
+type pageResult struct {
+	text   string
+	pdf    []byte // nil for a checkpoint, whose PDF stays in pages/
+	stats  pageStats
+	source string // where an earlier recognition came from, for the log
+}
+
+// pageStats are the counts of a page, in the JSON of ocr_python.py's
+// checkpoints and page cache entries.
+type pageStats struct {
+	Page            int       `json:"page"`
+	TotalWords      int       `json:"total_words"`
+	RTLWords        int       `json:"rtl_words"`
+	LinesReversed   int       `json:"lines_reversed"`
+	MeanConfidence  *float64  `json:"mean_confidence"`
+	ConfidenceSum   int       `json:"confidence_sum"`
+	ConfidenceCount int       `json:"confidence_count"`
+	LowLines        []LowLine `json:"low_lines,omitempty"`
+
+	Quality *PageQuality `json:"quality,omitempty"` // nil for a blank page or one an earlier version did
+}
+
+// pageText puts the recognized lines of page n together: one text line per
+// line, with the words of right-to-left lines in reverse order so the text
+// reads left to right.
+func (r *run) pageText(n int, lines []Line) (string, pageStats) {
+	s := pageStats{Page: n}
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		words, confident := r.words(line)
+		for _, w := range words {
+			s.TotalWords++
+			if isRTLWord(w) {
+				s.RTLWords++
+			}
+		}
+		if isRTLLine(words) {
+			slices.Reverse(words)
+			s.LinesReversed++
+		}
+		out = append(out, strings.Join(words, " "))
+
+		if len(confident) == 0 {
+			continue
+		}
+		sum := 0
+		for _, w := range confident {
+			s.ConfidenceSum += w.Confidence
+			sum += w.Confidence
+		}
+		s.ConfidenceCount += len(confident)
+		mean := round1(float64(sum) / float64(len(confident)))
+		if r.opts.LineConfidence > 0 && mean < r.opts.LineConfidence {
+			texts := make([]string, len(confident))
+			for i, w := range confident {
+				texts[i] = w.Text
+			}
+			if isRTLLine(texts) {
+				slices.Reverse(texts)
+			}
+			s.LowLines = append(s.LowLines, LowLine{Page: n, Text: strings.Join(texts, " "), Confidence: mean})
+		}
+	}
+	if s.ConfidenceCount > 0 {
+		m := round1(float64(s.ConfidenceSum) / float64(s.ConfidenceCount))
+		s.MeanConfidence = &m
+	}
+	return strings.Join(out, "\n"), s
+}
+
+// words returns the words of a line, and those of them with a confidence.
+func (r *run) words(line Line) ([]string, []Word) {
+	words := make([]string, len(line))
+	var confident []Word
+	for i, w := range line {
+		words[i] = w.Text
+		if w.Confidence >= 0 {
+			confident = append(confident, w)
+		}
+	}
+	return words, confident
+}
+
+func round1(x float64) float64 { return math.Round(x*10) / 10 }
+
+// checkpoint returns page n as an earlier run left it under dir, or nil
+// when the page still has to be done.
+func checkpoint(dir string, n int) *pageResult {
+	base := filepath.Join(dir, strconv.Itoa(n))
+	if _, err := os.Stat(base + ".pdf"); err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(base + ".json")
+	if err != nil {
+		return nil
+	}
+	p := &pageResult{source: "done by an earlier run"}
+	if json.Unmarshal(data, &p.stats) != nil {
+		return nil
+	}
+	text, err := os.ReadFile(base + ".txt")
+	if err != nil {
+		return nil
+	}
+	p.text = string(text)
+	return p
+}
+
+// save checkpoints the page under dir: its PDF, its stats and then its
+// text, so pages/<n>.txt existing means the whole page is done.
+func (p *pageResult) save(dir string, n int) error {
+	base := filepath.Join(dir, strconv.Itoa(n))
+	stats, err := json.Marshal(p.stats)
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(base+".pdf", p.pdf); err != nil {
+		return err
+	}
+	if err := writeAtomic(base+".json", stats); err != nil {
+		return err
+	}
+	return writeAtomic(base+".txt", []byte(p.text))
+}
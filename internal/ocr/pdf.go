@@ -0,0 +1,183 @@
+package ocr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// Tesseract writes the invisible text of right-to-left lines in the order
+// of its hOCR, so fixPDFRTL reverses the TJ arrays holding right-to-left
+// text in the page's content streams, as ocr_python.py does, and text
+// selected in a viewer comes out in the order of the text file.
+
+var (
+	firstObj   = regexp.MustCompile(`\n\d+ \d+ obj\b`)
+	objHeader  = regexp.MustCompile(`^(\d+) (\d+) obj\b`)
+	streamKey  = regexp.MustCompile(`stream\r?\n`)
+	lengthKey  = regexp.MustCompile(`/Length (\d+)(\s+\d+\s+R)?`)
+	endObj     = []byte("endobj")
+	tjArray    = regexp.MustCompile(`(?s)\[(.*?)\]\s*TJ`)
+	tjElement  = regexp.MustCompile(`<[0-9A-Fa-f]+>|-?\d+\.?\d*`)
+	trailerKey = regexp.MustCompile(`(?s)trailer\s*(<<.*?>>)\s*startxref`)
+)
+
+// fixPDFRTL returns the one-page PDF with its right-to-left TJ arrays
+// reversed and a cross-reference table for the new offsets. A PDF it
+// cannot follow, such as one with indirect stream lengths or an xref
+// stream, is returned as it is.
+func fixPDFRTL(pdf []byte) []byte {
+	first := firstObj.FindIndex(pdf)
+	trailer := trailerKey.FindSubmatch(pdf)
+	if first == nil || trailer == nil {
+		return pdf
+	}
+	out := bytes.NewBuffer(slices.Clone(pdf[:first[0]+1]))
+	offsets := map[int]int{}
+	changed := false
+	p := first[0] + 1
+	for {
+		for p < len(pdf) && isSpace(pdf[p]) {
+			p++
+		}
+		m := objHeader.FindSubmatch(pdf[p:])
+		if m == nil {
+			break
+		}
+		num, _ := strconv.Atoi(string(m[1]))
+		obj, next, fixed, ok := fixObject(pdf, p)
+		if !ok {
+			return pdf
+		}
+		changed = changed || fixed
+		offsets[num] = out.Len()
+		out.Write(obj)
+		out.WriteByte('\n')
+		p = next
+	}
+	if !changed || len(offsets) == 0 {
+		return pdf
+	}
+
+	size := slices.Max(slices.Collect(maps.Keys(offsets))) + 1
+	xref := out.Len()
+	fmt.Fprintf(out, "xref\n0 %d\n0000000000 65535 f \n", size)
+	for n := 1; n < size; n++ {
+		if off, ok := offsets[n]; ok {
+			fmt.Fprintf(out, "%010d 00000 n \n", off)
+		} else {
+			out.WriteString("0000000000 65535 f \n")
+		}
+	}
+	fmt.Fprintf(out, "trailer\n%s\nstartxref\n%d\n%%%%EOF\n", trailer[1], xref)
+	return out.Bytes()
+}
+
+// fixObject returns the object starting at p, with its content stream
+// fixed if it has one, and the offset after it.
+func fixObject(pdf []byte, p int) (obj []byte, next int, fixed, ok bool) {
+	end := bytes.Index(pdf[p:], endObj)
+	if end < 0 {
+		return nil, 0, false, false
+	}
+	s := streamKey.FindIndex(pdf[p : p+end])
+	if s == nil {
+		return pdf[p : p+end+len(endObj)], p + end + len(endObj), false, true
+	}
+	dict := pdf[p : p+s[0]]
+	l := lengthKey.FindSubmatch(dict)
+	if l == nil || l[2] != nil {
+		return nil, 0, false, false
+	}
+	n, _ := strconv.Atoi(string(l[1]))
+	start := p + s[1]
+	if start+n > len(pdf) {
+		return nil, 0, false, false
+	}
+	end = bytes.Index(pdf[start+n:], endObj)
+	if end < 0 {
+		return nil, 0, false, false
+	}
+	next = start + n + end + len(endObj)
+	whole := pdf[p:next]
+
+	data := pdf[start : start+n]
+	flate := bytes.Contains(dict, []byte("/FlateDecode"))
+	if flate {
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return whole, next, false, true
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return whole, next, false, true
+		}
+	}
+	if !bytes.Contains(data, []byte("TJ")) {
+		return whole, next, false, true
+	}
+	content := fixContentStream(data)
+	if bytes.Equal(content, data) {
+		return whole, next, false, true
+	}
+	if flate {
+		var b bytes.Buffer
+		zw := zlib.NewWriter(&b)
+		zw.Write(content)
+		zw.Close()
+		content = b.Bytes()
+	}
+	var o bytes.Buffer
+	o.Write(lengthKey.ReplaceAll(dict, []byte("/Length "+strconv.Itoa(len(content)))))
+	o.Write(pdf[p+s[0] : start]) // "stream" and its line end
+	o.Write(content)
+	o.Write(pdf[start+n : next])
+	return o.Bytes(), next, true, true
+}
+
+// fixContentStream reverses the elements of the TJ arrays that hold mostly
+// right-to-left text.
+func fixContentStream(content []byte) []byte {
+	return tjArray.ReplaceAllFunc(content, func(m []byte) []byte {
+		inner := tjArray.FindSubmatch(m)[1]
+		elems := tjElement.FindAll(inner, -1)
+		rtl := false
+		for _, e := range elems {
+			if e[0] == '<' && isRTLHex(e[1:len(e)-1]) {
+				rtl = true
+				break
+			}
+		}
+		if !rtl {
+			return m
+		}
+		slices.Reverse(elems)
+		return append(append([]byte("["), bytes.Join(elems, []byte(" "))...), "] TJ"...)
+	})
+}
+
+// isRTLHex reports whether most of the non-ASCII characters of a string of
+// UTF-16 code units in hex are right to left; the Hebrew presentation
+// forms are not counted.
+func isRTLHex(h []byte) bool {
+	rtl, total := 0, 0
+	for i := 0; i+4 <= len(h); i += 4 {
+		code, err := strconv.ParseUint(string(h[i:i+4]), 16, 16)
+		if err != nil || code <= 0x7F {
+			continue
+		}
+		total++
+		if isRTL(rune(code)) && (code < 0xFB00 || code > 0xFB4F) {
+			rtl++
+		}
+	}
+	return total > 0 && 2*rtl > total
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
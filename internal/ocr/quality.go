@@ -0,0 +1,267 @@
+package ocr
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A page scoring below these is likely too poor to recognize well and is
+// reported before it is recognized.
+const (
+	PoorSharpness  = 40  // ink edges blurred over more than about half a millimetre
+	PoorContrast   = 25  // ink a quarter of the way from the paper to black
+	PoorResolution = 150 // DPI of the scanned image
+)
+
+// PageQuality rates a page's scan from its rendered image. The scores are
+// rough: they tell a page worth scanning again from one worth recognizing,
+// not one good scan from another.
+type PageQuality struct {
+	Page       int      `json:"page"`
+	Sharpness  float64  `json:"sharpness"`            // 0-100, how crisp the edges of the ink are
+	Contrast   float64  `json:"contrast"`             // 0-100, how far the ink stands out from the paper
+	Resolution int      `json:"resolution,omitempty"` // DPI the page was scanned at, 0 when unknown or not scanned
+	Problems   []string `json:"problems,omitempty"`   // "blurred", "low contrast" or "low resolution"
+	Enhanced   bool     `json:"enhanced,omitempty"`   // sharpened or stretched before it was recognized, see Options.Enhance
+}
+
+// Poor says whether the page is likely too poor to recognize.
+func (q *PageQuality) Poor() bool { return len(q.Problems) > 0 }
+
+// grayPage is a page image as 8-bit luminance, row by row.
+type grayPage struct {
+	pix  []uint8
+	w, h int
+}
+
+func readGrayPage(path string) (*grayPage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	g := &grayPage{pix: make([]uint8, b.Dx()*b.Dy()), w: b.Dx(), h: b.Dy()}
+	switch m := img.(type) {
+	case *image.Gray:
+		for y := 0; y < g.h; y++ {
+			copy(g.pix[y*g.w:(y+1)*g.w], m.Pix[y*m.Stride:])
+		}
+	case *image.RGBA:
+		// pdftoppm's colour pages, which are opaque.
+		for y := 0; y < g.h; y++ {
+			row := m.Pix[y*m.Stride:]
+			for x := 0; x < g.w; x++ {
+				r, gr, bl := int(row[4*x]), int(row[4*x+1]), int(row[4*x+2])
+				g.pix[y*g.w+x] = uint8((299*r + 587*gr + 114*bl) / 1000)
+			}
+		}
+	default:
+		for y := 0; y < g.h; y++ {
+			for x := 0; x < g.w; x++ {
+				r, gr, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				g.pix[y*g.w+x] = uint8((299*r + 587*gr + 114*bl) / 1000 / 257)
+			}
+		}
+	}
+	return g, nil
+}
+
+// levels splits the page into ink and paper at the Otsu threshold of its
+// histogram and returns the mean luminance of each.
+func (g *grayPage) levels() (ink, paper float64) {
+	var hist [256]int
+	for _, v := range g.pix {
+		hist[v]++
+	}
+	total := len(g.pix)
+	sumAll := 0
+	for v, n := range hist {
+		sumAll += v * n
+	}
+	best := -1.0
+	below, sumBelow := 0, 0
+	for t := 0; t < 255; t++ {
+		below += hist[t]
+		sumBelow += t * hist[t]
+		above := total - below
+		if below == 0 || above == 0 {
+			continue
+		}
+		m0 := float64(sumBelow) / float64(below)
+		m1 := float64(sumAll-sumBelow) / float64(above)
+		if between := float64(below) * float64(above) * (m1 - m0) * (m1 - m0); between > best {
+			best, ink, paper = between, m0, m1
+		}
+	}
+	return ink, paper
+}
+
+// scoreQuality rates a page image rendered at dpi from a scan of
+// resolution DPI (0 when unknown). It returns nil for a blank page,
+// which has no ink to rate.
+func scoreQuality(g *grayPage, dpi, resolution int) *PageQuality {
+	ink, paper := g.levels()
+	span := paper - ink
+	if span < 8 {
+		return nil
+	}
+	q := &PageQuality{Contrast: round1(100 * span / 255), Resolution: resolution}
+
+	// The steepest ink edges, relative to the contrast, give the width of
+	// the blur: a clean edge steps from paper to ink within a pixel or two
+	// at 300 DPI, a blurred one ramps over many.
+	var hist [256]int
+	edges := 0
+	floor := int(span / 10)
+	for y := 1; y < g.h-1; y++ {
+		row := y * g.w
+		for x := 1; x < g.w-1; x++ {
+			dx := int(g.pix[row+x+1]) - int(g.pix[row+x-1])
+			dy := int(g.pix[row+x+g.w]) - int(g.pix[row+x-g.w])
+			grad := (abs(dx) + abs(dy)) / 2
+			if grad > floor {
+				hist[min(grad, 255)]++
+				edges++
+			}
+		}
+	}
+	steep, seen := 0, 0
+	for v := 255; v >= 0 && edges > 0; v-- {
+		if seen += hist[v]; seen*2 >= edges {
+			steep = v
+			break
+		}
+	}
+	q.Sharpness = round1(min(100, 200*float64(steep)/span*float64(dpi)/300))
+
+	if q.Sharpness < PoorSharpness {
+		q.Problems = append(q.Problems, "blurred")
+	}
+	if q.Contrast < PoorContrast {
+		q.Problems = append(q.Problems, "low contrast")
+	}
+	if resolution > 0 && resolution < PoorResolution {
+		q.Problems = append(q.Problems, "low resolution")
+	}
+	return q
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// enhance stretches the contrast of a faded page and sharpens a blurred
+// one, and writes it back to path as a grayscale PNG. A low resolution is
+// left alone: the detail the scan lacks cannot be made up.
+func (g *grayPage) enhance(q *PageQuality, path string) (bool, error) {
+	faded := slices.Contains(q.Problems, "low contrast")
+	blurred := slices.Contains(q.Problems, "blurred")
+	if !faded && !blurred {
+		return false, nil
+	}
+	if faded {
+		ink, paper := g.levels()
+		for i, v := range g.pix {
+			g.pix[i] = clamp255((float64(v) - ink) * 255 / (paper - ink))
+		}
+	}
+	if blurred {
+		// An unsharp mask over a 3x3 box blur.
+		src := append([]uint8(nil), g.pix...)
+		for y := 1; y < g.h-1; y++ {
+			for x := 1; x < g.w-1; x++ {
+				i := y*g.w + x
+				sum := 0
+				for _, j := range [...]int{i - g.w - 1, i - g.w, i - g.w + 1, i - 1, i, i + 1, i + g.w - 1, i + g.w, i + g.w + 1} {
+					sum += int(src[j])
+				}
+				v := float64(src[i])
+				g.pix[i] = clamp255(v + 1.5*(v-float64(sum)/9))
+			}
+		}
+	}
+	img := &image.Gray{Pix: g.pix, Stride: g.w, Rect: image.Rect(0, 0, g.w, g.h)}
+	f, err := os.Create(path)
+	if err != nil {
+		return false, err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return false, err
+	}
+	return true, f.Close()
+}
+
+func clamp255(v float64) uint8 {
+	return uint8(min(max(v+0.5, 0), 255))
+}
+
+// Reasons are the problems of the page with the scores behind them, such
+// as "blurred (sharpness 22.5)".
+func (q *PageQuality) Reasons() []string {
+	var why []string
+	for _, p := range q.Problems {
+		switch p {
+		case "blurred":
+			why = append(why, fmt.Sprintf("blurred (sharpness %g)", q.Sharpness))
+		case "low contrast":
+			why = append(why, fmt.Sprintf("low contrast (%g)", q.Contrast))
+		case "low resolution":
+			why = append(why, fmt.Sprintf("low resolution (%d DPI)", q.Resolution))
+		}
+	}
+	return why
+}
+
+// describe is the warning for a poor page.
+func (q *PageQuality) describe() string {
+	msg := "the scan may be too poor to recognize: " + strings.Join(q.Reasons(), ", ")
+	if q.Enhanced {
+		msg += "; the page was enhanced before recognition"
+	}
+	return msg
+}
+
+// scanResolutions asks pdfimages for the resolution each page was scanned
+// at: that of its largest image. Pages without images are left out.
+func (r *run) scanResolutions(ctx context.Context, pdfPath string) (map[int]int, error) {
+	out, err := r.exec(ctx, "pdfimages", 0, r.poppler("pdfimages"), []string{"-list", pdfPath})
+	if err != nil {
+		return nil, err
+	}
+	res := map[int]int{}
+	area := map[int]int{}
+	// page num type width height color comp bpc enc interp object ID x-ppi y-ppi size ratio
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 14 || f[2] != "image" {
+			continue
+		}
+		page, err1 := strconv.Atoi(f[0])
+		w, err2 := strconv.Atoi(f[3])
+		h, err3 := strconv.Atoi(f[4])
+		x, err4 := strconv.Atoi(f[12])
+		y, err5 := strconv.Atoi(f[13])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil {
+			continue
+		}
+		if w*h > area[page] {
+			area[page], res[page] = w*h, min(x, y)
+		}
+	}
+	return res, nil
+}
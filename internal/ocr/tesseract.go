@@ -0,0 +1,68 @@
+package ocr
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Tesseract is the default engine: one tesseract run per page, reading its
+// hOCR for the text and keeping the PDF it makes alongside.
+type Tesseract struct {
+	Command string // "tesseract" if empty
+	Exec    Runner // runs the command, as Options.Exec
+}
+
+func (t *Tesseract) Name() string { return "tesseract" }
+
+func (t *Tesseract) Capabilities() Capabilities {
+	return Capabilities{PDF: true, Confidence: true, Words: true, Charset: true}
+}
+
+func (t *Tesseract) command() string {
+	if t.Command == "" {
+		return "tesseract"
+	}
+	return t.Command
+}
+
+func (t *Tesseract) Recognize(ctx context.Context, page Page) (*Recognition, error) {
+	args := []string{page.Image, page.Base, "-l", page.Languages, "--dpi", strconv.Itoa(page.DPI)}
+	if page.Words != "" {
+		args = append(args, "--user-words", page.Words)
+	}
+	if page.Charset != "" {
+		args = append(args, "-c", "tessedit_char_whitelist="+page.Charset)
+	}
+	// One run makes both: ocr_python.py recognizes every page twice.
+	args = append(args, "hocr", "pdf")
+	if _, err := runTool(ctx, t.Exec, "tesseract", page.Number, t.command(), args); err != nil {
+		return nil, err
+	}
+	hocr, err := os.ReadFile(page.Base + ".hocr")
+	if err != nil {
+		return nil, err
+	}
+	pdf, err := os.ReadFile(page.Base + ".pdf")
+	if err != nil {
+		return nil, err
+	}
+	lines, err := parseHOCR(hocr)
+	if err != nil {
+		return nil, fmt.Errorf("reading tesseract's hOCR: %w", err)
+	}
+	return &Recognition{Lines: lines, PDF: fixPDFRTL(pdf)}, nil
+}
+
+// Version returns the first line of tesseract --version, or "" when it
+// cannot be run.
+func (t *Tesseract) Version(ctx context.Context) string {
+	out, err := runTool(ctx, t.Exec, "tesseract", 0, t.command(), []string{"--version"})
+	if err != nil {
+		return ""
+	}
+	first, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(first)
+}
@@ -0,0 +1,122 @@
+package ocr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png" // pdftoppm's page images
+	"os"
+	"slices"
+	"unicode/utf16"
+)
+
+// textPDF makes the one-page PDF of an engine that does not make its own:
+// the page image, with the recognized words as invisible text over it so
+// they can be searched and selected. Each word is scaled to its box; words
+// without one, or characters outside the Basic Multilingual Plane, are left
+// out of the text layer but not out of the text file.
+func textPDF(imagePath string, dpi int, lines []Line) ([]byte, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	colors := "/DeviceRGB"
+	if _, ok := img.(*image.Gray); ok {
+		colors = "/DeviceGray"
+	}
+	size := img.Bounds().Size()
+	pt := func(px int) float64 { return float64(px) * 72 / float64(dpi) }
+	width, height := pt(size.X), pt(size.Y)
+
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "q %.2f 0 0 %.2f 0 0 cm /Im1 Do Q\nBT 3 Tr\n", width, height)
+	for _, line := range lines {
+		texts := make([]string, len(line))
+		for i, w := range line {
+			texts[i] = w.Text
+		}
+		words := slices.Clone(line)
+		if isRTLLine(texts) {
+			slices.Reverse(words) // selected text comes out in reading order
+		}
+		for _, w := range words {
+			code := pdfHexText(w.Text)
+			if w.Box.Empty() || code == "" {
+				continue
+			}
+			fontSize := pt(w.Box.Dy())
+			scale := 100 * pt(w.Box.Dx()) / (float64(len(code)/4) * 0.5 * fontSize)
+			fmt.Fprintf(&content, "/F1 %.2f Tf %.2f Tz 1 0 0 1 %.2f %.2f Tm <%s> Tj\n",
+				fontSize, scale, pt(w.Box.Min.X), height-pt(w.Box.Max.Y), code)
+		}
+	}
+	content.WriteString("ET\n")
+
+	var cmap bytes.Buffer
+	cmap.WriteString("/CIDInit /ProcSet findresource begin 12 dict begin begincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def /CMapType 2 def\n" +
+		"1 begincodespacerange <0000> <FFFF> endcodespacerange\n")
+	// A bfrange may only vary in its last byte, hence one per high byte.
+	for _, block := range [][2]int{{0x00, 0x64}, {0x64, 0xC8}, {0xC8, 0x100}} {
+		fmt.Fprintf(&cmap, "%d beginbfrange\n", block[1]-block[0])
+		for hi := block[0]; hi < block[1]; hi++ {
+			fmt.Fprintf(&cmap, "<%02X00> <%02XFF> <%02X00>\n", hi, hi, hi)
+		}
+		cmap.WriteString("endbfrange\n")
+	}
+	cmap.WriteString("endcmap CMapName currentdict /CMap defineresource pop end end\n")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im1 4 0 R >> /Font << /F1 5 0 R >> >> /Contents 6 0 R >>", width, height),
+		pdfStream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode", size.X, size.Y, colors), jpg.Bytes()),
+		"<< /Type /Font /Subtype /Type0 /BaseFont /GlyphLessFont /Encoding /Identity-H /DescendantFonts [7 0 R] /ToUnicode 8 0 R >>",
+		pdfStream("", content.Bytes()),
+		"<< /Type /Font /Subtype /CIDFontType2 /BaseFont /GlyphLessFont /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor 9 0 R /DW 500 /CIDToGIDMap /Identity >>",
+		pdfStream("", cmap.Bytes()),
+		"<< /Type /FontDescriptor /FontName /GlyphLessFont /Flags 5 /FontBBox [0 0 500 1000] /ItalicAngle 0 /Ascent 1000 /Descent 0 /CapHeight 1000 /StemV 80 >>",
+	}
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.5\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes(), nil
+}
+
+// pdfStream is a stream object with the given dictionary entries.
+func pdfStream(dict string, data []byte) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+}
+
+// pdfHexText encodes s for the Identity-H font, a UTF-16 code unit per
+// character, dropping those that need two.
+func pdfHexText(s string) string {
+	var b bytes.Buffer
+	for _, c := range s {
+		if u := utf16.Encode([]rune{c}); len(u) == 1 {
+			fmt.Fprintf(&b, "%04X", u[0])
+		}
+	}
+	return b.String()
+}
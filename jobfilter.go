@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jobFilter selects jobs by metadata. The zero value matches every job.
+type jobFilter struct {
+	Tags          map[string]string
+	Filename      string // normalized with normalizePersian, substring match
+	Statuses      []JobStatus
+	Engine        string
+	From, To      time.Time // creation time range, To is exclusive
+	MinConfidence float64
+	Batch         string
+	Classes       []string // see Classification
+	Keyword       string   // normalized with normalizePersian, see extractKeywords
+	Account       string   // only matters to roles that see other accounts' jobs
+}
+
+// parseJobFilter reads a filter from query parameters:
+//
+//	tag=key=value  (repeatable)   filename=...   status=done,failed
+//	engine=...     from=2024-03-21 to=2024-04-01 (or RFC 3339)
+//	min_confidence=80 batch=...   class=invoice,letter
+//	account=...    keyword=...
+func parseJobFilter(q url.Values) (jobFilter, error) {
+	var f jobFilter
+	var err error
+	if f.Tags, err = parseTags(q["tag"]); err != nil {
+		return f, err
+	}
+	f.Filename = normalizePersian(q.Get("filename"))
+	for _, s := range strings.Split(q.Get("status"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			f.Statuses = append(f.Statuses, JobStatus(s))
+		}
+	}
+	f.Engine = strings.TrimSpace(q.Get("engine"))
+	f.Batch = strings.TrimSpace(q.Get("batch"))
+	for _, c := range strings.Split(q.Get("class"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			f.Classes = append(f.Classes, strings.ToLower(c))
+		}
+	}
+	f.Account = strings.TrimSpace(q.Get("account"))
+	f.Keyword = normalizePersian(q.Get("keyword"))
+	if f.From, err = parseFilterTime(q.Get("from"), false); err != nil {
+		return f, fmt.Errorf("from: %w", err)
+	}
+	if f.To, err = parseFilterTime(q.Get("to"), true); err != nil {
+		return f, fmt.Errorf("to: %w", err)
+	}
+	if v := q.Get("min_confidence"); v != "" {
+		if f.MinConfidence, err = strconv.ParseFloat(v, 64); err != nil {
+			return f, fmt.Errorf("min_confidence must be a number")
+		}
+	}
+	return f, nil
+}
+
+// parseFilterTime accepts RFC 3339 or a bare date. A bare "to" date covers
+// the whole day, so to=2024-04-01 includes jobs created that day.
+func parseFilterTime(v string, endOfDay bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("use YYYY-MM-DD or RFC 3339")
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func (f jobFilter) match(j *Job) bool {
+	if !matchesTags(j.Tags, f.Tags) {
+		return false
+	}
+	if f.Filename != "" && !strings.Contains(normalizePersian(j.Filename), f.Filename) {
+		return false
+	}
+	if len(f.Statuses) > 0 && !slices.Contains(f.Statuses, j.Status) {
+		return false
+	}
+	if f.Engine != "" && !strings.EqualFold(j.Engine, f.Engine) {
+		return false
+	}
+	if !f.From.IsZero() && j.CreatedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !j.CreatedAt.Before(f.To) {
+		return false
+	}
+	if f.MinConfidence > 0 && (j.Confidence == nil || *j.Confidence < f.MinConfidence) {
+		return false
+	}
+	if f.Batch != "" && j.Batch != f.Batch {
+		return false
+	}
+	if len(f.Classes) > 0 && (j.Class == nil || !slices.Contains(f.Classes, j.Class.Class)) {
+		return false
+	}
+	if f.Account != "" && j.account != f.Account {
+		return false
+	}
+	if f.Keyword != "" && !slices.ContainsFunc(j.Keywords, func(k string) bool { return normalizePersian(k) == f.Keyword }) {
+		return false
+	}
+	return true
+}
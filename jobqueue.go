@@ -0,0 +1,110 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// jobQueue hands queued job IDs to the workers, highest plan priority first.
+// Within a priority accounts take turns: every job gets a round, one past
+// the account's previous job or the round being served when the account
+// had nothing queued, so an account that queued hundreds of documents
+// cannot hold back one that queues a single document after it. Jobs of the
+// same round go in submission order.
+type jobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	items   queueHeap
+	seq     uint64
+	limit   int
+	round   uint64            // round of the job popped last
+	last    map[string]uint64 // round of each account's latest queued job
+	pending map[string]int    // queued jobs per account
+}
+
+type queueItem struct {
+	id       string
+	account  string
+	priority int
+	round    uint64
+	seq      uint64
+}
+
+func newJobQueue(limit int) *jobQueue {
+	q := &jobQueue{limit: limit, last: map[string]uint64{}, pending: map[string]int{}}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds a job of account and returns false when the queue is full.
+func (q *jobQueue) push(id, account string, priority int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) >= q.limit {
+		return false
+	}
+	q.seq++
+	round := max(q.last[account], q.round) + 1
+	q.last[account] = round
+	q.pending[account]++
+	heap.Push(&q.items, queueItem{id: id, account: account, priority: priority, round: round, seq: q.seq})
+	q.cond.Signal()
+	return true
+}
+
+// pop blocks until a job is queued and removes it.
+func (q *jobQueue) pop() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 {
+		q.cond.Wait()
+	}
+	it := heap.Pop(&q.items).(queueItem)
+	q.round = max(q.round, it.round)
+	q.taken(it.account)
+	return it.id
+}
+
+// remove takes a job out of the queue and reports whether it was queued.
+func (q *jobQueue) remove(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, it := range q.items {
+		if it.id == id {
+			heap.Remove(&q.items, i)
+			q.taken(it.account)
+			return true
+		}
+	}
+	return false
+}
+
+// taken forgets an account once it has no queued jobs left, so its next
+// job starts at the current round. The caller must hold q.mu.
+func (q *jobQueue) taken(account string) {
+	if q.pending[account]--; q.pending[account] <= 0 {
+		delete(q.pending, account)
+		delete(q.last, account)
+	}
+}
+
+type queueHeap []queueItem
+
+func (h queueHeap) Len() int { return len(h) }
+func (h queueHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	if h[i].round != h[j].round {
+		return h[i].round < h[j].round
+	}
+	return h[i].seq < h[j].seq
+}
+func (h queueHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *queueHeap) Push(x any)   { *h = append(*h, x.(queueItem)) }
+func (h *queueHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
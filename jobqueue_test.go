@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+type queuedJob struct {
+	id, account string
+	priority    int
+}
+
+func queueOf(t *testing.T, jobs ...queuedJob) *jobQueue {
+	t.Helper()
+	q := newJobQueue(100)
+	for _, j := range jobs {
+		if !q.push(j.id, j.account, j.priority) {
+			t.Fatalf("push %s: queue full", j.id)
+		}
+	}
+	return q
+}
+
+// drain pops every queued job.
+func drain(q *jobQueue) []string {
+	var ids []string
+	for len(q.items) > 0 {
+		ids = append(ids, q.pop())
+	}
+	return ids
+}
+
+func TestJobQueueTakesTurns(t *testing.T) {
+	q := queueOf(t,
+		queuedJob{"a1", "a", 0}, queuedJob{"a2", "a", 0}, queuedJob{"a3", "a", 0}, queuedJob{"a4", "a", 0},
+		queuedJob{"b1", "b", 0},
+		queuedJob{"c1", "c", 0}, queuedJob{"c2", "c", 0},
+	)
+	want := []string{"a1", "b1", "c1", "a2", "c2", "a3", "a4"}
+	if got := drain(q); !slices.Equal(got, want) {
+		t.Errorf("pop order = %v, want %v", got, want)
+	}
+}
+
+// TestJobQueueLateAccount checks that an account queueing after others
+// have been served joins the round being served, not the first one.
+func TestJobQueueLateAccount(t *testing.T) {
+	q := queueOf(t,
+		queuedJob{"a1", "a", 0}, queuedJob{"a2", "a", 0}, queuedJob{"a3", "a", 0},
+		queuedJob{"b1", "b", 0}, queuedJob{"b2", "b", 0},
+	)
+	got := []string{q.pop(), q.pop()}
+	q.push("c1", "c", 0)
+	got = append(got, drain(q)...)
+	want := []string{"a1", "b1", "a2", "b2", "c1", "a3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("pop order = %v, want %v", got, want)
+	}
+}
+
+func TestJobQueuePriority(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		jobs []queuedJob
+		want []string
+	}{
+		{"within an account",
+			[]queuedJob{{"low1", "a", 0}, {"high", "a", 10}, {"low2", "a", 0}, {"mid", "a", 5}},
+			[]string{"high", "mid", "low1", "low2"}},
+		{"before turns",
+			[]queuedJob{{"a1", "a", 0}, {"a2", "a", 0}, {"b1", "b", 10}, {"b2", "b", 10}},
+			[]string{"b1", "b2", "a1", "a2"}},
+	} {
+		if got := drain(queueOf(t, tc.jobs...)); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: pop order = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestJobQueueRemove(t *testing.T) {
+	var jobs []queuedJob
+	for i := range 30 {
+		jobs = append(jobs, queuedJob{fmt.Sprintf("j%02d", i), fmt.Sprintf("acct%d", i%4), i % 3})
+	}
+	q := queueOf(t, jobs...)
+	for _, id := range []string{"j00", "j13", "j29", "j07", "j21"} {
+		if !q.remove(id) {
+			t.Errorf("remove %s = false, want true", id)
+		}
+		for i := 1; i < len(q.items); i++ {
+			if q.items.Less(i, (i-1)/2) {
+				t.Fatalf("after removing %s, %s sorts before its parent %s", id, q.items[i].id, q.items[(i-1)/2].id)
+			}
+		}
+	}
+	if q.remove("j13") {
+		t.Error("remove of a job no longer queued = true")
+	}
+
+	sorted := slices.Clone(q.items)
+	slices.SortFunc(sorted, func(a, b queueItem) int {
+		if h := (queueHeap{a, b}); h.Less(0, 1) {
+			return -1
+		} else if h.Less(1, 0) {
+			return 1
+		}
+		return 0
+	})
+	var want []string
+	for _, it := range sorted {
+		want = append(want, it.id)
+	}
+	if got := drain(q); !slices.Equal(got, want) {
+		t.Errorf("pop order after remove = %v, want %v", got, want)
+	}
+}
+
+// TestJobQueueRemoveLast checks that an account whose only job is removed
+// starts again at the round being served.
+func TestJobQueueRemoveLast(t *testing.T) {
+	q := queueOf(t, queuedJob{"a1", "a", 0}, queuedJob{"a2", "a", 0}, queuedJob{"a3", "a", 0}, queuedJob{"b1", "b", 0})
+	q.remove("b1")
+	if _, ok := q.last["b"]; ok || q.pending["b"] != 0 {
+		t.Errorf("account b still tracked after its last job was removed: last %v, pending %v", q.last, q.pending)
+	}
+	q.push("b2", "b", 0)
+	want := []string{"a1", "b2", "a2", "a3"}
+	if got := drain(q); !slices.Equal(got, want) {
+		t.Errorf("pop order = %v, want %v", got, want)
+	}
+}
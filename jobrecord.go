@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// jobRecordName is the metadata file kept in every upload workspace.
+const jobRecordName = "job.json"
+
+// jobRecord is the on-disk form of a job. It carries the public job fields
+// plus what is needed to find the job's files again after a restart.
+type jobRecord struct {
+	Job
+	InputName      string `json:"input_name"`
+	Prefix         string `json:"prefix"`
+	DisplayPrefix  string `json:"display_prefix,omitempty"`
+	Account        string `json:"account,omitempty"`
+	Priority       int    `json:"priority,omitempty"`
+	Pages          int    `json:"pages,omitempty"`
+	CallbackURL    string `json:"callback_url,omitempty"`
+	NotifyEmail    string `json:"notify_email,omitempty"`
+	ExpiryNotified bool   `json:"expiry_notified,omitempty"`
+}
+
+// saveLocked writes j's record to its workspace. The caller must hold s.mu.
+func (s *JobStore) saveLocked(j *Job) {
+	rec := jobRecord{Job: *j, InputName: filepath.Base(j.inputPath), Prefix: j.prefix, DisplayPrefix: j.displayPrefix,
+		Account: j.account, Priority: j.priority, Pages: j.pages, CallbackURL: j.callbackURL,
+		NotifyEmail: j.notifyEmail, ExpiryNotified: j.expiryNotified}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(filepath.Dir(j.inputPath), jobRecordName), data)
+	}
+	if err != nil {
+		log.Printf("saving job %s: %v", j.ID, err)
+	}
+}
+
+// load reads every job record under user_file, in the owners' namespaces
+// and, for jobs stored before there were namespaces, directly below it.
+// Jobs that were queued or running when the server stopped are queued
+// again, oldest first; running ones resume after their last checkpointed
+// page. It must be called before the workers start.
+func (s *JobStore) load() error {
+	paths, err := globJobDirs(jobRecordName)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var interrupted []*Job
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var rec jobRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			log.Printf("skipping unreadable job record %s: %v", p, err)
+			continue
+		}
+		j := rec.Job
+		j.rebaseLinks()
+		inputPath, _ := filepath.Abs(filepath.Join(filepath.Dir(p), rec.InputName))
+		rel, _ := filepath.Rel("user_file", filepath.Dir(p))
+		outputDir, _ := filepath.Abs(filepath.Join("user_file_searchable", rel))
+		j.inputPath, j.outputDir, j.prefix = inputPath, outputDir, rec.Prefix
+		j.displayPrefix = rec.DisplayPrefix
+		j.account, j.priority, j.pages = rec.Account, rec.Priority, rec.Pages
+		j.callbackURL, j.notifyEmail, j.expiryNotified = rec.CallbackURL, rec.NotifyEmail, rec.ExpiryNotified
+		if j.displayPrefix == "" {
+			j.displayPrefix = rec.Prefix
+		}
+		j.done = make(chan struct{})
+		close(j.done)
+		if j.Status == JobQueued || j.Status == JobProcessing {
+			interrupted = append(interrupted, &j)
+		}
+		if j.Delivery != nil && j.Delivery.Status == "pending" {
+			go s.deliver(j.ID)
+		}
+		s.jobs[j.ID] = &j
+	}
+
+	sort.Slice(interrupted, func(a, b int) bool { return interrupted[a].CreatedAt.Before(interrupted[b].CreatedAt) })
+	for _, j := range interrupted {
+		if err := s.requeueLocked(j); err != nil {
+			j.Status = JobFailed
+			j.Error = "interrupted by a server restart"
+			recordEvent(j, TimelineFailed, 0, "%s", j.Error)
+		} else {
+			n := checkpointedPages(j.outputDir)
+			if n > 0 {
+				log.Printf("resuming job %s after %d finished pages", j.ID, n)
+			}
+			recordEvent(j, TimelineRequeued, 0, "queued again after a server restart, %d pages were finished", n)
+		}
+		s.saveLocked(j)
+	}
+	return nil
+}
+
+// adoptFinished reads job id's record back and reports whether another
+// instance sharing the volume has finished the job since it was queued here.
+// If so the job takes over that outcome instead of being run again.
+func (s *JobStore) adoptFinished(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return false
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(j.inputPath), jobRecordName))
+	if err != nil {
+		return false
+	}
+	var rec jobRecord
+	if err := json.Unmarshal(data, &rec); err != nil || (rec.Status != JobDone && rec.Status != JobFailed && rec.Status != JobCanceled) {
+		return false
+	}
+	local := *j
+	*j = rec.Job
+	j.inputPath, j.outputDir, j.prefix, j.displayPrefix = local.inputPath, local.outputDir, local.prefix, local.displayPrefix
+	j.account, j.priority, j.pages, j.done = local.account, local.priority, local.pages, local.done
+	j.callbackURL, j.notifyEmail = local.callbackURL, local.notifyEmail
+	close(j.done)
+	return true
+}
+
+// globJobDirs returns the paths of the files named name in every job's
+// upload directory.
+func globJobDirs(name string) ([]string, error) {
+	legacy, err := filepath.Glob(filepath.Join("user_file", "*", name))
+	if err != nil {
+		return nil, err
+	}
+	owned, err := filepath.Glob(filepath.Join("user_file", "*", "*", name))
+	return append(legacy, owned...), err
+}
+
+// checkpointedPages counts the pages an earlier run of a job finished.
+func checkpointedPages(outputDir string) int {
+	pages, _ := filepath.Glob(filepath.Join(outputDir, "pages", "*.txt"))
+	return len(pages)
+}
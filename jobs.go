@@ -0,0 +1,824 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued     JobStatus = "queued"
+	JobProcessing JobStatus = "processing"
+	JobDone       JobStatus = "done"
+	JobFailed     JobStatus = "failed"
+	JobCanceled   JobStatus = "canceled"
+)
+
+// Job is one OCR run. Exported fields form the job JSON returned by the
+// API; the unexported ones are server-side bookkeeping.
+type Job struct {
+	ID            string            `json:"id"`
+	Filename      string            `json:"filename"`
+	Status        JobStatus         `json:"status"`
+	Error         string            `json:"error,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	StartedAt     *time.Time        `json:"started_at,omitempty"`
+	FinishedAt    *time.Time        `json:"finished_at,omitempty"`
+	TextURL       string            `json:"text_url,omitempty"`
+	PDFURL        string            `json:"pdf_url,omitempty"`
+	LogURL        string            `json:"log_url,omitempty"`
+	ArticlesURL   string            `json:"articles_url,omitempty"`
+	NotesURL      string            `json:"notes_url,omitempty"`
+	RegionsURL    string            `json:"regions_url,omitempty"`
+	PartialPDFURL string            `json:"partial_pdf_url,omitempty"` // the pages a failed job finished, see partialPDF
+	BundleURL     string            `json:"bundle_url,omitempty"`      // all the results in one ZIP archive, see bundleHandler
+	Tags          map[string]string `json:"tags,omitempty"`
+	Engine        string            `json:"engine,omitempty"`
+	Languages     string            `json:"languages,omitempty"`      // Tesseract languages for the document
+	PageLanguages string            `json:"page_languages,omitempty"` // per-page overrides, e.g. "1-10=eng,11-=fas"
+	TextLayout    string            `json:"text_layout,omitempty"`    // see textLayouts
+	Mode          string            `json:"mode,omitempty"`           // see ocrModes
+	DPI           string            `json:"dpi,omitempty"`            // see dpiModes
+	SeparateNotes bool              `json:"separate_notes,omitempty"` // footnotes and marginalia go to NotesURL
+	GlossaryTerms int               `json:"glossary_terms,omitempty"` // size of the job's glossary
+	Charset       string            `json:"charset,omitempty"`        // characters recognition is limited to
+	Regions       []ocrRegion       `json:"regions,omitempty"`        // template regions recognized on their own
+	Confidence    *float64          `json:"confidence,omitempty"`     // mean word confidence, 0-100
+	Repaired      bool              `json:"repaired,omitempty"`       // the upload's PDF structure was repaired on arrival
+	ConvertedFrom string            `json:"converted_from,omitempty"` // see convertedFormat: the input is a PDF made from the upload
+	FailedPages   []PageFailure     `json:"failed_pages,omitempty"`   // pages that could not be recognized in a finished job
+	Progress      *JobProgress      `json:"progress,omitempty"`       // pages finished so far, as the engine reports them
+	Warnings      []PageWarning     `json:"warnings,omitempty"`       // pages the engine had trouble with
+	Pinned        bool              `json:"pinned,omitempty"`         // kept regardless of the retention period
+	LegalHold     *LegalHold        `json:"legal_hold,omitempty"`     // neither retention nor a cancel may delete the job, see legalhold.go
+	Class         *Classification   `json:"classification,omitempty"` // the kind of document, see classify.go
+	Correction    *TextCorrection   `json:"correction,omitempty"`     // low-confidence lines a language model fixed, see correct.go
+	Summary       *DocumentSummary  `json:"summary,omitempty"`        // a language model's summary of the text, see summary.go
+	Keywords      []string          `json:"keywords,omitempty"`       // terms that set the text apart, see keywords.go
+	DuplicateOf   *DuplicateMatch   `json:"duplicate_of,omitempty"`   // an earlier document with nearly the same text, see duplicates.go
+	Rescan        []RescanPage      `json:"rescan,omitempty"`         // pages to scan again, see rescan.go
+	Batch         string            `json:"batch,omitempty"`          // the batch the job was uploaded in, see batch.go
+	ArchiveEntry  string            `json:"archive_entry,omitempty"`  // path of the file in the ZIP archive it came in
+	SourceURL     string            `json:"source_url,omitempty"`     // the URL the document was fetched from, see fetch.go
+	SHA256        string            `json:"sha256,omitempty"`         // of the document as it arrived, before any conversion
+
+	Destination         string    `json:"destination,omitempty"`          // see Destination
+	DestinationPath     string    `json:"destination_path,omitempty"`     // folder below the destination
+	DestinationTemplate string    `json:"destination_template,omitempty"` // see renderDeliveryPath
+	Delivery            *Delivery `json:"delivery,omitempty"`
+	Routing             []RuleRun `json:"routing,omitempty"` // what the routing rules did when the job last finished
+
+	inputPath      string
+	outputDir      string
+	prefix         string        // result file prefix on disk, built from safeFileStem
+	displayPrefix  string        // the same prefix built from the original name
+	account        string        // API key name or "ip:<addr>" usage is metered against
+	priority       int           // queue priority from the account's plan
+	pages          int           // page count charged at admission
+	callbackURL    string        // hooks API callback, see sendHookCallback
+	notifyEmail    string        // mailed the results when the job finishes, see sendResultMail
+	expiryNotified bool          // the owner was told the job is about to be deleted
+	done           chan struct{} // closed once the job is done, failed or canceled
+	feed           *jobFeed      // the engine's warnings and log of the current run, see v1JobSocketHandler
+
+	cancel    context.CancelFunc // stops the OCR run of a job processing here
+	canceling bool               // cancel was requested and the run is being stopped
+}
+
+// JobProgress counts the pages of a job the engine has finished. It is
+// replaced, never modified, so job snapshots can share it.
+type JobProgress struct {
+	PagesDone int `json:"pages_done"`
+	Pages     int `json:"pages"`
+}
+
+// PageWarning is a problem the engine reported with one page while it ran:
+// a page that could not be processed, one without text, or one recognized
+// with low confidence.
+type PageWarning struct {
+	Page    int    `json:"page"`
+	Message string `json:"message"`
+}
+
+// finished reports whether the job has reached a final status.
+func (j *Job) finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed || j.Status == JobCanceled
+}
+
+var (
+	errIdempotencyMismatch = errors.New("idempotency key was already used for a different upload")
+	errQueueFull           = errors.New("the job queue is full, please try again later")
+	errNotResumable        = errors.New("only failed jobs can be resumed")
+	errNotCancelable       = errors.New("only queued or processing jobs can be canceled")
+	errLegalHold           = errors.New("the job is under legal hold")
+)
+
+// idempotencyTTL is how long a client's Idempotency-Key is remembered.
+const idempotencyTTL = 24 * time.Hour
+
+type idempotencyEntry struct {
+	jobID       string
+	fingerprint string
+	created     time.Time
+}
+
+// JobStore keeps every job in memory and feeds queued jobs to a fixed pool
+// of workers.
+type JobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	keys  map[string]idempotencyEntry
+	queue *jobQueue
+}
+
+func newJobStore(queueSize int) *JobStore {
+	return &JobStore{
+		jobs:  make(map[string]*Job),
+		keys:  make(map[string]idempotencyEntry),
+		queue: newJobQueue(queueSize),
+	}
+}
+
+// start launches n workers that process queued jobs until the process exits.
+func (s *JobStore) start(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				s.process(s.queue.pop())
+			}
+		}()
+	}
+}
+
+// get returns a snapshot of the job so callers never race with the worker.
+func (s *JobStore) get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// update applies fn to the job and saves its record.
+func (s *JobStore) update(id string, fn func(j *Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[id]; ok {
+		fn(j)
+		s.saveLocked(j)
+	}
+}
+
+// lookupKey returns the job previously created for the client's
+// Idempotency-Key, if any.
+func (s *JobStore) lookupKey(client, key, fingerprint string) (Job, bool, error) {
+	if key == "" {
+		return Job{}, false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookupKeyLocked(client+"\x00"+key, fingerprint)
+}
+
+func (s *JobStore) lookupKeyLocked(k, fingerprint string) (Job, bool, error) {
+	e, ok := s.keys[k]
+	if !ok || time.Since(e.created) > idempotencyTTL {
+		return Job{}, false, nil
+	}
+	if e.fingerprint != fingerprint {
+		return Job{}, false, errIdempotencyMismatch
+	}
+	j, ok := s.jobs[e.jobID]
+	if !ok {
+		return Job{}, false, nil
+	}
+	return *j, true, nil
+}
+
+// submission describes an uploaded document waiting to become a job.
+type submission struct {
+	Client        string // rate limiting identity of the submitter
+	Key           string // Idempotency-Key header, may be empty
+	Filename      string
+	SpoolPath     string // temporary copy written by spoolUpload
+	Fingerprint   string // SHA-256 of the upload
+	Tags          map[string]string
+	OutputName    string // output name template, empty for the server default
+	Account       string // see Job.account
+	Priority      int
+	Pages         int
+	MaxActive     int    // see Plan.activeJobLimit
+	Repaired      bool   // checkPDF rewrote the upload
+	ConvertedFrom string // see convertToPDF
+	Languages     string // empty for defaultLanguages
+	PageLanguages languageMap
+	TextLayout    string
+	Mode          string
+	DPI           string
+	Engine        string // one of knownEngines, empty for defaultEngine
+	SeparateNotes bool
+	Glossary      []string // see parseGlossary
+	Charset       string   // resolved by parseCharset
+	Regions       []ocrRegion
+
+	Destination         string // checked by checkDestination
+	DestinationPath     string
+	DestinationTemplate string // checked by validateDestinationTemplate
+	CallbackURL         string
+	NotifyEmail         string // checked by parseNotifyEmail
+	Batch               string // see Job.Batch
+	ArchiveEntry        string // see Job.ArchiveEntry
+	SourceURL           string // see Job.SourceURL
+}
+
+// submit moves the spooled upload into its workspace and queues a new job.
+// When the idempotency key matches an earlier submission from the same
+// client the original job is returned with replayed set and nothing is
+// queued.
+func (s *JobStore) submit(sub submission) (job Job, replayed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sub.Key != "" {
+		if j, ok, err := s.lookupKeyLocked(sub.Client+"\x00"+sub.Key, sub.Fingerprint); err != nil || ok {
+			return j, ok, err
+		}
+	}
+
+	if sub.MaxActive > 0 && s.activeLocked(sub.Account) >= sub.MaxActive {
+		return Job{}, false, errTooManyJobs
+	}
+
+	filename := sub.Filename
+	baseFilename := strings.TrimSuffix(filename, filepath.Ext(filename))
+	id := newID()
+	now := time.Now().UTC()
+	languages := sub.Languages
+	if languages == "" {
+		languages = defaultLanguages
+	}
+	tmpl := sub.OutputName
+	if tmpl == "" {
+		tmpl = outputNameTemplate
+	}
+	vars := outputNameVars{
+		Original: safeFileStem(baseFilename),
+		JobID:    id,
+		Lang:     languages,
+		Time:     now,
+		Tags:     sub.Tags,
+	}
+	prefix, err := renderOutputName(tmpl, vars)
+	if err != nil {
+		return Job{}, false, err
+	}
+	vars.Original = baseFilename
+	displayPrefix, err := renderOutputName(tmpl, vars)
+	if err != nil {
+		return Job{}, false, err
+	}
+
+	inputPath, outputDir, err := prepareWorkspace(id, sub.Account, filename)
+	if err != nil {
+		return Job{}, false, err
+	}
+	if err := os.Rename(sub.SpoolPath, inputPath); err != nil {
+		return Job{}, false, fmt.Errorf("Error saving file: %w", err)
+	}
+	if err := sealFile(inputPath); err != nil {
+		os.Remove(inputPath)
+		return Job{}, false, fmt.Errorf("Error encrypting file: %w", err)
+	}
+	if len(sub.Glossary) > 0 {
+		data := []byte(strings.Join(sub.Glossary, "\n") + "\n")
+		if err := writeFileAtomic(filepath.Join(filepath.Dir(inputPath), glossaryName), data); err != nil {
+			return Job{}, false, fmt.Errorf("Error saving glossary: %w", err)
+		}
+	}
+
+	j := &Job{
+		ID:            id,
+		Filename:      filename,
+		Status:        JobQueued,
+		CreatedAt:     now,
+		Tags:          sub.Tags,
+		Repaired:      sub.Repaired,
+		ConvertedFrom: sub.ConvertedFrom,
+		Languages:     languages,
+		inputPath:     inputPath,
+		outputDir:     outputDir,
+		prefix:        prefix,
+		done:          make(chan struct{}),
+
+		PageLanguages: sub.PageLanguages.String(),
+		TextLayout:    sub.TextLayout,
+		Mode:          sub.Mode,
+		DPI:           sub.DPI,
+		Engine:        sub.Engine,
+		SeparateNotes: sub.SeparateNotes,
+		GlossaryTerms: len(sub.Glossary),
+		Charset:       sub.Charset,
+		Regions:       sub.Regions,
+		Batch:         sub.Batch,
+		ArchiveEntry:  sub.ArchiveEntry,
+		SourceURL:     sub.SourceURL,
+		SHA256:        sub.Fingerprint,
+		displayPrefix: displayPrefix,
+		account:       sub.Account,
+		priority:      sub.Priority,
+		pages:         sub.Pages,
+		callbackURL:   sub.CallbackURL,
+		notifyEmail:   sub.NotifyEmail,
+
+		Destination:         sub.Destination,
+		DestinationPath:     sub.DestinationPath,
+		DestinationTemplate: sub.DestinationTemplate,
+	}
+	if !s.queue.push(j.ID, j.account, j.priority) {
+		os.Remove(inputPath)
+		return Job{}, false, errQueueFull
+	}
+	s.jobs[j.ID] = j
+	s.saveLocked(j)
+	if sub.Key != "" {
+		s.keys[sub.Client+"\x00"+sub.Key] = idempotencyEntry{jobID: j.ID, fingerprint: sub.Fingerprint, created: time.Now()}
+	}
+	recordEvent(j, TimelineQueued, 0, "%s, %d pages", filename, j.pages)
+	publishJobEvent(EventJobQueued, *j)
+	return *j, false, nil
+}
+
+// activeLocked counts the jobs of account that are queued or processing.
+// The caller must hold s.mu.
+func (s *JobStore) activeLocked(account string) int {
+	n := 0
+	for _, j := range s.jobs {
+		if j.account == account && !j.finished() {
+			n++
+		}
+	}
+	return n
+}
+
+// resume queues a failed job again. Pages the earlier run finished are
+// checkpointed in the job's pages/ directory and skipped by the OCR script,
+// so only the remaining pages are processed.
+func (s *JobStore) resume(id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if j.Status != JobFailed {
+		return Job{}, errNotResumable
+	}
+	if jobLeaseLive(id) {
+		return Job{}, errLeaseHeld
+	}
+	if err := s.requeueLocked(j); err != nil {
+		return Job{}, err
+	}
+	s.saveLocked(j)
+	recordEvent(j, TimelineRequeued, 0, "resumed after %d finished pages", checkpointedPages(j.outputDir))
+	publishJobEvent(EventJobQueued, *j)
+	return *j, nil
+}
+
+// requeueLocked resets j to queued and puts it back in the queue. The caller
+// must hold s.mu.
+func (s *JobStore) requeueLocked(j *Job) error {
+	if !s.queue.push(j.ID, j.account, j.priority) {
+		return errQueueFull
+	}
+	j.Status = JobQueued
+	j.Error, j.PartialPDFURL = "", ""
+	j.StartedAt, j.FinishedAt = nil, nil
+	j.Progress = nil
+	j.done = make(chan struct{})
+	return nil
+}
+
+func (s *JobStore) process(id string) {
+	j, ok := s.get(id)
+	if !ok || j.Status == JobCanceled {
+		return
+	}
+	lease, ctx, err := acquireLease(context.Background(), filepath.Dir(j.inputPath))
+	if errors.Is(err, errLeaseHeld) {
+		log.Printf("job %s is being processed by another instance, checking again in %s", id, leaseTTL)
+		recordEvent(&j, TimelineWaiting, 0, "another instance is processing the job, checking again in %s", leaseTTL)
+		time.AfterFunc(leaseTTL, func() { s.retry(id) })
+		return
+	}
+	if err == nil && s.adoptFinished(id) {
+		lease.release()
+		return
+	}
+
+	var result *OCRResult
+	if err != nil {
+		err = fmt.Errorf("Error taking job lease: %w", err)
+	} else {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		canceled := false
+		s.update(id, func(job *Job) {
+			if job.Status == JobCanceled {
+				// Canceled after the worker took it from the queue.
+				canceled = true
+				return
+			}
+			now := time.Now().UTC()
+			job.Status = JobProcessing
+			job.StartedAt = &now
+			job.cancel = cancel
+			job.feed = newJobFeed()
+			j = *job
+		})
+		if canceled {
+			lease.release()
+			return
+		}
+		recordEvent(&j, TimelineStarted, 0, "on %s", instanceID)
+		publishJobEvent(EventJobStarted, j)
+
+		opts := j.ocrOptions()
+		opts.Progress = func(done, total int) { s.setProgress(id, done, total) }
+		opts.Warning = func(page int, msg string) { s.addWarning(id, page, msg) }
+		opts.Log = func(line string) { j.feed.add(feedEntry{Type: "log", Message: line}) }
+		opts.Event = func(typ, msg string) { recordEvent(&j, typ, 0, "%s", msg) }
+		if err = unsealJob(&j); err != nil {
+			err = fmt.Errorf("Error decrypting job files: %w", err)
+		} else {
+			result, err = runOCR(ctx, j.inputPath, j.outputDir, j.prefix, j.ID, opts)
+		}
+		if !lease.release() {
+			// Another instance took the job over; its state is theirs to write.
+			log.Printf("job %s was taken over by another instance", id)
+			return
+		}
+		s.mu.Lock()
+		if job, ok := s.jobs[id]; ok {
+			job.cancel = nil
+			if job.canceling {
+				s.cancelLocked(job)
+				j = *job
+			}
+		}
+		s.mu.Unlock()
+		if j.Status == JobCanceled {
+			s.canceled(j)
+			return
+		}
+	}
+
+	var partial string
+	var class *Classification
+	var correction *TextCorrection
+	var summary *DocumentSummary
+	var keywords []string
+	var duplicate *DuplicateMatch
+	if err != nil {
+		partial, _ = partialPDF(j.outputDir, j.prefix)
+	} else {
+		if correction = correctText(context.Background(), j, result); correction != nil && correction.Changed > 0 {
+			recordEvent(&j, TimelineCorrected, 0, "%d of %d low-confidence lines", correction.Changed, correction.Lines)
+		}
+		if summary = summarizeText(context.Background(), j, result.TextFile); summary != nil && summary.URL != "" {
+			recordEvent(&j, TimelineSummarized, 0, "by %s", summary.Model)
+		}
+		keywords = extractKeywords(j, result.TextFile)
+		embedText(context.Background(), j, result.TextFile)
+		if duplicate = checkDuplicate(j, result.TextFile); duplicate != nil {
+			recordEvent(&j, TimelineDuplicate, 0, "%.0f%% like %s (%s)", 100*duplicate.Similarity, duplicate.Filename, duplicate.JobID)
+		}
+		class = classifyText(context.Background(), j, result.TextFile)
+	}
+	if serr := sealJob(&j); serr != nil {
+		log.Printf("job %s: encrypting its files: %v", id, serr)
+	}
+	s.update(id, func(job *Job) {
+		now := time.Now().UTC()
+		job.FinishedAt = &now
+		job.Routing = nil
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+			if partial != "" {
+				job.PartialPDFURL = downloadURL(partial)
+			}
+		} else {
+			job.Status = JobDone
+			job.Engine = result.Engine
+			job.Confidence = result.MeanConfidence
+			job.Class = class
+			job.Correction = correction
+			job.Summary = summary
+			job.Keywords = keywords
+			job.DuplicateOf = duplicate
+			job.FailedPages = result.FailedPages
+			job.Rescan = rescanPages(result)
+			job.TextURL = downloadURL(result.TextFile)
+			job.PDFURL = downloadURL(result.PDFFile)
+			if result.LogFile != "" {
+				job.LogURL = downloadURL(result.LogFile)
+			}
+			if result.ArticlesFile != "" {
+				job.ArticlesURL = downloadURL(result.ArticlesFile)
+			}
+			if result.NotesFile != "" {
+				job.NotesURL = downloadURL(result.NotesFile)
+			}
+			if result.RegionsFile != "" {
+				job.RegionsURL = downloadURL(result.RegionsFile)
+			}
+			job.BundleURL = bundleURL(job.ID)
+			if job.Destination != "" {
+				job.Delivery = &Delivery{Status: "pending"}
+			}
+		}
+		j = *job
+	})
+	close(j.done)
+	if err != nil {
+		log.Printf("job %s failed: %v", id, err)
+		recordEvent(&j, TimelineFailed, 0, "%s", firstLine([]byte(err.Error()), ""))
+		publishJobEvent(EventJobFailed, j)
+		if len(routingRules) > 0 {
+			go s.route(j)
+		}
+	} else {
+		pages := result.Pages
+		if pages == 0 {
+			pages = j.pages
+		}
+		if j.Confidence != nil {
+			recordEvent(&j, TimelineDone, 0, "%d pages, %d failed, mean confidence %.1f%%", pages, len(j.FailedPages), *j.Confidence)
+		} else {
+			recordEvent(&j, TimelineDone, 0, "%d pages, %d failed", pages, len(j.FailedPages))
+		}
+		// Pages the engine could not recognize are not billed.
+		meter.record(j, pages-len(result.FailedPages))
+		publishJobEvent(EventJobDone, j)
+		if len(j.Rescan) > 0 {
+			recordEvent(&j, TimelineRescan, 0, "%d pages to scan again", len(j.Rescan))
+			go sendRescanReport(j)
+		}
+		if j.Delivery != nil {
+			go s.deliver(id)
+		}
+		if len(routingRules) > 0 {
+			go s.route(j)
+		}
+	}
+	if j.callbackURL != "" {
+		event := EventJobDone
+		if err != nil {
+			event = EventJobFailed
+		}
+		go sendHookCallback(event, j)
+	}
+	if j.notifyEmail != "" {
+		go sendResultMail(j)
+	}
+}
+
+// setProgress records the engine's page count for job id. It is kept in
+// memory only; the job record is written when the job finishes.
+func (s *JobStore) setProgress(id string, done, total int) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	prev := 0
+	if j.Progress != nil {
+		prev = j.Progress.PagesDone
+	}
+	j.Progress = &JobProgress{PagesDone: done, Pages: total}
+	snap := *j
+	s.mu.Unlock()
+	if progressMilestone(prev, done, total) {
+		recordEvent(&snap, TimelineProgress, done, "%d of %d pages", done, total)
+	}
+}
+
+// addWarning records a warning the engine reported for job id and passes
+// it on to the job's feed.
+func (s *JobStore) addWarning(id string, page int, msg string) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	// Clipped so the append copies and earlier snapshots keep theirs.
+	j.Warnings = append(slices.Clip(j.Warnings), PageWarning{Page: page, Message: msg})
+	if j.feed != nil {
+		j.feed.add(feedEntry{Type: "warning", Page: page, Message: msg})
+	}
+	snap := *j
+	s.mu.Unlock()
+	recordEvent(&snap, TimelineWarning, page, "%s", msg)
+}
+
+// cancel stops job id. A queued job is taken out of the queue and canceled
+// right away. For a processing one the OCR run is killed and the job is
+// returned still processing; the worker marks it canceled once the engine
+// has exited.
+func (s *JobStore) cancel(id string) (Job, error) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	switch {
+	case !ok:
+		s.mu.Unlock()
+		return Job{}, errJobNotFound
+	case j.LegalHold != nil:
+		s.mu.Unlock()
+		return Job{}, errLegalHold
+	case j.Status == JobProcessing && j.cancel != nil:
+		j.canceling = true
+		j.cancel()
+		snap := *j
+		s.mu.Unlock()
+		return snap, nil
+	case j.Status == JobProcessing:
+		s.mu.Unlock()
+		return Job{}, errLeaseHeld
+	case j.Status != JobQueued:
+		s.mu.Unlock()
+		return Job{}, errNotCancelable
+	}
+	s.queue.remove(id)
+	s.cancelLocked(j)
+	snap := *j
+	s.mu.Unlock()
+	s.canceled(snap)
+	return snap, nil
+}
+
+// cancelLocked marks j canceled and wakes its waiters. The caller must hold
+// s.mu.
+func (s *JobStore) cancelLocked(j *Job) {
+	now := time.Now().UTC()
+	j.Status = JobCanceled
+	j.Error = ""
+	j.FinishedAt = &now
+	j.cancel, j.canceling = nil, false
+	s.saveLocked(j)
+	close(j.done)
+}
+
+// canceled cleans up after a canceled job: its partial output and input
+// are deleted, keeping only the job record. Pages the engine had already
+// recognized are metered and the rest of the charge is refunded.
+func (s *JobStore) canceled(j Job) {
+	finished := min(checkpointedPages(j.outputDir), j.pages)
+	os.RemoveAll(j.outputDir)
+	os.Remove(j.inputPath)
+	usage.refund(j.account, j.pages-finished)
+	if finished > 0 {
+		if j.Engine == "" {
+			j.Engine = defaultEngine
+		}
+		meter.record(j, finished)
+	}
+	log.Printf("job %s was canceled after %d of %d pages", j.ID, finished, j.pages)
+	recordEvent(&j, TimelineCanceled, 0, "after %d of %d pages", finished, j.pages)
+	publishJobEvent(EventJobCanceled, j)
+	if j.callbackURL != "" {
+		go sendHookCallback(EventJobCanceled, j)
+	}
+	if j.notifyEmail != "" && j.Batch != "" {
+		// The rest of its batch may be waiting on it to be reported.
+		go sendResultMail(j)
+	}
+}
+
+// ocrOptions returns the settings the job was submitted with.
+func (j *Job) ocrOptions() ocrOptions {
+	opts := ocrOptions{
+		Languages:     j.Languages,
+		PageLanguages: j.PageLanguages,
+		TextLayout:    j.TextLayout,
+		SeparateNotes: j.SeparateNotes,
+		Charset:       j.Charset,
+		Mode:          j.Mode,
+		DPI:           j.DPI,
+		Engine:        j.Engine,
+	}
+	if len(j.Regions) > 0 {
+		data, _ := json.Marshal(j.Regions)
+		opts.Regions = string(data)
+	}
+	if j.GlossaryTerms > 0 {
+		opts.Glossary = filepath.Join(filepath.Dir(j.inputPath), glossaryName)
+	}
+	return opts
+}
+
+// retry puts job id back in the queue after another instance held its lease.
+func (s *JobStore) retry(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.Status != JobQueued && j.Status != JobProcessing {
+		return
+	}
+	if !s.queue.push(id, j.account, j.priority) {
+		time.AfterFunc(leaseTTL, func() { s.retry(id) })
+	}
+}
+
+// list returns the jobs accepted by keep, newest first.
+func (s *JobStore) list(keep func(j *Job) bool) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Job{}
+	for _, j := range s.jobs {
+		if keep(j) {
+			out = append(out, *j)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].CreatedAt.After(out[b].CreatedAt) })
+	return out
+}
+
+// wait blocks until the job finishes or ctx is done and returns the job as
+// it is at that point.
+func (s *JobStore) wait(ctx context.Context, id string) (Job, bool) {
+	j, ok := s.get(id)
+	if !ok {
+		return Job{}, false
+	}
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+	}
+	return s.get(id)
+}
+
+// sweep forgets idempotency keys once they expire.
+func (s *JobStore) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mu.Lock()
+		for k, e := range s.keys {
+			if time.Since(e.created) > idempotencyTTL {
+				delete(s.keys, k)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// spoolUpload copies src into a temporary file under user_file and returns
+// its path together with the hex SHA-256 of the content.
+func spoolUpload(src io.Reader) (string, string, error) {
+	if err := os.MkdirAll("user_file", 0755); err != nil {
+		return "", "", fmt.Errorf("Error creating user_file directory: %w", err)
+	}
+	f, err := os.CreateTemp("user_file", ".upload-*")
+	if err != nil {
+		return "", "", fmt.Errorf("Error saving file: %w", err)
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", "", fmt.Errorf("Error writing file: %w", err)
+	}
+	return f.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newID returns a random RFC 4122 version 4 UUID.
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
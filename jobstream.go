@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// streamHeartbeat is how often an idle event stream sends a comment, so
+// proxies do not close it while a job waits in the queue.
+const streamHeartbeat = 15 * time.Second
+
+// v1JobEventsHandler streams a job as Server-Sent Events: a "status" event
+// with the job whenever its status changes, a "progress" event with
+// {"pages_done", "pages"} as the engine finishes pages and a "warning"
+// event with {"page", "message"} for pages it had trouble with. The stream
+// ends once the job is done, failed or canceled; browsers that reconnect
+// get the current status first. Clients asking for JSON with ?format=json
+// or Accept: application/json get the job's whole timeline instead, see
+// TimelineEvent.
+func v1JobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, ok := jobs.get(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+id)
+		return
+	}
+	if wantsTimeline(r) {
+		events, err := readTimeline(&job)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"job_id": id, "status": job.Status, "events": events})
+		return
+	}
+	rc := http.NewResponseController(w)
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Accel-Buffering", "no") // nginx would hold the events back
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(pagePollInterval)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	var status JobStatus
+	var progress JobProgress
+	warned := len(job.Warnings) // the job carries the earlier ones
+	for {
+		if p := job.Progress; p != nil && *p != progress {
+			writeEvent(w, "progress", p)
+			progress = *p
+		}
+		for _, pw := range job.Warnings[min(warned, len(job.Warnings)):] {
+			writeEvent(w, "warning", pw)
+		}
+		warned = len(job.Warnings)
+		if job.Status != status {
+			writeEvent(w, "status", job)
+			status = job.Status
+		}
+		if err := rc.Flush(); err != nil || job.finished() {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-ticker.C:
+		case <-job.done:
+		}
+		if job, ok = jobs.get(id); !ok {
+			return
+		}
+	}
+}
+
+// wantsTimeline reports whether the client asked the events endpoint for
+// JSON rather than a stream, like wantsCSV.
+func wantsTimeline(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeEvent writes v as one Server-Sent Event.
+func writeEvent(w io.Writer, event string, v any) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// maxFeedEntries bounds the log lines and warnings a job's feed keeps for
+// sockets that connect late; older ones are dropped.
+const maxFeedEntries = 2000
+
+// feedEntry is one message of a job's feed: a "warning" about a page or a
+// "log" line.
+type feedEntry struct {
+	Type    string `json:"type"`
+	Page    int    `json:"page,omitempty"`
+	Message string `json:"message"`
+}
+
+// jobFeed collects what the engine reports during one run of a job for
+// the sockets following it.
+type jobFeed struct {
+	mu      sync.Mutex
+	entries []feedEntry
+	dropped int           // entries removed from the front
+	wake    chan struct{} // closed and replaced by every add
+}
+
+func newJobFeed() *jobFeed {
+	return &jobFeed{wake: make(chan struct{})}
+}
+
+func (f *jobFeed) add(e feedEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.entries) == maxFeedEntries {
+		f.entries = f.entries[1:]
+		f.dropped++
+	}
+	f.entries = append(f.entries, e)
+	close(f.wake)
+	f.wake = make(chan struct{})
+}
+
+// since returns the entries from position n on, the position after them,
+// and a channel closed when more arrive.
+func (f *jobFeed) since(n int) ([]feedEntry, int, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	start := max(n-f.dropped, 0)
+	return slices.Clone(f.entries[start:]), f.dropped + len(f.entries), f.wake
+}
+
+// v1JobSocketHandler follows a job over a WebSocket. The server sends JSON
+// messages, each with a "type": "status" with the job whenever its status
+// changes, "progress" with pages_done and pages, "warning" with a page and
+// a message, "log" with a line of the job log, and finally "result", the
+// same object POST /ocr answers with, after which it closes the socket.
+// The warnings and log of the current run are replayed to sockets that
+// connect late. Pages from other origins may not connect.
+func v1JobSocketHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := jobs.get(id); !ok {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+id)
+		return
+	}
+	srv := websocket.Server{
+		Handshake: checkSocketOrigin,
+		Handler:   func(ws *websocket.Conn) { followJob(ws, id) },
+	}
+	srv.ServeHTTP(w, r)
+}
+
+// checkSocketOrigin refuses WebSockets opened by pages of other sites,
+// which browsers do not stop the way they stop cross-origin requests.
+func checkSocketOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil // not a browser
+	}
+	if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+		return errors.New("cross-origin WebSocket refused")
+	}
+	return nil
+}
+
+func followJob(ws *websocket.Conn, id string) {
+	defer ws.Close()
+	// The client sends nothing; reading notices when it goes away.
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ws)
+		close(gone)
+	}()
+	ticker := time.NewTicker(pagePollInterval)
+	defer ticker.Stop()
+
+	var status JobStatus
+	var progress JobProgress
+	var feed *jobFeed
+	var fed int
+	for {
+		job, ok := jobs.get(id)
+		if !ok {
+			return
+		}
+		var wake <-chan struct{}
+		if job.feed != nil {
+			if job.feed != feed {
+				feed, fed = job.feed, 0 // a new run
+			}
+			var entries []feedEntry
+			entries, fed, wake = feed.since(fed)
+			for _, e := range entries {
+				if websocket.JSON.Send(ws, e) != nil {
+					return
+				}
+			}
+		}
+		if p := job.Progress; p != nil && *p != progress {
+			progress = *p
+			if websocket.JSON.Send(ws, map[string]any{"type": "progress", "pages_done": p.PagesDone, "pages": p.Pages}) != nil {
+				return
+			}
+		}
+		if job.Status != status {
+			status = job.Status
+			if websocket.JSON.Send(ws, map[string]any{"type": "status", "job": job}) != nil {
+				return
+			}
+		}
+		if job.finished() {
+			resp, err := newOCRResponse(job)
+			if err != nil {
+				log.Printf("job %s: %v", id, err)
+			}
+			websocket.JSON.Send(ws, map[string]any{"type": "result", "result": resp})
+			return
+		}
+
+		select {
+		case <-gone:
+			return
+		case <-wake:
+		case <-job.done:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Every finished document is tagged with the words and two-word phrases
+// that set it apart from the rest of the archive: terms frequent in its
+// text but rare in other documents, ranked by TF-IDF. How many documents
+// contain each term is counted as documents finish and kept under the data
+// directory, so the ranking sharpens as the archive grows. The keywords are
+// stored with the job, shown in the history and select jobs with ?keyword=.
+
+// keywordCount is -keywords, the keywords kept per document; 0 turns
+// extraction off.
+var keywordCount int
+
+const (
+	// maxKeywordTerms bounds the document frequencies kept; the rarest
+	// terms are forgotten first.
+	maxKeywordTerms = 50000
+	// minPhraseCount is how often a two-word phrase must occur in a
+	// document to be a keyword of it.
+	minPhraseCount = 2
+	// phraseWeight ranks a phrase above its words when it makes up most
+	// of their occurrences: "قرارداد اجاره" says more than "اجاره".
+	phraseWeight = 2
+)
+
+// keywordIndex counts the documents each term occurs in.
+type keywordIndex struct {
+	mu   sync.Mutex
+	path string
+	Docs int            `json:"docs"`
+	DF   map[string]int `json:"df"` // normalized term -> documents containing it
+}
+
+var keywordStats = &keywordIndex{DF: map[string]int{}}
+
+func openKeywordIndex(path string) (*keywordIndex, error) {
+	x := &keywordIndex{path: path, DF: map[string]int{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, x); err != nil {
+		return nil, err
+	}
+	if x.DF == nil {
+		x.DF = map[string]int{}
+	}
+	return x, nil
+}
+
+// keywordStopwords are Persian and English words too common to describe
+// a document, in normalizePersian form.
+var keywordStopwords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`
+		و در به از که این را با است برای آن یک خود تا کرد بر هم نیز شده شود می
+		ها های ای اند بود دارد کند باید او ما من شما آنها ایشان هر اما یا اگر پس
+		چه همه دیگر کرده شد کنند وی بین پیش بی روی زیر نه بعد قبل داشت دارند
+		کرده‌اند شده‌است خواهد باشد بوده گفت چون چند چنین همین آنچه ولی زیرا
+		سپس هیچ نیست هست هستند بودند کنیم کنید کردن شدن نمی‌شود می‌شود می‌کند
+		توسط طی درباره مورد نظر عنوان اینکه آن‌ها این‌ها یکی دو سه جا آیا الا
+		صفحه
+		the a an and or of to in on at for with by from as is are was were be
+		been it its this that these those not no but if so than then there
+		which who whom what when where why how all any each page`) {
+		keywordStopwords[normalizePersian(w)] = true
+	}
+}
+
+// extractKeywords ranks the terms of the text, updates the document
+// frequencies and returns the top keywordCount terms as they are written
+// in the text.
+func extractKeywords(j Job, textFile string) []string {
+	if keywordCount <= 0 || textFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(textFile)
+	if err != nil {
+		log.Printf("job %s: reading the text for keywords: %v", j.ID, err)
+		return nil
+	}
+	tf, surface := termCounts(string(data))
+	if len(tf) == 0 {
+		return nil
+	}
+	idf := keywordStats.add(tf)
+
+	type scored struct {
+		term  string
+		score float64
+	}
+	total := 0
+	for _, n := range tf {
+		total += n
+	}
+	var ranked []scored
+	for t, n := range tf {
+		score := float64(n) / float64(total) * idf[t]
+		if strings.Contains(t, " ") {
+			score *= phraseWeight
+		}
+		ranked = append(ranked, scored{t, score})
+	}
+	slices.SortFunc(ranked, func(a, b scored) int {
+		if a.score != b.score {
+			if a.score > b.score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.term, b.term)
+	})
+
+	var keywords, taken []string
+	for _, s := range ranked {
+		if len(keywords) == keywordCount {
+			break
+		}
+		// Skip a word of a phrase already chosen, and a phrase of words
+		// already chosen.
+		dup := false
+		for _, t := range taken {
+			if strings.Contains(" "+t+" ", " "+s.term+" ") || strings.Contains(" "+s.term+" ", " "+t+" ") {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		taken = append(taken, s.term)
+		keywords = append(keywords, surface[s.term])
+	}
+	return keywords
+}
+
+// termCounts returns how often each word and repeated two-word phrase
+// occurs in the text, by normalized form, and the spelling each occurs
+// with most.
+func termCounts(text string) (map[string]int, map[string]string) {
+	tf := map[string]int{}
+	spellings := map[string]map[string]int{}
+	count := func(key, raw string) {
+		tf[key]++
+		if spellings[key] == nil {
+			spellings[key] = map[string]int{}
+		}
+		spellings[key][raw]++
+	}
+	for _, sec := range splitPages(text) {
+		for _, line := range strings.Split(sec.text, "\n") {
+			var prev, prevRaw string
+			for _, raw := range strings.FieldsFunc(line, func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.Is(unicode.Mn, r) && r != '\u200c'
+			}) {
+				raw = strings.Trim(raw, "\u200c")
+				key := normalizePersian(raw)
+				if len([]rune(key)) < 2 || keywordStopwords[key] {
+					prev = ""
+					continue
+				}
+				count(key, raw)
+				if prev != "" {
+					count(prev+" "+key, prevRaw+" "+raw)
+				}
+				prev, prevRaw = key, raw
+			}
+		}
+	}
+	surface := map[string]string{}
+	for key, n := range tf {
+		if strings.Contains(key, " ") && n < minPhraseCount {
+			delete(tf, key)
+			continue
+		}
+		best, most := "", 0
+		for raw, m := range spellings[key] {
+			if m > most || m == most && raw < best {
+				best, most = raw, m
+			}
+		}
+		surface[key] = best
+	}
+	return tf, surface
+}
+
+// add counts a new document with the terms of tf and returns their
+// inverse document frequencies, the document itself included.
+func (x *keywordIndex) add(tf map[string]int) map[string]float64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.Docs++
+	idf := make(map[string]float64, len(tf))
+	for t := range tf {
+		x.DF[t]++
+		idf[t] = math.Log(float64(x.Docs+1)/float64(x.DF[t]+1)) + 1
+	}
+	x.pruneLocked()
+	x.saveLocked()
+	return idf
+}
+
+// pruneLocked forgets the rarest terms once there are more than
+// maxKeywordTerms. A forgotten term counts as new when it comes back,
+// which only flatters it slightly.
+func (x *keywordIndex) pruneLocked() {
+	for floor := 1; len(x.DF) > maxKeywordTerms; floor++ {
+		for t, n := range x.DF {
+			if n <= floor {
+				delete(x.DF, t)
+			}
+		}
+	}
+}
+
+func (x *keywordIndex) saveLocked() {
+	if x.path == "" {
+		return
+	}
+	data, err := json.Marshal(x)
+	if err == nil {
+		err = writeFileAtomic(x.path, data)
+	}
+	if err != nil {
+		log.Printf("saving the keyword statistics: %v", err)
+	}
+}
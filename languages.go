@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tesseractLanguage matches a Tesseract language string such as "fas" or
+// "eng+fas": traineddata names joined with '+'.
+var tesseractLanguage = regexp.MustCompile(`^[A-Za-z0-9_]+(\+[A-Za-z0-9_]+)*$`)
+
+// pageLanguage sets the languages for pages First through Last. Last is 0
+// for a range that runs to the end of the document.
+type pageLanguage struct {
+	First, Last int
+	Lang        string
+}
+
+// languageMap overrides the document languages for ranges of pages. Ranges
+// are sorted and never overlap.
+type languageMap []pageLanguage
+
+// parseLanguageMap reads page language overrides such as "1-10=eng,11-=fas".
+// Each item is a page ("3"), a range ("1-10") or an open range ("11-")
+// followed by '=' and a language string.
+func parseLanguageMap(s string) (languageMap, error) {
+	var m languageMap
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pages, lang, ok := strings.Cut(item, "=")
+		lang = strings.TrimSpace(lang)
+		if !ok {
+			return nil, fmt.Errorf("invalid page languages %q: use pages=languages, e.g. 1-10=eng", item)
+		}
+		if err := checkLanguages(lang); err != nil {
+			return nil, err
+		}
+		first, last, err := parsePageRange(strings.TrimSpace(pages))
+		if err != nil {
+			return nil, fmt.Errorf("invalid page languages %q: %v", item, err)
+		}
+		m = append(m, pageLanguage{First: first, Last: last, Lang: lang})
+	}
+	sort.Slice(m, func(a, b int) bool { return m[a].First < m[b].First })
+	for i := 1; i < len(m); i++ {
+		if prev := m[i-1]; prev.Last == 0 || prev.Last >= m[i].First {
+			return nil, fmt.Errorf("page languages %s and %s overlap", prev.pages(), m[i].pages())
+		}
+	}
+	return m, nil
+}
+
+func parsePageRange(s string) (first, last int, err error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if first, err = strconv.Atoi(strings.TrimSpace(from)); err != nil || first < 1 {
+		return 0, 0, fmt.Errorf("%q is not a page number", from)
+	}
+	if !isRange {
+		return first, first, nil
+	}
+	if to = strings.TrimSpace(to); to == "" {
+		return first, 0, nil
+	}
+	if last, err = strconv.Atoi(to); err != nil || last < first {
+		return 0, 0, fmt.Errorf("%q is not a page number from %d on", to, first)
+	}
+	return first, last, nil
+}
+
+func (p pageLanguage) pages() string {
+	switch p.Last {
+	case p.First:
+		return strconv.Itoa(p.First)
+	case 0:
+		return strconv.Itoa(p.First) + "-"
+	}
+	return strconv.Itoa(p.First) + "-" + strconv.Itoa(p.Last)
+}
+
+// String returns the map in the form parseLanguageMap reads. This is what
+// the OCR script receives in OCR_PAGE_LANGUAGES.
+func (m languageMap) String() string {
+	items := make([]string, len(m))
+	for i, p := range m {
+		items[i] = p.pages() + "=" + p.Lang
+	}
+	return strings.Join(items, ",")
+}
+
+// checkLanguages validates a Tesseract language string and, when tesseract
+// is on the PATH, that every language in it is installed.
+func checkLanguages(lang string) error {
+	if !tesseractLanguage.MatchString(lang) {
+		return fmt.Errorf("invalid language %q: use Tesseract codes joined with '+', e.g. eng+fas", lang)
+	}
+	installed := installedLanguages()
+	if installed == nil {
+		return nil
+	}
+	for _, l := range strings.Split(lang, "+") {
+		if !installed[l] {
+			return fmt.Errorf("language %q is not installed on this server", l)
+		}
+	}
+	return nil
+}
+
+var (
+	languagesOnce sync.Once
+	languagesSet  map[string]bool
+)
+
+// installedLanguages returns the languages reported by tesseract
+// --list-langs, or nil if tesseract cannot be run.
+func installedLanguages() map[string]bool {
+	languagesOnce.Do(func() {
+		out, err := exec.Command("tesseract", "--list-langs").Output()
+		if err != nil {
+			return
+		}
+		set := map[string]bool{}
+		for _, l := range strings.Split(string(out), "\n")[1:] {
+			if l = strings.TrimSpace(l); l != "" {
+				set[l] = true
+			}
+		}
+		languagesSet = set
+	})
+	return languagesSet
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ldapDir is the LDAP or Active Directory server people sign in to the web
+// UI with, by user name and password. nil leaves the web UI open to anyone,
+// unless an OpenID Connect provider is configured instead.
+var ldapDir *ldapDirectory
+
+const ldapTimeout = 10 * time.Second // time a sign-in may take at the directory
+
+var (
+	errLDAPCredentials = errors.New("invalid user name or password")
+	errLDAPNotAllowed  = errors.New("not a member of a group allowed to sign in")
+)
+
+// ldapDirectory checks passwords the way most LDAP applications do: it binds
+// with a service account, searches the base DN for the one entry whose user
+// attribute is the name signed in with, then binds as that entry with the
+// password. Each sign-in uses a connection of its own.
+type ldapDirectory struct {
+	url          *url.URL
+	startTLS     bool
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	userAttr     string
+	groupRoles   map[string]string // normalized group DN -> role, see normalizeDN
+	membersOnly  bool              // the user role is mapped, so only members of mapped groups sign in
+}
+
+func newLDAPDirectory(cfg Config) (*ldapDirectory, error) {
+	u, err := url.Parse(cfg.LDAPURL)
+	if err != nil || u.Host == "" || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+		return nil, fmt.Errorf("-ldap-url must be ldap://host[:port] or ldaps://host[:port], got %q", cfg.LDAPURL)
+	}
+	if cfg.LDAPStartTLS && u.Scheme == "ldaps" {
+		return nil, errors.New("-ldap-start-tls cannot be used with an ldaps:// URL")
+	}
+	if cfg.LDAPBaseDN == "" {
+		return nil, errors.New("-ldap-base-dn is required with -ldap-url")
+	}
+	if cfg.LDAPUserAttr == "" {
+		return nil, errors.New("-ldap-user-attr must not be empty")
+	}
+	d := &ldapDirectory{
+		url:          u,
+		startTLS:     cfg.LDAPStartTLS,
+		bindDN:       cfg.LDAPBindDN,
+		bindPassword: cfg.LDAPBindPassword,
+		baseDN:       cfg.LDAPBaseDN,
+		userAttr:     cfg.LDAPUserAttr,
+		groupRoles:   map[string]string{},
+	}
+	for _, entry := range strings.Split(cfg.LDAPGroupRoles, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		role, group, ok := strings.Cut(entry, "=")
+		role = strings.TrimSpace(role)
+		if !ok || role == "" || strings.TrimSpace(group) == "" {
+			return nil, fmt.Errorf("-ldap-group-roles: %q is not role=group DN", entry)
+		}
+		if err := checkRole(role); err != nil {
+			return nil, fmt.Errorf("-ldap-group-roles: %v", err)
+		}
+		d.groupRoles[normalizeDN(group)] = role
+		d.membersOnly = d.membersOnly || role == roleUser
+	}
+	return d, nil
+}
+
+// normalizeDN lets group DNs be compared the way directories do: ignoring
+// case and the spaces around the commas between their components.
+func normalizeDN(dn string) string {
+	parts := strings.Split(strings.ToLower(dn), ",")
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
+	}
+	return strings.Join(parts, ",")
+}
+
+// role is the highest role mapped to one of groups, the memberOf values of
+// the signed-in entry. Users outside every mapped group have no role, and
+// may not sign in at all when the user role is mapped to a group.
+func (d *ldapDirectory) role(groups []string) (string, error) {
+	role := ""
+	for _, g := range groups {
+		if r, ok := d.groupRoles[normalizeDN(g)]; ok && (role == "" || roleAtLeast(r, role)) {
+			role = r
+		}
+	}
+	if role == "" && d.membersOnly {
+		return "", errLDAPNotAllowed
+	}
+	return role, nil
+}
+
+// authenticate checks the password of user and returns the session of the
+// directory entry. Unknown users and wrong passwords are both
+// errLDAPCredentials.
+func (d *ldapDirectory) authenticate(ctx context.Context, user, password string) (*session, error) {
+	// A simple bind with an empty password is an unauthenticated bind,
+	// which many directories accept for any DN.
+	if user == "" || password == "" {
+		return nil, errLDAPCredentials
+	}
+	ctx, cancel := context.WithTimeout(ctx, ldapTimeout)
+	defer cancel()
+	c, err := d.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	if d.bindDN != "" {
+		if err := c.bind(d.bindDN, d.bindPassword); err != nil {
+			return nil, fmt.Errorf("bind as %s: %w", d.bindDN, err)
+		}
+	}
+	entries, err := c.search(d.baseDN, d.userAttr, user, []string{d.userAttr, "mail", "displayName", "memberOf"})
+	if err != nil {
+		return nil, fmt.Errorf("search %s: %w", d.baseDN, err)
+	}
+	switch len(entries) {
+	case 0:
+		return nil, errLDAPCredentials
+	case 1:
+	default:
+		return nil, fmt.Errorf("more than one entry below %s has %s=%s", d.baseDN, d.userAttr, user)
+	}
+	e := entries[0]
+	if err := c.bind(e.dn, password); err != nil {
+		var lerr *ldapError
+		if errors.As(err, &lerr) && lerr.code == ldapInvalidCredentials {
+			return nil, errLDAPCredentials
+		}
+		return nil, fmt.Errorf("bind as %s: %w", e.dn, err)
+	}
+	role, err := d.role(e.attrs["memberof"])
+	if err != nil {
+		return nil, err
+	}
+	s := &session{Subject: e.dn, Login: e.first(d.userAttr), Email: e.first("mail"), Name: e.first("displayName"), Role: role}
+	if s.Login == "" {
+		s.Login = user
+	}
+	return s, nil
+}
+
+type loginPage struct {
+	Error    string
+	Next     string
+	Username string
+	CSRF     string // see csrf.go
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, page loginPage) {
+	page.CSRF = csrfToken(w, r)
+	tmpl := template.Must(template.New("login.html").Funcs(pageFuncs).ParseFiles("templates/login.html"))
+	tmpl.Execute(w, page)
+}
+
+// ldapLoginPageHandler shows the sign-in form.
+func ldapLoginPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderLogin(w, r, loginPage{Next: localPath(r.URL.Query().Get("next"))})
+}
+
+// ldapLoginHandler signs the user in with the password from the sign-in
+// form. Why a sign-in was refused is only told apart where it does not
+// reveal which user names exist.
+func ldapLoginHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	page := loginPage{Next: localPath(r.FormValue("next")), Username: strings.TrimSpace(r.FormValue("username"))}
+	if !validCSRF(r) {
+		// A sign-in from another site's form would sign the browser in to
+		// the other site's account.
+		w.WriteHeader(http.StatusForbidden)
+		page.Error = "The form has expired; sign in again"
+		renderLogin(w, r, page)
+		return
+	}
+	s, err := ldapDir.authenticate(r.Context(), page.Username, r.FormValue("password"))
+	switch {
+	case errors.Is(err, errLDAPCredentials):
+		w.WriteHeader(http.StatusUnauthorized)
+		page.Error = "Invalid user name or password"
+	case errors.Is(err, errLDAPNotAllowed):
+		w.WriteHeader(http.StatusForbidden)
+		page.Error = "Your account may not use this service"
+	case err != nil:
+		log.Printf("LDAP login of %q: %v", page.Username, err)
+		w.WriteHeader(http.StatusBadGateway)
+		page.Error = "The directory is not reachable; try again later"
+	default:
+		startSession(w, r, *s, page.Next)
+		return
+	}
+	renderLogin(w, r, page)
+}
+
+// LDAP result codes the sign-in tells apart (RFC 4511, appendix A).
+const (
+	ldapSuccess            = 0
+	ldapSizeLimitExceeded  = 4
+	ldapInvalidCredentials = 49
+)
+
+// BER tags of the LDAP messages the sign-in sends and receives.
+const (
+	tagInteger      = 0x02
+	tagOctetString  = 0x04
+	tagEnumerated   = 0x0a
+	tagBoolean      = 0x01
+	tagSequence     = 0x30
+	tagBindRequest  = 0x60
+	tagBindResponse = 0x61
+	tagSearchReq    = 0x63
+	tagSearchEntry  = 0x64
+	tagSearchDone   = 0x65
+	tagSearchRef    = 0x73
+	tagExtendedReq  = 0x77
+	tagExtendedResp = 0x78
+	tagUnbind       = 0x42
+	tagSimpleAuth   = 0x80 // [0] of BindRequest.authentication, also ExtendedRequest.requestName
+	tagEqualityFilt = 0xa3
+)
+
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// ldapMaxMessage bounds the messages read from the directory, which for a
+// user with a great many groups can still be large.
+const ldapMaxMessage = 1 << 20
+
+type ldapError struct {
+	code    int
+	message string
+}
+
+func (e *ldapError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("LDAP result %d", e.code)
+	}
+	return fmt.Sprintf("LDAP result %d: %s", e.code, e.message)
+}
+
+type ldapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int
+}
+
+func (d *ldapDirectory) dial(ctx context.Context) (*ldapConn, error) {
+	host := d.url.Host
+	if d.url.Port() == "" {
+		port := "389"
+		if d.url.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(d.url.Hostname(), port)
+	}
+	tlsConfig := &tls.Config{ServerName: d.url.Hostname()}
+	var conn net.Conn
+	var err error
+	if d.url.Scheme == "ldaps" {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if d.startTLS {
+		if err := c.request(berTLV(tagExtendedReq, berString(tagSimpleAuth, ldapStartTLSOID)), tagExtendedResp); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+		tconn := tls.Client(conn, tlsConfig)
+		if err := tconn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+		c.conn, c.r = tconn, bufio.NewReader(tconn)
+	}
+	return c, nil
+}
+
+func (c *ldapConn) close() {
+	c.send(berTLV(tagUnbind))
+	c.conn.Close()
+}
+
+func (c *ldapConn) send(op []byte) error {
+	c.id++
+	_, err := c.conn.Write(berTLV(tagSequence, berInt(tagInteger, c.id), op))
+	return err
+}
+
+// receive reads the next response to the last request sent, returning its
+// protocol operation.
+func (c *ldapConn) receive() (byte, []byte, error) {
+	for {
+		tag, msg, err := readBER(c.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if tag != tagSequence {
+			return 0, nil, fmt.Errorf("unexpected message tag %#x", tag)
+		}
+		_, idData, rest, err := berNext(msg)
+		if err != nil {
+			return 0, nil, err
+		}
+		opTag, op, _, err := berNext(rest)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch id := berIntValue(idData); id {
+		case c.id:
+			return opTag, op, nil
+		case 0:
+			// An unsolicited notification, sent before the directory
+			// closes the connection.
+			if err := ldapResult(op); err != nil {
+				return 0, nil, err
+			}
+			return 0, nil, errors.New("the directory closed the connection")
+		}
+	}
+}
+
+// request sends op and checks the result of the response, which must have
+// the tag want.
+func (c *ldapConn) request(op []byte, want byte) error {
+	if err := c.send(op); err != nil {
+		return err
+	}
+	tag, resp, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if tag != want {
+		return fmt.Errorf("unexpected response tag %#x", tag)
+	}
+	return ldapResult(resp)
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	return c.request(berTLV(tagBindRequest,
+		berInt(tagInteger, 3),
+		berString(tagOctetString, dn),
+		berString(tagSimpleAuth, password),
+	), tagBindResponse)
+}
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string // keyed by lower case attribute name
+}
+
+func (e ldapEntry) first(attr string) string {
+	if v := e.attrs[strings.ToLower(attr)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// search returns the entries below base whose attr equals value, asking
+// for at most two so an ambiguous user name is noticed.
+func (c *ldapConn) search(base, attr, value string, attrs []string) ([]ldapEntry, error) {
+	var list [][]byte
+	for _, a := range attrs {
+		list = append(list, berString(tagOctetString, a))
+	}
+	err := c.send(berTLV(tagSearchReq,
+		berString(tagOctetString, base),
+		berInt(tagEnumerated, 2), // wholeSubtree
+		berInt(tagEnumerated, 0), // neverDerefAliases
+		berInt(tagInteger, 2),    // sizeLimit
+		berInt(tagInteger, int(ldapTimeout/time.Second)),
+		berTLV(tagBoolean, []byte{0}), // typesOnly
+		berTLV(tagEqualityFilt, berString(tagOctetString, attr), berString(tagOctetString, value)),
+		berTLV(tagSequence, list...),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		tag, op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagSearchEntry:
+			e, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case tagSearchRef:
+			// Referrals to other servers, which Active Directory returns
+			// for searches at the domain root, are not followed.
+		case tagSearchDone:
+			var lerr *ldapError
+			if err := ldapResult(op); err != nil && !(errors.As(err, &lerr) && lerr.code == ldapSizeLimitExceeded) {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("unexpected response tag %#x", tag)
+		}
+	}
+}
+
+func parseEntry(op []byte) (ldapEntry, error) {
+	_, dn, rest, err := berNext(op)
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	_, list, _, err := berNext(rest)
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	e := ldapEntry{dn: string(dn), attrs: map[string][]string{}}
+	for len(list) > 0 {
+		var attr []byte
+		if _, attr, list, err = berNext(list); err != nil {
+			return ldapEntry{}, err
+		}
+		_, name, rest, err := berNext(attr)
+		if err != nil {
+			return ldapEntry{}, err
+		}
+		_, vals, _, err := berNext(rest)
+		if err != nil {
+			return ldapEntry{}, err
+		}
+		key := strings.ToLower(string(name))
+		for len(vals) > 0 {
+			var v []byte
+			if _, v, vals, err = berNext(vals); err != nil {
+				return ldapEntry{}, err
+			}
+			e.attrs[key] = append(e.attrs[key], string(v))
+		}
+	}
+	return e, nil
+}
+
+// ldapResult returns the error of an LDAPResult, nil on success.
+func ldapResult(op []byte) error {
+	_, code, rest, err := berNext(op)
+	if err != nil {
+		return err
+	}
+	lerr := &ldapError{code: berIntValue(code)}
+	if lerr.code == ldapSuccess {
+		return nil
+	}
+	if _, _, rest, err = berNext(rest); err == nil { // matchedDN
+		if _, msg, _, err := berNext(rest); err == nil {
+			lerr.message = string(msg)
+		}
+	}
+	return lerr
+}
+
+// berTLV encodes an element of the given tag holding the concatenated
+// encoded elements parts.
+func berTLV(tag byte, parts ...[]byte) []byte {
+	var n int
+	for _, p := range parts {
+		n += len(p)
+	}
+	b := append([]byte{tag}, berLength(n)...)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+// berInt encodes a non-negative integer in the fewest bytes.
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berIntValue(b []byte) int {
+	n := 0
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		n = -1
+	}
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n
+}
+
+// berNext splits the first element off b, returning its tag and contents.
+func berNext(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag, n, hdr := b[0], int(b[1]), 2
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < 2+size {
+			return 0, nil, nil, errors.New("bad BER length")
+		}
+		n = 0
+		for _, c := range b[2 : 2+size] {
+			n = n<<8 | int(c)
+		}
+		hdr += size
+	}
+	if n > len(b)-hdr {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, b[hdr : hdr+n], b[hdr+n:], nil
+}
+
+// readBER reads one element from r, refusing ones over ldapMaxMessage.
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return 0, nil, errors.New("bad BER length")
+		}
+		lb := make([]byte, size)
+		if _, err := io.ReadFull(r, lb); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, c := range lb {
+			n = n<<8 | int(c)
+		}
+	}
+	if n > ldapMaxMessage {
+		return 0, nil, fmt.Errorf("LDAP message of %d bytes is too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], data, nil
+}
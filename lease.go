@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Several server instances may share the user_file volume. Before an
+// instance works on a job, or removes its files, it takes the job's lease:
+// a lease.json file in the job's upload directory naming the instance and
+// an expiry. The lease is renewed while the work runs, so a crashed
+// instance's jobs become claimable again after leaseTTL. Expiry uses wall
+// clock time, so the instances' clocks must be roughly in sync.
+const (
+	leaseName  = "lease.json"
+	leaseTTL   = time.Minute
+	leaseRenew = leaseTTL / 3
+)
+
+var errLeaseHeld = errors.New("the job is being worked on by another server instance")
+
+// instanceID names this process in lease files.
+var instanceID string
+
+func init() {
+	host, _ := os.Hostname()
+	instanceID = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), randomHex(4))
+}
+
+type leaseFile struct {
+	Instance string    `json:"instance"`
+	Token    string    `json:"token"`
+	Expires  time.Time `json:"expires"`
+}
+
+// jobLease is a lease held by this instance.
+type jobLease struct {
+	path   string
+	token  string
+	cancel context.CancelFunc
+	lost   bool          // set by renew once the lease was taken over
+	done   chan struct{} // closed by release
+	exited chan struct{} // closed when renew returns
+}
+
+// acquireLease takes the lease on the job whose upload lives in dir. It
+// fails with errLeaseHeld while another instance holds a live lease. The
+// returned context is cancelled if the lease is lost, and must be released
+// with release.
+func acquireLease(ctx context.Context, dir string) (*jobLease, context.Context, error) {
+	path := filepath.Join(dir, leaseName)
+	l := &jobLease{path: path, token: randomHex(16), done: make(chan struct{}), exited: make(chan struct{})}
+	for attempt := 0; attempt < 3; attempt++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			data, _ := json.Marshal(l.content())
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, nil, err
+			}
+			ctx, l.cancel = context.WithCancel(ctx)
+			go l.renew()
+			return l, ctx, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, nil, err
+		}
+		if leaseLive(path) {
+			return nil, nil, errLeaseHeld
+		}
+		// The holder is gone. Move its lease aside; of several instances
+		// doing this at once only one rename succeeds, the others retry.
+		tomb := path + "." + randomHex(4)
+		if err := os.Rename(path, tomb); err != nil {
+			continue
+		}
+		if leaseLive(tomb) {
+			// A fresh lease was created between the check and the
+			// rename. Put it back; its holder never notices. Should yet
+			// another lease be at path by now, the moved one is kept,
+			// not removed as if it were stale.
+			if err := os.Link(tomb, path); err == nil {
+				os.Remove(tomb)
+			}
+			return nil, nil, errLeaseHeld
+		}
+		os.Remove(tomb)
+	}
+	return nil, nil, errLeaseHeld
+}
+
+func (l *jobLease) content() leaseFile {
+	return leaseFile{Instance: instanceID, Token: l.token, Expires: time.Now().Add(leaseTTL).UTC()}
+}
+
+// renew extends the lease until release is called. If the file no longer
+// carries this lease's token another instance has taken over, and the
+// work is cancelled.
+func (l *jobLease) renew() {
+	defer close(l.exited)
+	t := time.NewTicker(leaseRenew)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+		}
+		cur, err := readLease(l.path)
+		if err != nil || cur.Token != l.token {
+			log.Printf("lost lease %s to %s", l.path, cur.Instance)
+			l.lost = true
+			l.cancel()
+			return
+		}
+		data, _ := json.Marshal(l.content())
+		if err := writeFileAtomic(l.path, data); err != nil {
+			log.Printf("renewing lease %s: %v", l.path, err)
+		}
+	}
+}
+
+// release gives the lease up. It reports false if the lease had been lost,
+// in which case the caller must not publish the results of its work.
+func (l *jobLease) release() bool {
+	close(l.done)
+	<-l.exited
+	l.cancel()
+	if cur, err := readLease(l.path); err == nil && cur.Token == l.token {
+		os.Remove(l.path)
+		return !l.lost
+	}
+	return false
+}
+
+func readLease(path string) (leaseFile, error) {
+	var lf leaseFile
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &lf)
+	}
+	return lf, err
+}
+
+// leaseLive reports whether the lease at path is held by a running
+// instance. A file that is not readable yet was probably just created and
+// counts as live until it is older than leaseTTL.
+func leaseLive(path string) bool {
+	if lf, err := readLease(path); err == nil {
+		return time.Now().Before(lf.Expires)
+	}
+	fi, err := os.Stat(path)
+	return err == nil && time.Since(fi.ModTime()) < leaseTTL
+}
+
+// jobLeaseLive reports whether another instance may be working on job id.
+// The job's directory is looked up on disk, as the job may not be loaded
+// yet.
+func jobLeaseLive(id string) bool {
+	for _, pattern := range []string{filepath.Join("user_file", id, leaseName), filepath.Join("user_file", "*", id, leaseName)} {
+		paths, _ := filepath.Glob(pattern)
+		for _, p := range paths {
+			if leaseLive(p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
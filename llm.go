@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// llmClient talks to a language model over the OpenAI chat completions
+// API, which hosted services and self-hosted servers such as Ollama, vLLM
+// and llama.cpp all offer. The model fixes recognition errors and
+// summarizes documents, see correct.go and summary.go.
+type llmClient struct {
+	url    string // base URL, such as http://localhost:11434/v1
+	model  string
+	apiKey string // sent as a bearer token, empty for servers without keys
+	client *http.Client
+}
+
+// languageModel is the configured model, nil without -llm-url.
+var languageModel *llmClient
+
+// maxLLMResponse bounds the answer read from the model.
+const maxLLMResponse = 4 << 20
+
+func newLLMClient(url, model, apiKey string, timeout time.Duration) (*llmClient, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("-llm-url must be an http or https URL, got %q", url)
+	}
+	if model == "" {
+		return nil, errors.New("-llm-url needs -llm-model")
+	}
+	return &llmClient{url: strings.TrimSuffix(url, "/"), model: model, apiKey: apiKey, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// complete sends one system and one user message and returns the model's
+// answer.
+func (c *llmClient) complete(ctx context.Context, system, user string) (string, error) {
+	body, err := json.Marshal(map[string]any{
+		"model": c.model,
+		"messages": []map[string]string{
+			{"role": "system", "content": system},
+			{"role": "user", "content": user},
+		},
+		"temperature": 0,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxLLMResponse))
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	jerr := json.Unmarshal(data, &out)
+	switch {
+	case resp.StatusCode >= 300 && out.Error != nil:
+		return "", fmt.Errorf("the language model answered %s: %s", resp.Status, out.Error.Message)
+	case resp.StatusCode >= 300:
+		return "", fmt.Errorf("the language model answered %s", resp.Status)
+	case jerr != nil:
+		return "", fmt.Errorf("reading the language model's answer: %w", jerr)
+	case len(out.Choices) == 0:
+		return "", errors.New("the language model gave no answer")
+	}
+	return out.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsageRecord is the billable summary of one finished job.
+type UsageRecord struct {
+	Time         time.Time `json:"time"`
+	Month        string    `json:"month"` // "2006-01", UTC
+	Account      string    `json:"account"`
+	JobID        string    `json:"job_id"`
+	Engine       string    `json:"engine"`
+	Pages        int       `json:"pages"`
+	StorageBytes int64     `json:"storage_bytes"` // upload plus results when the job finished
+	Cost         float64   `json:"cost"`          // Pages × the engine's price per page
+}
+
+// UsageRollup totals the records of one account for one month.
+type UsageRollup struct {
+	Month        string  `json:"month"`
+	Account      string  `json:"account"`
+	Jobs         int     `json:"jobs"`
+	Pages        int     `json:"pages"`
+	StorageBytes int64   `json:"storage_bytes"`
+	Cost         float64 `json:"cost"`
+}
+
+// engineCosts is the price per page of each engine, for engines billed by
+// a cloud provider. Engines without an entry cost nothing.
+var engineCosts = map[string]float64{}
+
+// parseEngineCosts reads "engine=price,engine=price".
+func parseEngineCosts(s string) (map[string]float64, error) {
+	costs := map[string]float64{}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, price, ok := strings.Cut(part, "=")
+		p, err := strconv.ParseFloat(strings.TrimSpace(price), 64)
+		if !ok || err != nil || p < 0 {
+			return nil, fmt.Errorf("invalid engine cost %q, want engine=price", part)
+		}
+		costs[strings.TrimSpace(name)] = p
+	}
+	return costs, nil
+}
+
+// meterStore is the append-only ledger of usage records, one JSON object
+// per line under the data directory. It outlives the jobs themselves, so
+// billing exports stay correct after results are deleted.
+type meterStore struct {
+	mu      sync.Mutex
+	path    string
+	records []UsageRecord
+}
+
+var meter = &meterStore{}
+
+func openMeter(path string) (*meterStore, error) {
+	s := &meterStore{path: path}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec UsageRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			log.Printf("skipping unreadable usage record in %s: %v", path, err)
+			continue
+		}
+		s.records = append(s.records, rec)
+	}
+	return s, sc.Err()
+}
+
+// record meters a finished job.
+func (s *meterStore) record(j Job, pages int) {
+	now := time.Now().UTC()
+	rec := UsageRecord{
+		Time:         now,
+		Month:        usageMonth(now),
+		Account:      j.account,
+		JobID:        j.ID,
+		Engine:       j.Engine,
+		Pages:        pages,
+		StorageBytes: jobStorage(j),
+		Cost:         math.Round(float64(pages)*engineCosts[j.Engine]*1e6) / 1e6,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, rec)
+	if s.path == "" {
+		return
+	}
+	line, _ := json.Marshal(rec)
+	if err := appendLine(s.path, line); err != nil {
+		log.Printf("saving usage record for job %s: %v", j.ID, err)
+	}
+}
+
+// usageQuery selects records: account is an exact match, months an
+// inclusive "2006-01" range. Empty fields match everything.
+type usageQuery struct {
+	Account  string
+	From, To string
+}
+
+func parseUsageQuery(q url.Values) (usageQuery, error) {
+	uq := usageQuery{Account: q.Get("account"), From: q.Get("from"), To: q.Get("to")}
+	if m := q.Get("month"); m != "" {
+		uq.From, uq.To = m, m
+	}
+	for _, m := range []string{uq.From, uq.To} {
+		if _, err := time.Parse("2006-01", m); m != "" && err != nil {
+			return uq, fmt.Errorf("months must look like 2024-03, got %q", m)
+		}
+	}
+	return uq, nil
+}
+
+func (s *meterStore) list(q usageQuery) []UsageRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []UsageRecord{}
+	for _, r := range s.records {
+		if (q.Account == "" || r.Account == q.Account) &&
+			(q.From == "" || r.Month >= q.From) && (q.To == "" || r.Month <= q.To) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// rollup totals the selected records per month and account.
+func (s *meterStore) rollup(q usageQuery) []UsageRollup {
+	byKey := map[[2]string]*UsageRollup{}
+	for _, r := range s.list(q) {
+		k := [2]string{r.Month, r.Account}
+		u := byKey[k]
+		if u == nil {
+			u = &UsageRollup{Month: r.Month, Account: r.Account}
+			byKey[k] = u
+		}
+		u.Jobs++
+		u.Pages += r.Pages
+		u.StorageBytes += r.StorageBytes
+		u.Cost += r.Cost
+	}
+	out := make([]UsageRollup, 0, len(byKey))
+	for _, u := range byKey {
+		u.Cost = math.Round(u.Cost*1e6) / 1e6
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].Month != out[b].Month {
+			return out[a].Month < out[b].Month
+		}
+		return out[a].Account < out[b].Account
+	})
+	return out
+}
+
+// jobStorage is the disk space a job's upload and results take up.
+func jobStorage(j Job) int64 {
+	var total int64
+	for _, dir := range []string{filepath.Dir(j.inputPath), j.outputDir} {
+		filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if fi, err := d.Info(); err == nil {
+					total += fi.Size()
+				}
+			}
+			return nil
+		})
+	}
+	return total
+}
+
+func appendLine(path string, line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// wantsCSV reports whether the client asked for CSV with ?format=csv or an
+// Accept: text/csv header.
+func wantsCSV(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "csv"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+func writeCSV(w http.ResponseWriter, filename string, header []string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", attachmentDisposition(filename))
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	cw.WriteAll(rows)
+}
+
+func writeUsageRecords(w http.ResponseWriter, r *http.Request, recs []UsageRecord) {
+	if !wantsCSV(r) {
+		writeJSON(w, http.StatusOK, map[string]any{"records": recs})
+		return
+	}
+	rows := make([][]string, len(recs))
+	for i, rec := range recs {
+		rows[i] = []string{rec.Time.Format(time.RFC3339), rec.Month, rec.Account, rec.JobID, rec.Engine,
+			strconv.Itoa(rec.Pages), strconv.FormatInt(rec.StorageBytes, 10), strconv.FormatFloat(rec.Cost, 'f', -1, 64)}
+	}
+	writeCSV(w, "usage.csv", []string{"time", "month", "account", "job_id", "engine", "pages", "storage_bytes", "cost"}, rows)
+}
+
+func writeUsageRollup(w http.ResponseWriter, r *http.Request, rollup []UsageRollup) {
+	if !wantsCSV(r) {
+		writeJSON(w, http.StatusOK, map[string]any{"months": rollup})
+		return
+	}
+	rows := make([][]string, len(rollup))
+	for i, u := range rollup {
+		rows[i] = []string{u.Month, u.Account, strconv.Itoa(u.Jobs), strconv.Itoa(u.Pages),
+			strconv.FormatInt(u.StorageBytes, 10), strconv.FormatFloat(u.Cost, 'f', -1, 64)}
+	}
+	writeCSV(w, "usage-monthly.csv", []string{"month", "account", "jobs", "pages", "storage_bytes", "cost"}, rows)
+}
+
+// v1AdminUsageHandler exports usage records for every account, filtered by
+// ?account=, ?month= or ?from=/&to= (months), as JSON or CSV.
+func v1AdminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseUsageQuery(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_query", err.Error())
+		return
+	}
+	writeUsageRecords(w, r, meter.list(q))
+}
+
+// v1AdminUsageMonthlyHandler is the per-account monthly rollup.
+func v1AdminUsageMonthlyHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseUsageQuery(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_query", err.Error())
+		return
+	}
+	writeUsageRollup(w, r, meter.rollup(q))
+}
+
+// v1AccountUsageHandler and v1AccountUsageMonthlyHandler are the same
+// exports restricted to the caller's own account.
+func v1AccountUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if q, ok := accountUsageQuery(w, r); ok {
+		writeUsageRecords(w, r, meter.list(q))
+	}
+}
+
+func v1AccountUsageMonthlyHandler(w http.ResponseWriter, r *http.Request) {
+	if q, ok := accountUsageQuery(w, r); ok {
+		writeUsageRollup(w, r, meter.rollup(q))
+	}
+}
+
+func accountUsageQuery(w http.ResponseWriter, r *http.Request) (usageQuery, bool) {
+	account, _, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return usageQuery{}, false
+	}
+	q, err := parseUsageQuery(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_query", err.Error())
+		return usageQuery{}, false
+	}
+	q.Account = account
+	return q, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttNotifier publishes job events as JSON to a single MQTT topic, so
+// scanning kiosks and document stations can react without polling.
+type mqttNotifier struct {
+	client mqtt.Client
+	topic  string
+	qos    byte
+}
+
+func newMQTTNotifier(cfg Config) (*mqttNotifier, error) {
+	host, _ := os.Hostname()
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTTBroker).
+		SetClientID("persianocr-" + host).
+		SetUsername(cfg.MQTTUsername).
+		SetPassword(cfg.MQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second)
+
+	client := mqtt.NewClient(opts)
+	// With ConnectRetry set the token only fails on configuration errors;
+	// an unreachable broker is retried in the background.
+	if tok := client.Connect(); tok.WaitTimeout(5*time.Second) && tok.Error() != nil {
+		return nil, fmt.Errorf("connecting to MQTT broker %s: %w", cfg.MQTTBroker, tok.Error())
+	}
+	return &mqttNotifier{client: client, topic: cfg.MQTTTopic, qos: byte(cfg.MQTTQoS)}, nil
+}
+
+func (m *mqttNotifier) Name() string { return "mqtt" }
+
+func (m *mqttNotifier) Notify(ev JobEvent) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	tok := m.client.Publish(m.topic, m.qos, false, payload)
+	if !tok.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("publish to %s timed out", m.topic)
+	}
+	return tok.Error()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultOutputName reproduces the historical <basename>_searchable naming.
+const defaultOutputName = "{original}_searchable"
+
+var outputNameTemplate = defaultOutputName
+
+// namePlaceholder matches {name} and {tag:key} placeholders.
+var namePlaceholder = regexp.MustCompile(`\{([a-z0-9]+)(?::([A-Za-z0-9._-]+))?\}`)
+
+// outputNameVars are the values available to output name templates.
+type outputNameVars struct {
+	Original string // upload file name without extension
+	JobID    string
+	Lang     string // engine language string such as "eng+fas"
+	Time     time.Time
+	Tags     map[string]string
+	Fields   map[string]string // recognized region values, nil until the job is done
+	Class    string            // see Classification, empty until the job is done
+}
+
+// renderOutputName expands tmpl into the file stem shared by every artifact
+// of a job (the .txt, .pdf and log files only differ by suffix).
+//
+//	{original} {date} {time} {datetime} {year} {month} {day} {lang} {job} {id8} {tag:key}
+//
+// A trailing artifact extension in the template such as ".pdf" is dropped,
+// and the result is made safe to use as a single path element.
+func renderOutputName(tmpl string, v outputNameVars) (string, error) {
+	out, err := expandName(trimArtifactExt(tmpl), v)
+	if err != nil {
+		return "", err
+	}
+	out = sanitizeNameElement(out)
+	if out == "" {
+		return "", fmt.Errorf("output name template %q produced an empty name", tmpl)
+	}
+	return out, nil
+}
+
+// renderDeliveryPath expands a destination template such as
+// "{year}/{tag:department}/{field:docnumber}.pdf" into the folder results
+// are filed in and the file stem they are renamed to. Besides the output
+// name placeholders it takes {field:name}, the text recognized in the
+// template region of that name, and {class}, the document's class. Each
+// element is made safe on its own, and one that comes out empty, such as a
+// missing field, becomes "_".
+func renderDeliveryPath(tmpl string, v outputNameVars) (string, string, error) {
+	elems := strings.Split(strings.Trim(trimArtifactExt(tmpl), "/"), "/")
+	for i, e := range elems {
+		out, err := expandName(e, v)
+		if err != nil {
+			return "", "", err
+		}
+		if elems[i] = sanitizeNameElement(out); elems[i] == "" {
+			elems[i] = "_"
+		}
+	}
+	return path.Join(elems[:len(elems)-1]...), elems[len(elems)-1], nil
+}
+
+// validateDestinationTemplate checks a destination template for unknown
+// placeholders.
+func validateDestinationTemplate(tmpl string) error {
+	if len(tmpl) > 200 || strings.Trim(trimArtifactExt(tmpl), "/") == "" {
+		return fmt.Errorf("destination template must name a file, such as {year}/{field:docnumber}.pdf, got %q", tmpl)
+	}
+	_, _, err := renderDeliveryPath(tmpl, outputNameVars{Original: "x", JobID: "00000000-0000-0000-0000-000000000000", Lang: "eng", Time: time.Now(), Fields: map[string]string{}})
+	return err
+}
+
+func trimArtifactExt(tmpl string) string {
+	for _, ext := range []string{".pdf", ".txt"} {
+		tmpl = strings.TrimSuffix(tmpl, ext)
+	}
+	return tmpl
+}
+
+// expandName replaces the placeholders in tmpl.
+func expandName(tmpl string, v outputNameVars) (string, error) {
+	var bad error
+	out := namePlaceholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		sub := namePlaceholder.FindStringSubmatch(m)
+		switch sub[1] {
+		case "original":
+			return v.Original
+		case "date":
+			return v.Time.Format("2006-01-02")
+		case "time":
+			return v.Time.Format("150405")
+		case "datetime":
+			return v.Time.Format("20060102-150405")
+		case "year":
+			return v.Time.Format("2006")
+		case "month":
+			return v.Time.Format("01")
+		case "day":
+			return v.Time.Format("02")
+		case "lang":
+			return v.Lang
+		case "job":
+			return v.JobID
+		case "id8":
+			return strings.ReplaceAll(v.JobID, "-", "")[:min(8, len(v.JobID))]
+		case "tag":
+			if sub[2] == "" {
+				bad = fmt.Errorf("placeholder %s needs a tag key, e.g. {tag:department}", m)
+			}
+			return v.Tags[sub[2]]
+		case "class":
+			if v.Fields == nil {
+				bad = fmt.Errorf("placeholder %s is only available in destination templates, once the document is classified", m)
+			}
+			return v.Class
+		case "field":
+			switch {
+			case sub[2] == "":
+				bad = fmt.Errorf("placeholder %s needs a region name, e.g. {field:docnumber}", m)
+			case v.Fields == nil:
+				bad = fmt.Errorf("placeholder %s is only available in destination templates, once the regions are recognized", m)
+			}
+			return v.Fields[sub[2]]
+		}
+		bad = fmt.Errorf("unknown placeholder %s in name template", m)
+		return ""
+	})
+	return out, bad
+}
+
+// validateOutputName checks a template for unknown placeholders.
+func validateOutputName(tmpl string) error {
+	_, err := renderOutputName(tmpl, outputNameVars{Original: "x", JobID: "00000000-0000-0000-0000-000000000000", Lang: "eng", Time: time.Now()})
+	return err
+}
+
+// sanitizeNameElement strips characters that would turn a generated name
+// into a path, are invalid in Windows file names, or would end or escape
+// a command to smbclient.
+func sanitizeNameElement(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|', ';', '!':
+			return '_'
+		}
+		if r < 0x20 {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.Trim(s, " .")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Route groups the network policy tells apart. Every path is in one of
+// them; downloads, which pages and API responses both link to, are
+// reachable from the networks of either.
+const (
+	groupUI    = "ui"    // the web UI and its login
+	groupAPI   = "api"   // /api, WebDAV and the gRPC API
+	groupAdmin = "admin" // /api/v1/admin
+)
+
+// accessRule restricts a route group to client networks. An address in
+// deny is refused; with an allow list, so is every address outside it.
+type accessRule struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// accessRules are the rules of the route groups that have one, see
+// -allow-ui and the other -allow-* and -deny-* options.
+var accessRules = map[string]accessRule{}
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For header
+// names the client, see -trusted-proxies and clientKey.
+var trustedProxies []netip.Prefix
+
+func trustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseAccessRules(cfg Config) (map[string]accessRule, error) {
+	rules := map[string]accessRule{}
+	for _, g := range []struct {
+		group       string
+		allow, deny string
+	}{
+		{groupUI, cfg.AllowUI, cfg.DenyUI},
+		{groupAPI, cfg.AllowAPI, cfg.DenyAPI},
+		{groupAdmin, cfg.AllowAdmin, cfg.DenyAdmin},
+	} {
+		allow, err := parseNetworks(g.allow)
+		if err != nil {
+			return nil, fmt.Errorf("-allow-%s: %v", g.group, err)
+		}
+		deny, err := parseNetworks(g.deny)
+		if err != nil {
+			return nil, fmt.Errorf("-deny-%s: %v", g.group, err)
+		}
+		if len(allow) > 0 || len(deny) > 0 {
+			rules[g.group] = accessRule{allow: allow, deny: deny}
+		}
+	}
+	return rules, nil
+}
+
+// parseNetworks parses a comma-separated list of addresses and CIDR
+// networks, such as "10.20.0.0/16, 192.0.2.7, fd00::/8".
+func parseNetworks(list string) ([]netip.Prefix, error) {
+	var nets []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addr = addr.Unmap()
+			nets = append(nets, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an address nor a network", s)
+		}
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		nets = append(nets, p.Masked())
+	}
+	return nets, nil
+}
+
+func (a accessRule) allows(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, p := range a.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, p := range a.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupAllows reports whether the rule of group, if it has one, lets
+// addr in.
+func groupAllows(group string, addr netip.Addr) bool {
+	rule, ok := accessRules[group]
+	return !ok || rule.allows(addr)
+}
+
+// routeGroup is the group of the route path belongs to.
+func routeGroup(path string) string {
+	if path == webDAVPrefix || strings.HasPrefix(path, webDAVPrefix+"/") {
+		return groupAPI
+	}
+	rest, ok := strings.CutPrefix(path, "/api")
+	if !ok || rest != "" && !strings.HasPrefix(rest, "/") {
+		return groupUI
+	}
+	if version, sub, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/"); isVersionName(version) {
+		rest = "/" + sub
+	}
+	if rest == "/admin" || strings.HasPrefix(rest, "/admin/") {
+		return groupAdmin
+	}
+	return groupAPI
+}
+
+// networkPolicy refuses requests from client addresses the access rules
+// of their route group do not let in. The web UI answers with its error
+// page, everything else with a JSON error.
+func networkPolicy(next http.Handler) http.Handler {
+	if len(accessRules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHealthPath(r.URL.Path) {
+			// Probes come from the cluster, not the clients.
+			next.ServeHTTP(w, r)
+			return
+		}
+		addr, _ := netip.ParseAddr(clientKey(r))
+		group := routeGroup(r.URL.Path)
+		allowed := groupAllows(group, addr)
+		if strings.HasPrefix(r.URL.Path, "/download/") {
+			allowed = allowed || groupAllows(groupAPI, addr)
+		}
+		switch {
+		case allowed:
+			next.ServeHTTP(w, r)
+		case group == groupUI:
+			w.WriteHeader(http.StatusForbidden)
+			renderError(w, r, "This service is not available from your network")
+		default:
+			writeAPIError(w, http.StatusForbidden, "network_not_allowed", "the "+group+" endpoints are not available from "+clientKey(r))
+		}
+	})
+}
+
+// grpcNetworkPolicy applies the access rules of the API to gRPC calls.
+func grpcNetworkPolicy() []grpc.ServerOption {
+	check := func(ctx context.Context) error {
+		var addr netip.Addr
+		if p, ok := peer.FromContext(ctx); ok {
+			if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+				addr, _ = netip.ParseAddr(host)
+			}
+		}
+		if !groupAllows(groupAPI, addr) {
+			return status.Errorf(codes.PermissionDenied, "the api endpoints are not available from %s", addr)
+		}
+		return nil
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, h grpc.UnaryHandler) (any, error) {
+			if err := check(ctx); err != nil {
+				return nil, err
+			}
+			return h(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, h grpc.StreamHandler) error {
+			if err := check(ss.Context()); err != nil {
+				return err
+			}
+			return h(srv, ss)
+		}),
+	}
+}
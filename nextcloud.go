@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nextcloudAccount is the account documents picked up from Nextcloud are
+// metered against.
+const nextcloudAccount = "nextcloud"
+
+// nextcloudWatcher polls a Nextcloud or ownCloud folder over its WebDAV API,
+// queues every new or changed PDF in it and uploads the searchable PDF and
+// the text next to the original once the job is done.
+type nextcloudWatcher struct {
+	folder   *url.URL // e.g. https://cloud.example.com/remote.php/dav/files/ocr/Scans
+	dest     *Destination
+	interval time.Duration
+
+	mu        sync.Mutex
+	statePath string
+	state     map[string]*nextcloudFile // by decoded path on the server
+}
+
+// nextcloudFile is what the watcher remembers about a file in the folder.
+type nextcloudFile struct {
+	ETag     string `json:"etag,omitempty"`
+	JobID    string `json:"job_id,omitempty"`
+	Uploaded bool   `json:"uploaded,omitempty"` // the job's results were written back
+	Result   bool   `json:"result,omitempty"`   // the file is a result the watcher wrote itself
+}
+
+func newNextcloudWatcher(cfg Config) (*nextcloudWatcher, error) {
+	u, err := url.Parse(strings.TrimSuffix(cfg.NextcloudURL, "/") + "/")
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid Nextcloud folder URL %q", cfg.NextcloudURL)
+	}
+	scheme := "webdav"
+	if u.Scheme == "https" {
+		scheme = "webdavs"
+	}
+	w := &nextcloudWatcher{
+		folder:    u,
+		dest:      &Destination{Name: "nextcloud", Username: cfg.NextcloudUser, Password: cfg.NextcloudPassword, u: &url.URL{Scheme: scheme, Host: u.Host}},
+		interval:  cfg.NextcloudInterval,
+		statePath: filepath.Join(cfg.DataDir, "nextcloud.json"),
+		state:     map[string]*nextcloudFile{},
+	}
+	data, err := os.ReadFile(w.statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &w.state); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", w.statePath, err)
+		}
+	}
+	return w, nil
+}
+
+// run scans the folder every interval until the process exits. Results of
+// jobs queued before a restart are written back first.
+func (w *nextcloudWatcher) run() {
+	w.mu.Lock()
+	for p, f := range w.state {
+		if f.JobID != "" && !f.Uploaded {
+			go w.writeBack(p, f.JobID)
+		}
+	}
+	w.mu.Unlock()
+
+	for {
+		if err := w.scan(); err != nil {
+			log.Printf("scanning Nextcloud folder %s: %v", w.folder.Path, err)
+		}
+		time.Sleep(w.interval)
+	}
+}
+
+func (w *nextcloudWatcher) scan() error {
+	files, err := w.list()
+	if err != nil {
+		return err
+	}
+	for p, etag := range files {
+		w.mu.Lock()
+		f := w.state[p]
+		seen := f != nil && (f.Result || f.ETag == etag)
+		w.mu.Unlock()
+		if seen {
+			continue
+		}
+		id, err := w.queue(p)
+		if err != nil {
+			// Rejected documents are not retried until they change.
+			log.Printf("Nextcloud file %s was not queued: %v", p, err)
+		}
+		w.mu.Lock()
+		w.state[p] = &nextcloudFile{ETag: etag, JobID: id}
+		w.saveLocked()
+		w.mu.Unlock()
+		if id != "" {
+			go w.writeBack(p, id)
+		}
+	}
+	return nil
+}
+
+// davMultistatus is the part of a PROPFIND response the watcher reads.
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ETag         string `xml:"getetag"`
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const davListBody = `<?xml version="1.0"?><d:propfind xmlns:d="DAV:"><d:prop><d:getetag/><d:resourcetype/></d:prop></d:propfind>`
+
+// list returns the PDFs directly in the folder with their ETags, keyed by
+// decoded path.
+func (w *nextcloudWatcher) list() (map[string]string, error) {
+	return listDAVFolder(w.folder, w.dest.Username, w.dest.Password)
+}
+
+// listDAVFolder returns the PDFs directly in a WebDAV folder with their
+// ETags, keyed by decoded path.
+func listDAVFolder(folder *url.URL, username, password string) (map[string]string, error) {
+	req, err := http.NewRequest("PROPFIND", folder.String(), strings.NewReader(davListBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+	req.SetBasicAuth(username, password)
+	resp, err := deliveryHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND returned %s", resp.Status)
+	}
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("reading PROPFIND response: %w", err)
+	}
+	files := map[string]string{}
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil || !strings.EqualFold(path.Ext(href.Path), ".pdf") {
+			continue
+		}
+		for _, ps := range r.Propstat {
+			if strings.Contains(ps.Status, " 200 ") && ps.Prop.ResourceType.Collection == nil {
+				files[href.Path] = ps.Prop.ETag
+			}
+		}
+	}
+	return files, nil
+}
+
+// queue downloads the file at p and submits it as a job.
+func (w *nextcloudWatcher) queue(p string) (string, error) {
+	u := url.URL{Scheme: w.folder.Scheme, Host: w.folder.Host, Path: p}
+	body, err := openDAVFile(u.String(), w.dest.Username, w.dest.Password)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	j, err := queueDocument(body, submission{
+		Client:   nextcloudAccount,
+		Filename: cleanUploadName(path.Base(p)),
+		Tags:     map[string]string{"source": "nextcloud"},
+		Account:  nextcloudAccount,
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("queued Nextcloud file %s as job %s", p, j.ID)
+	return j.ID, nil
+}
+
+// openDAVFile downloads the file at the WebDAV URL u.
+func openDAVFile(u, username, password string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(username, password)
+	resp, err := deliveryHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download returned %s", resp.Status)
+	}
+	if resp.ContentLength > maxUploadSize {
+		resp.Body.Close()
+		return nil, fmt.Errorf("the file is larger than %d MB", maxUploadSize>>20)
+	}
+	return resp.Body, nil
+}
+
+// queueDocument spools the PDF read from r, checks it as an upload is
+// checked and submits it as sub, which is completed with the spool and what
+// the checks found.
+func queueDocument(r io.Reader, sub submission) (Job, error) {
+	spoolPath, fingerprint, err := spoolUpload(io.LimitReader(r, maxUploadSize))
+	if err != nil {
+		return Job{}, err
+	}
+	check, err := checkPDF(spoolPath)
+	var est resourceEstimate
+	if err == nil {
+		est, err = checkResources(spoolPath)
+	}
+	if err == nil {
+		if perr := checkPages(est.Pages, maxPages); perr != nil {
+			err = perr
+		}
+	}
+	if err != nil {
+		os.Remove(spoolPath)
+		return Job{}, err
+	}
+	sub.SpoolPath, sub.Fingerprint = spoolPath, fingerprint
+	sub.Pages, sub.Repaired = est.Pages, check.Repaired
+	j, _, err := jobs.submit(sub)
+	if err != nil {
+		os.Remove(spoolPath)
+		return Job{}, err
+	}
+	return j, nil
+}
+
+// writeBack waits for job id and uploads its searchable PDF and text next
+// to the original at p, named by the output name template.
+func (w *nextcloudWatcher) writeBack(p, id string) {
+	j, ok := jobs.wait(context.Background(), id)
+	if !ok || j.Status != JobDone {
+		if ok {
+			log.Printf("Nextcloud file %s: job %s failed: %s", p, id, j.Error)
+		}
+		w.markUploaded(p)
+		return
+	}
+	var uploads [][2]string // local file, remote path
+	for _, suffix := range []string{".pdf", ".txt"} {
+		local := filepath.Join(j.outputDir, j.prefix+suffix)
+		remote := path.Join(path.Dir(p), j.displayPrefix+suffix)
+		if _, err := os.Stat(local); err == nil && remote != p {
+			uploads = append(uploads, [2]string{local, remote})
+		}
+	}
+
+	// Remember the results before they appear, so the next scan does not
+	// queue the searchable PDF as a new document.
+	w.mu.Lock()
+	for _, up := range uploads {
+		w.state[up[1]] = &nextcloudFile{Result: true}
+	}
+	w.saveLocked()
+	w.mu.Unlock()
+
+	for _, up := range uploads {
+		var err error
+		delay := deliveryBackoff
+		for attempt := 1; attempt <= deliveryAttempts; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+			u := url.URL{Scheme: w.folder.Scheme, Host: w.folder.Host, Path: up[1]}
+			err = w.dest.putFile(ctx, u.String(), up[0])
+			cancel()
+			if err == nil || attempt == deliveryAttempts {
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err != nil {
+			log.Printf("writing job %s back to Nextcloud as %s failed: %v", id, up[1], err)
+		}
+	}
+	w.markUploaded(p)
+}
+
+func (w *nextcloudWatcher) markUploaded(p string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if f := w.state[p]; f != nil {
+		f.Uploaded = true
+		w.saveLocked()
+	}
+}
+
+// saveLocked writes the watcher state. The caller must hold w.mu.
+func (w *nextcloudWatcher) saveLocked() {
+	data, err := json.MarshalIndent(w.state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(w.statePath, data)
+	}
+	if err != nil {
+		log.Printf("saving Nextcloud watcher state: %v", err)
+	}
+}
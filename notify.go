@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// Job lifecycle event names.
+const (
+	EventJobQueued   = "job.queued"
+	EventJobStarted  = "job.started"
+	EventJobDone     = "job.done"
+	EventJobFailed   = "job.failed"
+	EventJobCanceled = "job.canceled"
+)
+
+// JobEvent is delivered to every configured notifier whenever a job changes
+// state. Links are absolute when a public URL is configured.
+type JobEvent struct {
+	Event    string            `json:"event"`
+	JobID    string            `json:"job_id"`
+	Filename string            `json:"filename"`
+	Status   JobStatus         `json:"status"`
+	Error    string            `json:"error,omitempty"`
+	JobURL   string            `json:"job_url"`
+	TextURL  string            `json:"text_url,omitempty"`
+	PDFURL   string            `json:"pdf_url,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Time     time.Time         `json:"time"`
+}
+
+// Notifier delivers job events to an external system.
+type Notifier interface {
+	Name() string
+	Notify(ev JobEvent) error
+}
+
+// notifyQueueSize bounds the events buffered per notifier; when a notifier
+// falls that far behind new events for it are dropped and logged.
+const notifyQueueSize = 256
+
+var (
+	notifyQueues []chan JobEvent
+	publicURL    string
+)
+
+// addNotifier registers n and starts the goroutine that feeds it. Each
+// notifier gets its own queue so a slow endpoint never delays the others or
+// the OCR workers, and events reach it in order.
+func addNotifier(n Notifier) {
+	ch := make(chan JobEvent, notifyQueueSize)
+	notifyQueues = append(notifyQueues, ch)
+	go func() {
+		for ev := range ch {
+			if err := n.Notify(ev); err != nil {
+				log.Printf("%s notification for job %s failed: %v", n.Name(), ev.JobID, err)
+			}
+		}
+	}()
+}
+
+// publishJobEvent builds the event for a job snapshot and hands it to every
+// notifier without blocking.
+func publishJobEvent(event string, j Job) {
+	if len(notifyQueues) == 0 {
+		return
+	}
+	ev := jobEvent(event, j)
+	for _, ch := range notifyQueues {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("notification queue full, dropping %s for job %s", event, j.ID)
+		}
+	}
+}
+
+// jobEvent builds the event for a job snapshot.
+func jobEvent(event string, j Job) JobEvent {
+	ev := JobEvent{
+		Event:    event,
+		JobID:    j.ID,
+		Filename: j.Filename,
+		Status:   j.Status,
+		Error:    j.Error,
+		JobURL:   absoluteURL(appPath("/api/v1/jobs/" + j.ID)),
+		Tags:     j.Tags,
+		Time:     time.Now().UTC(),
+	}
+	if j.TextURL != "" {
+		ev.TextURL = absoluteURL(j.TextURL)
+	}
+	if j.PDFURL != "" {
+		ev.PDFURL = absoluteURL(j.PDFURL)
+	}
+	return ev
+}
+
+// absoluteURL prefixes a server-relative path with the configured public URL.
+func absoluteURL(path string) string {
+	return strings.TrimSuffix(publicURL, "/") + path
+}
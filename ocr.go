@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mosaeedv/persianOCR/internal/ocr"
+)
+
+// knownEngines lists the OCR engines a job can ask for: "command" is the
+// program of -engine-command, when there is one, see ocr.Command, and
+// "azure" Azure AI Document Intelligence with -azure-endpoint.
+var knownEngines = []string{"tesseract"}
+
+// defaultEngine is used when a submission does not name an engine.
+var defaultEngine = "tesseract"
+
+// textLayouts lists the shapes the text export can take besides the
+// default of one line per text line in the engine's order: "physical" keeps
+// columns and regions apart with blank lines, "logical" puts them in
+// reading order with one line per paragraph, "verse" pairs the two
+// hemistichs of each couplet in Persian poetry, and "newspaper" segments
+// pages into articles, which are also listed with their regions in the
+// result's articles file.
+var textLayouts = []string{"physical", "logical", "verse", "newspaper"}
+
+// ocrModes lists the image preparations besides the default one for
+// scanned paper: "screenshot" is for low-resolution captures of screens,
+// such as chat apps and user interfaces. Their pages are upscaled and
+// binarized with anti-aliased glyph edges in mind, dark themes are
+// inverted, and Tesseract assumes no page layout.
+var ocrModes = []string{"screenshot"}
+
+// dpiModes lists the resolutions a job can ask for besides renderDPI:
+// "auto" measures the text lines of every page and renders the pages with
+// small print again at up to autoDPIMax, so the rest keep their speed.
+var dpiModes = []string{"auto"}
+
+// rasterizers lists the ways ocr_python.py can turn PDF pages into images:
+// "mupdf" renders them in-process with PyMuPDF, opening the document once,
+// "poppler" runs pdftoppm for every page, and "auto" picks MuPDF when
+// PyMuPDF is installed.
+var rasterizers = []string{"auto", "mupdf", "poppler"}
+
+// pdfRasterizer is the one of rasterizers the server's runs use.
+var pdfRasterizer = "auto"
+
+// pageImageModes lists how ocr_python.py hands page images to Tesseract:
+// "pipe" over its stdin, without writing them to disk, and "file" as PNGs
+// in the run's temp directory.
+var pageImageModes = []string{"pipe", "file"}
+
+// pageImages is the one of pageImageModes the server's runs use.
+var pageImages = "pipe"
+
+// defaultLanguages is the Tesseract language string used by ocr_python.py.
+const defaultLanguages = "eng+fas"
+
+// OCRResult is the JSON summary printed by ocr_python.py on stdout.
+type OCRResult struct {
+	Success  bool   `json:"success"`
+	TextFile string `json:"text_file"`
+	PDFFile  string `json:"pdf_file"`
+	LogFile  string `json:"log_file"`
+	Error    string `json:"error"`
+
+	ArticlesFile string `json:"articles_file"` // "newspaper" layout only: articles and their regions per page
+	NotesFile    string `json:"notes_file"`    // footnotes and marginalia per page, when kept separate
+	RegionsFile  string `json:"regions_file"`  // text of the job's template regions
+
+	Pages          int      `json:"pages"` // pages recognized, 0 from older scripts
+	Engine         string   `json:"engine"`
+	MeanConfidence *float64 `json:"mean_confidence"` // 0-100, nil when no words were found
+
+	FailedPages []PageFailure `json:"failed_pages"`
+	LowLines    []LowLine     `json:"low_lines"` // lines below OCR_LINE_CONFIDENCE, see correct.go
+
+	Quality        []ocr.PageQuality    `json:"quality"`         // the native pipeline's scan ratings
+	PageConfidence []ocr.PageConfidence `json:"page_confidence"` // mean word confidence of each page with words
+}
+
+// PageFailure is a page the OCR script could not rasterize or recognize.
+// The rest of the document is still processed.
+type PageFailure struct {
+	Page  int    `json:"page"`
+	Error string `json:"error"`
+}
+
+// procLimits bounds one OCR process together with everything it starts
+// (pdftoppm, tesseract). Zero values mean no limit.
+type procLimits struct {
+	Memory  int64         // bytes
+	CPU     int           // percent of one core, 100 = one full core
+	Timeout time.Duration // wall clock, after which the process tree is killed
+}
+
+var (
+	ocrLimits  procLimits
+	cgroupRoot string // parent cgroup for per-run cgroups, Linux only
+)
+
+// ocrOptions are the per-job settings of an OCR run, passed to the OCR
+// script in its environment or to the native pipeline as ocr.Options.
+type ocrOptions struct {
+	Languages     string // Tesseract language string, defaultLanguages if empty
+	PageLanguages string // overrides for page ranges, see parseLanguageMap
+	TextLayout    string // one of textLayouts, empty for the default
+	SeparateNotes bool   // move footnotes and marginalia out of the text into a notes file
+	Glossary      string // file with one term per line to bias recognition toward, optional
+	Charset       string // characters recognition is limited to, empty for no limit
+	Regions       string // JSON template regions recognized separately, see parseRegions
+	Mode          string // one of ocrModes, empty for scans
+	DPI           string // one of dpiModes, empty for renderDPI
+	Engine        string // one of knownEngines, empty for defaultEngine
+
+	// Reports from the script as it runs; any of them may be nil.
+	Progress func(done, total int)      // pages finished so far
+	Warning  func(page int, msg string) // a page that failed or whose text looks doubtful
+	Log      func(line string)          // each line of the job log as it is written
+	Event    func(typ, msg string)      // something for the job's timeline, see TimelineEvent
+}
+
+// runOCR recognizes pdfPath, with the native pipeline or the Python OCR
+// script, and writes the results into outputDir using prefix for the file
+// names. jobID is forwarded so the script can write its progress file; it
+// may be empty.
+func runOCR(ctx context.Context, pdfPath, outputDir, prefix, jobID string, opts ocrOptions) (*OCRResult, error) {
+	if ocrLimits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ocrLimits.Timeout)
+		defer cancel()
+	}
+
+	args := []string{"ocr_python.py", pdfPath, outputDir, prefix}
+	if jobID != "" {
+		args = append(args, jobID)
+	}
+	workDir, err := newJobTempDir(jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	if opts.Languages == "" {
+		opts.Languages = defaultLanguages
+	}
+	if opts.Engine == "" {
+		opts.Engine = defaultEngine
+	}
+	if opts.Engine != "tesseract" {
+		// Only the native pipeline has engines besides Tesseract.
+		if option := scriptOption(opts); option != "" {
+			return nil, fmt.Errorf("the %s engine does not support %s", opts.Engine, option)
+		}
+		return runNativeOCR(ctx, pdfPath, outputDir, prefix, jobID, workDir, opts)
+	}
+	if ocrPipeline == "native" && scriptOption(opts) == "" {
+		return runNativeOCR(ctx, pdfPath, outputDir, prefix, jobID, workDir, opts)
+	}
+	env := []string{
+		"OCR_WORK_DIR=" + workDir,
+		"OCR_LANGUAGES=" + opts.Languages,
+		"OCR_PAGE_LANGUAGES=" + opts.PageLanguages,
+		"OCR_TEXT_LAYOUT=" + opts.TextLayout,
+		"OCR_RASTERIZER=" + pdfRasterizer,
+		"OCR_PAGE_IMAGES=" + pageImages}
+	if opts.SeparateNotes {
+		env = append(env, "OCR_SEPARATE_NOTES=1")
+	}
+	if opts.Glossary != "" {
+		env = append(env, "OCR_GLOSSARY="+opts.Glossary)
+	}
+	if opts.Charset != "" {
+		env = append(env, "OCR_CHARSET="+opts.Charset)
+	}
+	if opts.Regions != "" {
+		env = append(env, "OCR_REGIONS="+opts.Regions)
+	}
+	if opts.Mode != "" {
+		env = append(env, "OCR_MODE="+opts.Mode)
+	}
+	if opts.DPI != "" {
+		env = append(env, "OCR_DPI="+opts.DPI)
+	}
+	if pageCacheDir != "" {
+		env = append(env, "OCR_PAGE_CACHE="+pageCacheDir)
+	}
+	if languageModel != nil && correctBelow > 0 {
+		env = append(env, "OCR_LINE_CONFIDENCE="+strconv.Itoa(correctBelow))
+	}
+	var buf bytes.Buffer
+	pw := &reportWriter{w: &buf, opts: &opts}
+	var exceeded string
+	if ocrWorkers != nil {
+		exceeded, err = ocrWorkers.run(ctx, args, env, pw, pdfPath, outputDir, workDir)
+	} else {
+		exceeded, err = runOCRProcess(ctx, args, env, pw, pdfPath, outputDir, workDir, jobID)
+	}
+	pw.flush()
+	output := buf.Bytes()
+	var setup setupError
+	switch {
+	case errors.As(err, &setup):
+		return nil, setup.error
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, fmt.Errorf("OCR was stopped after running longer than %s", ocrLimits.Timeout)
+	case exceeded != "":
+		return nil, fmt.Errorf("OCR was stopped because it %s\nOutput: %s", exceeded, string(output))
+	case err != nil:
+		return nil, fmt.Errorf("Error running OCR: %s\nOutput: %s", err.Error(), string(output))
+	}
+
+	// Extract JSON from output (in case there are warnings before the JSON)
+	jsonStr := string(output)
+	jsonStart := strings.Index(jsonStr, "{")
+	if jsonStart == -1 {
+		return nil, fmt.Errorf("No valid JSON found in OCR output:\n%s", string(output))
+	}
+	jsonStr = jsonStr[jsonStart:]
+
+	var result OCRResult
+	if err := json.Unmarshal([]byte(jsonStr), &result); err != nil {
+		return nil, fmt.Errorf("Error parsing OCR result: %s\nOutput: %s", err.Error(), string(output))
+	}
+	if !result.Success {
+		return nil, fmt.Errorf("OCR processing failed: %s", result.Error)
+	}
+	return &result, nil
+}
+
+// setupError is an OCR run that could not be started. It is reported as it
+// is, without the script's output.
+type setupError struct{ error }
+
+// runOCRProcess runs the script once in a process of its own, writing its
+// output to out, and returns which resource limit it hit, if any.
+func runOCRProcess(ctx context.Context, args, env []string, out io.Writer, pdfPath, outputDir, workDir, jobID string) (string, error) {
+	cmd, err := ocrCommand(ctx, args, pdfPath, outputDir, workDir)
+	if err != nil {
+		return "", setupError{err}
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	proc, err := newLimitedProc(cmd, ocrLimits, jobID)
+	if err != nil {
+		return "", setupError{fmt.Errorf("Error running OCR: %w", err)}
+	}
+	err = cmd.Start()
+	if err == nil {
+		if lerr := proc.started(); lerr != nil {
+			log.Printf("OCR resource limits not applied: %v", lerr)
+		}
+		err = cmd.Wait()
+	}
+	return proc.finish(), err
+}
+
+// Lines ocr_python.py writes to stderr to report on a run as it goes:
+// "OCR-PROGRESS <done> <total>", "OCR-WARNING <page> <message>",
+// "OCR-LOG <log line>" and "OCR-EVENT <type> <message>".
+const (
+	progressPrefix = "OCR-PROGRESS "
+	warningPrefix  = "OCR-WARNING "
+	logPrefix      = "OCR-LOG "
+	eventPrefix    = "OCR-EVENT "
+)
+
+// reportWriter passes the script's output on to w, except its report
+// lines, which are handed to the callbacks in opts instead. Stdout and
+// stderr share one reportWriter, so exec never calls Write concurrently.
+type reportWriter struct {
+	w    io.Writer
+	opts *ocrOptions
+	line []byte
+}
+
+func (p *reportWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.line = append(p.line, b...)
+			break
+		}
+		p.line = append(p.line, b[:i+1]...)
+		b = b[i+1:]
+		p.flush()
+	}
+	return n, nil
+}
+
+// flush handles the buffered line, complete or not.
+func (p *reportWriter) flush() {
+	if !p.report(strings.TrimRight(string(p.line), "\r\n")) {
+		p.w.Write(p.line)
+	}
+	p.line = p.line[:0]
+}
+
+// report hands a report line to its callback and returns false for any
+// other output.
+func (p *reportWriter) report(line string) bool {
+	if rest, ok := strings.CutPrefix(line, progressPrefix); ok {
+		var done, total int
+		if _, err := fmt.Sscan(rest, &done, &total); err != nil {
+			return false
+		}
+		if p.opts.Progress != nil {
+			p.opts.Progress(done, total)
+		}
+		return true
+	}
+	if rest, ok := strings.CutPrefix(line, warningPrefix); ok {
+		num, msg, _ := strings.Cut(rest, " ")
+		page, err := strconv.Atoi(num)
+		if err != nil {
+			return false
+		}
+		if p.opts.Warning != nil {
+			p.opts.Warning(page, msg)
+		}
+		return true
+	}
+	if rest, ok := strings.CutPrefix(line, logPrefix); ok {
+		if p.opts.Log != nil {
+			p.opts.Log(rest)
+		}
+		return true
+	}
+	if rest, ok := strings.CutPrefix(line, eventPrefix); ok {
+		typ, msg, _ := strings.Cut(rest, " ")
+		if p.opts.Event != nil {
+			p.opts.Event(typ, msg)
+		}
+		return true
+	}
+	return false
+}
+
+// partialPDF returns the searchable PDF of the pages a failed run finished
+// before it stopped, which ocr_python.py leaves as <prefix>.partial.pdf: it
+// writes the PDF a page at a time, each page an incremental update ending
+// in %%EOF. A page the run was killed in the middle of is cut off, so what
+// remains is a complete PDF. It returns false when no page was finished.
+func partialPDF(outputDir, prefix string) (string, bool) {
+	path := filepath.Join(outputDir, prefix+".partial.pdf")
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", false
+	}
+	// Look for the last end-of-file marker from the back, a block at a
+	// time; blocks overlap so a marker across a boundary is found.
+	marker := []byte("%%EOF\n")
+	const block = 64 << 10
+	buf := make([]byte, block+len(marker))
+	for end := fi.Size(); end > 0; end -= block {
+		start := max(end-block, 0)
+		n, err := f.ReadAt(buf[:min(end+int64(len(marker)), fi.Size())-start], start)
+		if err != nil && err != io.EOF {
+			return "", false
+		}
+		if i := bytes.LastIndex(buf[:n], marker); i >= 0 {
+			if size := start + int64(i+len(marker)); size < fi.Size() {
+				if err := f.Truncate(size); err != nil {
+					return "", false
+				}
+			}
+			return path, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/mosaeedv/persianOCR/internal/ocr"
+)
+
+// With -ocr-pipeline native, the default, runs go through the internal/ocr
+// package instead of ocr_python.py: the server runs pdfinfo, pdftoppm,
+// tesseract and pdfunite itself, one page at a time, and gets errors and
+// reports back as values rather than as lines and JSON on the script's
+// output. Jobs asking for something only the script does, named by
+// scriptOption, still run it.
+
+// azureHTTPClient makes the calls of the azure engine; its timeout bounds
+// one request, a page's polling is bounded by ocr.AzureTimeout and by
+// -ocr-page-timeout.
+var azureHTTPClient = &http.Client{Timeout: time.Minute}
+
+// ocrPipelines lists the values of -ocr-pipeline.
+var ocrPipelines = []string{"native", "python"}
+
+var (
+	ocrPipeline      = "native"
+	tesseractCommand = "tesseract"
+	engineProgram    string // program of the "command" engine
+	azureEndpoint    string // Document Intelligence resource of the "azure" engine
+	azureKey         string
+	popplerDir       string // empty to find Poppler's tools in PATH
+	ocrPageTimeout   time.Duration
+	enhancePoorScans bool
+)
+
+// scriptOption names the option of opts that needs ocr_python.py, or
+// returns "" when the native pipeline can run the job.
+func scriptOption(opts ocrOptions) string {
+	switch {
+	case opts.TextLayout != "":
+		return "the " + opts.TextLayout + " layout"
+	case opts.SeparateNotes:
+		return "separate notes"
+	case opts.Regions != "":
+		return "template regions"
+	case opts.Mode != "":
+		return opts.Mode + " mode"
+	case opts.DPI != "":
+		return "dpi=" + opts.DPI
+	}
+	return ""
+}
+
+// popplerTool is the command of one of Poppler's tools.
+func popplerTool(name string) string {
+	if popplerDir == "" {
+		return name
+	}
+	return filepath.Join(popplerDir, name)
+}
+
+// runNativeOCR is runOCR with the native pipeline. Each tool it starts is
+// sandboxed like the script and held to the procLimits on its own; the
+// run as a whole is bounded by the timeout of ctx.
+func runNativeOCR(ctx context.Context, pdfPath, outputDir, prefix, jobID, workDir string, opts ocrOptions) (*OCRResult, error) {
+	if err := shareWorkerRun(pdfPath, outputDir, workDir); err != nil {
+		return nil, err
+	}
+	o := ocr.Options{
+		Languages:   opts.Languages,
+		Glossary:    opts.Glossary,
+		Charset:     opts.Charset,
+		DPI:         renderDPI,
+		PageTimeout: ocrPageTimeout,
+		WorkDir:     workDir,
+		PageCache:   pageCacheDir,
+		Enhance:     enhancePoorScans,
+		PopplerDir:  popplerDir,
+		Progress:    opts.Progress,
+		Warning:     opts.Warning,
+		Log:         opts.Log,
+		Event:       opts.Event,
+	}
+	if languageModel != nil && correctBelow > 0 {
+		o.LineConfidence = float64(correctBelow)
+	}
+	if m, err := parseLanguageMap(opts.PageLanguages); err == nil {
+		for _, p := range m {
+			o.PageLanguages = append(o.PageLanguages, ocr.PageLanguages{First: p.First, Last: p.Last, Languages: p.Lang})
+		}
+	}
+	var exceeded string
+	o.Exec = func(ctx context.Context, name string, args []string, stdout, stderr io.Writer) error {
+		cmd, err := toolCommand(ctx, name, args, pdfPath, outputDir, workDir)
+		if err != nil {
+			return err
+		}
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		proc, err := newLimitedProc(cmd, ocrLimits, jobID)
+		if err != nil {
+			return err
+		}
+		err = cmd.Start()
+		if err == nil {
+			if lerr := proc.started(); lerr != nil {
+				log.Printf("OCR resource limits not applied: %v", lerr)
+			}
+			err = cmd.Wait()
+		}
+		if e := proc.finish(); e != "" {
+			exceeded = e
+		}
+		return err
+	}
+	switch opts.Engine {
+	case "command":
+		o.Engine = &ocr.Command{Program: engineProgram, Exec: o.Exec}
+	case "azure":
+		o.Engine = &ocr.Azure{Endpoint: azureEndpoint, Key: azureKey, Client: azureHTTPClient}
+	default:
+		o.Engine = &ocr.Tesseract{Command: tesseractCommand, Exec: o.Exec}
+	}
+
+	res, err := ocr.Run(ctx, pdfPath, outputDir, prefix, o)
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, fmt.Errorf("OCR was stopped after running longer than %s", ocrLimits.Timeout)
+	case err != nil && exceeded != "":
+		return nil, fmt.Errorf("OCR was stopped because it %s: %w", exceeded, err)
+	case err != nil:
+		return nil, err
+	}
+
+	result := &OCRResult{
+		Success:        true,
+		TextFile:       res.TextFile,
+		PDFFile:        res.PDFFile,
+		LogFile:        res.LogFile,
+		Pages:          res.Pages,
+		Engine:         o.Engine.Name(),
+		MeanConfidence: res.MeanConfidence,
+		Quality:        res.Quality,
+		PageConfidence: res.PageConfidence,
+	}
+	for _, f := range res.FailedPages {
+		result.FailedPages = append(result.FailedPages, PageFailure{Page: f.Page, Error: f.Err.Error()})
+	}
+	for _, l := range res.LowLines {
+		result.LowLines = append(result.LowLines, LowLine{Page: l.Page, Text: l.Text, Confidence: l.Confidence})
+	}
+	return result, nil
+}
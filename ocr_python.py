@@ -6,16 +6,22 @@ for Persian/Arabic words. Includes logging of all changes.
 
 Install:
     pip install pdf2image pillow pytesseract PyPDF2 pikepdf lxml
+    pip install pymupdf    # optional, renders pages in-process
 """
 
 import os
 import sys
+import tempfile
 import json
+import hashlib
 import re
-from pdf2image import convert_from_path
-from PIL import Image
+import shlex
+import subprocess
+from pdf2image import convert_from_path, pdfinfo_from_path
+from PIL import Image, ImageOps
 import pytesseract
-from PyPDF2 import PdfMerger
+from PyPDF2 import PdfReader
+from PyPDF2.generic import ArrayObject, DictionaryObject, IndirectObject, NameObject, StreamObject
 from io import BytesIO
 from datetime import datetime
 from lxml import etree
@@ -27,6 +33,12 @@ except ImportError:
     PIKEPDF_AVAILABLE = False
     print("Warning: pikepdf not available, using fallback method", file=sys.stderr)
 
+try:
+    import fitz  # PyMuPDF
+    MUPDF_AVAILABLE = True
+except ImportError:
+    MUPDF_AVAILABLE = False
+
 
 # =============================================================================
 # RTL DETECTION
@@ -63,6 +75,73 @@ def is_rtl_line(words):
     return rtl_count > len(words) / 2
 
 
+# =============================================================================
+# GLOSSARY
+# =============================================================================
+
+# Arabic letters commonly typed or recognized in place of Persian ones, and
+# marks that do not change a word for matching.
+GLOSSARY_FOLD = str.maketrans({"ي": "ی", "ى": "ی", "ك": "ک", "ة": "ه", "ۀ": "ه",
+                               "\u200c": None, "\u200d": None, "\u0640": None})
+GLOSSARY_MARKS = re.compile(r'[\u064B-\u065F\u0670]')
+WORD_EDGES = re.compile(r'^(\W*)(.*?)(\W*)$', re.S)
+
+
+def glossary_key(word):
+    return GLOSSARY_MARKS.sub('', word.translate(GLOSSARY_FOLD)).lower()
+
+
+def deletions(word):
+    return {word[:i] + word[i+1:] for i in range(len(word))}
+
+
+class Glossary:
+    """
+    A job's word list: names, technical terms, transliterations. The words
+    are handed to Tesseract as user words to bias recognition, and
+    recognized words afterwards are corrected toward them: a word that
+    matches a glossary word after folding Arabic letter variants and
+    diacritics is replaced by the glossary spelling, and so is a word of
+    four or more letters that is one edit away from exactly one glossary
+    word.
+    """
+    
+    def __init__(self, path):
+        with open(path, encoding="utf-8") as f:
+            self.words = sorted({w for line in f for w in line.split()})
+        self.path = os.path.join(tempfile.gettempdir(), "glossary_words.txt")
+        with open(self.path, "w", encoding="utf-8") as f:
+            f.write("\n".join(self.words) + "\n")
+        self.exact = {glossary_key(w): w for w in self.words}
+        # Single deletions of every word, to find words one edit away.
+        self.near = {}
+        for key, word in self.exact.items():
+            if len(key) >= 4:
+                for d in deletions(key) | {key}:
+                    self.near.setdefault(d, set()).add(word)
+        self.corrections = 0
+    
+    def tesseract_config(self):
+        return "--user-words " + shlex.quote(self.path)
+    
+    def correct(self, token):
+        lead, word, trail = WORD_EDGES.match(token).groups()
+        if not word or word in self.words:
+            return token
+        key = glossary_key(word)
+        fixed = self.exact.get(key)
+        if fixed is None and len(key) >= 4:
+            candidates = set(self.near.get(key, ()))
+            for d in deletions(key):
+                candidates |= self.near.get(d, set())
+            if len(candidates) == 1:
+                fixed = candidates.pop()
+        if fixed is None or fixed == word:
+            return token
+        self.corrections += 1
+        return lead + fixed + trail
+
+
 # =============================================================================
 # HOCR PARSING
 # =============================================================================
@@ -144,6 +223,266 @@ def extract_lines_from_hocr(hocr_bytes):
         return []
 
 
+def hocr_bbox(elem):
+    """Return the (x0, y0, x1, y1) bbox from an HOCR element's title."""
+    match = re.search(r'bbox (\d+) (\d+) (\d+) (\d+)', elem.get('title', ''))
+    return tuple(int(v) for v in match.groups()) if match else (0, 0, 0, 0)
+
+
+def extract_blocks_from_hocr(hocr_bytes):
+    """
+    Parse HOCR into Tesseract's text blocks (ocr_carea), which are roughly
+    one per column or region. Returns (page_width, blocks); each block is a
+    dict with its bbox, the median height of its lines and its paragraphs, a
+    paragraph is a list of lines and a line a list of words.
+    """
+    try:
+        root = etree.fromstring(hocr_bytes)
+        pages = root.xpath("//*[@class='ocr_page']")
+        page_width = hocr_bbox(pages[0])[2] if pages else 0
+        
+        blocks = []
+        for block_elem in root.xpath("//*[@class='ocr_carea']"):
+            paragraphs = []
+            heights = []
+            for par_elem in block_elem.xpath(".//*[@class='ocr_par']"):
+                lines = []
+                for line_elem in par_elem.xpath(".//*[@class='ocr_line']"):
+                    words = line_elem.xpath(".//*[@class='ocrx_word' or @class='ocr_word']")
+                    line_words = [t for t in (''.join(w.itertext()).strip() for w in words) if t]
+                    if line_words:
+                        lines.append(line_words)
+                        _, y0, _, y1 = hocr_bbox(line_elem)
+                        heights.append(y1 - y0)
+                if lines:
+                    paragraphs.append(lines)
+            if paragraphs:
+                heights.sort()
+                blocks.append({'bbox': hocr_bbox(block_elem), 'line_height': heights[len(heights) // 2],
+                               'paragraphs': paragraphs})
+        return page_width, blocks
+        
+    except Exception as e:
+        print(f"HOCR block parsing error: {e}", file=sys.stderr)
+        return 0, []
+
+
+def reading_order(blocks, page_width, rtl):
+    """
+    Sort blocks into reading order. Blocks wider than most of the page
+    (titles, full-width paragraphs) split the page into bands; within a band,
+    blocks whose horizontal extents overlap form a column, columns are read
+    right to left on RTL pages, and each column top to bottom.
+    """
+    ordered = []
+    band = []
+    
+    def flush():
+        columns = []
+        for block in sorted(band, key=lambda b: b['bbox'][0]):
+            x0, _, x1, _ = block['bbox']
+            for col in columns:
+                if x0 < col['x1'] and x1 > col['x0']:
+                    col['blocks'].append(block)
+                    col['x0'], col['x1'] = min(col['x0'], x0), max(col['x1'], x1)
+                    break
+            else:
+                columns.append({'x0': x0, 'x1': x1, 'blocks': [block]})
+        if rtl:
+            columns.reverse()
+        for col in columns:
+            ordered.extend(sorted(col['blocks'], key=lambda b: b['bbox'][1]))
+        band.clear()
+    
+    for block in sorted(blocks, key=lambda b: b['bbox'][1]):
+        x0, _, x1, _ = block['bbox']
+        if page_width and x1 - x0 > 0.6 * page_width:
+            flush()
+            ordered.append(block)
+        else:
+            band.append(block)
+    flush()
+    return ordered
+
+
+def segment_articles(blocks, page_width, rtl):
+    """
+    Group the blocks of a newspaper page into articles. Headlines are short
+    blocks (up to three lines) set clearly larger than the body text. Every
+    other block belongs to the nearest headline above it that spans at least
+    half its width; blocks without one become untitled articles. Returns
+    articles in reading order, each a dict with its headline block (or
+    None), its body blocks in reading order and the bbox around all of them.
+    """
+    if not blocks:
+        return []
+    heights = sorted(b['line_height'] for b in blocks)
+    body_height = heights[len(heights) // 2]
+    articles = [{'title': b, 'blocks': []} for b in blocks
+                if b['line_height'] > 1.4 * body_height and sum(len(p) for p in b['paragraphs']) <= 3]
+    titles = {id(a['title']) for a in articles}
+    
+    for block in blocks:
+        if id(block) in titles:
+            continue
+        x0, y0, x1, _ = block['bbox']
+        above = [a for a in articles
+                 if a['title']['bbox'][3] <= y0 + body_height
+                 and min(x1, a['title']['bbox'][2]) - max(x0, a['title']['bbox'][0]) >= (x1 - x0) / 2]
+        if above:
+            max(above, key=lambda a: a['title']['bbox'][3])['blocks'].append(block)
+        else:
+            articles.append({'title': None, 'blocks': [block]})
+    
+    for article in articles:
+        article['blocks'] = reading_order(article['blocks'], page_width, rtl)
+        boxes = [b['bbox'] for b in article['blocks']]
+        if article['title']:
+            boxes.append(article['title']['bbox'])
+        article['bbox'] = (min(b[0] for b in boxes), min(b[1] for b in boxes),
+                           max(b[2] for b in boxes), max(b[3] for b in boxes))
+    return reading_order(articles, page_width, rtl)
+
+
+def extract_line_boxes(hocr_bytes):
+    """
+    Parse HOCR into lines with their bboxes. Each line is a dict with the
+    line's bbox and its words as (text, bbox) pairs in HOCR order.
+    """
+    try:
+        root = etree.fromstring(hocr_bytes)
+        lines = []
+        for line_elem in root.xpath("//*[@class='ocr_line']"):
+            words = []
+            for word_elem in line_elem.xpath(".//*[@class='ocrx_word' or @class='ocr_word']"):
+                text = ''.join(word_elem.itertext()).strip()
+                if text:
+                    words.append((text, hocr_bbox(word_elem)))
+            if words:
+                lines.append({'bbox': hocr_bbox(line_elem), 'words': words})
+        return lines
+    except Exception as e:
+        print(f"HOCR line parsing error: {e}", file=sys.stderr)
+        return []
+
+
+def verse_text(lines, process_line):
+    """
+    Lay out a page of classical Persian verse, where each couplet (beyt) is
+    printed as two hemistichs (mesra) side by side. Reading order logic
+    takes the two halves of the page for columns and reads all first
+    hemistichs before the second ones; here every line is split at the
+    page's centre gutter and the halves in the same row are paired again.
+    Each couplet becomes its two hemistichs on consecutive lines, first one
+    first, with a blank line between couplets. Lines that cross the gutter
+    (titles, prose) are kept whole.
+    
+    Returns None when the page does not look like verse, so the caller can
+    fall back to another layout.
+    """
+    if not lines:
+        return None
+    mid = (min(l['bbox'][0] for l in lines) + max(l['bbox'][2] for l in lines)) / 2
+    
+    rows = []    # (y0, y1, kind, words) with kind "left", "right" or "whole"
+    for line in lines:
+        words = line['words']
+        left = [w for w in words if w[1][2] <= mid]
+        right = [w for w in words if w[1][0] >= mid]
+        _, y0, _, y1 = line['bbox']
+        if left and right and len(left) + len(right) == len(words):
+            rows.append((y0, y1, "left", left))
+            rows.append((y0, y1, "right", right))
+        elif len(right) == len(words):
+            rows.append((y0, y1, "right", words))
+        elif len(left) == len(words):
+            rows.append((y0, y1, "left", words))
+        else:
+            rows.append((y0, y1, "whole", words))
+    
+    def same_row(a, b):
+        overlap = min(a[1], b[1]) - max(a[0], b[0])
+        return overlap > 0.5 * min(a[1] - a[0], b[1] - b[0])
+    
+    rows.sort(key=lambda r: r[0])
+    items = []   # (y0, [word lists]) in page order
+    used = set()
+    for i, row in enumerate(rows):
+        if i in used:
+            continue
+        used.add(i)
+        if row[2] == "whole":
+            items.append((row[0], [row[3]]))
+            continue
+        other = "left" if row[2] == "right" else "right"
+        match = next((j for j in range(i + 1, len(rows))
+                      if j not in used and rows[j][2] == other and same_row(row, rows[j])), None)
+        if match is None:
+            items.append((row[0], [row[3]]))
+            continue
+        used.add(match)
+        pair = {row[2]: row[3], other: rows[match][3]}
+        items.append((row[0], [pair["right"], pair["left"]]))
+    
+    couplets = sum(1 for _, hemistichs in items if len(hemistichs) == 2)
+    halves = sum(1 for r in rows if r[2] != "whole")
+    if couplets < 2 or 2 * couplets < 0.6 * halves:
+        return None
+    
+    # Persian verse starts on the right; an LTR page reads left first.
+    words = [w[0] for l in lines for w in l['words']]
+    rtl = is_rtl_line(words)
+    blocks = []
+    for _, hemistichs in items:
+        if not rtl:
+            hemistichs = hemistichs[::-1]
+        blocks.append('\n'.join(process_line([w[0] for w in h]) for h in hemistichs))
+    return '\n\n'.join(blocks)
+
+
+def extract_line_confidences(hocr_bytes):
+    """
+    Parse HOCR and return (words, mean confidence) for every line that has
+    words with an x_wconf confidence.
+    """
+    try:
+        root = etree.fromstring(hocr_bytes)
+        lines = []
+        for line_elem in root.xpath("//*[@class='ocr_line']"):
+            words, confidences = [], []
+            for word_elem in line_elem.xpath(".//*[@class='ocrx_word' or @class='ocr_word']"):
+                text = ''.join(word_elem.itertext()).strip()
+                match = re.search(r'x_wconf\s+(\d+)', word_elem.get('title', ''))
+                if text and match:
+                    words.append(text)
+                    confidences.append(int(match.group(1)))
+            if words:
+                lines.append((words, round(sum(confidences) / len(confidences), 1)))
+        return lines
+    except Exception as e:
+        print(f"HOCR confidence parsing error: {e}", file=sys.stderr)
+        return []
+
+
+def extract_word_confidences(hocr_bytes):
+    """
+    Parse HOCR and return the x_wconf confidence (0-100) of every word.
+    """
+    try:
+        root = etree.fromstring(hocr_bytes)
+        words = root.xpath("//*[@class='ocrx_word' or @class='ocr_word']")
+        confidences = []
+        for word_elem in words:
+            text = ''.join(word_elem.itertext()).strip()
+            match = re.search(r'x_wconf\s+(\d+)', word_elem.get('title', ''))
+            if text and match:
+                confidences.append(int(match.group(1)))
+        return confidences
+    except Exception as e:
+        print(f"HOCR confidence parsing error: {e}", file=sys.stderr)
+        return []
+
+
 # =============================================================================
 # TEXT EXTRACTION WITH RTL MARKERS
 # =============================================================================
@@ -155,6 +494,8 @@ class RTLLogger:
         self.total_words = 0
         self.rtl_words = 0
         self.lines_reversed = 0
+        self.confidence_sum = 0
+        self.confidence_count = 0
         self.page_stats = []
         self.log_entries = []
     
@@ -162,25 +503,43 @@ class RTLLogger:
         timestamp = datetime.now().strftime("%H:%M:%S")
         entry = f"[{timestamp}] {message}"
         self.log_entries.append(entry)
+        # The server follows the log as it is written (see report_pages).
+        print("OCR-LOG " + entry.replace("\n", " "), file=sys.stderr, flush=True)
     
-    def add_page_stats(self, page_num, total, rtl, reversed_lines):
+    def add_page_stats(self, page_num, total, rtl, reversed_lines, confidences=()):
         self.page_stats.append({
             'page': page_num,
             'total_words': total,
             'rtl_words': rtl,
-            'lines_reversed': reversed_lines
+            'lines_reversed': reversed_lines,
+            'mean_confidence': round(sum(confidences) / len(confidences), 1) if confidences else None,
+            'confidence_sum': sum(confidences),
+            'confidence_count': len(confidences)
         })
+        self.confidence_sum += sum(confidences)
+        self.confidence_count += len(confidences)
         self.total_words += total
         self.rtl_words += rtl
         self.lines_reversed += reversed_lines
         self.log(f"Page {page_num}: {total} words ({rtl} RTL), {reversed_lines} lines reversed")
     
+    def add_page_checkpoint(self, stats, source="done by an earlier run"):
+        """Add the stats of a page finished by an earlier run."""
+        self.page_stats.append(stats)
+        self.confidence_sum += stats.get('confidence_sum', 0)
+        self.confidence_count += stats.get('confidence_count', 0)
+        self.total_words += stats['total_words']
+        self.rtl_words += stats['rtl_words']
+        self.lines_reversed += stats['lines_reversed']
+        self.log(f"Page {stats['page']}: {source}")
+    
     def get_summary(self):
         return {
             'total_words': self.total_words,
             'rtl_words': self.rtl_words,
             'lines_reversed': self.lines_reversed,
             'rtl_percentage': round(100 * self.rtl_words / self.total_words, 1) if self.total_words > 0 else 0,
+            'mean_confidence': round(self.confidence_sum / self.confidence_count, 1) if self.confidence_count > 0 else None,
             'pages': self.page_stats
         }
     
@@ -213,55 +572,343 @@ class RTLLogger:
                 f.write(entry + "\n")
 
 
-def extract_text_with_hocr(png_path, languages, page_num, logger):
+def split_notes(blocks):
+    """
+    Separate footnotes and marginalia from the body text of a page. The body
+    text size is the median line height of the blocks. Footnotes are blocks
+    in the lower third of the text area set smaller than that, together with
+    everything below the first of them. Marginalia are narrow blocks (under a
+    quarter of the text area's width) beside the main text column. Returns
+    (body, footnotes, margins), each a list of blocks in their original
+    order.
+    """
+    if len(blocks) < 2:
+        return blocks, [], []
+    heights = sorted(b['line_height'] for b in blocks)
+    body_height = heights[len(heights) // 2]
+    left = min(b['bbox'][0] for b in blocks)
+    right = max(b['bbox'][2] for b in blocks)
+    top = min(b['bbox'][1] for b in blocks)
+    bottom = max(b['bbox'][3] for b in blocks)
+    width = right - left
+    
+    # The main column spans the wide blocks set in the body size.
+    main = [b for b in blocks
+            if b['bbox'][2] - b['bbox'][0] >= width / 4 and b['line_height'] >= 0.85 * body_height]
+    main_x0 = min((b['bbox'][0] for b in main), default=left)
+    main_x1 = max((b['bbox'][2] for b in main), default=right)
+    
+    small = [b['bbox'][1] for b in blocks
+             if b['bbox'][1] > top + 2 * (bottom - top) / 3 and b['line_height'] < 0.85 * body_height]
+    footnote_top = min(small, default=None)
+    
+    body, footnotes, margins = [], [], []
+    for block in blocks:
+        x0, y0, x1, _ = block['bbox']
+        if footnote_top is not None and y0 >= footnote_top:
+            footnotes.append(block)
+        elif x1 - x0 < width / 4 and (x1 <= main_x0 or x0 >= main_x1):
+            margins.append(block)
+        else:
+            body.append(block)
+    return body, footnotes, margins
+
+
+# Screenshots are upscaled this many times before recognition; their text
+# is typically 10-16 pixels high, well below what Tesseract reads reliably.
+SCREENSHOT_SCALE = 3
+
+
+def prepare_screenshot(img, dpi):
+    """
+    Prepare a page image of a screenshot for recognition. Dark themes are
+    inverted to dark text on light, the image is upscaled, and then
+    binarized at the Otsu threshold of its histogram: anti-aliased glyph
+    edges become gray ramps when upscaled, and a threshold between the text
+    and background levels cuts them in the middle instead of thickening or
+    eroding the strokes as a fixed one does with colored text. The
+    resolution is raised by the same factor, so the page keeps its size.
+    """
+    gray = ImageOps.grayscale(img)
+    hist = gray.histogram()
+    total = sum(hist)
+    if sum(i * n for i, n in enumerate(hist)) / total < 128:
+        gray = ImageOps.invert(gray)
+        hist = hist[::-1]
+    gray = gray.resize((gray.width * SCREENSHOT_SCALE, gray.height * SCREENSHOT_SCALE), Image.LANCZOS)
+
+    sum_all = sum(i * n for i, n in enumerate(hist))
+    best, threshold = -1, 128
+    weight, sum_low = 0, 0
+    for level, count in enumerate(hist):
+        weight += count
+        if weight == 0:
+            continue
+        if weight == total:
+            break
+        sum_low += level * count
+        mean_low = sum_low / weight
+        mean_high = (sum_all - sum_low) / (total - weight)
+        between = weight * (total - weight) * (mean_low - mean_high) ** 2
+        if between > best:
+            best, threshold = between, level
+    out = gray.point(lambda v: 255 if v > threshold else 0, mode="1")
+    out.info["dpi"] = (dpi * SCREENSHOT_SCALE, dpi * SCREENSHOT_SCALE)
+    return out
+
+
+# With OCR_DPI=auto, pages whose text lines are lower than SMALL_TEXT_HEIGHT
+# pixels at the normal resolution (about 8 pt Naskh at 300 DPI) are rendered
+# again so their lines become about AUTO_DPI_LINE_HEIGHT pixels high, at up
+# to AUTO_DPI_MAX DPI. Tesseract misreads the dots of small Persian letters
+# well before it loses the letters themselves.
+SMALL_TEXT_HEIGHT = 30
+AUTO_DPI_LINE_HEIGHT = 45
+AUTO_DPI_MAX = 600
+
+
+def text_line_height(img):
+    """
+    Estimate the typical height in pixels of the text lines of a page image
+    from its row profile, without recognizing anything: the image is
+    binarized and averaged across every row, and each run of rows with ink in
+    it is taken for a line. Returns the median run, or None when there are too
+    few runs to tell, as on a page that is mostly a picture. Lines of
+    neighbouring columns that do not line up merge into taller runs, which
+    errs on the side of keeping the resolution.
+    """
+    gray = img.convert("L")
+    profile = gray.point(lambda v: 0 if v < 128 else 255).resize((1, gray.height), Image.BOX)
+    heights, run = [], 0
+    for level in list(profile.getdata()) + [255]:
+        if level < 252:  # more than about 1% of the row is ink
+            run += 1
+            continue
+        if run >= 4:  # shorter runs are specks and rules
+            heights.append(run)
+        run = 0
+    if len(heights) < 5:
+        return None
+    heights.sort()
+    return heights[len(heights) // 2]
+
+
+def auto_dpi(img, dpi):
+    """
+    The resolution a page rendered at dpi is recognized at under OCR_DPI=auto:
+    dpi itself unless its text is small (see SMALL_TEXT_HEIGHT), otherwise
+    one that makes the lines tall enough, in steps of 50.
+    """
+    height = text_line_height(img)
+    if height is None or height >= SMALL_TEXT_HEIGHT:
+        return dpi
+    return min(AUTO_DPI_MAX, -(-dpi * AUTO_DPI_LINE_HEIGHT // height // 50) * 50)
+
+
+def tesseract_config(glossary=None, charset="", mode=""):
+    """
+    Build Tesseract's extra arguments for a glossary, a character set and an
+    OCR mode. Screenshots have no page layout to analyse: text sits in
+    bubbles, buttons and lists, so it is found wherever it is (sparse text).
+    """
+    args = []
+    if mode == "screenshot":
+        args.append("--psm 11")
+    if glossary:
+        args.append(glossary.tesseract_config())
+    if charset:
+        args.append("-c " + shlex.quote("tessedit_char_whitelist=" + charset))
+    return " ".join(args)
+
+
+def run_tesseract(img, languages, config, extension):
+    """
+    Recognize img and return Tesseract's output as bytes: "hocr", "pdf" or
+    "txt". OCR_PAGE_IMAGES says how the image gets there: "pipe" (the
+    default) hands it over on Tesseract's stdin as uncompressed PNM, "file"
+    lets pytesseract write it to a PNG in the work directory first. Piped
+    images never touch the disk, which saves compressing and writing a page
+    image of tens of megabytes for every call; PNM carries no resolution, so
+    it is passed on the command line to keep the sizes of the page PDFs
+    right.
+    """
+    if os.environ.get("OCR_PAGE_IMAGES") == "file":
+        if extension == "txt":
+            return pytesseract.image_to_string(img, lang=languages, config=config).encode("utf-8")
+        return pytesseract.image_to_pdf_or_hocr(img, lang=languages, extension=extension, config=config)
+    if img.mode not in ("1", "L", "RGB"):
+        img = img.convert("RGB")
+    dpi = img.info.get("dpi", (300, 300))[0]
+    cmd = [pytesseract.pytesseract.tesseract_cmd, "stdin", "stdout", "-l", languages,
+           "--dpi", str(round(dpi))] + shlex.split(config)
+    if extension != "txt":
+        cmd.append(extension)
+    # Tesseract reads all of stdin before it writes anything, so the image
+    # is written straight into the pipe rather than held a second time.
+    proc = subprocess.Popen(cmd, stdin=subprocess.PIPE, stdout=subprocess.PIPE, stderr=subprocess.PIPE)
+    try:
+        img.save(proc.stdin, "PPM")
+    except BrokenPipeError:
+        pass  # Tesseract gave up; its stderr says why
+    out, err = proc.communicate()
+    if proc.returncode != 0:
+        raise RuntimeError("tesseract failed: " + (err.decode("utf-8", "replace").strip()
+                                                   or f"exit status {proc.returncode}"))
+    return out
+
+
+def recognize_regions(img, regions, page_num, languages):
+    """
+    Recognize the template regions that apply to this page on their own, each
+    limited to its character set. Boxes are fractions of the page; the result
+    gives them in pixels.
+    """
+    results = []
+    width, height = img.size
+    for region in regions:
+        if region.get("page") and region["page"] != page_num:
+            continue
+        x0, y0, x1, y1 = region["box"]
+        box = (round(x0 * width), round(y0 * height), round(x1 * width), round(y1 * height))
+        # A form field is a single block of text.
+        config = "--psm 6 " + tesseract_config(charset=region.get("charset", ""))
+        crop = img.crop(box)
+        crop.info["dpi"] = img.info.get("dpi", (300, 300))
+        text = run_tesseract(crop, languages, config, "txt").decode("utf-8")
+        results.append({"name": region["name"], "text": text.strip(), "bbox": list(box)})
+    return results
+
+
+def extract_text_with_hocr(img, languages, page_num, logger, layout="", separate_notes=False,
+                           glossary=None, charset="", mode=""):
     """
     Extract text from image using HOCR.
     Reverses word order in RTL lines for correct reading order.
     Keeps text as LTR so selection works left-to-right.
     Returns processed text and updates logger.
-    """
-    img = Image.open(png_path)
     
-    # Get HOCR output
-    hocr = pytesseract.image_to_pdf_or_hocr(img, lang=languages, extension='hocr')
+    layout selects the shape of the text: "" gives one line per text line in
+    Tesseract's order, "physical" keeps the page's blocks (columns, regions)
+    apart with blank lines, "logical" puts the blocks in reading order and
+    joins each paragraph into one line for reflowing, "verse" pairs the
+    hemistichs of couplets (see verse_text), falling back to "logical" on
+    pages that are not verse, and "newspaper" gives one text block per
+    article (see segment_articles) and records the articles with their
+    regions in the page stats.
     
-    # Parse HOCR to get lines and words
-    lines = extract_lines_from_hocr(hocr)
+    With separate_notes, footnotes and marginalia (see split_notes) are left
+    out of the text and recorded in the page stats instead. A glossary biases
+    recognition and corrects the recognized words (see Glossary),
+    charset limits recognition to the given characters, and mode selects
+    Tesseract's page segmentation (see tesseract_config).
+    """
+    # Get HOCR output
+    config = tesseract_config(glossary, charset, mode)
+    hocr = run_tesseract(img, languages, config, 'hocr')
     
-    # Process lines
     page_total = 0
     page_rtl = 0
     page_reversed = 0
-    processed_lines = []
     
-    for line_words in lines:
+    def process_line(line_words):
+        nonlocal page_total, page_rtl, page_reversed
+        if glossary:
+            line_words = [glossary.correct(w) for w in line_words]
         # Count words
         for word in line_words:
             page_total += 1
             if is_rtl_word(word):
                 page_rtl += 1
         
-        # Check if line is predominantly RTL
-        line_is_rtl = is_rtl_line(line_words)
-        
         # If RTL line, reverse word order (keep as LTR, just reorder)
-        if line_is_rtl:
+        if is_rtl_line(line_words):
             line_words = line_words[::-1]
             page_reversed += 1
         
         # Join words - no markers, just reversed order
-        line_text = ' '.join(line_words)
-        processed_lines.append(line_text)
+        return ' '.join(line_words)
+    
+    def block_text(block):
+        return '\n'.join(process_line(line) for par in block['paragraphs'] for line in par)
+    
+    page_width, blocks = extract_blocks_from_hocr(hocr)
+    notes = None
+    note_boxes = []
+    if separate_notes:
+        blocks, footnotes, margins = split_notes(blocks)
+        note_boxes = [b['bbox'] for b in footnotes + margins]
+        notes = {'footnotes': [block_text(b) for b in footnotes],
+                 'margins': [block_text(b) for b in margins]}
+    
+    page_text = None
+    if layout == "verse":
+        lines = [l for l in extract_line_boxes(hocr)
+                 if not any(box_contains(box, l['bbox']) for box in note_boxes)]
+        page_text = verse_text(lines, process_line)
+        if page_text is None:
+            logger.log(f"Page {page_num}: no couplets found, using the logical layout")
+            layout = "logical"
+    
+    if layout == "physical":
+        page_text = '\n\n'.join(block_text(block) for block in blocks)
+    elif layout == "logical":
+        words = [w for block in blocks for par in block['paragraphs'] for line in par for w in line]
+        blocks = reading_order(blocks, page_width, is_rtl_line(words))
+        page_text = '\n\n'.join(
+            ' '.join(process_line(line) for line in par)
+            for block in blocks for par in block['paragraphs'])
+    elif layout == "newspaper":
+        words = [w for block in blocks for par in block['paragraphs'] for line in par for w in line]
+        articles = []
+        for article in segment_articles(blocks, page_width, is_rtl_line(words)):
+            title = article['title']
+            articles.append({
+                'title': ' '.join(process_line(line) for par in title['paragraphs'] for line in par) if title else "",
+                'body': '\n\n'.join(' '.join(process_line(line) for line in par)
+                                     for block in article['blocks'] for par in block['paragraphs']),
+                'bbox': list(article['bbox']),
+            })
+        page_text = '\n\n\n'.join(f"## {a['title']}\n\n{a['body']}" if a['title'] else a['body']
+                                   for a in articles)
+    elif page_text is None and separate_notes:
+        page_text = '\n'.join(block_text(block) for block in blocks)
+    elif page_text is None:
+        # Parse HOCR to get lines and words
+        lines = extract_lines_from_hocr(hocr)
+        page_text = '\n'.join(process_line(line) for line in lines)
     
     # Update logger
-    logger.add_page_stats(page_num, page_total, page_rtl, page_reversed)
+    logger.add_page_stats(page_num, page_total, page_rtl, page_reversed,
+                          extract_word_confidences(hocr))
+    if layout == "newspaper":
+        logger.page_stats[-1]['articles'] = articles
+    if notes:
+        logger.page_stats[-1]['notes'] = notes
     
-    # Join lines
-    page_text = '\n'.join(processed_lines)
+    # Lines below OCR_LINE_CONFIDENCE, as they appear in the text, for the
+    # server's correction step.
+    line_confidence = float(os.environ.get("OCR_LINE_CONFIDENCE") or 0)
+    if line_confidence > 0:
+        low_lines = []
+        for words, confidence in extract_line_confidences(hocr):
+            if confidence >= line_confidence:
+                continue
+            if glossary:
+                words = [glossary.correct(w) for w in words]
+            if is_rtl_line(words):
+                words = words[::-1]
+            low_lines.append({'text': ' '.join(words), 'confidence': confidence})
+        logger.page_stats[-1]['low_lines'] = low_lines
     
     return page_text
 
 
+def box_contains(outer, inner):
+    """Report whether the centre of bbox inner lies inside bbox outer."""
+    cx, cy = (inner[0] + inner[2]) / 2, (inner[1] + inner[3]) / 2
+    return outer[0] <= cx <= outer[2] and outer[1] <= cy <= outer[3]
+
+
 # =============================================================================
 # RTL FIXING FOR PDF - Reverse word order (keep LTR, reverse words)
 # =============================================================================
@@ -416,6 +1063,148 @@ def fix_pdf_rtl(pdf_bytes):
         return fix_pdf_with_regex(pdf_bytes)
 
 
+# =============================================================================
+# PDF ASSEMBLY
+# =============================================================================
+
+class IncrementalPDF:
+    """
+    The searchable PDF, written a page at a time as pages are recognized
+    instead of merged at the end, so memory stays flat however long the
+    document is. Each page is appended as an incremental update: its
+    objects, the page tree nodes it changes and a cross-reference section
+    for them. The file is therefore a complete PDF of the pages added so far
+    after every page, and a run that fails, or is killed, leaves the pages
+    it finished readable. close() ends the file with one cross-reference
+    table of everything, so readers skip the superseded tree nodes.
+
+    The page tree has two levels of at most LEAF_PAGES kids each, which
+    keeps the nodes rewritten per page small.
+    """
+    LEAF_PAGES = 100
+    INHERITED = ("/Resources", "/MediaBox", "/CropBox", "/Rotate")
+
+    def __init__(self, path):
+        self.path = path
+        self.f = None  # opened with the first page
+        self.offsets = {}  # object number -> offset of its last version
+        self.next_num = 3  # 1 is the catalog, 2 the root of the page tree
+        self.leaves = []  # (object number, [page object numbers])
+        self.pages = 0
+        self.prev_xref = None
+
+    def _number(self):
+        num = self.next_num
+        self.next_num += 1
+        return num
+
+    def _write(self, num, obj):
+        self.offsets[num] = self.f.tell()
+        self.f.write(b"%d 0 obj\n" % num)
+        if isinstance(obj, bytes):
+            self.f.write(obj)
+        else:
+            obj.write_to_stream(self.f, None)
+        self.f.write(b"\nendobj\n")
+
+    def _xref(self, nums, prev):
+        """Write a cross-reference section for nums and the trailer."""
+        start = self.f.tell()
+        self.f.write(b"xref\n")
+        nums = sorted(nums)
+        i = 0
+        while i < len(nums):
+            j = i
+            while j + 1 < len(nums) and nums[j + 1] == nums[j] + 1:
+                j += 1
+            self.f.write(b"%d %d\n" % (nums[i], j - i + 1))
+            for num in nums[i:j + 1]:
+                if num == 0:
+                    self.f.write(b"0000000000 65535 f \n")
+                else:
+                    self.f.write(b"%010d 00000 n \n" % self.offsets[num])
+            i = j + 1
+        trailer = b"<< /Size %d /Root 1 0 R" % self.next_num
+        if prev is not None:
+            trailer += b" /Prev %d" % prev
+        self.f.write(b"trailer\n" + trailer + b" >>\nstartxref\n%d\n%%%%EOF\n" % start)
+        self.f.flush()
+        return start
+
+    def add_page(self, page_pdf):
+        """Append the one-page PDF page_pdf (bytes) as the next page."""
+        changed = []
+        if self.f is None:
+            self.f = open(self.path, "wb")
+            self.f.write(b"%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+            self._write(1, b"<< /Type /Catalog /Pages 2 0 R >>")
+            changed = [0, 1]
+
+        reader = PdfReader(BytesIO(page_pdf))
+        tree = reader.trailer["/Root"]["/Pages"]
+        page_ref = dict.__getitem__(tree, "/Kids")[0]
+        page = page_ref.get_object()
+        for key in self.INHERITED:
+            if key not in page and key in tree:
+                dict.__setitem__(page, NameObject(key), dict.__getitem__(tree, key))
+        dict.pop(page, "/Parent", None)
+
+        # Copy the objects the page uses under new numbers. The base class
+        # methods keep PyPDF2 from resolving references on access.
+        numbers = {}
+        pending = []
+
+        def renumber(obj):
+            if isinstance(obj, IndirectObject):
+                key = (obj.idnum, obj.generation)
+                if key not in numbers:
+                    numbers[key] = self._number()
+                    pending.append((numbers[key], obj.get_object()))
+                return IndirectObject(numbers[key], 0, None)
+            if isinstance(obj, DictionaryObject):
+                for key, value in list(dict.items(obj)):
+                    # A stream's length is written from its data.
+                    if not (key == "/Length" and isinstance(obj, StreamObject)):
+                        dict.__setitem__(obj, key, renumber(value))
+            elif isinstance(obj, ArrayObject):
+                for i, value in enumerate(list.__iter__(obj)):
+                    list.__setitem__(obj, i, renumber(value))
+            return obj
+
+        if not self.leaves or len(self.leaves[-1][1]) == self.LEAF_PAGES:
+            self.leaves.append((self._number(), []))
+        leaf_num, kids = self.leaves[-1]
+        page_num = renumber(page_ref).idnum
+        while pending:
+            num, obj = pending.pop()
+            renumber(obj)
+            if num == page_num:
+                dict.__setitem__(obj, NameObject("/Parent"), IndirectObject(leaf_num, 0, None))
+            self._write(num, obj)
+            changed.append(num)
+        kids.append(page_num)
+        self.pages += 1
+        self._write(leaf_num, b"<< /Type /Pages /Parent 2 0 R /Count %d /Kids [%s] >>" % (
+            len(kids), b" ".join(b"%d 0 R" % k for k in kids)))
+        self._write(2, b"<< /Type /Pages /Count %d /Kids [%s] >>" % (
+            self.pages, b" ".join(b"%d 0 R" % leaf for leaf, _ in self.leaves)))
+        self.prev_xref = self._xref(changed + [leaf_num, 2], self.prev_xref)
+
+    def close(self):
+        """Finish the file with a cross-reference table of all objects."""
+        if self.f is None:
+            return
+        self._xref([0] + sorted(self.offsets), None)
+        self.f.close()
+        self.f = None
+
+    def abandon(self):
+        """Close the file as it is, a PDF of the pages added."""
+        if self.f is not None:
+            self.f.close()
+            self.f = None
+
+
 # =============================================================================
 # PROGRESS TRACKER
 # =============================================================================
@@ -459,6 +1248,268 @@ class ProgressTracker:
             }, f, ensure_ascii=False)
 
 
+# =============================================================================
+# RASTERIZATION
+# =============================================================================
+
+class PopplerRasterizer:
+    """Renders pages with Poppler's pdftoppm through pdf2image. Every page
+    starts a pdftoppm process, which parses the PDF again and pipes the
+    image back."""
+    name = "poppler"
+
+    def __init__(self, pdf_path, poppler_path):
+        self.pdf_path = pdf_path
+        self.poppler_path = poppler_path
+
+    def page_count(self):
+        return pdfinfo_from_path(self.pdf_path, poppler_path=self.poppler_path)["Pages"]
+
+    def render(self, page_num, dpi):
+        pages = convert_from_path(self.pdf_path, dpi=dpi, poppler_path=self.poppler_path,
+                                  first_page=page_num, last_page=page_num)
+        if not pages:
+            raise ValueError("Poppler rendered no image for this page")
+        pages[0].info["dpi"] = (dpi, dpi)
+        return pages[0]
+
+    def close(self):
+        pass
+
+
+class MuPDFRasterizer:
+    """Renders pages in-process with MuPDF. The document is parsed once for
+    the whole job and each page is rendered straight into memory."""
+    name = "mupdf"
+
+    def __init__(self, pdf_path):
+        self.doc = fitz.open(pdf_path)
+
+    def page_count(self):
+        return self.doc.page_count
+
+    def render(self, page_num, dpi):
+        pix = self.doc.load_page(page_num - 1).get_pixmap(dpi=dpi, alpha=False)
+        img = Image.frombytes("RGB", (pix.width, pix.height), pix.samples)
+        img.info["dpi"] = (dpi, dpi)
+        return img
+
+    def close(self):
+        self.doc.close()
+
+
+def open_rasterizer(pdf_path, poppler_path, choice):
+    """Returns the rasterizer named by OCR_RASTERIZER: "mupdf", "poppler",
+    or "auto" (the default) for MuPDF when PyMuPDF is installed and Poppler
+    otherwise."""
+    if choice == "mupdf" and not MUPDF_AVAILABLE:
+        raise RuntimeError("the mupdf rasterizer needs PyMuPDF (pip install pymupdf)")
+    if choice == "mupdf" or (choice in ("", "auto") and MUPDF_AVAILABLE):
+        return MuPDFRasterizer(pdf_path)
+    if choice not in ("", "auto", "poppler"):
+        raise ValueError(f"unknown rasterizer {choice!r}")
+    return PopplerRasterizer(pdf_path, poppler_path)
+
+
+def report_pages(done, total):
+    """Tell the server how many pages are finished. It reads these lines off
+    stderr as they are written and keeps them out of the output it parses
+    the result JSON from."""
+    print(f"OCR-PROGRESS {done} {total}", file=sys.stderr, flush=True)
+
+
+def report_event(kind, message):
+    """Add an entry to the job's timeline on the server, like report_pages."""
+    print(f"OCR-EVENT {kind} " + message.replace("\n", " "), file=sys.stderr, flush=True)
+
+
+# Pages recognized with a lower mean word confidence are reported: the scan
+# is usually skewed, blurred or too small.
+LOW_CONFIDENCE = 50
+
+
+def report_warning(page_num, message):
+    """Tell the server about a problem with a page as soon as it is noticed,
+    like report_pages."""
+    print(f"OCR-WARNING {page_num} " + message.replace("\n", " "), file=sys.stderr, flush=True)
+
+
+def check_page(stats):
+    """Report pages whose recognition looks doubtful from their stats."""
+    if stats['total_words'] == 0:
+        report_warning(stats['page'], "no text was found on this page")
+    elif stats['mean_confidence'] is not None and stats['mean_confidence'] < LOW_CONFIDENCE:
+        report_warning(stats['page'], f"low recognition confidence ({stats['mean_confidence']}%); "
+                                      "the scan may be skewed, blurred or too small")
+
+
+def write_page_text(pages_dir, page_num, text):
+    """
+    Write one page's text to pages/<n>.txt. The file is written under a
+    temporary name and renamed so readers never see a half-written page.
+    """
+    final_path = os.path.join(pages_dir, f"{page_num}.txt")
+    tmp_path = final_path + ".tmp"
+    with open(tmp_path, "w", encoding="utf-8") as f:
+        f.write(text)
+    os.replace(tmp_path, final_path)
+
+
+def write_atomic(path, data):
+    """Write bytes to path via a temporary file and rename."""
+    tmp_path = path + ".tmp"
+    with open(tmp_path, "wb") as f:
+        f.write(data)
+    os.replace(tmp_path, path)
+
+
+def write_page_checkpoint(pages_dir, page_num, text, page_pdf, stats):
+    """
+    Checkpoint a finished page: its PDF, its stats and then its text. The
+    text file is written last, so pages/<n>.txt existing means the whole
+    page is done.
+    """
+    write_atomic(os.path.join(pages_dir, f"{page_num}.pdf"), page_pdf)
+    write_atomic(os.path.join(pages_dir, f"{page_num}.json"),
+                 json.dumps(stats, ensure_ascii=False).encode("utf-8"))
+    write_page_text(pages_dir, page_num, text)
+
+
+def load_page_checkpoint(pages_dir, page_num, logger):
+    """
+    Return the text of a page finished by an earlier run and add its stats
+    to logger, or None when the page still has to be done.
+    """
+    paths = [os.path.join(pages_dir, f"{page_num}.{ext}") for ext in ("txt", "pdf", "json")]
+    if not all(os.path.exists(p) for p in paths):
+        return None
+    try:
+        with open(paths[2], encoding="utf-8") as f:
+            stats = json.load(f)
+        with open(paths[0], encoding="utf-8") as f:
+            text = f.read()
+    except (OSError, ValueError):
+        return None
+    logger.add_page_checkpoint(stats)
+    return text
+
+
+def parse_page_languages(spec):
+    """Parse the server's page language overrides, e.g. "1-10=eng,11-=fas".
+
+    Returns (first, last, languages) tuples; last is 0 for an open range.
+    """
+    ranges = []
+    for item in spec.split(","):
+        if not item.strip():
+            continue
+        pages, lang = item.split("=", 1)
+        first, _, last = pages.partition("-")
+        if "-" not in pages:
+            last = first
+        ranges.append((int(first), int(last) if last else 0, lang.strip()))
+    return ranges
+
+
+def languages_for_page(page_languages, page_num, default):
+    for first, last, lang in page_languages:
+        if first <= page_num and (last == 0 or page_num <= last):
+            return lang
+    return default
+
+
+# =============================================================================
+# PAGE CACHE
+# =============================================================================
+
+# Bumped whenever recognition changes in a way that makes cached pages stale.
+PAGE_CACHE_VERSION = 1
+
+
+class PageCache:
+    """
+    Recognized pages kept across jobs under OCR_PAGE_CACHE, keyed by a hash
+    of the rendered page image and the settings it was recognized with, so
+    a document submitted again with a few pages changed only has those
+    pages recognized. An entry is the same text, page PDF and stats as a
+    checkpoint, under <key[:2]>/<key>. The server removes the entries used
+    least recently once the cache is over its size.
+    """
+    
+    def __init__(self, root, settings):
+        self.root = root
+        self.settings = settings
+        self.hits = 0
+    
+    def key(self, img, page_settings):
+        h = hashlib.sha256()
+        h.update(json.dumps([PAGE_CACHE_VERSION, self.settings, page_settings,
+                             img.mode, img.size], sort_keys=True).encode("utf-8"))
+        h.update(img.tobytes())
+        return h.hexdigest()
+    
+    def paths(self, key):
+        base = os.path.join(self.root, key[:2], key)
+        return [base + ext for ext in (".txt", ".pdf", ".json")]
+    
+    def load(self, key, page_num, logger):
+        """
+        Return the text and PDF of a cached page and add its stats to
+        logger, or None when the page is not in the cache.
+        """
+        paths = self.paths(key)
+        try:
+            with open(paths[2], encoding="utf-8") as f:
+                stats = json.load(f)
+            with open(paths[1], "rb") as f:
+                page_pdf = f.read()
+            with open(paths[0], encoding="utf-8") as f:
+                text = f.read()
+            for p in paths:
+                os.utime(p)  # recently used, see the server's sweep
+        except (OSError, ValueError):
+            return None
+        stats['page'] = page_num
+        logger.add_page_checkpoint(stats, "reused from the page cache")
+        self.hits += 1
+        return text, page_pdf
+    
+    def store(self, key, text, page_pdf, stats):
+        """Add a page; a full or read-only cache only costs the reuse."""
+        paths = self.paths(key)
+        try:
+            os.makedirs(os.path.dirname(paths[0]), exist_ok=True)
+            write_atomic(paths[1], page_pdf)
+            write_atomic(paths[2], json.dumps(stats, ensure_ascii=False).encode("utf-8"))
+            write_atomic(paths[0], text.encode("utf-8"))
+        except OSError as e:
+            print(f"Warning: page cache: {e}", file=sys.stderr)
+
+
+def open_page_cache(root, text_layout, separate_notes, glossary_path, charset, mode, adaptive_dpi):
+    """The page cache for this job's settings, or None without OCR_PAGE_CACHE.
+    The languages and regions can differ by page and are keyed per page."""
+    if not root:
+        return None
+    try:
+        version = str(pytesseract.get_tesseract_version())
+    except Exception:
+        version = ""
+    glossary = ""
+    if glossary_path:
+        with open(glossary_path, "rb") as f:
+            glossary = hashlib.sha256(f.read()).hexdigest()
+    return PageCache(root, {
+        "tesseract": version,
+        "layout": text_layout,
+        "notes": separate_notes,
+        "glossary": glossary,
+        "charset": charset,
+        "mode": mode,
+        "auto_dpi": adaptive_dpi,
+    })
+
+
 # =============================================================================
 # MAIN
 # =============================================================================
@@ -473,50 +1524,161 @@ def main():
         print(json.dumps({"error": "Usage: python script.py <pdf> <output_folder> <prefix> [job_id]"}))
         sys.exit(1)
     
+    # Scratch space for page images; the server creates a private directory
+    # per run and removes it afterwards, whatever the outcome.
+    work_dir = os.environ.get("OCR_WORK_DIR") or output_folder
+    tempfile.tempdir = work_dir
+    
     progress = ProgressTracker(job_id, output_folder)
     rtl_logger = RTLLogger()
     
     tesseract_cmd = r"C:\Program Files\Tesseract-OCR\tesseract.exe"
     poppler_path = r"C:\Program Files\poppler-24.08.0\Library\bin"
-    languages = "eng+fas"
+    languages = os.environ.get("OCR_LANGUAGES") or "eng+fas"
+    page_languages = parse_page_languages(os.environ.get("OCR_PAGE_LANGUAGES", ""))
+    text_layout = os.environ.get("OCR_TEXT_LAYOUT", "")
+    separate_notes = os.environ.get("OCR_SEPARATE_NOTES") == "1"
+    glossary_path = os.environ.get("OCR_GLOSSARY")
+    charset = os.environ.get("OCR_CHARSET", "")
+    regions = json.loads(os.environ.get("OCR_REGIONS") or "[]")
+    mode = os.environ.get("OCR_MODE", "")
+    adaptive_dpi = os.environ.get("OCR_DPI") == "auto" and mode != "screenshot"
+    rasterizer = None
+    pdf_writer = None
     dpi = 300
+    # The resolution of the images recognized, which screenshot mode raises.
+    image_dpi = dpi * SCREENSHOT_SCALE if mode == "screenshot" else dpi
     
     try:
         progress.update("init", 5, "Initializing...")
         rtl_logger.log("OCR process started")
         rtl_logger.log(f"Input PDF: {pdf_path}")
         rtl_logger.log(f"Languages: {languages}")
-        rtl_logger.log(f"DPI: {dpi}")
+        if page_languages:
+            rtl_logger.log("Page languages: " + ", ".join(
+                f"{first}-{last or ''}={lang}" for first, last, lang in page_languages))
+        rtl_logger.log(f"DPI: {dpi}" + (f", up to {AUTO_DPI_MAX} for small text" if adaptive_dpi else ""))
+        if mode:
+            rtl_logger.log(f"Mode: {mode}")
+        if text_layout:
+            rtl_logger.log(f"Text layout: {text_layout}")
+        if separate_notes:
+            rtl_logger.log("Footnotes and marginalia are written separately")
+        glossary = Glossary(glossary_path) if glossary_path else None
+        if glossary:
+            rtl_logger.log(f"Glossary: {len(glossary.words)} words")
+        if charset:
+            rtl_logger.log(f"Character set: {charset}")
+        if regions:
+            rtl_logger.log(f"Template regions: {len(regions)}")
         
         os.makedirs(output_folder, exist_ok=True)
         pytesseract.pytesseract.tesseract_cmd = tesseract_cmd
+        page_cache = open_page_cache(os.environ.get("OCR_PAGE_CACHE"), text_layout, separate_notes,
+                                     glossary_path, charset, mode, adaptive_dpi)
         
-        # Convert PDF to images
-        progress.update("convert", 10, "Converting PDF...")
-        rtl_logger.log("Converting PDF to images...")
-        pages = convert_from_path(pdf_path, dpi=dpi, poppler_path=poppler_path)
-        total = len(pages)
+        # Pages are rasterized and OCRed one at a time. Every finished page
+        # is checkpointed under pages/ (text, page PDF, stats), so a job that
+        # is interrupted and started again skips the pages it already did.
+        progress.update("convert", 10, "Reading PDF...")
+        rasterizer = open_rasterizer(pdf_path, poppler_path, os.environ.get("OCR_RASTERIZER", ""))
+        total = rasterizer.page_count()
         rtl_logger.log(f"PDF has {total} pages")
+        rtl_logger.log(f"Rasterizer: {rasterizer.name}")
+        report_event("engine", f"tesseract, pages rendered with {rasterizer.name}")
+        rtl_logger.log("Page images: " + (os.environ.get("OCR_PAGE_IMAGES") or "pipe"))
         
-        png_files = []
-        for i, page in enumerate(pages):
-            p = os.path.join(output_folder, f"{output_prefix}_p{i+1}.png")
-            page.save(p, "PNG")
-            png_files.append(p)
+        pages_dir = os.path.join(output_folder, "pages")
+        os.makedirs(pages_dir, exist_ok=True)
         
-        # Extract text using HOCR with RTL markers
-        progress.update("ocr", 25, "Extracting text with HOCR...")
+        progress.update("ocr", 15, "Extracting text with HOCR...")
         rtl_logger.log("Starting HOCR text extraction...")
         
+        # The searchable PDF grows as pages are finished, under a name of its
+        # own until every page is in; a failed run leaves the pages before
+        # the failure there.
+        pdf_out = os.path.join(output_folder, f"{output_prefix}.pdf")
+        partial_pdf = os.path.join(output_folder, f"{output_prefix}.partial.pdf")
+        pdf_writer = IncrementalPDF(partial_pdf)
+        
+        # A page that cannot be rasterized or recognized (a damaged image
+        # stream, say) is reported and left out instead of failing the job.
         all_text = ""
-        for i, png in enumerate(png_files):
-            progress.update("ocr", 25 + (25*i/total), f"OCR page {i+1}/{total}")
-            
-            # Use HOCR extraction with RTL markers
-            page_text = extract_text_with_hocr(png, languages, i+1, rtl_logger)
-            all_text += f"\n\n--- Page {i+1} ---\n\n{page_text}"
+        resumed = 0
+        failed_pages = []
+        for i in range(total):
+            page_num = i + 1
+            report_pages(i, total)
+            page_text = load_page_checkpoint(pages_dir, page_num, rtl_logger)
+            if page_text is not None:
+                resumed += 1
+                with open(os.path.join(pages_dir, f"{page_num}.pdf"), "rb") as f:
+                    page_pdf = f.read()
+            else:
+                progress.update("ocr", 15 + (70*i/total), f"OCR page {page_num}/{total}")
+                page_lang = languages_for_page(page_languages, page_num, languages)
+                cached = None
+                try:
+                    img = rasterizer.render(page_num, dpi)
+                    if page_cache:
+                        cache_key = page_cache.key(img, {
+                            "languages": page_lang,
+                            "regions": [r for r in regions if not r.get("page") or r["page"] == page_num]})
+                        cached = page_cache.load(cache_key, page_num, rtl_logger)
+                    if cached:
+                        page_text, page_pdf = cached
+                    else:
+                        page_dpi = auto_dpi(img, dpi) if adaptive_dpi else dpi
+                        if page_dpi != dpi:
+                            rtl_logger.log(f"Page {page_num}: small text, rendered again at {page_dpi} DPI")
+                            report_event("engine", f"page {page_num} rendered again at {page_dpi} DPI for its small text")
+                            img = None  # free the page before rendering it larger
+                            img = rasterizer.render(page_num, page_dpi)
+                        if mode == "screenshot":
+                            img = prepare_screenshot(img, dpi)
+                        
+                        # Use HOCR extraction with RTL markers
+                        page_text = extract_text_with_hocr(img, page_lang, page_num, rtl_logger,
+                                                           text_layout, separate_notes, glossary, charset, mode)
+                        page_pdf = run_tesseract(img, page_lang, tesseract_config(glossary, charset, mode), 'pdf')
+                        if page_dpi != dpi:
+                            rtl_logger.page_stats[-1]['dpi'] = page_dpi
+                        if regions:
+                            rtl_logger.page_stats[-1]['regions'] = recognize_regions(img, regions, page_num, page_lang)
+                except Exception as e:
+                    rtl_logger.log(f"Page {page_num} could not be processed: {e}")
+                    report_warning(page_num, f"the page could not be processed: {e}")
+                    failed_pages.append({"page": page_num, "error": str(e)})
+                    all_text += f"\n\n--- Page {page_num} ---\n\n[page could not be processed]"
+                    continue
+                finally:
+                    img = None  # a page image is tens of megabytes
+                if not cached:
+                    try:
+                        page_pdf = fix_pdf_rtl(page_pdf)
+                    except:
+                        pass
+                    if page_cache:
+                        page_cache.store(cache_key, page_text, page_pdf, rtl_logger.page_stats[-1])
+                check_page(rtl_logger.page_stats[-1])
+                write_page_checkpoint(pages_dir, page_num, page_text, page_pdf, rtl_logger.page_stats[-1])
+            pdf_writer.add_page(page_pdf)
+            page_pdf = None
+            all_text += f"\n\n--- Page {page_num} ---\n\n{page_text}"
+        report_pages(total, total)
+        if resumed:
+            rtl_logger.log(f"Resumed: {resumed} of {total} pages were already done")
+            report_event("resumed", f"{resumed} of {total} pages were done by an earlier run")
+        if page_cache and page_cache.hits:
+            rtl_logger.log(f"Page cache: {page_cache.hits} of {total} pages were reused")
+            report_event("cache", f"{page_cache.hits} of {total} pages were reused from the page cache")
+        if len(failed_pages) == total:
+            raise RuntimeError("No page could be processed: " +
+                               "; ".join(f"page {f['page']}: {f['error']}" for f in failed_pages))
         
         rtl_logger.log(f"Text extraction complete. {rtl_logger.lines_reversed} lines reversed")
+        if glossary:
+            rtl_logger.log(f"Glossary corrections: {glossary.corrections}")
         
         # Save text file
         text_path = os.path.join(output_folder, f"{output_prefix}.txt")
@@ -524,44 +1686,59 @@ def main():
             f.write(all_text)
         rtl_logger.log(f"Text saved to: {text_path}")
         
+        # Footnotes and marginalia, under the number of the page they are on.
+        notes_path = None
+        if separate_notes:
+            notes_path = os.path.join(output_folder, f"{output_prefix}_notes.txt")
+            with open(notes_path, "w", encoding="utf-8") as f:
+                for stat in sorted(rtl_logger.page_stats, key=lambda s: s["page"]):
+                    notes = stat.get("notes")
+                    if not notes or not (notes["footnotes"] or notes["margins"]):
+                        continue
+                    f.write(f"\n\n--- Page {stat['page']} ---\n")
+                    for heading, key in (("Footnotes", "footnotes"), ("Margin notes", "margins")):
+                        if notes[key]:
+                            f.write(f"\n{heading}:\n\n" + "\n\n".join(notes[key]) + "\n")
+            rtl_logger.log(f"Notes saved to: {notes_path}")
+        
+        # Template regions, in pixels of the page images recognized. Pages
+        # dpi=auto rendered larger give their own resolution.
+        regions_path = None
+        if regions:
+            regions_path = os.path.join(output_folder, f"{output_prefix}_regions.json")
+            pages = [{"page": stat["page"], "dpi": stat.get("dpi", image_dpi), "regions": stat["regions"]}
+                     for stat in sorted(rtl_logger.page_stats, key=lambda s: s["page"]) if stat.get("regions")]
+            with open(regions_path, "w", encoding="utf-8") as f:
+                json.dump({"dpi": image_dpi, "pages": pages}, f, ensure_ascii=False, indent=2)
+            rtl_logger.log(f"Regions saved to: {regions_path}")
+        
+        # Newspaper articles with their regions, in pixels of the page
+        # images recognized.
+        articles_path = None
+        if text_layout == "newspaper":
+            articles_path = os.path.join(output_folder, f"{output_prefix}_articles.json")
+            pages = [{"page": stat["page"], "dpi": stat.get("dpi", image_dpi), "articles": stat.get("articles", [])}
+                     for stat in sorted(rtl_logger.page_stats, key=lambda s: s["page"])]
+            with open(articles_path, "w", encoding="utf-8") as f:
+                json.dump({"dpi": image_dpi, "pages": pages}, f, ensure_ascii=False, indent=2)
+            rtl_logger.log(f"Articles saved to: {articles_path}")
+        
+        progress.update("merge", 90, "Finishing PDF...")
+        pdf_writer.close()
+        os.replace(partial_pdf, pdf_out)
+        rtl_logger.log(f"PDF saved to: {pdf_out}")
+        
         # Save log file
         log_path = os.path.join(output_folder, f"{output_prefix}_rtl_log.txt")
         rtl_logger.write_log(log_path)
         
-        # Create Tesseract PDFs
-        progress.update("pdf", 55, "Creating PDFs...")
-        rtl_logger.log("Creating searchable PDFs...")
-        tess_pdfs = []
-        for i, png in enumerate(png_files):
-            progress.update("pdf", 55 + (15*i/total), f"PDF page {i+1}/{total}")
-            tess_pdfs.append(pytesseract.image_to_pdf_or_hocr(Image.open(png), lang=languages, extension='pdf'))
-        
-        # Fix RTL in PDFs
-        progress.update("fix", 75, "Fixing RTL text in PDF...")
-        rtl_logger.log("Fixing RTL text in PDF streams...")
-        fixed = []
-        for i, pdf in enumerate(tess_pdfs):
-            progress.update("fix", 75 + (10*i/total), f"Fixing page {i+1}/{total}")
-            try:
-                fixed.append(fix_pdf_rtl(pdf))
-            except:
-                fixed.append(pdf)
-        
-        # Merge PDFs
-        progress.update("merge", 90, "Merging...")
-        rtl_logger.log("Merging PDF pages...")
-        pdf_out = os.path.join(output_folder, f"{output_prefix}.pdf")
-        merger = PdfMerger()
-        for f in fixed:
-            merger.append(BytesIO(f))
-        merger.write(pdf_out)
-        merger.close()
-        rtl_logger.log(f"PDF saved to: {pdf_out}")
-        
-        # Cleanup PNG files
-        for p in png_files:
-            if os.path.exists(p):
-                os.remove(p)
+        # The page texts stay for the API; page PDFs and stats were only
+        # needed to resume.
+        for i in range(total):
+            for ext in ("pdf", "json"):
+                p = os.path.join(pages_dir, f"{i+1}.{ext}")
+                if os.path.exists(p):
+                    os.remove(p)
         
         rtl_stats = rtl_logger.get_summary()
         progress.complete(text_path, pdf_out, log_path, rtl_stats)
@@ -574,10 +1751,23 @@ def main():
             "text_file": text_path,
             "pdf_file": pdf_out,
             "log_file": log_path,
+            "articles_file": articles_path,
+            "notes_file": notes_path,
+            "regions_file": regions_path,
             "original_kb": round(orig/1024, 1),
             "output_kb": round(out/1024, 1),
             "ratio": round(out/orig, 2) if orig else 0,
             "method": "pikepdf" if PIKEPDF_AVAILABLE else "regex",
+            "engine": "tesseract",
+            "pages": total,
+            "failed_pages": failed_pages,
+            "mean_confidence": rtl_stats['mean_confidence'],
+            "page_confidence": [{"page": stat['page'], "confidence": stat['mean_confidence']}
+                                for stat in sorted(rtl_logger.page_stats, key=lambda s: s["page"])
+                                if stat.get('mean_confidence') is not None],
+            "low_lines": [dict(line, page=stat['page'])
+                          for stat in sorted(rtl_logger.page_stats, key=lambda s: s["page"])
+                          for line in stat.get('low_lines', [])],
             "job_id": job_id,
             "rtl_stats": {
                 "total_words": rtl_stats['total_words'],
@@ -596,7 +1786,44 @@ def main():
             "traceback": traceback.format_exc(), "job_id": job_id
         }))
         sys.exit(1)
+    finally:
+        # A warm worker lives on after the job; do not keep its PDF open.
+        if rasterizer:
+            rasterizer.close()
+        if pdf_writer:
+            pdf_writer.abandon()
+
+
+def serve():
+    """Run one job after another for the server, which keeps a few of these
+    workers started so a job does not wait for the interpreter and the
+    imports. Each job is a JSON line on stdin with the command-line
+    arguments and the OCR_* environment of a one-off run; its output is the
+    same, followed by an "OCR-DONE <exit status>" line once it is over."""
+    base_env = dict(os.environ)
+    for line in sys.stdin:
+        if not line.strip():
+            continue
+        code = 0
+        try:
+            req = json.loads(line)
+            os.environ.clear()
+            os.environ.update(base_env)
+            os.environ.update(kv.split("=", 1) for kv in req.get("env", []))
+            sys.argv = [sys.argv[0]] + req["args"]
+            main()
+        except SystemExit as e:
+            code = e.code if isinstance(e.code, int) else 1
+        except Exception as e:
+            import traceback
+            print(json.dumps({"success": False, "error": str(e), "traceback": traceback.format_exc()}))
+            code = 1
+        sys.stdout.flush()
+        print(f"OCR-DONE {code}", file=sys.stderr, flush=True)
 
 
 if __name__ == "__main__":
-    main()
\ No newline at end of file
+    if sys.argv[1:] == ["--serve"]:
+        serve()
+    else:
+        main()
\ No newline at end of file
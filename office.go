@@ -0,0 +1,434 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Word and PowerPoint files often are nothing but pasted photographs of
+// documents. Such uploads are turned into a PDF with one page per embedded
+// image at intake, so they go through the same checks and OCR as a scan.
+// PNG and JPEG uploads, typically screenshots, become a one-page PDF the
+// same way.
+
+// officeFormats maps the accepted Office extensions to their format name.
+var officeFormats = map[string]string{".docx": "docx", ".pptx": "pptx"}
+
+// imageFormats maps the accepted image extensions to their format name.
+var imageFormats = map[string]string{".png": "png", ".jpg": "jpeg", ".jpeg": "jpeg"}
+
+// officeImageDPI is the resolution images are placed at. The OCR script
+// renders pages at the same resolution, so it sees the original pixels.
+const officeImageDPI = 300
+
+// minOfficeImage skips bullets, icons and rules, which have nothing to read;
+// maxOfficePixels skips images too large to decode safely.
+const (
+	minOfficeImage  = 48
+	maxOfficePixels = 100 << 20
+)
+
+// officeFormat returns "docx" or "pptx" for an Office upload, "" otherwise.
+func officeFormat(filename string) string {
+	return officeFormats[strings.ToLower(path.Ext(filename))]
+}
+
+// convertedFormat returns the format of an upload that is converted to a
+// PDF at intake (see convertToPDF), "" for PDFs.
+func convertedFormat(filename string) string {
+	if f := officeFormat(filename); f != "" {
+		return f
+	}
+	return imageFormats[strings.ToLower(path.Ext(filename))]
+}
+
+// uploadType is a file extension the server can take, with the name the
+// upload form asks for it by.
+type uploadType struct{ ext, name string }
+
+// knownUploadTypes are the types the server can take, ".zip" being an
+// archive of the others.
+var knownUploadTypes = []uploadType{
+	{".pdf", "PDF"}, {".docx", "Word (.docx)"}, {".pptx", "PowerPoint (.pptx)"},
+	{".png", "PNG"}, {".jpg", "JPEG"}, {".jpeg", "JPEG"}, {".zip", "ZIP archive"},
+}
+
+// uploadTypes are the extensions accepted for upload, see -upload-types.
+var uploadTypes = []string{".pdf", ".docx", ".pptx", ".png", ".jpg", ".jpeg", ".zip"}
+
+// parseUploadTypes parses the comma-separated -upload-types list, whose
+// extensions may leave out the dot.
+func parseUploadTypes(list string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !strings.HasPrefix(t, ".") {
+			t = "." + t
+		}
+		if !slices.ContainsFunc(knownUploadTypes, func(k uploadType) bool { return k.ext == t }) {
+			return nil, fmt.Errorf("-upload-types: unknown type %q", t)
+		}
+		if !slices.Contains(types, t) {
+			types = append(types, t)
+		}
+	}
+	if !slices.ContainsFunc(types, func(t string) bool { return t != ".zip" }) {
+		return nil, errors.New("-upload-types must allow a document type besides .zip")
+	}
+	return types, nil
+}
+
+// uploadTypesMessage asks for a file of the accepted types.
+func uploadTypesMessage() string {
+	var names []string
+	for _, k := range knownUploadTypes {
+		if k.ext != ".zip" && slices.Contains(uploadTypes, k.ext) && !slices.Contains(names, k.name) {
+			names = append(names, k.name)
+		}
+	}
+	if n := len(names); n > 1 {
+		names = append(names[:n-2], names[n-2]+" or "+names[n-1])
+	}
+	return "Please upload a " + strings.Join(names, ", ") + " file"
+}
+
+// isUploadType reports whether filename is one of the accepted upload
+// types, not counting archives.
+func isUploadType(filename string) bool {
+	ext := strings.ToLower(path.Ext(filename))
+	return ext != ".zip" && slices.Contains(uploadTypes, ext)
+}
+
+// convertToPDF replaces the upload at p, of the given convertedFormat, with
+// the PDF it is OCRed as. An Office file with more than maxPages images to
+// make pages of is refused before any is decoded; 0 sets no limit.
+func convertToPDF(p, format string, maxPages int) error {
+	if format == "docx" || format == "pptx" {
+		return officeToPDF(p, format, maxPages)
+	}
+	return imageToPDF(p)
+}
+
+// imageToPDF replaces the image at p with a one-page PDF of it.
+func imageToPDF(p string) error {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("Error reading image: %w", err)
+	}
+	var buf bytes.Buffer
+	pw := newImagePDF(&buf)
+	switch err := pw.addImage(data); {
+	case errors.Is(err, errSmallImage):
+		return &pdfError{"image_too_small", fmt.Sprintf("The image is smaller than %dx%d pixels; nothing to OCR", minOfficeImage, minOfficeImage)}
+	case err != nil:
+		return &pdfError{"invalid_image", "The file is not a readable PNG or JPEG image: " + err.Error()}
+	}
+	if err := pw.close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, buf.Bytes())
+}
+
+// officeToPDF replaces the Office file at p with a PDF of the images
+// embedded in it, in document order.
+func officeToPDF(p, format string, maxPages int) error {
+	zr, err := zip.OpenReader(p)
+	if err != nil {
+		return &pdfError{"invalid_office", fmt.Sprintf("The file is not a valid %s document", strings.ToUpper(format))}
+	}
+	defer zr.Close()
+	files, err := officeImages(&zr.Reader, format)
+	if err != nil {
+		return err
+	}
+	if maxPages > 0 {
+		if perr := checkPages(officePages(files), maxPages); perr != nil {
+			return perr
+		}
+	}
+
+	var buf bytes.Buffer
+	pw := newImagePDF(&buf)
+	for _, f := range files {
+		data, err := readZipFile(f)
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %w", f.Name, err)
+		}
+		// Formats that cannot be decoded, such as EMF or TIFF, are skipped
+		// like images too small to hold text.
+		pw.addImage(data)
+	}
+	if pw.pages == 0 {
+		return &pdfError{"no_raster_content", "This document contains no images; nothing to OCR"}
+	}
+	if err := pw.close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, buf.Bytes())
+}
+
+// officePages counts the images of files that become pages, from their
+// headers alone.
+func officePages(files []*zip.File) int {
+	pages := 0
+	for _, f := range files {
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(rc)
+		rc.Close()
+		if err == nil && imagePage(cfg) == nil {
+			pages++
+		}
+	}
+	return pages
+}
+
+// officeRels is a part's relationships file.
+type officeRels struct {
+	Rels []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+		Mode   string `xml:"TargetMode,attr"`
+	} `xml:"Relationship"`
+}
+
+// imageRef matches the attributes that point at an embedded image: DrawingML
+// blips and legacy VML image data.
+var imageRef = regexp.MustCompile(`r:(?:embed|id)="([^"]+)"`)
+
+var slideName = regexp.MustCompile(`^ppt/slides/slide(\d+)\.xml$`)
+
+// officeImages returns the images a document shows, in order: the document
+// body of a Word file, or the slides of a presentation by number. An image
+// shown more than once is returned once.
+func officeImages(zr *zip.Reader, format string) ([]*zip.File, error) {
+	byName := map[string]*zip.File{}
+	for _, f := range zr.File {
+		byName[f.Name] = f
+	}
+	var parts []string
+	if format == "docx" {
+		parts = []string{"word/document.xml"}
+	} else {
+		for _, f := range zr.File {
+			if slideName.MatchString(f.Name) {
+				parts = append(parts, f.Name)
+			}
+		}
+		sort.Slice(parts, func(a, b int) bool {
+			na, _ := strconv.Atoi(slideName.FindStringSubmatch(parts[a])[1])
+			nb, _ := strconv.Atoi(slideName.FindStringSubmatch(parts[b])[1])
+			return na < nb
+		})
+	}
+	if len(parts) == 0 || byName[parts[0]] == nil {
+		return nil, &pdfError{"invalid_office", fmt.Sprintf("The file is not a valid %s document", strings.ToUpper(format))}
+	}
+
+	var images []*zip.File
+	seen := map[string]bool{}
+	for _, part := range parts {
+		body, err := readZipFile(byName[part])
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %w", part, err)
+		}
+		targets := map[string]string{}
+		if rf := byName[path.Join(path.Dir(part), "_rels", path.Base(part)+".rels")]; rf != nil {
+			data, err := readZipFile(rf)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading %s: %w", rf.Name, err)
+			}
+			var rels officeRels
+			if err := xml.Unmarshal(data, &rels); err == nil {
+				for _, r := range rels.Rels {
+					if r.Mode != "External" {
+						targets[r.ID] = officeTarget(part, r.Target)
+					}
+				}
+			}
+		}
+		for _, m := range imageRef.FindAllSubmatch(body, -1) {
+			name := targets[string(m[1])]
+			if f := byName[name]; f != nil && !seen[name] && strings.Contains(name, "/media/") {
+				seen[name] = true
+				images = append(images, f)
+			}
+		}
+	}
+	return images, nil
+}
+
+// officeTarget is the name in the package of a relationship's target: a
+// path relative to the part, or one from the package root when it starts
+// with a slash.
+func officeTarget(part, target string) string {
+	if strings.HasPrefix(target, "/") {
+		return strings.TrimPrefix(path.Clean(target), "/")
+	}
+	return path.Join(path.Dir(part), target)
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, maxUploadSize))
+}
+
+var errSmallImage = errors.New("image is too small to contain text")
+
+// imagePDF writes a PDF with one image per page, each page the size of its
+// image at officeImageDPI.
+type imagePDF struct {
+	w       *countingWriter
+	offsets []int64 // by object number - 1
+	kids    []int
+	pages   int
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Objects 1 and 2 are the catalog and the page tree, written last.
+func newImagePDF(w io.Writer) *imagePDF {
+	p := &imagePDF{w: &countingWriter{w: bufio.NewWriter(w)}, offsets: make([]int64, 2)}
+	fmt.Fprint(p.w, "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	return p
+}
+
+func (p *imagePDF) object(body []byte, dict string) int {
+	p.offsets = append(p.offsets, p.w.n)
+	n := len(p.offsets)
+	p.writeObject(n, body, dict)
+	return n
+}
+
+func (p *imagePDF) writeObject(n int, body []byte, dict string) {
+	if body == nil {
+		fmt.Fprintf(p.w, "%d 0 obj\n%s\nendobj\n", n, dict)
+		return
+	}
+	fmt.Fprintf(p.w, "%d 0 obj\n<< %s /Length %d >>\nstream\n", n, dict, len(body))
+	p.w.Write(body)
+	fmt.Fprint(p.w, "\nendstream\nendobj\n")
+}
+
+// imagePage reports why an image of cfg is not made a page, nil when it is.
+func imagePage(cfg image.Config) error {
+	if cfg.Width < minOfficeImage || cfg.Height < minOfficeImage {
+		return errSmallImage
+	}
+	if cfg.Width*cfg.Height > maxOfficePixels {
+		return fmt.Errorf("image of %dx%d pixels is too large", cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+// addImage adds a page with the JPEG, PNG or GIF image in data. JPEGs are
+// embedded as they are; other images are stored as deflated RGB on white.
+func (p *imagePDF) addImage(data []byte) error {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := imagePage(cfg); err != nil {
+		return err
+	}
+	var stream []byte
+	var dict string
+	if format == "jpeg" && (cfg.ColorModel == color.YCbCrModel || cfg.ColorModel == color.GrayModel) {
+		space := "/DeviceRGB"
+		if cfg.ColorModel == color.GrayModel {
+			space = "/DeviceGray"
+		}
+		stream = data
+		dict = fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode",
+			cfg.Width, cfg.Height, space)
+	} else {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		var raw bytes.Buffer
+		zw := zlib.NewWriter(&raw)
+		row := make([]byte, 0, 3*cfg.Width)
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row = row[:0]
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, a := img.At(x, y).RGBA()
+				// Composite over white, as the image would appear on a page.
+				white := 0xffff - a
+				row = append(row, byte((r+white)>>8), byte((g+white)>>8), byte((bl+white)>>8))
+			}
+			zw.Write(row)
+		}
+		zw.Close()
+		stream = raw.Bytes()
+		dict = fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode",
+			b.Dx(), b.Dy())
+		cfg.Width, cfg.Height = b.Dx(), b.Dy()
+	}
+	w := float64(cfg.Width) * 72 / officeImageDPI
+	h := float64(cfg.Height) * 72 / officeImageDPI
+	imgObj := p.object(stream, dict)
+	content := []byte(fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", w, h))
+	contentObj := p.object(content, "")
+	page := p.object(nil, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+		w, h, imgObj, contentObj))
+	p.kids = append(p.kids, page)
+	p.pages++
+	return nil
+}
+
+func (p *imagePDF) close() error {
+	kids := make([]string, len(p.kids))
+	for i, k := range p.kids {
+		kids[i] = strconv.Itoa(k) + " 0 R"
+	}
+	p.offsets[0] = p.w.n
+	p.writeObject(1, nil, "<< /Type /Catalog /Pages 2 0 R >>")
+	p.offsets[1] = p.w.n
+	p.writeObject(2, nil, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+
+	xref := p.w.n
+	fmt.Fprintf(p.w, "xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, off := range p.offsets {
+		fmt.Fprintf(p.w, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(p.w, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, xref)
+	return p.w.w.Flush()
+}
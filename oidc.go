@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidc is the OpenID Connect provider people sign in to the web UI with,
+// Keycloak or Google for example. nil leaves the web UI open to anyone,
+// unless an LDAP directory is configured instead.
+var oidc *oidcProvider
+
+const (
+	loginCookie  = "ocr_login"
+	loginTimeout = 10 * time.Minute // time a sign-in may take at the provider
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// oidcProvider signs users in with the authorization code flow and PKCE.
+// Its endpoints come from the issuer's discovery document, fetched at the
+// first sign-in, and its signing keys from the document's JWKS.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+
+	mu          sync.Mutex
+	meta        *oidcMetadata
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// oidcMetadata is the part of the discovery document the login uses.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// loginState is what the login cookie holds while the user signs in at the
+// provider.
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+	Expires  int64  `json:"exp"`
+}
+
+func newOIDCProvider(cfg Config) (*oidcProvider, error) {
+	if cfg.OIDCClientID == "" {
+		return nil, errors.New("-oidc-client-id is required with -oidc-issuer")
+	}
+	return &oidcProvider{
+		issuer:       strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		clientID:     cfg.OIDCClientID,
+		clientSecret: cfg.OIDCClientSecret,
+		redirectURL:  absoluteURL(appPath("/auth/callback")),
+	}, nil
+}
+
+// loginHandler starts a sign-in at the provider.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	meta, err := oidc.metadata(r.Context())
+	if err != nil {
+		log.Printf("OIDC login: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+		renderError(w, r, "The login provider is not reachable; try again later")
+		return
+	}
+	st := loginState{
+		State:    randomHex(16),
+		Nonce:    randomHex(16),
+		Verifier: randomHex(32),
+		Next:     localPath(r.URL.Query().Get("next")),
+		Expires:  time.Now().Add(loginTimeout).Unix(),
+	}
+	setCookie(w, r, loginCookie, "/auth/", signCookie(loginCookie, st), loginTimeout)
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.clientID},
+		"redirect_uri":          {oidc.redirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, meta.AuthorizationEndpoint+sep+q.Encode(), http.StatusSeeOther)
+}
+
+// callbackHandler finishes a sign-in: the provider sends the user back
+// here with a code, which is exchanged for an ID token that becomes the
+// session.
+func callbackHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var st loginState
+	if !readCookie(r, loginCookie, &st) || time.Now().Unix() >= st.Expires ||
+		subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(st.State)) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		renderError(w, r, "The sign-in expired or was started elsewhere; sign in again")
+		return
+	}
+	clearCookie(w, loginCookie, "/auth/")
+	if e := q.Get("error"); e != "" {
+		msg := e
+		if d := q.Get("error_description"); d != "" {
+			msg = d
+		}
+		w.WriteHeader(http.StatusForbidden)
+		renderError(w, r, "Sign-in failed: "+msg)
+		return
+	}
+	claims, err := oidc.exchange(r.Context(), q.Get("code"), st)
+	if err != nil {
+		log.Printf("OIDC login: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+		renderError(w, r, "Sign-in failed; try again")
+		return
+	}
+	// Only an address the provider vouches for names the account; without
+	// the claim the jobs are the subject's.
+	s := session{Subject: claims.Subject, Name: claims.Name}
+	if bytes.Equal(claims.EmailVerified, []byte("true")) || bytes.Equal(claims.EmailVerified, []byte(`"true"`)) {
+		s.Email = claims.Email
+	}
+	startSession(w, r, s, st.Next)
+}
+
+// metadata returns the provider's discovery document. A failed fetch is
+// not kept, so the next sign-in tries again.
+func (p *oidcProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var meta oidcMetadata
+	if err := oidcGetJSON(ctx, p.issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if meta.Issuer != p.issuer {
+		return nil, fmt.Errorf("discovery: the document is for issuer %q, not %q", meta.Issuer, p.issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("discovery: the document lacks the authorization, token or JWKS endpoint")
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+func oidcGetJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<20)).Decode(v)
+}
+
+// idClaims are the ID token claims the login checks and keeps.
+type idClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"` // a string or a list of them
+	Expires       int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified json.RawMessage `json:"email_verified"` // a boolean, or a string with some providers
+	Name          string          `json:"name"`
+}
+
+// exchange redeems an authorization code at the token endpoint and returns
+// the verified claims of the ID token it is answered with.
+func (p *oidcProvider) exchange(ctx context.Context, code string, st loginState) (*idClaims, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"client_id":     {p.clientID},
+		"code_verifier": {st.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("token response: %s: %w", resp.Status, err)
+	}
+	if tok.Error != "" {
+		return nil, fmt.Errorf("token request: %s: %s", tok.Error, tok.ErrorDescription)
+	}
+	if tok.IDToken == "" {
+		return nil, fmt.Errorf("token response: %s without an ID token", resp.Status)
+	}
+	return p.verify(ctx, tok.IDToken, st.Nonce)
+}
+
+// verify checks the signature of an ID token against the provider's keys
+// and that it was issued by the provider, for this client and this
+// sign-in, and has not expired.
+func (p *oidcProvider) verify(ctx context.Context, token, nonce string) (*idClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("ID token: not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("ID token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("ID token signature: %w", err)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("ID token: invalid %s signature", header.Alg)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("ID token: invalid %s signature", header.Alg)
+		}
+	default:
+		return nil, fmt.Errorf("ID token: unsupported key type %T", key)
+	}
+	var c idClaims
+	if err := decodeJWTPart(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("ID token claims: %w", err)
+	}
+	var aud []string
+	if json.Unmarshal(c.Audience, &aud) != nil {
+		aud = make([]string, 1)
+		json.Unmarshal(c.Audience, &aud[0])
+	}
+	switch {
+	case c.Issuer != p.issuer:
+		return nil, fmt.Errorf("ID token: issued by %q", c.Issuer)
+	case !slices.Contains(aud, p.clientID):
+		return nil, errors.New("ID token: issued for another client")
+	case time.Now().Add(-time.Minute).Unix() >= c.Expires:
+		return nil, errors.New("ID token: expired")
+	case subtle.ConstantTimeCompare([]byte(c.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("ID token: nonce does not match the sign-in")
+	case c.Subject == "":
+		return nil, errors.New("ID token: no subject")
+	}
+	return &c, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the provider's signing key kid. The JWKS is fetched again
+// for a key it does not know, as providers rotate them, but at most once a
+// minute.
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("ID token: signed with unknown key %q", kid)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oidcGetJSON(ctx, meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("JWKS: %w", err)
+	}
+	p.keys, p.keysFetched = map[string]crypto.PublicKey{}, time.Now()
+	for _, jk := range set.Keys {
+		if jk.Use == "enc" {
+			continue
+		}
+		switch {
+		case jk.Kty == "RSA":
+			n, e := jwkInt(jk.N), jwkInt(jk.E)
+			if n != nil && e != nil && e.IsInt64() {
+				p.keys[jk.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+			}
+		case jk.Kty == "EC" && jk.Crv == "P-256":
+			x, y := jwkInt(jk.X), jwkInt(jk.Y)
+			if x != nil && y != nil {
+				p.keys[jk.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+			}
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("ID token: signed with unknown key %q", kid)
+}
+
+func jwkInt(s string) *big.Int {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	return new(big.Int).SetBytes(b)
+}
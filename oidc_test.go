@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OpenID Connect provider with an RSA and a P-256 key.
+type testIssuer struct {
+	*httptest.Server
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{rsa: rk, ec: ek}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMetadata{
+			Issuer:                iss.URL,
+			AuthorizationEndpoint: iss.URL + "/authorize",
+			TokenEndpoint:         iss.URL + "/token",
+			JWKSURI:               iss.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rk.N.Bytes()), "e": b64(big.NewInt(int64(rk.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ek.X.FillBytes(make([]byte, 32))), "y": b64(ek.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rk.N.Bytes()), "e": "AQAB"},
+		}})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func (iss *testIssuer) provider() *oidcProvider {
+	return &oidcProvider{issuer: iss.URL, clientID: "client"}
+}
+
+// token signs claims with the key kid, under header alg.
+func (iss *testIssuer) token(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch kid {
+	case "rsa", "enc":
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, iss.rsa, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		r, s, err := ecdsa.Sign(rand.Reader, iss.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (iss *testIssuer) claims() map[string]any {
+	return map[string]any{
+		"iss":            iss.URL,
+		"sub":            "user-1",
+		"aud":            "client",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          "nonce",
+		"email":          "a@example.com",
+		"email_verified": true,
+	}
+}
+
+func TestVerify(t *testing.T) {
+	iss := newTestIssuer(t)
+	for _, tc := range []struct {
+		name   string
+		alg    string
+		kid    string
+		change func(map[string]any)
+	}{
+		{"RS256", "RS256", "rsa", nil},
+		{"ES256", "ES256", "ec", nil},
+		{"audience list", "RS256", "rsa", func(c map[string]any) { c["aud"] = []string{"other", "client"} }},
+	} {
+		c := iss.claims()
+		if tc.change != nil {
+			tc.change(c)
+		}
+		got, err := iss.provider().verify(context.Background(), iss.token(t, tc.alg, tc.kid, c), "nonce")
+		if err != nil {
+			t.Errorf("%s: verify: %v", tc.name, err)
+			continue
+		}
+		if got.Subject != "user-1" || got.Email != "a@example.com" || string(got.EmailVerified) != "true" {
+			t.Errorf("%s: verify = %+v", tc.name, got)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	iss := newTestIssuer(t)
+	for _, tc := range []struct {
+		name   string
+		alg    string
+		kid    string
+		change func(map[string]any)
+		nonce  string
+		want   string
+	}{
+		{"other issuer", "RS256", "rsa", func(c map[string]any) { c["iss"] = "https://evil.example" }, "nonce", "issued by"},
+		{"other client", "RS256", "rsa", func(c map[string]any) { c["aud"] = []string{"other"} }, "nonce", "another client"},
+		{"expired", "RS256", "rsa", func(c map[string]any) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, "nonce", "expired"},
+		{"other sign-in", "RS256", "rsa", nil, "another nonce", "nonce"},
+		{"no subject", "RS256", "rsa", func(c map[string]any) { delete(c, "sub") }, "nonce", "no subject"},
+		{"algorithm mismatch", "ES256", "rsa", nil, "nonce", "invalid ES256 signature"},
+		{"EC key as RS256", "RS256", "ec", nil, "nonce", "invalid RS256 signature"},
+		{"unknown key", "RS256", "missing", nil, "nonce", "unknown key"},
+		{"encryption key", "RS256", "enc", nil, "nonce", "unknown key"},
+	} {
+		c := iss.claims()
+		if tc.change != nil {
+			tc.change(c)
+		}
+		_, err := iss.provider().verify(context.Background(), iss.token(t, tc.alg, tc.kid, c), tc.nonce)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: verify error = %v, want one about %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	iss := newTestIssuer(t)
+	token := iss.token(t, "RS256", "rsa", iss.claims())
+	parts := strings.Split(token, ".")
+	c := iss.claims()
+	c["sub"] = "admin"
+	body, _ := json.Marshal(c)
+	parts[1] = base64.RawURLEncoding.EncodeToString(body)
+	p := iss.provider()
+	for name, token := range map[string]string{
+		"claims":       strings.Join(parts, "."),
+		"no signature": parts[0] + "." + parts[1],
+		"garbage":      "not a token",
+	} {
+		if _, err := p.verify(context.Background(), token, "nonce"); err == nil {
+			t.Errorf("%s: verify accepted %q", name, token)
+		}
+	}
+}
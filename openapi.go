@@ -0,0 +1,496 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The OpenAPI document of the JSON API is built from apiOperations when it
+// is requested. The request fields are listed there by hand, next to the
+// routes; the response schemas are derived from the Go types the handlers
+// encode, so they follow the code when a field is added.
+
+// apiOperation describes one endpoint of the JSON API.
+type apiOperation struct {
+	Method, Path string
+	Tag          string
+	Summary      string
+	Query        []apiField
+	Form         []apiField  // multipart form fields
+	Body         any         // JSON request body, a value of its type
+	Responses    map[int]any // response body by status, a value of its type; nil for none
+	Access       string      // "admin" or "operator" for the admin endpoints
+}
+
+// apiField is a query parameter or form field.
+type apiField struct {
+	Name        string
+	Type        string // "string", "integer", "number", "boolean" or "file"
+	Description string
+	Repeated    bool
+	Required    bool
+}
+
+// object is a JSON object response the handler builds as a map, by the
+// values of its fields.
+type object map[string]any
+
+// plainText is a text/plain response.
+type plainText struct{}
+
+// atomXML is an Atom feed response.
+type atomXML struct{}
+
+var jobOptionFields = []apiField{
+	{Name: "tag", Description: "key=value metadata, see the job filters", Repeated: true},
+	{Name: "engine", Description: "OCR engine, the server default when empty"},
+	{Name: "languages", Description: "Tesseract languages, e.g. fas+eng"},
+	{Name: "page_languages", Description: "per-page languages, e.g. 1-10=eng,11-=fas"},
+	{Name: "text_layout", Description: "shape of the text output, see textLayouts"},
+	{Name: "mode", Description: "recognition mode, e.g. screenshot"},
+	{Name: "dpi", Description: "rendering resolution, or auto"},
+	{Name: "separate_notes", Type: "boolean", Description: "put footnotes and marginalia in a file of their own"},
+	{Name: "glossary", Description: "terms recognition should prefer, one per line, or a file of them", Repeated: true},
+	{Name: "charset", Description: "characters recognition is limited to, or a preset name"},
+	{Name: "regions", Description: "JSON array of named template regions"},
+	{Name: "destination", Description: "result destination to deliver to"},
+	{Name: "destination_path", Description: "folder below the destination"},
+	{Name: "destination_template", Description: "file name template for the delivered results"},
+	{Name: "output_name", Description: "result file name template"},
+	{Name: "sha256", Description: "hex SHA-256 the document must arrive with"},
+	{Name: "notify_email", Description: "address mailed the result links when the job finishes"},
+}
+
+// jobSubmitFields are the fields of POST /jobs and POST /ocr.
+var jobSubmitFields = append([]apiField{
+	{Name: "file", Type: "file", Description: "the document; or send url or upload instead"},
+	{Name: "url", Description: "URL the server downloads the document from, see -fetch-hosts"},
+	{Name: "upload", Description: "ID of a finished resumable upload"},
+}, jobOptionFields...)
+
+var jobIDPath = []apiField{{Name: "id", Required: true}}
+
+var waitQuery = []apiField{{Name: "timeout", Description: "how long to wait, e.g. 60s"}}
+
+var usageQueryFields = []apiField{
+	{Name: "month", Description: "one month, e.g. 2024-03"},
+	{Name: "from", Description: "first month"},
+	{Name: "to", Description: "last month"},
+	{Name: "format", Description: "csv for a CSV export"},
+}
+
+var jobFilterQuery = []apiField{
+	{Name: "tag", Description: "key=value or key, all must match", Repeated: true},
+	{Name: "filename", Description: "part of the file name"},
+	{Name: "status", Description: "comma-separated statuses"},
+	{Name: "engine"},
+	{Name: "batch"},
+	{Name: "class", Description: "comma-separated document classes"},
+	{Name: "keyword", Description: "one of the keywords extracted from the text"},
+	{Name: "account", Description: "owner, for reviewers and up"},
+	{Name: "from", Description: "created at or after, a date or RFC 3339 time"},
+	{Name: "to", Description: "created at or before"},
+	{Name: "min_confidence", Type: "number"},
+}
+
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/", Tag: "service", Summary: "Describe the API version",
+		Responses: map[int]any{200: object{"version": "", "service": ""}}},
+	{Method: "GET", Path: "/account", Tag: "account", Summary: "The caller's account and plan",
+		Responses: map[int]any{200: object{"account": "", "plan": Plan{}, "month": "", "pages_this_month": 0}}},
+	{Method: "GET", Path: "/account/usage", Tag: "account", Summary: "The caller's usage records", Query: usageQueryFields,
+		Responses: map[int]any{200: object{"records": []UsageRecord{}}}},
+	{Method: "GET", Path: "/account/usage/monthly", Tag: "account", Summary: "The caller's usage by month", Query: usageQueryFields,
+		Responses: map[int]any{200: object{"months": []UsageRollup{}}}},
+	{Method: "GET", Path: "/uploads/{id}/progress", Tag: "jobs", Summary: "Progress of an upload sent with X-Upload-ID", Query: jobIDPath,
+		Responses: map[int]any{200: object{"upload_id": "", "bytes_received": int64(0), "bytes_total": int64(0), "percent": 0.0, "status": "", "job_id": ""}}},
+	{Method: "POST", Path: "/quick", Tag: "jobs", Summary: "Recognize a PNG or JPEG image and answer with its text",
+		Form:      []apiField{{Name: "file", Type: "file", Required: true}, {Name: "languages"}, {Name: "mode"}},
+		Responses: map[int]any{200: plainText{}}},
+	{Method: "POST", Path: "/ocr", Tag: "jobs", Summary: "Submit a document and wait for its text", Query: waitQuery, Form: jobSubmitFields,
+		Responses: map[int]any{200: ocrResponse{}, 202: ocrResponse{}}},
+	{Method: "POST", Path: "/quote", Tag: "jobs", Summary: "Estimate the pages, time and cost of a document",
+		Form:      []apiField{{Name: "file", Type: "file", Required: true}, {Name: "engine"}},
+		Responses: map[int]any{200: Quote{}}},
+	{Method: "POST", Path: "/extension/ocr", Tag: "extension", Summary: "Recognize an image for a browser extension", Body: extensionRequest{},
+		Responses: map[int]any{200: object{"text": "", "confidence": (*float64)(nil)}}},
+	{Method: "GET", Path: "/extension", Tag: "extension", Summary: "Settings of the calling browser extension",
+		Responses: map[int]any{200: object{"extension": "", "max_image_bytes": int64(0), "modes": []string{}, "timeout_seconds": 0}}},
+	{Method: "POST", Path: "/batches", Tag: "batches", Summary: "Submit several files, or ZIP archives, as a batch",
+		Form:      []apiField{{Name: "file", Type: "file", Repeated: true, Required: true}, {Name: "tag", Repeated: true}, {Name: "notify_email"}},
+		Responses: map[int]any{202: BatchSummary{}, 422: BatchSummary{}}},
+	{Method: "GET", Path: "/batches/{id}", Tag: "batches", Summary: "The jobs of a batch", Query: jobIDPath,
+		Responses: map[int]any{200: BatchSummary{}}},
+	{Method: "GET", Path: "/jobs", Tag: "jobs", Summary: "List jobs, newest first", Query: jobFilterQuery,
+		Responses: map[int]any{200: object{"jobs": []Job{}}}},
+	{Method: "POST", Path: "/jobs", Tag: "jobs", Summary: "Submit a document", Form: jobSubmitFields,
+		Responses: map[int]any{200: Job{}, 202: Job{}}},
+	{Method: "POST", Path: "/jobs/validate", Tag: "jobs", Summary: "Check documents without submitting them",
+		Form:      []apiField{{Name: "file", Type: "file", Repeated: true, Required: true}, {Name: "engine"}},
+		Responses: map[int]any{200: object{"valid": false, "files": []uploadValidation{}}}},
+	{Method: "GET", Path: "/jobs/stats", Tag: "jobs", Summary: "Count jobs by status, optionally per tag value",
+		Query:     append([]apiField{{Name: "by", Description: "tag key to group by"}}, jobFilterQuery...),
+		Responses: map[int]any{200: object{"by": "", "groups": map[string]map[JobStatus]int{}}}},
+	{Method: "GET", Path: "/search", Tag: "jobs", Summary: "Find finished documents by meaning; needs -embeddings",
+		Query: append([]apiField{
+			{Name: "q", Required: true, Description: "what the documents are about"},
+			{Name: "limit", Type: "integer", Description: "results, 1-100 (default 10)"},
+		}, jobFilterQuery...),
+		Responses: map[int]any{200: object{"model": "", "results": []SearchResult{}}}},
+	{Method: "GET", Path: "/feed.atom", Tag: "jobs", Summary: "Atom feed of the newest finished documents; also takes ?key=",
+		Query:     append([]apiField{{Name: "limit", Type: "integer"}, {Name: "key", Description: "API key, for feed readers that cannot send headers"}}, jobFilterQuery...),
+		Responses: map[int]any{200: atomXML{}}},
+	{Method: "GET", Path: "/jobs/{id}", Tag: "jobs", Summary: "Get a job", Query: jobIDPath,
+		Responses: map[int]any{200: Job{}}},
+	{Method: "DELETE", Path: "/jobs/{id}", Tag: "jobs", Summary: "Cancel a job", Query: jobIDPath,
+		Responses: map[int]any{200: Job{}, 202: Job{}}},
+	{Method: "GET", Path: "/jobs/{id}/wait", Tag: "jobs", Summary: "Wait for a job to finish", Query: append(waitQuery, jobIDPath...),
+		Responses: map[int]any{200: Job{}}},
+	{Method: "POST", Path: "/jobs/{id}/resume", Tag: "jobs", Summary: "Queue a failed job again", Query: jobIDPath,
+		Responses: map[int]any{202: Job{}}},
+	{Method: "PUT", Path: "/jobs/{id}/pin", Tag: "jobs", Summary: "Keep a job regardless of retention", Query: jobIDPath,
+		Responses: map[int]any{200: Job{}}},
+	{Method: "DELETE", Path: "/jobs/{id}/pin", Tag: "jobs", Summary: "Unpin a job", Query: jobIDPath,
+		Responses: map[int]any{200: Job{}}},
+	{Method: "GET", Path: "/jobs/{id}/pages/{n}/text", Tag: "jobs", Summary: "The text of a page, once the engine has finished it",
+		Query:     []apiField{{Name: "id"}, {Name: "n", Type: "integer"}},
+		Responses: map[int]any{200: plainText{}}},
+	{Method: "GET", Path: "/jobs/{id}/rescan", Tag: "jobs", Summary: "The pages of a finished job to scan again",
+		Query:     append([]apiField{{Name: "format", Description: "csv for a CSV export"}}, jobIDPath...),
+		Responses: map[int]any{200: RescanReport{}}},
+	{Method: "GET", Path: "/admin/usage", Tag: "admin", Access: roleOperator, Summary: "Usage records of every account",
+		Query:     append([]apiField{{Name: "account"}}, usageQueryFields...),
+		Responses: map[int]any{200: object{"records": []UsageRecord{}}}},
+	{Method: "GET", Path: "/admin/usage/monthly", Tag: "admin", Access: roleOperator, Summary: "Usage of every account by month",
+		Query:     append([]apiField{{Name: "account"}}, usageQueryFields...),
+		Responses: map[int]any{200: object{"months": []UsageRollup{}}}},
+	{Method: "GET", Path: "/admin/pinned", Tag: "admin", Access: roleOperator, Summary: "Storage held by pinned jobs",
+		Responses: map[int]any{200: object{"jobs": 0, "bytes": int64(0), "accounts": []pinnedUsage{}}}},
+	{Method: "GET", Path: "/admin/holds", Tag: "admin", Access: roleAdmin, Summary: "Jobs under legal hold",
+		Responses: map[int]any{200: object{"jobs": []Job{}}}},
+	{Method: "PUT", Path: "/admin/jobs/{id}/hold", Tag: "admin", Access: roleAdmin, Summary: "Place a legal hold on a job",
+		Query: jobIDPath, Body: object{"reason": ""}, Responses: map[int]any{200: Job{}}},
+	{Method: "DELETE", Path: "/admin/jobs/{id}/hold", Tag: "admin", Access: roleAdmin, Summary: "Lift a job's legal hold",
+		Query: jobIDPath, Body: object{"reason": ""}, Responses: map[int]any{200: Job{}}},
+	{Method: "GET", Path: "/admin/audit", Tag: "admin", Access: roleAdmin, Summary: "The audit log, oldest first",
+		Query: []apiField{{Name: "job", Description: "only the entries of this job"}}, Responses: map[int]any{200: object{"entries": []AuditEntry{}}}},
+	{Method: "GET", Path: "/admin/duplicates", Tag: "admin", Access: roleOperator, Summary: "Groups of finished jobs flagged as near-duplicates",
+		Responses: map[int]any{200: object{"groups": []DuplicateGroup{}}}},
+	{Method: "POST", Path: "/admin/duplicates/{id}/merge", Tag: "admin", Access: roleAdmin, Summary: "Keep one copy of a job's group, the best by default, and delete the others",
+		Query: jobIDPath, Body: object{"keep": ""}, Responses: map[int]any{200: object{"kept": Job{}, "deleted": []string{}, "held": []string{}}}},
+	{Method: "DELETE", Path: "/admin/duplicates/{id}", Tag: "admin", Access: roleOperator, Summary: "Clear the duplicate flags linking a job to others",
+		Query: jobIDPath, Responses: map[int]any{200: Job{}}},
+	{Method: "GET", Path: "/admin/schedules", Tag: "admin", Access: roleOperator, Summary: "List the recurring tasks with their next and last run",
+		Responses: map[int]any{200: object{"schedules": []scheduleStatus{}}}},
+	{Method: "POST", Path: "/admin/schedules", Tag: "admin", Access: roleAdmin, Summary: "Create a recurring task", Body: Schedule{},
+		Responses: map[int]any{201: scheduleStatus{}}},
+	{Method: "DELETE", Path: "/admin/schedules/{name}", Tag: "admin", Access: roleAdmin, Summary: "Delete a recurring task created over the API",
+		Query: []apiField{{Name: "name", Required: true}}, Responses: map[int]any{204: nil}},
+	{Method: "GET", Path: "/admin/schedules/{name}/runs", Tag: "admin", Access: roleOperator, Summary: "A recurring task's run history, newest first",
+		Query: []apiField{{Name: "name", Required: true}}, Responses: map[int]any{200: object{"runs": []ScheduleRun{}}}},
+	{Method: "POST", Path: "/admin/schedules/{name}/run", Tag: "admin", Access: roleOperator, Summary: "Run a recurring task now",
+		Query: []apiField{{Name: "name", Required: true}}, Responses: map[int]any{202: ScheduleRun{}}},
+	{Method: "GET", Path: "/admin/keys", Tag: "admin", Access: roleAdmin, Summary: "List the stored API keys",
+		Responses: map[int]any{200: object{"keys": []StoredKey{}}}},
+	{Method: "POST", Path: "/admin/keys", Tag: "admin", Access: roleAdmin, Summary: "Create an API key", Body: StoredKey{},
+		Responses: map[int]any{201: object{"key": "", "api_key": StoredKey{}}}},
+	{Method: "DELETE", Path: "/admin/keys/{id}", Tag: "admin", Access: roleAdmin, Summary: "Revoke an API key", Query: jobIDPath,
+		Responses: map[int]any{204: nil}},
+	{Method: "GET", Path: "/admin/users", Tag: "admin", Access: roleAdmin, Summary: "List the users",
+		Responses: map[int]any{200: object{"users": []userView{}}}},
+	{Method: "POST", Path: "/admin/users", Tag: "admin", Access: roleAdmin, Summary: "Create a user and its first key", Body: userRequest{},
+		Responses: map[int]any{201: object{"user": userView{}, "key": "", "api_key": StoredKey{}}}},
+	{Method: "GET", Path: "/admin/users/{name}", Tag: "admin", Access: roleAdmin, Summary: "Get a user",
+		Query: []apiField{{Name: "name", Required: true}}, Responses: map[int]any{200: userView{}}},
+	{Method: "PATCH", Path: "/admin/users/{name}", Tag: "admin", Access: roleAdmin, Summary: "Change a user",
+		Query: []apiField{{Name: "name", Required: true}}, Body: userPatch{}, Responses: map[int]any{200: userView{}}},
+	{Method: "POST", Path: "/admin/users/{name}/keys", Tag: "admin", Access: roleAdmin, Summary: "Replace a user's keys with a new one",
+		Query: []apiField{{Name: "name", Required: true}}, Body: object{"scopes": []string{}},
+		Responses: map[int]any{200: object{"key": "", "api_key": StoredKey{}, "revoked": 0}}},
+	{Method: "GET", Path: "/admin/users/{name}/jobs", Tag: "admin", Access: roleOperator, Summary: "A user's jobs",
+		Query:     []apiField{{Name: "name", Required: true}, {Name: "limit", Type: "integer"}},
+		Responses: map[int]any{200: object{"jobs": []Job{}, "total": 0}}},
+	{Method: "GET", Path: "/admin/webhooks/dead-letters", Tag: "admin", Access: roleOperator, Summary: "Webhook deliveries that failed for good",
+		Responses: map[int]any{200: object{"dead_letters": []DeadLetter{}}}},
+	{Method: "POST", Path: "/admin/webhooks/dead-letters/{id}/redeliver", Tag: "admin", Access: roleOperator, Summary: "Deliver a dead letter again",
+		Query: jobIDPath, Responses: map[int]any{200: object{"status": ""}}},
+	{Method: "DELETE", Path: "/admin/webhooks/dead-letters/{id}", Tag: "admin", Access: roleOperator, Summary: "Drop a dead letter",
+		Query: jobIDPath, Responses: map[int]any{204: nil}},
+}
+
+// userRequest is the body of POST /admin/users.
+type userRequest struct {
+	User
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// userPatch is the body of PATCH /admin/users/{name}; fields left out are
+// kept.
+type userPatch struct {
+	Email         *string `json:"email,omitempty"`
+	Plan          *string `json:"plan,omitempty"`
+	PagesPerMonth *int    `json:"pages_per_month,omitempty"` // 0 for unlimited, null for the plan's
+	Disabled      *bool   `json:"disabled,omitempty"`
+	Role          *string `json:"role,omitempty"`
+}
+
+// openAPIHandler serves the OpenAPI 3 document of the current JSON API at
+// /api/openapi.json, with this server's public URL.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPISpec(apiDefault))
+}
+
+func openAPISpec(version string) map[string]any {
+	s := &schemaSet{schemas: map[string]any{
+		"Error": map[string]any{
+			"type":     "object",
+			"required": []string{"error"},
+			"properties": map[string]any{
+				"error": map[string]any{"$ref": "#/components/schemas/APIError"},
+			},
+		},
+	}}
+	s.schema(reflect.TypeOf(APIError{}))
+
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations {
+		item := paths[op.Path]
+		if item == nil {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = s.operation(op)
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "persianOCR API",
+			"version":     version,
+			"description": "OCR for Persian and English documents. Errors share the Error shape; its code tells them apart. The webhook submission API is described at hooks/openapi.json.",
+		},
+		"servers":  []map[string]string{{"url": absoluteURL(appPath("/api/" + version))}},
+		"security": []map[string][]string{{"bearerAuth": {}}, {"apiKeyHeader": {}}, {}},
+		"paths":    paths,
+		"components": map[string]any{
+			"schemas": s.schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth":   map[string]string{"type": "http", "scheme": "bearer", "description": "an API key, or the admin token for the admin endpoints"},
+				"apiKeyHeader": map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+func (s *schemaSet) operation(op apiOperation) map[string]any {
+	o := map[string]any{
+		"operationId": operationID(op),
+		"summary":     op.Summary,
+		"tags":        []string{op.Tag},
+	}
+	if op.Access != "" {
+		o["description"] = "Needs the " + op.Access + " role or the admin token."
+	}
+	var params []map[string]any
+	for _, f := range op.Query {
+		in, required := "query", f.Required
+		if strings.Contains(op.Path, "{"+f.Name+"}") {
+			in, required = "path", true
+		}
+		p := map[string]any{"name": f.Name, "in": in, "schema": fieldSchema(f)}
+		if required {
+			p["required"] = true
+		}
+		if f.Description != "" {
+			p["description"] = f.Description
+		}
+		params = append(params, p)
+	}
+	if len(params) > 0 {
+		o["parameters"] = params
+	}
+	switch {
+	case op.Form != nil:
+		props := map[string]any{}
+		var required []string
+		for _, f := range op.Form {
+			props[f.Name] = fieldSchema(f)
+			if f.Required {
+				required = append(required, f.Name)
+			}
+		}
+		form := map[string]any{"type": "object", "properties": props}
+		if required != nil {
+			form["required"] = required
+		}
+		content := map[string]any{"multipart/form-data": map[string]any{"schema": form}}
+		if op.Path == "/jobs" || op.Path == "/ocr" {
+			content["application/pdf"] = map[string]any{"schema": map[string]string{"type": "string", "format": "binary"}}
+		}
+		o["requestBody"] = map[string]any{"required": true, "content": content}
+	case op.Body != nil:
+		o["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+			"application/json": map[string]any{"schema": s.value(op.Body)},
+		}}
+	}
+	responses := map[string]any{
+		"default": map[string]any{"description": "an error", "content": map[string]any{
+			"application/json": map[string]any{"schema": map[string]string{"$ref": "#/components/schemas/Error"}},
+		}},
+	}
+	for status, body := range op.Responses {
+		resp := map[string]any{"description": http.StatusText(status)}
+		switch body.(type) {
+		case nil:
+		case plainText:
+			resp["content"] = map[string]any{"text/plain": map[string]any{"schema": map[string]string{"type": "string"}}}
+		case atomXML:
+			resp["content"] = map[string]any{"application/atom+xml": map[string]any{"schema": map[string]string{"type": "string"}}}
+		default:
+			resp["content"] = map[string]any{"application/json": map[string]any{"schema": s.value(body)}}
+		}
+		responses[strconv.Itoa(status)] = resp
+	}
+	o["responses"] = responses
+	return o
+}
+
+// operationID names an operation after its method and path, e.g.
+// getJobsIdWait.
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool { return r == '/' || r == '-' || r == '{' || r == '}' }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func fieldSchema(f apiField) map[string]any {
+	var sch map[string]any
+	switch f.Type {
+	case "", "string":
+		sch = map[string]any{"type": "string"}
+	case "file":
+		sch = map[string]any{"type": "string", "format": "binary"}
+	default:
+		sch = map[string]any{"type": f.Type}
+	}
+	if f.Description != "" && !f.Repeated {
+		sch["description"] = f.Description
+	}
+	if f.Repeated {
+		sch = map[string]any{"type": "array", "items": sch}
+		if f.Description != "" {
+			sch["description"] = f.Description
+		}
+	}
+	return sch
+}
+
+// schemaSet collects the component schemas of the named types it is asked
+// about.
+type schemaSet struct {
+	schemas map[string]any
+}
+
+// value is the schema of v's type, or of an object with v's fields.
+func (s *schemaSet) value(v any) map[string]any {
+	obj, ok := v.(object)
+	if !ok {
+		return s.schema(reflect.TypeOf(v))
+	}
+	props := map[string]any{}
+	for name, fv := range obj {
+		props[name] = s.value(fv)
+	}
+	return map[string]any{"type": "object", "properties": props}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (s *schemaSet) schema(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		sch := s.schema(t.Elem())
+		if _, ref := sch["$ref"]; ref {
+			return map[string]any{"allOf": []any{sch}, "nullable": true}
+		}
+		sch["nullable"] = true
+		return sch
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]any{"type": "array", "items": s.schema(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := s.schemas[name]; !ok {
+			s.schemas[name] = nil // a placeholder while the fields are built
+			props, required := map[string]any{}, []string{}
+			s.fields(t, props, &required)
+			sch := map[string]any{"type": "object", "properties": props}
+			if len(required) > 0 {
+				sch["required"] = required
+			}
+			s.schemas[name] = sch
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// fields adds the JSON fields of struct type t, those of embedded structs
+// included, as encoding/json encodes them.
+func (s *schemaSet) fields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			s.fields(f.Type, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = s.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// schemaName is the component name of a struct type: its Go name, with an
+// upper-case first letter for unexported types and OCR spelled as such.
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if rest, ok := strings.CutPrefix(name, "ocr"); ok {
+		return "OCR" + rest
+	}
+	r := []rune(name)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
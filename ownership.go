@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// anonymousDir is the storage namespace of anonymous clients. Namespaces of
+// accounts never start with "_", see ownerDir.
+const anonymousDir = "_anonymous"
+
+// jobOwner is who may see the jobs of account: the account itself, or ""
+// for anonymous clients, which are metered per address but share their
+// jobs, as everyone did before there were accounts.
+func jobOwner(account string) string {
+	if strings.HasPrefix(account, "ip:") {
+		return ""
+	}
+	return account
+}
+
+// ownerDir is the directory the jobs of owner are kept in under user_file
+// and user_file_searchable. Letters, digits, "@", "-" and, after the first
+// character, "." and "_" are kept; other bytes are percent-encoded, so two
+// accounts never share a directory.
+func ownerDir(owner string) string {
+	if owner == "" {
+		return anonymousDir
+	}
+	var b strings.Builder
+	for i := 0; i < len(owner); i++ {
+		switch c := owner[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '@', c == '-',
+			(c == '.' || c == '_') && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// viewer is who a request is from, as far as the jobs it may see and
+// change are concerned.
+type viewer struct {
+	owner string // see jobOwner
+	role  string // see roles
+}
+
+// requestViewer returns who r is from. A request whose credentials are
+// refused may see no jobs.
+func requestViewer(r *http.Request) (viewer, *planError) {
+	account, _, perr := plans.identify(r)
+	if perr != nil {
+		return viewer{}, perr
+	}
+	return viewer{owner: jobOwner(account), role: accountRole(r, account)}, nil
+}
+
+// visibleTo reports whether j belongs to owner.
+func (j *Job) visibleTo(owner string) bool {
+	return jobOwner(j.account) == owner
+}
+
+// sees reports whether v may read j: its own jobs, and every job from the
+// reviewer role up.
+func (v viewer) sees(j *Job) bool {
+	return j.visibleTo(v.owner) || roleAtLeast(v.role, roleReviewer)
+}
+
+// manages reports whether v may change j, by cancelling, resuming or
+// pinning it: its own jobs, and every job from the operator role up.
+func (v viewer) manages(j *Job) bool {
+	return j.visibleTo(v.owner) || roleAtLeast(v.role, roleOperator)
+}
+
+// canAccess reports whether r may see job j.
+func canAccess(r *http.Request, j Job) bool {
+	v, perr := requestViewer(r)
+	return perr == nil && v.sees(&j)
+}
+
+// ownJob answers API requests for a job the request may not see as if the
+// job did not exist, so job IDs cannot be probed. Requests that would
+// change a job it may only see are refused.
+func ownJob(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		j, ok := jobs.get(r.PathValue("id"))
+		if !ok {
+			h(w, r)
+			return
+		}
+		v, perr := requestViewer(r)
+		if perr != nil || !v.sees(&j) {
+			writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+r.PathValue("id"))
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !v.manages(&j) {
+			writeAPIError(w, http.StatusForbidden, "forbidden", "the "+v.role+" role cannot change jobs of other accounts")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ownDownloads serves only the results of jobs the request may see; every
+// other path below /download/ is not found.
+func ownDownloads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if j, _, ok := downloadJob(r.URL.Path); !ok || !canAccess(r, j) && !validLink(r, j.ID) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
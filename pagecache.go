@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// pageCacheDir holds recognized pages across jobs, keyed by a hash of the
+// rendered page image and the recognition settings, so a document that is
+// submitted again with a few pages changed only has those pages recognized.
+// The OCR script reads and writes the entries; the server only bounds the
+// cache's size. Empty disables the cache.
+var pageCacheDir string
+
+// pageCacheSize is the size in bytes sweepPageCache trims the cache to.
+var pageCacheSize int64
+
+// initPageCache creates the cache directory. With a sandbox user the OCR
+// runs write there as that user, so the directory is shared with its group.
+func initPageCache(dir string, sizeMB int) error {
+	if dir == "" {
+		return nil
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(abs, 0700); err != nil {
+		return fmt.Errorf("Error creating page cache: %w", err)
+	}
+	if ocrSandbox.User != "" {
+		if err := os.Chown(abs, -1, ocrSandbox.gid); err != nil {
+			return fmt.Errorf("Error preparing page cache: %w", err)
+		}
+		if err := os.Chmod(abs, 0770|fs.ModeSetgid); err != nil {
+			return fmt.Errorf("Error preparing page cache: %w", err)
+		}
+	}
+	pageCacheDir, pageCacheSize = abs, int64(sizeMB)<<20
+	return nil
+}
+
+// sweepPageCache trims the page cache every interval.
+func sweepPageCache(interval time.Duration) {
+	for range time.Tick(interval) {
+		trimPageCache()
+	}
+}
+
+// pageCacheEntry is the text, page PDF and stats of one cached page.
+type pageCacheEntry struct {
+	files []string
+	size  int64
+	used  time.Time // the script touches an entry's files when it reuses them
+}
+
+// trimPageCache removes the entries used least recently until the cache is
+// no larger than pageCacheSize, and files left half-written by runs that
+// were killed.
+func trimPageCache() {
+	entries := map[string]*pageCacheEntry{}
+	var total int64
+	filepath.WalkDir(pageCacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			if time.Since(fi.ModTime()) > 24*time.Hour {
+				os.Remove(path)
+			}
+			return nil
+		}
+		key := strings.TrimSuffix(path, filepath.Ext(path))
+		e := entries[key]
+		if e == nil {
+			e = &pageCacheEntry{}
+			entries[key] = e
+		}
+		e.files = append(e.files, path)
+		e.size += fi.Size()
+		if fi.ModTime().After(e.used) {
+			e.used = fi.ModTime()
+		}
+		total += fi.Size()
+		return nil
+	})
+	if total <= pageCacheSize {
+		return
+	}
+	byUse := make([]*pageCacheEntry, 0, len(entries))
+	for _, e := range entries {
+		byUse = append(byUse, e)
+	}
+	slices.SortFunc(byUse, func(a, b *pageCacheEntry) int { return a.used.Compare(b.used) })
+	removed := 0
+	for _, e := range byUse {
+		if total <= pageCacheSize {
+			break
+		}
+		for _, f := range e.files {
+			os.Remove(f)
+		}
+		total -= e.size
+		removed++
+	}
+	log.Printf("page cache: removed %d pages used least recently, %s left", removed, formatBytes(total))
+}
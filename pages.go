@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var errJobNotFound = errors.New("job not found")
+
+// pagePollInterval is how often watchPages checks for newly written pages.
+const pagePollInterval = 500 * time.Millisecond
+
+// pagePath is where the engine writes the text of page n (1-based).
+func pagePath(outputDir string, n int) string {
+	return filepath.Join(outputDir, "pages", strconv.Itoa(n)+".txt")
+}
+
+// watchPages calls emit for every page of the job, in order, starting at
+// page from. It returns once the job has finished and every page written by
+// the engine has been emitted, or when ctx is cancelled.
+func watchPages(ctx context.Context, id string, from int, emit func(n int, path string) error) error {
+	next := max(from, 1)
+	ticker := time.NewTicker(pagePollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, ok := jobs.get(id)
+		if !ok {
+			return errJobNotFound
+		}
+		finished := job.finished()
+
+		for {
+			p := pagePath(job.outputDir, next)
+			if _, err := os.Stat(p); err != nil {
+				break
+			}
+			if err := emit(next, p); err != nil {
+				return err
+			}
+			next++
+		}
+		if finished {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-job.done:
+		}
+	}
+}
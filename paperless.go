@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// paperlessRoutes installs the subset of the paperless-ngx REST API that
+// document scanners, mobile apps and mail fetchers use to hand documents to
+// paperless, so they can use this server as a Persian-capable OCR backend:
+// consuming a document, polling its task, and fetching the recognized
+// content and the searchable PDF. Documents and tasks are both identified
+// by the job ID. Unlike the v1 API these endpoints answer in paperless'
+// shapes, including its errors.
+func paperlessRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/documents/post_document/", paperlessPostDocumentHandler)
+	mux.HandleFunc("GET /api/tasks/", paperlessTasksHandler)
+	mux.HandleFunc("GET /api/documents/{id}/{$}", paperlessDocumentHandler)
+	mux.HandleFunc("GET /api/documents/{id}/download/", paperlessDownloadHandler)
+	mux.HandleFunc("GET /api/documents/{id}/preview/", paperlessDownloadHandler)
+}
+
+// paperlessTask is an entry of paperless' /api/tasks/ list.
+type paperlessTask struct {
+	ID              string     `json:"id"`
+	TaskID          string     `json:"task_id"`
+	TaskFileName    string     `json:"task_file_name"`
+	DateCreated     time.Time  `json:"date_created"`
+	DateDone        *time.Time `json:"date_done"`
+	Type            string     `json:"type"`
+	Status          string     `json:"status"`
+	Result          *string    `json:"result"`
+	Acknowledged    bool       `json:"acknowledged"`
+	RelatedDocument *string    `json:"related_document"`
+}
+
+// paperlessDocument is paperless' document JSON, with the fields this
+// server has no notion of left empty.
+type paperlessDocument struct {
+	ID                  string    `json:"id"`
+	Title               string    `json:"title"`
+	Content             string    `json:"content"`
+	Created             time.Time `json:"created"`
+	Added               time.Time `json:"added"`
+	Modified            time.Time `json:"modified"`
+	OriginalFileName    string    `json:"original_file_name"`
+	ArchivedFileName    string    `json:"archived_file_name"`
+	Tags                []int     `json:"tags"`
+	Correspondent       *int      `json:"correspondent"`
+	DocumentType        *int      `json:"document_type"`
+	ArchiveSerialNumber *int      `json:"archive_serial_number"`
+}
+
+// paperlessKey lets paperless clients authenticate the way they do with
+// paperless itself: "Authorization: Token <key>" or basic auth with the key
+// as the password. Either is turned into an X-API-Key for plans.identify.
+func paperlessKey(r *http.Request) {
+	if k, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Token "); ok {
+		r.Header.Set("X-API-Key", strings.TrimSpace(k))
+	} else if _, pass, ok := r.BasicAuth(); ok && r.Header.Get("X-API-Key") == "" {
+		r.Header.Set("X-API-Key", pass)
+	}
+}
+
+// paperlessAuth checks the API key of paperless requests like authorizeAPI
+// does for the JSON API, and the CSRF token of uploads made with the
+// session cookie like checkAPICSRF does.
+func paperlessAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		paperlessKey(r)
+		route := strings.TrimPrefix(r.URL.Path, "/api")
+		perr := authorizeAPI(r, route)
+		if perr == nil {
+			perr = checkAPICSRF(r, route)
+		}
+		if perr != nil {
+			paperlessError(w, perr.Status, "", perr.Error())
+			return
+		}
+		h(w, r)
+	}
+}
+
+// paperlessError writes an error the way Django REST framework does:
+// field errors as {"field": ["message"]}, others as {"detail": "message"}.
+func paperlessError(w http.ResponseWriter, status int, field, msg string) {
+	if field == "" {
+		writeJSON(w, status, map[string]string{"detail": msg})
+		return
+	}
+	writeJSON(w, status, map[string][]string{field: {msg}})
+}
+
+// paperlessPostDocumentHandler consumes the PDF in the "document" field and
+// answers with the task ID, as paperless does. A "title" becomes the job's
+// file name.
+func paperlessPostDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	paperlessKey(r)
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		paperlessError(w, perr.Status, "", perr.Error())
+		return
+	}
+	if err := parseUploadForm(w, r, maxUploadSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			paperlessError(w, http.StatusRequestEntityTooLarge, "document", fmt.Sprintf("The document is larger than %d MB.", maxUploadSize>>20))
+			return
+		}
+		paperlessError(w, http.StatusBadRequest, "", "Error parsing form: "+err.Error())
+		return
+	}
+	file, header, err := r.FormFile("document")
+	if err != nil {
+		paperlessError(w, http.StatusBadRequest, "document", "No file was submitted.")
+		return
+	}
+	defer file.Close()
+
+	filename := cleanUploadName(header.Filename)
+	if !strings.HasSuffix(strings.ToLower(filename), ".pdf") {
+		paperlessError(w, http.StatusBadRequest, "document", "Unsupported file type: only PDF documents can be processed.")
+		return
+	}
+	if title := strings.TrimSpace(r.FormValue("title")); title != "" {
+		filename = cleanUploadName(title + ".pdf")
+	}
+	if perr := plan.checkUpload(header.Size, defaultEngine); perr != nil {
+		paperlessError(w, perr.Status, "document", perr.Error())
+		return
+	}
+
+	spoolPath, fingerprint, err := spoolUpload(file)
+	if err != nil {
+		paperlessError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	check, err := checkPDF(spoolPath)
+	var est resourceEstimate
+	if err == nil {
+		est, err = checkResources(spoolPath)
+	}
+	if err != nil {
+		os.Remove(spoolPath)
+		var pe *pdfError
+		var re *resourceError
+		switch {
+		case errors.As(err, &pe):
+			paperlessError(w, http.StatusBadRequest, "document", err.Error())
+		case errors.As(err, &re):
+			paperlessError(w, http.StatusServiceUnavailable, "", err.Error())
+		default:
+			paperlessError(w, http.StatusInternalServerError, "", err.Error())
+		}
+		return
+	}
+	if !limiter.allowSubmission(w, r) {
+		os.Remove(spoolPath)
+		paperlessError(w, http.StatusTooManyRequests, "", "Daily submission quota exceeded")
+		return
+	}
+	if perr := checkPages(est.Pages, plan.pageLimit()); perr != nil {
+		os.Remove(spoolPath)
+		paperlessError(w, perr.Status, "document", perr.Error())
+		return
+	}
+	if perr := plan.chargePages(account, est.Pages); perr != nil {
+		os.Remove(spoolPath)
+		paperlessError(w, perr.Status, "", perr.Error())
+		return
+	}
+
+	job, _, err := jobs.submit(submission{
+		Client:      clientKey(r),
+		Filename:    filename,
+		SpoolPath:   spoolPath,
+		Fingerprint: fingerprint,
+		Tags:        map[string]string{"source": "paperless"},
+		Account:     account,
+		Priority:    plan.Priority,
+		Pages:       est.Pages,
+		MaxActive:   plan.activeJobLimit(),
+		Repaired:    check.Repaired,
+	})
+	if errors.Is(err, errTooManyJobs) {
+		os.Remove(spoolPath)
+		usage.refund(account, est.Pages)
+		setRetryAfter(w, err)
+		paperlessError(w, http.StatusTooManyRequests, "", err.Error())
+		return
+	}
+	if err != nil {
+		os.Remove(spoolPath)
+		usage.refund(account, est.Pages)
+		paperlessError(w, http.StatusServiceUnavailable, "", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, job.ID)
+}
+
+// paperlessTasksHandler lists the task for ?task_id=, or every document
+// consumed through the paperless endpoint, newest first.
+func paperlessTasksHandler(w http.ResponseWriter, r *http.Request) {
+	v, perr := requestViewer(r)
+	if perr != nil {
+		paperlessError(w, perr.Status, "", perr.Error())
+		return
+	}
+	id := r.URL.Query().Get("task_id")
+	list := jobs.list(func(j *Job) bool {
+		if !v.sees(j) {
+			return false
+		}
+		if id != "" {
+			return j.ID == id
+		}
+		return j.Tags["source"] == "paperless"
+	})
+	tasks := make([]paperlessTask, len(list))
+	for i, j := range list {
+		t := paperlessTask{
+			ID:           j.ID,
+			TaskID:       j.ID,
+			TaskFileName: j.Filename,
+			DateCreated:  j.CreatedAt,
+			DateDone:     j.FinishedAt,
+			Type:         "file",
+		}
+		switch j.Status {
+		case JobQueued:
+			t.Status = "PENDING"
+		case JobProcessing:
+			t.Status = "STARTED"
+		case JobDone:
+			t.Status = "SUCCESS"
+			result := "Success. New document id " + j.ID + " created"
+			t.Result, t.RelatedDocument = &result, &j.ID
+		case JobFailed:
+			t.Status = "FAILURE"
+			t.Result = &j.Error
+		case JobCanceled:
+			t.Status = "REVOKED"
+		}
+		tasks[i] = t
+	}
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+// paperlessJob returns the done job a document URL refers to.
+func paperlessJob(w http.ResponseWriter, r *http.Request) (Job, bool) {
+	j, ok := jobs.get(r.PathValue("id"))
+	if !ok || j.Status != JobDone || !canAccess(r, j) {
+		paperlessError(w, http.StatusNotFound, "", "Not found.")
+		return Job{}, false
+	}
+	return j, true
+}
+
+func paperlessDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := paperlessJob(w, r)
+	if !ok {
+		return
+	}
+	text, err := readStored(filepath.Join(j.outputDir, j.prefix+".txt"))
+	if err != nil {
+		paperlessError(w, http.StatusInternalServerError, "", "Error reading text: "+err.Error())
+		return
+	}
+	modified := j.CreatedAt
+	if j.FinishedAt != nil {
+		modified = *j.FinishedAt
+	}
+	writeJSON(w, http.StatusOK, paperlessDocument{
+		ID:               j.ID,
+		Title:            strings.TrimSuffix(j.Filename, filepath.Ext(j.Filename)),
+		Content:          string(text),
+		Created:          j.CreatedAt,
+		Added:            j.CreatedAt,
+		Modified:         modified,
+		OriginalFileName: j.Filename,
+		ArchivedFileName: j.displayPrefix + ".pdf",
+		Tags:             []int{},
+	})
+}
+
+// paperlessDownloadHandler serves the searchable PDF, which paperless calls
+// the archived version, or the upload itself with ?original=true.
+func paperlessDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	j, ok := paperlessJob(w, r)
+	if !ok {
+		return
+	}
+	path, name := filepath.Join(j.outputDir, j.prefix+".pdf"), j.displayPrefix+".pdf"
+	if r.URL.Query().Get("original") == "true" {
+		path, name = j.inputPath, j.Filename
+	}
+	disposition := attachmentDisposition(name)
+	if strings.HasSuffix(r.URL.Path, "/preview/") {
+		disposition = "inline" + strings.TrimPrefix(disposition, "attachment")
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Type", "application/pdf")
+	f, err := openStored(path)
+	if err != nil {
+		paperlessError(w, http.StatusNotFound, "", "the document is no longer available")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		paperlessError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// pdfError is returned for uploads the OCR script cannot read, even after
+// an attempt to repair them, or that have nothing in them to recognize. The
+// API answers it with 422 and Code.
+type pdfError struct {
+	Code string
+	msg  string
+}
+
+func (e *pdfError) Error() string { return e.msg }
+
+// pdfCheck is what checkPDF found out about an upload.
+type pdfCheck struct {
+	Problem  string // structural damage that was detected, empty if none
+	Repaired bool   // the file was rewritten to fix Problem
+}
+
+// checkPDF validates the structure of the PDF at path before it is queued.
+// Files from phone scanner apps often have a broken cross-reference table or
+// are cut off at the end. Those are rewritten in place by qpdf, which
+// rebuilds the structure from the objects it can still find. A file Poppler
+// cannot open afterwards is rejected with a *pdfError, and so is one that
+// scanPDF finds nothing to OCR in.
+func checkPDF(path string) (pdfCheck, error) {
+	check, err := repairIfDamaged(path)
+	if err == nil {
+		err = scanPDF(path)
+	}
+	return check, err
+}
+
+func repairIfDamaged(path string) (pdfCheck, error) {
+	problem, err := pdfProblem(path)
+	if err != nil || problem == "" {
+		return pdfCheck{}, err
+	}
+	rerr := repairPDF(path)
+	if _, err := pdfInfo(path); err != nil && !errors.Is(err, exec.ErrNotFound) {
+		if strings.Contains(err.Error(), "Incorrect password") {
+			return pdfCheck{}, errPDFPassword
+		}
+		if rerr != nil {
+			err = rerr
+		}
+		return pdfCheck{}, &pdfError{"invalid_pdf", fmt.Sprintf("The PDF is damaged (%s) and could not be repaired: %v", problem, err)}
+	}
+	if rerr != nil {
+		// Poppler reconstructs broken cross-reference tables itself, so a
+		// file it opens is still worth a try.
+		log.Printf("could not repair %s (%s), processing it as is: %v", path, problem, rerr)
+		return pdfCheck{Problem: problem}, nil
+	}
+	log.Printf("repaired %s: %s", path, problem)
+	return pdfCheck{Problem: problem, Repaired: true}, nil
+}
+
+// pdfProblem describes what is structurally wrong with the PDF at path, or
+// returns "" for a sound file. Files that are not PDFs at all are a
+// *pdfError.
+func pdfProblem(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Error reading file: %w", err)
+	}
+	defer f.Close()
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(f, head)
+	if !bytes.Contains(head[:n], []byte("%PDF-")) {
+		return "", &pdfError{"invalid_pdf", "The file is not a PDF"}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("Error reading file: %w", err)
+	}
+	tail := make([]byte, min(fi.Size(), 1024))
+	if _, err := f.ReadAt(tail, fi.Size()-int64(len(tail))); err != nil {
+		return "", fmt.Errorf("Error reading file: %w", err)
+	}
+	if !bytes.Contains(tail, []byte("%%EOF")) {
+		return "the file is truncated", nil
+	}
+
+	if _, err := exec.LookPath("qpdf"); err == nil {
+		// qpdf exits with 2 for errors and 3 for warnings such as a
+		// reconstructed cross-reference table.
+		out, err := exec.Command("qpdf", "--check", path).CombinedOutput()
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && (ee.ExitCode() == 2 || ee.ExitCode() == 3) {
+			return firstLine(out, "qpdf reported problems"), nil
+		}
+		return "", nil
+	}
+	if stderr, err := pdfInfo(path); errors.Is(err, exec.ErrNotFound) {
+		return "", nil
+	} else if bytes.Contains(stderr, []byte("Incorrect password")) {
+		return "", errPDFPassword
+	} else if err != nil || bytes.Contains(stderr, []byte("Syntax Error")) {
+		return firstLine(stderr, "pdfinfo could not read the file"), nil
+	}
+	return "", nil
+}
+
+var errPDFPassword = &pdfError{"encrypted_pdf", "The PDF is protected with a password; remove it and upload the file again"}
+
+var (
+	pdfImageXObject = regexp.MustCompile(`/Subtype\s*/Image\b`)
+	pdfInlineImage  = regexp.MustCompile(`(?s)(?:^|\s)BI\s.*?\sID\s`)
+	pdfStream       = regexp.MustCompile(`(?s)/FlateDecode.*?stream\r?\n`)
+)
+
+// maxScanInflate bounds how much compressed content scanPDF inflates while
+// looking for inline images.
+const maxScanInflate = 64 << 20
+
+// scanPDF rejects documents with nothing to OCR before they use a worker:
+// ones without pages, and ones without any raster image, whose text (if
+// any) is already selectable. It uses Poppler's pdfimages when that is on
+// the PATH and otherwise looks for image objects and inline images in the
+// file itself. When the content cannot be inspected, as in an encrypted
+// file, the document is let through.
+func scanPDF(path string) error {
+	if countPDFPages(path) == 0 {
+		return &pdfError{"no_pages", "This PDF has no pages; nothing to OCR"}
+	}
+	if hasRasterContent(path) {
+		return nil
+	}
+	return &pdfError{"no_raster_content", "This PDF has no raster content; nothing to OCR"}
+}
+
+func hasRasterContent(path string) bool {
+	if out, err := exec.Command("pdfimages", "-list", path).Output(); err == nil {
+		// Two header lines, then one line per image.
+		return bytes.Count(out, []byte("\n")) > 2
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || pdfImageXObject.Match(data) {
+		return true
+	}
+	if bytes.Contains(data, []byte("/Encrypt")) {
+		return true // content streams are encrypted
+	}
+	if pdfInlineImage.Match(data) {
+		return true
+	}
+	budget := int64(maxScanInflate)
+	for _, loc := range pdfStream.FindAllIndex(data, -1) {
+		zr, err := zlib.NewReader(bytes.NewReader(data[loc[1]:]))
+		if err != nil {
+			continue
+		}
+		content, _ := io.ReadAll(io.LimitReader(zr, budget))
+		budget -= int64(len(content))
+		if pdfInlineImage.Match(content) || pdfImageXObject.Match(content) || budget <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// repairPDF rewrites the PDF at path with qpdf, or MuPDF's mutool when qpdf
+// is not installed.
+func repairPDF(path string) error {
+	tmp := filepath.Join(filepath.Dir(path), ".repair-"+filepath.Base(path))
+	defer os.Remove(tmp)
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("qpdf"); err == nil {
+		cmd = exec.Command("qpdf", path, tmp)
+	} else if _, err := exec.LookPath("mutool"); err == nil {
+		cmd = exec.Command("mutool", "clean", path, tmp)
+	} else {
+		return errors.New("neither qpdf nor mutool is installed")
+	}
+	out, err := cmd.CombinedOutput()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && cmd.Args[0] == "qpdf" && ee.ExitCode() == 3 {
+		err = nil // repaired with warnings
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, firstLine(out, "no output"))
+	}
+	return os.Rename(tmp, path)
+}
+
+// pdfInfo runs Poppler's pdfinfo on path. It returns pdfinfo's stderr, which
+// lists the syntax errors Poppler worked around, and fails when the file
+// cannot be opened at all, with exec.ErrNotFound if Poppler is not on the
+// PATH.
+func pdfInfo(path string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("pdfinfo", path)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return stderr.Bytes(), errors.New(firstLine(stderr.Bytes(), err.Error()))
+		}
+		return nil, err
+	}
+	return stderr.Bytes(), nil
+}
+
+// firstLine returns the first non-empty line of out, or def.
+func firstLine(out []byte, def string) string {
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if l := strings.TrimSpace(sc.Text()); l != "" {
+			return l
+		}
+	}
+	return def
+}
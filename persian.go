@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// persianFold maps Arabic code points that are commonly typed in place of
+// their Persian equivalents, and Persian/Arabic-Indic digits, to one form.
+var persianFold = strings.NewReplacer(
+	"ي", "ی", "ى", "ی", "ئ", "ی",
+	"ك", "ک",
+	"أ", "ا", "إ", "ا", "آ", "ا", "ٱ", "ا",
+	"ؤ", "و",
+	"ة", "ه", "ۀ", "ه",
+	"۰", "0", "۱", "1", "۲", "2", "۳", "3", "۴", "4",
+	"۵", "5", "۶", "6", "۷", "7", "۸", "8", "۹", "9",
+	"٠", "0", "١", "1", "٢", "2", "٣", "3", "٤", "4",
+	"٥", "5", "٦", "6", "٧", "7", "٨", "8", "٩", "9",
+)
+
+// normalizePersian folds s for matching: Arabic variants become Persian
+// letters, digits become ASCII, diacritics, tatweel and zero-width joiners
+// are dropped, separators collapse to single spaces and Latin text is
+// lower-cased. It is meant for comparisons, not for display.
+func normalizePersian(s string) string {
+	s = persianFold.Replace(s)
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		switch {
+		case r == '\u200c' || r == '\u200d' || r == '\u0640' || r == '\u200e' || r == '\u200f':
+			continue
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case unicode.IsSpace(r) || r == '_' || r == '-':
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Plan is a service tier. Every API key belongs to one plan; requests
+// without a key use the file's default plan, if it has one.
+type Plan struct {
+	Name          string   `json:"name"`
+	MaxFileSizeMB int      `json:"max_file_size_mb,omitempty"` // 0 = no limit
+	PagesPerMonth int      `json:"pages_per_month,omitempty"`  // 0 = unlimited
+	MaxPages      int      `json:"max_pages,omitempty"`        // per document; 0 = -max-pages, -1 = unlimited
+	Priority      int      `json:"priority,omitempty"`         // higher is processed first
+	MaxActiveJobs int      `json:"max_active_jobs,omitempty"`  // 0 = -max-active-jobs, -1 = unlimited
+	Engines       []string `json:"engines,omitempty"`          // empty allows every engine
+}
+
+// APIKey is one entry of the plans file.
+type APIKey struct {
+	Key  string `json:"key"`
+	Name string `json:"name"` // account the usage is metered against
+	Plan string `json:"plan"`
+	// Email receives the account's notices, such as results about to expire.
+	Email  string   `json:"email,omitempty"`
+	Scopes []string `json:"scopes,omitempty"` // see knownScopes; empty gives defaultScopes
+}
+
+// plansFile is the JSON layout of the -plans-file option.
+type plansFile struct {
+	Default string          `json:"default"` // plan for requests without a key, empty requires a key
+	Plans   map[string]Plan `json:"plans"`
+	Keys    []APIKey        `json:"keys"`
+}
+
+// planSet resolves requests to an account and its plan.
+type planSet struct {
+	anonymous *Plan
+	byHash    map[[32]byte]apiAccount
+	emails    map[string]string // contact address by account name
+	named     map[string]*Plan  // nil without a plans file
+}
+
+type apiAccount struct {
+	name   string
+	plan   *Plan
+	scopes []string
+}
+
+// unlimitedPlan applies to everybody when no plans file is configured.
+var unlimitedPlan = &Plan{Name: "unlimited"}
+
+var plans = &planSet{anonymous: unlimitedPlan}
+
+func loadPlans(path string) (*planSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f plansFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	byName := make(map[string]*Plan)
+	ps := &planSet{byHash: make(map[[32]byte]apiAccount), emails: make(map[string]string), named: byName}
+	for name, p := range f.Plans {
+		for _, e := range p.Engines {
+			if !slices.Contains(knownEngines, e) {
+				return nil, fmt.Errorf("parsing %s: plan %s allows unknown engine %q", path, name, e)
+			}
+		}
+		p.Name = name
+		byName[name] = &p
+	}
+	if f.Default != "" {
+		if ps.anonymous = byName[f.Default]; ps.anonymous == nil {
+			return nil, fmt.Errorf("parsing %s: default plan %q is not defined", path, f.Default)
+		}
+	}
+	for i, k := range f.Keys {
+		p := byName[k.Plan]
+		switch {
+		case k.Key == "":
+			return nil, fmt.Errorf("parsing %s: key %d is empty", path, i)
+		case p == nil:
+			return nil, fmt.Errorf("parsing %s: key %d uses undefined plan %q", path, i, k.Plan)
+		}
+		for _, sc := range k.Scopes {
+			if !slices.Contains(knownScopes, sc) {
+				return nil, fmt.Errorf("parsing %s: key %d has unknown scope %q", path, i, sc)
+			}
+		}
+		scopes := k.Scopes
+		if len(scopes) == 0 {
+			scopes = defaultScopes
+		}
+		name := k.Name
+		if name == "" {
+			name = fmt.Sprintf("key-%d", i)
+		}
+		// Keys are looked up by hash so the map access does not leak
+		// timing information about valid keys.
+		ps.byHash[sha256.Sum256([]byte(k.Key))] = apiAccount{name: name, plan: p, scopes: scopes}
+		if k.Email != "" {
+			ps.emails[name] = k.Email
+		}
+	}
+	return ps, nil
+}
+
+// requestAPIKey returns the key sent as "Authorization: Bearer <key>" or in
+// the X-API-Key header. Only the feed, for readers that cannot send headers,
+// also takes it as ?key=; a key in the URL ends up in access logs and
+// browser history.
+func requestAPIKey(r *http.Request) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	if k, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(k)
+	}
+	if isFeedRequest(r) {
+		return r.URL.Query().Get("key")
+	}
+	return ""
+}
+
+// identify returns the account a request is metered against and its plan.
+// Keys are those of the plans file and the stored keys (see keyStore).
+// Anonymous callers share the default plan but are metered per client
+// address. Users signed in to the web UI are metered as their account and
+// get the default plan.
+func (ps *planSet) identify(r *http.Request) (string, *Plan, *planError) {
+	if key := requestAPIKey(r); key != "" && (ps.byHash != nil || !apiKeys.empty()) {
+		if a, ok := ps.byHash[sha256.Sum256([]byte(key))]; ok {
+			return ps.forAccount(a.name, a.plan)
+		}
+		k, ok := apiKeys.lookup(key)
+		if !ok {
+			return "", nil, &planError{http.StatusUnauthorized, "invalid_api_key", "the API key is not valid"}
+		}
+		p, err := ps.plan(k.Plan)
+		if u, _ := users.get(k.Name); err != nil && u.Plan == "" {
+			return "", nil, &planError{http.StatusForbidden, "invalid_plan", "the API key's " + err.Error()}
+		}
+		return ps.forAccount(k.Name, p)
+	}
+	if s, ok := currentSession(r); ok {
+		p, err := ps.plan("")
+		if err != nil {
+			return "", nil, &planError{http.StatusForbidden, "invalid_plan", "the signed-in user's " + err.Error()}
+		}
+		return ps.forAccount(s.account(), p)
+	}
+	if ps.anonymous == nil {
+		return "", nil, &planError{http.StatusUnauthorized, "api_key_required", "an API key is required"}
+	}
+	return "ip:" + clientKey(r), ps.anonymous, nil
+}
+
+// plan returns the plan of a stored key. Without a plans file there is
+// only the unlimited plan; with one a key names one of its plans or uses
+// the default plan.
+func (ps *planSet) plan(name string) (*Plan, error) {
+	if ps.named == nil {
+		if name != "" {
+			return nil, fmt.Errorf("plan %q is not defined: no plans file is configured", name)
+		}
+		return unlimitedPlan, nil
+	}
+	p := ps.named[name]
+	if name == "" && ps.anonymous != nil {
+		p = ps.anonymous
+	}
+	if p == nil && name == "" {
+		return nil, errors.New("plan is missing and the plans file has no default plan")
+	}
+	if p == nil {
+		return nil, fmt.Errorf("plan %q is not defined in the plans file", name)
+	}
+	return p, nil
+}
+
+// email returns the contact address of an account, or "" if it has none.
+func (ps *planSet) email(account string) string {
+	if u, ok := users.get(account); ok && u.Email != "" {
+		return u.Email
+	}
+	if e := ps.emails[account]; e != "" {
+		return e
+	}
+	keys, _ := apiKeys.list()
+	for _, k := range keys {
+		if k.Name == account && k.Email != "" {
+			return k.Email
+		}
+	}
+	return ""
+}
+
+// planError is a request refused by plan enforcement.
+type planError struct {
+	Status int
+	Code   string
+	msg    string
+}
+
+func (e *planError) Error() string { return e.msg }
+
+// checkUpload enforces the plan's per-document limits.
+func (p *Plan) checkUpload(size int64, engine string) *planError {
+	if p.MaxFileSizeMB > 0 && size > int64(p.MaxFileSizeMB)<<20 {
+		return &planError{http.StatusRequestEntityTooLarge, "file_too_large",
+			fmt.Sprintf("the %s plan accepts files up to %d MB", p.Name, p.MaxFileSizeMB)}
+	}
+	if !slices.Contains(knownEngines, engine) {
+		return &planError{http.StatusBadRequest, "unknown_engine", fmt.Sprintf("unknown engine %q", engine)}
+	}
+	if len(p.Engines) > 0 && !slices.Contains(p.Engines, engine) {
+		return &planError{http.StatusForbidden, "engine_not_allowed",
+			fmt.Sprintf("the %s plan does not include the %s engine", p.Name, engine)}
+	}
+	return nil
+}
+
+// maxActiveJobs and maxPages are the -max-active-jobs and -max-pages
+// limits of plans that set none.
+var maxActiveJobs, maxPages int
+
+// activeJobLimit is how many jobs an account of the plan may have queued
+// or processing at once, 0 for no limit.
+func (p *Plan) activeJobLimit() int {
+	if p == nil {
+		return maxActiveJobs
+	}
+	return planLimit(p.MaxActiveJobs, maxActiveJobs)
+}
+
+// pageLimit is how many pages a document of the plan may have, 0 for no
+// limit.
+func (p *Plan) pageLimit() int {
+	if p == nil {
+		return maxPages
+	}
+	return planLimit(p.MaxPages, maxPages)
+}
+
+// planLimit is the limit v of a plan: server when the plan sets none, 0
+// for a negative one, which lifts it.
+func planLimit(v, server int) int {
+	switch {
+	case v == 0:
+		return server
+	case v < 0:
+		return 0
+	}
+	return v
+}
+
+// checkPages refuses a document of more pages than limit, 0 for none.
+func checkPages(pages, limit int) *planError {
+	if limit > 0 && pages > limit {
+		return &planError{http.StatusRequestEntityTooLarge, "too_many_pages",
+			fmt.Sprintf("documents may have up to %d pages; this one has %d", limit, pages)}
+	}
+	return nil
+}
+
+// errTooManyJobs refuses a job of an account that has as many jobs queued
+// or processing as its plan allows.
+var errTooManyJobs = &planError{http.StatusTooManyRequests, "too_many_jobs", "too many of your jobs are queued or processing, please try again once one has finished"}
+
+// tooManyJobsRetry is the Retry-After of errTooManyJobs, in seconds.
+const tooManyJobsRetry = "30"
+
+// setRetryAfter tells the client when to submit again after err.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTooManyJobs) {
+		w.Header().Set("Retry-After", tooManyJobsRetry)
+	}
+}
+
+// chargePages books a document's pages against the account's monthly
+// allowance.
+func (p *Plan) chargePages(account string, pages int) *planError {
+	if !usage.charge(account, pages, p.PagesPerMonth) {
+		return &planError{http.StatusTooManyRequests, "page_quota_exceeded",
+			fmt.Sprintf("the %s plan allows %d pages per month; this document has %d", p.Name, p.PagesPerMonth, pages)}
+	}
+	return nil
+}
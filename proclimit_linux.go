@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// limitedProc applies procLimits to an OCR run on Linux. Each run gets its
+// own cgroup v2 under cgroupRoot, so the memory and CPU limits cover the
+// whole process tree and anything left behind can be killed in one go. When
+// cgroups are not available (no delegation, cgroup v1) it falls back to an
+// address-space rlimit, which only bounds each process on its own.
+type limitedProc struct {
+	cmd    *exec.Cmd
+	lim    procLimits
+	cgroup string   // empty when the rlimit fallback is used
+	dirFD  *os.File // open cgroup directory handed to clone3
+}
+
+var cgroupWarning sync.Once
+
+func newLimitedProc(cmd *exec.Cmd, lim procLimits, name string) (*limitedProc, error) {
+	p := &limitedProc{cmd: cmd, lim: lim}
+
+	// A process group of its own lets a timeout kill pdftoppm and
+	// tesseract along with the Python script. Pdeathsig stops the run if
+	// the server dies, so a resumed job never races an orphaned one.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+
+	if lim.Memory <= 0 && lim.CPU <= 0 {
+		return p, nil
+	}
+	if name == "" {
+		name = newID()
+	}
+	if err := p.createCgroup("ocr-" + name); err != nil {
+		cgroupWarning.Do(func() {
+			log.Printf("cgroup limits unavailable, falling back to rlimits: %v", err)
+		})
+		p.removeCgroup()
+		return p, nil
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(p.dirFD.Fd())
+	return p, nil
+}
+
+func (p *limitedProc) createCgroup(name string) error {
+	if cgroupRoot == "" {
+		return fmt.Errorf("no cgroup root configured")
+	}
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return fmt.Errorf("cgroup v2 is not mounted at /sys/fs/cgroup")
+	}
+	if err := os.MkdirAll(cgroupRoot, 0755); err != nil {
+		return err
+	}
+	// Controllers must be enabled on the parent before the child's
+	// memory.max and cpu.max files exist.
+	if err := os.WriteFile(filepath.Join(cgroupRoot, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644); err != nil {
+		return fmt.Errorf("enabling controllers in %s: %w", cgroupRoot, err)
+	}
+	dir := filepath.Join(cgroupRoot, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	p.cgroup = dir
+
+	if p.lim.Memory > 0 {
+		limit := strconv.FormatInt(p.lim.Memory, 10)
+		if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(limit), 0644); err != nil {
+			return err
+		}
+		// Swapping a runaway rasterizer only makes the host slower.
+		os.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0644)
+	}
+	if p.lim.CPU > 0 {
+		const period = 100000 // µs
+		quota := fmt.Sprintf("%d %d", p.lim.CPU*period/100, period)
+		if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(quota), 0644); err != nil {
+			return err
+		}
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	p.dirFD = fd
+	return nil
+}
+
+// started is called once the process is running.
+func (p *limitedProc) started() error {
+	if p.cgroup != "" || p.lim.Memory <= 0 {
+		return nil
+	}
+	rl := unix.Rlimit{Cur: uint64(p.lim.Memory), Max: uint64(p.lim.Memory)}
+	return unix.Prlimit(p.cmd.Process.Pid, unix.RLIMIT_AS, &rl, nil)
+}
+
+// finish kills whatever is left of the process tree, removes the cgroup and
+// reports which limit the run hit, if any.
+func (p *limitedProc) finish() string {
+	if p.cgroup == "" {
+		return ""
+	}
+	exceeded := ""
+	if data, err := os.ReadFile(filepath.Join(p.cgroup, "memory.events")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if v, ok := strings.CutPrefix(line, "oom_kill "); ok && v != "0" {
+				exceeded = "exceeded the memory limit of " + formatBytes(p.lim.Memory)
+			}
+		}
+	}
+	p.removeCgroup()
+	return exceeded
+}
+
+func (p *limitedProc) removeCgroup() {
+	if p.dirFD != nil {
+		p.dirFD.Close()
+		p.dirFD = nil
+	}
+	if p.cgroup == "" {
+		return
+	}
+	os.WriteFile(filepath.Join(p.cgroup, "cgroup.kill"), []byte("1"), 0644)
+	// The directory can only be removed once the killed processes are gone.
+	for i := 0; i < 20; i++ {
+		if err := os.Remove(p.cgroup); err == nil || os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	p.cgroup = ""
+}
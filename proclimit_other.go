@@ -0,0 +1,28 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"log"
+	"os/exec"
+	"sync"
+)
+
+// limitedProc is a no-op on platforms without cgroups or job objects; only
+// the timeout in procLimits is enforced there.
+type limitedProc struct{}
+
+var limitWarning sync.Once
+
+func newLimitedProc(cmd *exec.Cmd, lim procLimits, name string) (*limitedProc, error) {
+	if lim.Memory > 0 || lim.CPU > 0 {
+		limitWarning.Do(func() {
+			log.Printf("OCR memory and CPU limits are not supported on this platform")
+		})
+	}
+	return &limitedProc{}, nil
+}
+
+func (p *limitedProc) started() error { return nil }
+
+func (p *limitedProc) finish() string { return "" }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// limitedProc applies procLimits to an OCR run on Windows by placing the
+// process in a job object. Child processes join the job automatically, the
+// memory limit covers the whole tree, and closing the job kills anything
+// still running.
+type limitedProc struct {
+	cmd *exec.Cmd
+	lim procLimits
+	job windows.Handle
+}
+
+// jobObjectCPURateControl mirrors JOBOBJECT_CPU_RATE_CONTROL_INFORMATION.
+type jobObjectCPURateControl struct {
+	ControlFlags uint32
+	CPURate      uint32 // 1/100 of a percent of all processors
+}
+
+const (
+	jobObjectCPURateControlEnable  = 0x1
+	jobObjectCPURateControlHardCap = 0x4
+)
+
+func newLimitedProc(cmd *exec.Cmd, lim procLimits, name string) (*limitedProc, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating job object: %w", err)
+	}
+	p := &limitedProc{cmd: cmd, lim: lim, job: job}
+
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	if lim.Memory > 0 {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_JOB_MEMORY
+		info.JobMemoryLimit = uintptr(lim.Memory)
+	}
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(job)
+		return nil, fmt.Errorf("setting job object limits: %w", err)
+	}
+	if lim.CPU > 0 {
+		rate := jobObjectCPURateControl{
+			ControlFlags: jobObjectCPURateControlEnable | jobObjectCPURateControlHardCap,
+			CPURate:      uint32(min(max(lim.CPU*100/runtime.NumCPU(), 1), 100) * 100),
+		}
+		if _, err := windows.SetInformationJobObject(job, windows.JobObjectCpuRateControlInformation,
+			uintptr(unsafe.Pointer(&rate)), uint32(unsafe.Sizeof(rate))); err != nil {
+			windows.CloseHandle(job)
+			return nil, fmt.Errorf("setting job object CPU rate: %w", err)
+		}
+	}
+
+	cmd.Cancel = func() error {
+		return windows.TerminateJobObject(p.job, 1)
+	}
+	return p, nil
+}
+
+// started moves the running process into the job object.
+func (p *limitedProc) started() error {
+	h, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(p.cmd.Process.Pid))
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(h)
+	return windows.AssignProcessToJobObject(p.job, h)
+}
+
+// finish closes the job object, which kills any process still in it, and
+// reports which limit the run hit, if any.
+func (p *limitedProc) finish() string {
+	exceeded := ""
+	if p.lim.Memory > 0 {
+		var info windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+		err := windows.QueryInformationJobObject(p.job, windows.JobObjectExtendedLimitInformation,
+			uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)), nil)
+		if err == nil && int64(info.PeakJobMemoryUsed) >= p.lim.Memory {
+			exceeded = "exceeded the memory limit of " + formatBytes(p.lim.Memory)
+		}
+	}
+	windows.CloseHandle(p.job)
+	return exceeded
+}
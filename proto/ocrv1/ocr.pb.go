@@ -0,0 +1,806 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: ocrv1/ocr.proto
+
+package ocrv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type JobStatus int32
+
+const (
+	JobStatus_JOB_STATUS_UNSPECIFIED JobStatus = 0
+	JobStatus_JOB_STATUS_QUEUED      JobStatus = 1
+	JobStatus_JOB_STATUS_PROCESSING  JobStatus = 2
+	JobStatus_JOB_STATUS_DONE        JobStatus = 3
+	JobStatus_JOB_STATUS_FAILED      JobStatus = 4
+	JobStatus_JOB_STATUS_CANCELED    JobStatus = 5
+)
+
+// Enum value maps for JobStatus.
+var (
+	JobStatus_name = map[int32]string{
+		0: "JOB_STATUS_UNSPECIFIED",
+		1: "JOB_STATUS_QUEUED",
+		2: "JOB_STATUS_PROCESSING",
+		3: "JOB_STATUS_DONE",
+		4: "JOB_STATUS_FAILED",
+		5: "JOB_STATUS_CANCELED",
+	}
+	JobStatus_value = map[string]int32{
+		"JOB_STATUS_UNSPECIFIED": 0,
+		"JOB_STATUS_QUEUED":      1,
+		"JOB_STATUS_PROCESSING":  2,
+		"JOB_STATUS_DONE":        3,
+		"JOB_STATUS_FAILED":      4,
+		"JOB_STATUS_CANCELED":    5,
+	}
+)
+
+func (x JobStatus) Enum() *JobStatus {
+	p := new(JobStatus)
+	*p = x
+	return p
+}
+
+func (x JobStatus) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (JobStatus) Descriptor() protoreflect.EnumDescriptor {
+	return file_ocrv1_ocr_proto_enumTypes[0].Descriptor()
+}
+
+func (JobStatus) Type() protoreflect.EnumType {
+	return &file_ocrv1_ocr_proto_enumTypes[0]
+}
+
+func (x JobStatus) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use JobStatus.Descriptor instead.
+func (JobStatus) EnumDescriptor() ([]byte, []int) {
+	return file_ocrv1_ocr_proto_rawDescGZIP(), []int{0}
+}
+
+type ResultKind int32
+
+const (
+	ResultKind_RESULT_KIND_UNSPECIFIED ResultKind = 0
+	ResultKind_RESULT_KIND_TEXT        ResultKind = 1
+	ResultKind_RESULT_KIND_PDF         ResultKind = 2
+	ResultKind_RESULT_KIND_LOG         ResultKind = 3
+)
+
+// Enum value maps for ResultKind.
+var (
+	ResultKind_name = map[int32]string{
+		0: "RESULT_KIND_UNSPECIFIED",
+		1: "RESULT_KIND_TEXT",
+		2: "RESULT_KIND_PDF",
+		3: "RESULT_KIND_LOG",
+	}
+	ResultKind_value = map[string]int32{
+		"RESULT_KIND_UNSPECIFIED": 0,
+		"RESULT_KIND_TEXT":        1,
+		"RESULT_KIND_PDF":         2,
+		"RESULT_KIND_LOG":         3,
+	}
+)
+
+func (x ResultKind) Enum() *ResultKind {
+	p := new(ResultKind)
+	*p = x
+	return p
+}
+
+func (x ResultKind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ResultKind) Descriptor() protoreflect.EnumDescriptor {
+	return file_ocrv1_ocr_proto_enumTypes[1].Descriptor()
+}
+
+func (ResultKind) Type() protoreflect.EnumType {
+	return &file_ocrv1_ocr_proto_enumTypes[1]
+}
+
+func (x ResultKind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ResultKind.Descriptor instead.
+func (ResultKind) EnumDescriptor() ([]byte, []int) {
+	return file_ocrv1_ocr_proto_rawDescGZIP(), []int{1}
+}
+
+type SubmitDocumentRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The file name decides how the document is read, e.g. "letter.pdf" or
+	// "scan.png".
+	Filename string `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	Content  []byte `protobuf:"bytes,2,opt,name=content,proto3" json:"content,omitempty"`
+	// Tesseract languages, e.g. "fas+eng". Empty for the server default.
+	Languages string            `protobuf:"bytes,3,opt,name=languages,proto3" json:"languages,omitempty"`
+	Tags      map[string]string `protobuf:"bytes,4,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// The SHA-256 of content in hex. When set, a document that arrives with
+	// another hash is refused with INVALID_ARGUMENT.
+	Sha256        string `protobuf:"bytes,5,opt,name=sha256,proto3" json:"sha256,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SubmitDocumentRequest) Reset() {
+	*x = SubmitDocumentRequest{}
+	mi := &file_ocrv1_ocr_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SubmitDocumentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubmitDocumentRequest) ProtoMessage() {}
+
+func (x *SubmitDocumentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ocrv1_ocr_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubmitDocumentRequest.ProtoReflect.Descriptor instead.
+func (*SubmitDocumentRequest) Descriptor() ([]byte, []int) {
+	return file_ocrv1_ocr_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SubmitDocumentRequest) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *SubmitDocumentRequest) GetContent() []byte {
+	if x != nil {
+		return x.Content
+	}
+	return nil
+}
+
+func (x *SubmitDocumentRequest) GetLanguages() string {
+	if x != nil {
+		return x.Languages
+	}
+	return ""
+}
+
+func (x *SubmitDocumentRequest) GetTags() map[string]string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *SubmitDocumentRequest) GetSha256() string {
+	if x != nil {
+		return x.Sha256
+	}
+	return ""
+}
+
+type GetJobRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	JobId         string                 `protobuf:"bytes,1,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetJobRequest) Reset() {
+	*x = GetJobRequest{}
+	mi := &file_ocrv1_ocr_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetJobRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetJobRequest) ProtoMessage() {}
+
+func (x *GetJobRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ocrv1_ocr_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetJobRequest.ProtoReflect.Descriptor instead.
+func (*GetJobRequest) Descriptor() ([]byte, []int) {
+	return file_ocrv1_ocr_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *GetJobRequest) GetJobId() string {
+	if x != nil {
+		return x.JobId
+	}
+	return ""
+}
+
+type Job struct {
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	Id         string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Filename   string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	Status     JobStatus              `protobuf:"varint,3,opt,name=status,proto3,enum=persianocr.v1.JobStatus" json:"status,omitempty"`
+	Error      string                 `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	CreatedAt  *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	StartedAt  *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=started_at,json=startedAt,proto3" json:"started_at,omitempty"`
+	FinishedAt *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=finished_at,json=finishedAt,proto3" json:"finished_at,omitempty"`
+	// Pages the engine has finished so far, and the page count once known.
+	PagesDone int32 `protobuf:"varint,8,opt,name=pages_done,json=pagesDone,proto3" json:"pages_done,omitempty"`
+	Pages     int32 `protobuf:"varint,9,opt,name=pages,proto3" json:"pages,omitempty"`
+	// Mean word confidence, 0-100, of a finished job.
+	Confidence *float64 `protobuf:"fixed64,10,opt,name=confidence,proto3,oneof" json:"confidence,omitempty"`
+	// The SHA-256 of the document as it arrived, in hex.
+	Sha256 string            `protobuf:"bytes,11,opt,name=sha256,proto3" json:"sha256,omitempty"`
+	Tags   map[string]string `protobuf:"bytes,12,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// The results FetchResult can return.
+	Results       []ResultKind `protobuf:"varint,13,rep,packed,name=results,proto3,enum=persianocr.v1.ResultKind" json:"results,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Job) Reset() {
+	*x = Job{}
+	mi := &file_ocrv1_ocr_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Job) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Job) ProtoMessage() {}
+
+func (x *Job) ProtoReflect() protoreflect.Message {
+	mi := &file_ocrv1_ocr_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Job.ProtoReflect.Descriptor instead.
+func (*Job) Descriptor() ([]byte, []int) {
+	return file_ocrv1_ocr_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Job) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Job) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *Job) GetStatus() JobStatus {
+	if x != nil {
+		return x.Status
+	}
+	return JobStatus_JOB_STATUS_UNSPECIFIED
+}
+
+func (x *Job) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *Job) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *Job) GetStartedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.StartedAt
+	}
+	return nil
+}
+
+func (x *Job) GetFinishedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.FinishedAt
+	}
+	return nil
+}
+
+func (x *Job) GetPagesDone() int32 {
+	if x != nil {
+		return x.PagesDone
+	}
+	return 0
+}
+
+func (x *Job) GetPages() int32 {
+	if x != nil {
+		return x.Pages
+	}
+	return 0
+}
+
+func (x *Job) GetConfidence() float64 {
+	if x != nil && x.Confidence != nil {
+		return *x.Confidence
+	}
+	return 0
+}
+
+func (x *Job) GetSha256() string {
+	if x != nil {
+		return x.Sha256
+	}
+	return ""
+}
+
+func (x *Job) GetTags() map[string]string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Job) GetResults() []ResultKind {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+type FetchResultRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	JobId         string                 `protobuf:"bytes,1,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	Kind          ResultKind             `protobuf:"varint,2,opt,name=kind,proto3,enum=persianocr.v1.ResultKind" json:"kind,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FetchResultRequest) Reset() {
+	*x = FetchResultRequest{}
+	mi := &file_ocrv1_ocr_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FetchResultRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FetchResultRequest) ProtoMessage() {}
+
+func (x *FetchResultRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ocrv1_ocr_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FetchResultRequest.ProtoReflect.Descriptor instead.
+func (*FetchResultRequest) Descriptor() ([]byte, []int) {
+	return file_ocrv1_ocr_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *FetchResultRequest) GetJobId() string {
+	if x != nil {
+		return x.JobId
+	}
+	return ""
+}
+
+func (x *FetchResultRequest) GetKind() ResultKind {
+	if x != nil {
+		return x.Kind
+	}
+	return ResultKind_RESULT_KIND_UNSPECIFIED
+}
+
+type ResultChunk struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The file name and content type are sent with the first chunk only.
+	Filename      string `protobuf:"bytes,1,opt,name=filename,proto3" json:"filename,omitempty"`
+	ContentType   string `protobuf:"bytes,2,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	Data          []byte `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ResultChunk) Reset() {
+	*x = ResultChunk{}
+	mi := &file_ocrv1_ocr_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ResultChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ResultChunk) ProtoMessage() {}
+
+func (x *ResultChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_ocrv1_ocr_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ResultChunk.ProtoReflect.Descriptor instead.
+func (*ResultChunk) Descriptor() ([]byte, []int) {
+	return file_ocrv1_ocr_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ResultChunk) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *ResultChunk) GetContentType() string {
+	if x != nil {
+		return x.ContentType
+	}
+	return ""
+}
+
+func (x *ResultChunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type StreamPagesRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	JobId string                 `protobuf:"bytes,1,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	// Pages numbered below from_page are skipped so a client can resume a
+	// broken stream. Zero starts from the first page.
+	FromPage      int32 `protobuf:"varint,2,opt,name=from_page,json=fromPage,proto3" json:"from_page,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamPagesRequest) Reset() {
+	*x = StreamPagesRequest{}
+	mi := &file_ocrv1_ocr_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamPagesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamPagesRequest) ProtoMessage() {}
+
+func (x *StreamPagesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ocrv1_ocr_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamPagesRequest.ProtoReflect.Descriptor instead.
+func (*StreamPagesRequest) Descriptor() ([]byte, []int) {
+	return file_ocrv1_ocr_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *StreamPagesRequest) GetJobId() string {
+	if x != nil {
+		return x.JobId
+	}
+	return ""
+}
+
+func (x *StreamPagesRequest) GetFromPage() int32 {
+	if x != nil {
+		return x.FromPage
+	}
+	return 0
+}
+
+type PageResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	JobId         string                 `protobuf:"bytes,1,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	Page          int32                  `protobuf:"varint,2,opt,name=page,proto3" json:"page,omitempty"`
+	Text          string                 `protobuf:"bytes,3,opt,name=text,proto3" json:"text,omitempty"`
+	WordCount     int32                  `protobuf:"varint,4,opt,name=word_count,json=wordCount,proto3" json:"word_count,omitempty"`
+	RecognizedAt  *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=recognized_at,json=recognizedAt,proto3" json:"recognized_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PageResult) Reset() {
+	*x = PageResult{}
+	mi := &file_ocrv1_ocr_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PageResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PageResult) ProtoMessage() {}
+
+func (x *PageResult) ProtoReflect() protoreflect.Message {
+	mi := &file_ocrv1_ocr_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PageResult.ProtoReflect.Descriptor instead.
+func (*PageResult) Descriptor() ([]byte, []int) {
+	return file_ocrv1_ocr_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PageResult) GetJobId() string {
+	if x != nil {
+		return x.JobId
+	}
+	return ""
+}
+
+func (x *PageResult) GetPage() int32 {
+	if x != nil {
+		return x.Page
+	}
+	return 0
+}
+
+func (x *PageResult) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *PageResult) GetWordCount() int32 {
+	if x != nil {
+		return x.WordCount
+	}
+	return 0
+}
+
+func (x *PageResult) GetRecognizedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.RecognizedAt
+	}
+	return nil
+}
+
+var File_ocrv1_ocr_proto protoreflect.FileDescriptor
+
+const file_ocrv1_ocr_proto_rawDesc = "" +
+	"\n" +
+	"\x0focrv1/ocr.proto\x12\rpersianocr.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\x80\x02\n" +
+	"\x15SubmitDocumentRequest\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12\x18\n" +
+	"\acontent\x18\x02 \x01(\fR\acontent\x12\x1c\n" +
+	"\tlanguages\x18\x03 \x01(\tR\tlanguages\x12B\n" +
+	"\x04tags\x18\x04 \x03(\v2..persianocr.v1.SubmitDocumentRequest.TagsEntryR\x04tags\x12\x16\n" +
+	"\x06sha256\x18\x05 \x01(\tR\x06sha256\x1a7\n" +
+	"\tTagsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"&\n" +
+	"\rGetJobRequest\x12\x15\n" +
+	"\x06job_id\x18\x01 \x01(\tR\x05jobId\"\xcd\x04\n" +
+	"\x03Job\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x1a\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\x120\n" +
+	"\x06status\x18\x03 \x01(\x0e2\x18.persianocr.v1.JobStatusR\x06status\x12\x14\n" +
+	"\x05error\x18\x04 \x01(\tR\x05error\x129\n" +
+	"\n" +
+	"created_at\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x129\n" +
+	"\n" +
+	"started_at\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\tstartedAt\x12;\n" +
+	"\vfinished_at\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"finishedAt\x12\x1d\n" +
+	"\n" +
+	"pages_done\x18\b \x01(\x05R\tpagesDone\x12\x14\n" +
+	"\x05pages\x18\t \x01(\x05R\x05pages\x12#\n" +
+	"\n" +
+	"confidence\x18\n" +
+	" \x01(\x01H\x00R\n" +
+	"confidence\x88\x01\x01\x12\x16\n" +
+	"\x06sha256\x18\v \x01(\tR\x06sha256\x120\n" +
+	"\x04tags\x18\f \x03(\v2\x1c.persianocr.v1.Job.TagsEntryR\x04tags\x123\n" +
+	"\aresults\x18\r \x03(\x0e2\x19.persianocr.v1.ResultKindR\aresults\x1a7\n" +
+	"\tTagsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01B\r\n" +
+	"\v_confidence\"Z\n" +
+	"\x12FetchResultRequest\x12\x15\n" +
+	"\x06job_id\x18\x01 \x01(\tR\x05jobId\x12-\n" +
+	"\x04kind\x18\x02 \x01(\x0e2\x19.persianocr.v1.ResultKindR\x04kind\"`\n" +
+	"\vResultChunk\x12\x1a\n" +
+	"\bfilename\x18\x01 \x01(\tR\bfilename\x12!\n" +
+	"\fcontent_type\x18\x02 \x01(\tR\vcontentType\x12\x12\n" +
+	"\x04data\x18\x03 \x01(\fR\x04data\"H\n" +
+	"\x12StreamPagesRequest\x12\x15\n" +
+	"\x06job_id\x18\x01 \x01(\tR\x05jobId\x12\x1b\n" +
+	"\tfrom_page\x18\x02 \x01(\x05R\bfromPage\"\xab\x01\n" +
+	"\n" +
+	"PageResult\x12\x15\n" +
+	"\x06job_id\x18\x01 \x01(\tR\x05jobId\x12\x12\n" +
+	"\x04page\x18\x02 \x01(\x05R\x04page\x12\x12\n" +
+	"\x04text\x18\x03 \x01(\tR\x04text\x12\x1d\n" +
+	"\n" +
+	"word_count\x18\x04 \x01(\x05R\twordCount\x12?\n" +
+	"\rrecognized_at\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\frecognizedAt*\x9e\x01\n" +
+	"\tJobStatus\x12\x1a\n" +
+	"\x16JOB_STATUS_UNSPECIFIED\x10\x00\x12\x15\n" +
+	"\x11JOB_STATUS_QUEUED\x10\x01\x12\x19\n" +
+	"\x15JOB_STATUS_PROCESSING\x10\x02\x12\x13\n" +
+	"\x0fJOB_STATUS_DONE\x10\x03\x12\x15\n" +
+	"\x11JOB_STATUS_FAILED\x10\x04\x12\x17\n" +
+	"\x13JOB_STATUS_CANCELED\x10\x05*i\n" +
+	"\n" +
+	"ResultKind\x12\x1b\n" +
+	"\x17RESULT_KIND_UNSPECIFIED\x10\x00\x12\x14\n" +
+	"\x10RESULT_KIND_TEXT\x10\x01\x12\x13\n" +
+	"\x0fRESULT_KIND_PDF\x10\x02\x12\x13\n" +
+	"\x0fRESULT_KIND_LOG\x10\x032\xf9\x02\n" +
+	"\n" +
+	"OCRService\x12J\n" +
+	"\x0eSubmitDocument\x12$.persianocr.v1.SubmitDocumentRequest\x1a\x12.persianocr.v1.Job\x12:\n" +
+	"\x06GetJob\x12\x1c.persianocr.v1.GetJobRequest\x1a\x12.persianocr.v1.Job\x12D\n" +
+	"\x0eStreamProgress\x12\x1c.persianocr.v1.GetJobRequest\x1a\x12.persianocr.v1.Job0\x01\x12N\n" +
+	"\vFetchResult\x12!.persianocr.v1.FetchResultRequest\x1a\x1a.persianocr.v1.ResultChunk0\x01\x12M\n" +
+	"\vStreamPages\x12!.persianocr.v1.StreamPagesRequest\x1a\x19.persianocr.v1.PageResult0\x01B2Z0github.com/mosaeedv/persianOCR/proto/ocrv1;ocrv1b\x06proto3"
+
+var (
+	file_ocrv1_ocr_proto_rawDescOnce sync.Once
+	file_ocrv1_ocr_proto_rawDescData []byte
+)
+
+func file_ocrv1_ocr_proto_rawDescGZIP() []byte {
+	file_ocrv1_ocr_proto_rawDescOnce.Do(func() {
+		file_ocrv1_ocr_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_ocrv1_ocr_proto_rawDesc), len(file_ocrv1_ocr_proto_rawDesc)))
+	})
+	return file_ocrv1_ocr_proto_rawDescData
+}
+
+var file_ocrv1_ocr_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_ocrv1_ocr_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_ocrv1_ocr_proto_goTypes = []any{
+	(JobStatus)(0),                // 0: persianocr.v1.JobStatus
+	(ResultKind)(0),               // 1: persianocr.v1.ResultKind
+	(*SubmitDocumentRequest)(nil), // 2: persianocr.v1.SubmitDocumentRequest
+	(*GetJobRequest)(nil),         // 3: persianocr.v1.GetJobRequest
+	(*Job)(nil),                   // 4: persianocr.v1.Job
+	(*FetchResultRequest)(nil),    // 5: persianocr.v1.FetchResultRequest
+	(*ResultChunk)(nil),           // 6: persianocr.v1.ResultChunk
+	(*StreamPagesRequest)(nil),    // 7: persianocr.v1.StreamPagesRequest
+	(*PageResult)(nil),            // 8: persianocr.v1.PageResult
+	nil,                           // 9: persianocr.v1.SubmitDocumentRequest.TagsEntry
+	nil,                           // 10: persianocr.v1.Job.TagsEntry
+	(*timestamppb.Timestamp)(nil), // 11: google.protobuf.Timestamp
+}
+var file_ocrv1_ocr_proto_depIdxs = []int32{
+	9,  // 0: persianocr.v1.SubmitDocumentRequest.tags:type_name -> persianocr.v1.SubmitDocumentRequest.TagsEntry
+	0,  // 1: persianocr.v1.Job.status:type_name -> persianocr.v1.JobStatus
+	11, // 2: persianocr.v1.Job.created_at:type_name -> google.protobuf.Timestamp
+	11, // 3: persianocr.v1.Job.started_at:type_name -> google.protobuf.Timestamp
+	11, // 4: persianocr.v1.Job.finished_at:type_name -> google.protobuf.Timestamp
+	10, // 5: persianocr.v1.Job.tags:type_name -> persianocr.v1.Job.TagsEntry
+	1,  // 6: persianocr.v1.Job.results:type_name -> persianocr.v1.ResultKind
+	1,  // 7: persianocr.v1.FetchResultRequest.kind:type_name -> persianocr.v1.ResultKind
+	11, // 8: persianocr.v1.PageResult.recognized_at:type_name -> google.protobuf.Timestamp
+	2,  // 9: persianocr.v1.OCRService.SubmitDocument:input_type -> persianocr.v1.SubmitDocumentRequest
+	3,  // 10: persianocr.v1.OCRService.GetJob:input_type -> persianocr.v1.GetJobRequest
+	3,  // 11: persianocr.v1.OCRService.StreamProgress:input_type -> persianocr.v1.GetJobRequest
+	5,  // 12: persianocr.v1.OCRService.FetchResult:input_type -> persianocr.v1.FetchResultRequest
+	7,  // 13: persianocr.v1.OCRService.StreamPages:input_type -> persianocr.v1.StreamPagesRequest
+	4,  // 14: persianocr.v1.OCRService.SubmitDocument:output_type -> persianocr.v1.Job
+	4,  // 15: persianocr.v1.OCRService.GetJob:output_type -> persianocr.v1.Job
+	4,  // 16: persianocr.v1.OCRService.StreamProgress:output_type -> persianocr.v1.Job
+	6,  // 17: persianocr.v1.OCRService.FetchResult:output_type -> persianocr.v1.ResultChunk
+	8,  // 18: persianocr.v1.OCRService.StreamPages:output_type -> persianocr.v1.PageResult
+	14, // [14:19] is the sub-list for method output_type
+	9,  // [9:14] is the sub-list for method input_type
+	9,  // [9:9] is the sub-list for extension type_name
+	9,  // [9:9] is the sub-list for extension extendee
+	0,  // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_ocrv1_ocr_proto_init() }
+func file_ocrv1_ocr_proto_init() {
+	if File_ocrv1_ocr_proto != nil {
+		return
+	}
+	file_ocrv1_ocr_proto_msgTypes[2].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_ocrv1_ocr_proto_rawDesc), len(file_ocrv1_ocr_proto_rawDesc)),
+			NumEnums:      2,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_ocrv1_ocr_proto_goTypes,
+		DependencyIndexes: file_ocrv1_ocr_proto_depIdxs,
+		EnumInfos:         file_ocrv1_ocr_proto_enumTypes,
+		MessageInfos:      file_ocrv1_ocr_proto_msgTypes,
+	}.Build()
+	File_ocrv1_ocr_proto = out.File
+	file_ocrv1_ocr_proto_goTypes = nil
+	file_ocrv1_ocr_proto_depIdxs = nil
+}
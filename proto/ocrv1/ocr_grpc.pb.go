@@ -0,0 +1,309 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: ocrv1/ocr.proto
+
+package ocrv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	OCRService_SubmitDocument_FullMethodName = "/persianocr.v1.OCRService/SubmitDocument"
+	OCRService_GetJob_FullMethodName         = "/persianocr.v1.OCRService/GetJob"
+	OCRService_StreamProgress_FullMethodName = "/persianocr.v1.OCRService/StreamProgress"
+	OCRService_FetchResult_FullMethodName    = "/persianocr.v1.OCRService/FetchResult"
+	OCRService_StreamPages_FullMethodName    = "/persianocr.v1.OCRService/StreamPages"
+)
+
+// OCRServiceClient is the client API for OCRService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// OCRService exposes the OCR job system to internal services. Calls are
+// made as the API key in the "authorization" ("Bearer <key>") or
+// "x-api-key" metadata, like the HTTP API, and only see that account's
+// jobs.
+type OCRServiceClient interface {
+	// SubmitDocument queues a document as a new job. It is checked like an
+	// upload to POST /api/v1/jobs.
+	SubmitDocument(ctx context.Context, in *SubmitDocumentRequest, opts ...grpc.CallOption) (*Job, error)
+	// GetJob returns the current state of a job.
+	GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error)
+	// StreamProgress emits the job now and every time its status or progress
+	// changes, and ends the stream once the job has finished.
+	StreamProgress(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Job], error)
+	// FetchResult streams one result file of a finished job in chunks.
+	FetchResult(ctx context.Context, in *FetchResultRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ResultChunk], error)
+	// StreamPages emits each page's text as soon as the engine has recognized
+	// it and ends the stream once the job has finished.
+	StreamPages(ctx context.Context, in *StreamPagesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PageResult], error)
+}
+
+type oCRServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOCRServiceClient(cc grpc.ClientConnInterface) OCRServiceClient {
+	return &oCRServiceClient{cc}
+}
+
+func (c *oCRServiceClient) SubmitDocument(ctx context.Context, in *SubmitDocumentRequest, opts ...grpc.CallOption) (*Job, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Job)
+	err := c.cc.Invoke(ctx, OCRService_SubmitDocument_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *oCRServiceClient) GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Job)
+	err := c.cc.Invoke(ctx, OCRService_GetJob_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *oCRServiceClient) StreamProgress(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Job], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &OCRService_ServiceDesc.Streams[0], OCRService_StreamProgress_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[GetJobRequest, Job]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type OCRService_StreamProgressClient = grpc.ServerStreamingClient[Job]
+
+func (c *oCRServiceClient) FetchResult(ctx context.Context, in *FetchResultRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ResultChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &OCRService_ServiceDesc.Streams[1], OCRService_FetchResult_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[FetchResultRequest, ResultChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type OCRService_FetchResultClient = grpc.ServerStreamingClient[ResultChunk]
+
+func (c *oCRServiceClient) StreamPages(ctx context.Context, in *StreamPagesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PageResult], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &OCRService_ServiceDesc.Streams[2], OCRService_StreamPages_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamPagesRequest, PageResult]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type OCRService_StreamPagesClient = grpc.ServerStreamingClient[PageResult]
+
+// OCRServiceServer is the server API for OCRService service.
+// All implementations must embed UnimplementedOCRServiceServer
+// for forward compatibility.
+//
+// OCRService exposes the OCR job system to internal services. Calls are
+// made as the API key in the "authorization" ("Bearer <key>") or
+// "x-api-key" metadata, like the HTTP API, and only see that account's
+// jobs.
+type OCRServiceServer interface {
+	// SubmitDocument queues a document as a new job. It is checked like an
+	// upload to POST /api/v1/jobs.
+	SubmitDocument(context.Context, *SubmitDocumentRequest) (*Job, error)
+	// GetJob returns the current state of a job.
+	GetJob(context.Context, *GetJobRequest) (*Job, error)
+	// StreamProgress emits the job now and every time its status or progress
+	// changes, and ends the stream once the job has finished.
+	StreamProgress(*GetJobRequest, grpc.ServerStreamingServer[Job]) error
+	// FetchResult streams one result file of a finished job in chunks.
+	FetchResult(*FetchResultRequest, grpc.ServerStreamingServer[ResultChunk]) error
+	// StreamPages emits each page's text as soon as the engine has recognized
+	// it and ends the stream once the job has finished.
+	StreamPages(*StreamPagesRequest, grpc.ServerStreamingServer[PageResult]) error
+	mustEmbedUnimplementedOCRServiceServer()
+}
+
+// UnimplementedOCRServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedOCRServiceServer struct{}
+
+func (UnimplementedOCRServiceServer) SubmitDocument(context.Context, *SubmitDocumentRequest) (*Job, error) {
+	return nil, status.Error(codes.Unimplemented, "method SubmitDocument not implemented")
+}
+func (UnimplementedOCRServiceServer) GetJob(context.Context, *GetJobRequest) (*Job, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetJob not implemented")
+}
+func (UnimplementedOCRServiceServer) StreamProgress(*GetJobRequest, grpc.ServerStreamingServer[Job]) error {
+	return status.Error(codes.Unimplemented, "method StreamProgress not implemented")
+}
+func (UnimplementedOCRServiceServer) FetchResult(*FetchResultRequest, grpc.ServerStreamingServer[ResultChunk]) error {
+	return status.Error(codes.Unimplemented, "method FetchResult not implemented")
+}
+func (UnimplementedOCRServiceServer) StreamPages(*StreamPagesRequest, grpc.ServerStreamingServer[PageResult]) error {
+	return status.Error(codes.Unimplemented, "method StreamPages not implemented")
+}
+func (UnimplementedOCRServiceServer) mustEmbedUnimplementedOCRServiceServer() {}
+func (UnimplementedOCRServiceServer) testEmbeddedByValue()                    {}
+
+// UnsafeOCRServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OCRServiceServer will
+// result in compilation errors.
+type UnsafeOCRServiceServer interface {
+	mustEmbedUnimplementedOCRServiceServer()
+}
+
+func RegisterOCRServiceServer(s grpc.ServiceRegistrar, srv OCRServiceServer) {
+	// If the following call panics, it indicates UnimplementedOCRServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&OCRService_ServiceDesc, srv)
+}
+
+func _OCRService_SubmitDocument_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitDocumentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OCRServiceServer).SubmitDocument(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OCRService_SubmitDocument_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OCRServiceServer).SubmitDocument(ctx, req.(*SubmitDocumentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OCRService_GetJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OCRServiceServer).GetJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OCRService_GetJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OCRServiceServer).GetJob(ctx, req.(*GetJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OCRService_StreamProgress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetJobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(OCRServiceServer).StreamProgress(m, &grpc.GenericServerStream[GetJobRequest, Job]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type OCRService_StreamProgressServer = grpc.ServerStreamingServer[Job]
+
+func _OCRService_FetchResult_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FetchResultRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(OCRServiceServer).FetchResult(m, &grpc.GenericServerStream[FetchResultRequest, ResultChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type OCRService_FetchResultServer = grpc.ServerStreamingServer[ResultChunk]
+
+func _OCRService_StreamPages_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamPagesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(OCRServiceServer).StreamPages(m, &grpc.GenericServerStream[StreamPagesRequest, PageResult]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type OCRService_StreamPagesServer = grpc.ServerStreamingServer[PageResult]
+
+// OCRService_ServiceDesc is the grpc.ServiceDesc for OCRService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var OCRService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "persianocr.v1.OCRService",
+	HandlerType: (*OCRServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SubmitDocument",
+			Handler:    _OCRService_SubmitDocument_Handler,
+		},
+		{
+			MethodName: "GetJob",
+			Handler:    _OCRService_GetJob_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamProgress",
+			Handler:       _OCRService_StreamProgress_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "FetchResult",
+			Handler:       _OCRService_FetchResult_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamPages",
+			Handler:       _OCRService_StreamPages_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "ocrv1/ocr.proto",
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The quick endpoint is for browser extensions and hotkey tools: one small
+// image in, its text back in the same response. It bypasses the job queue,
+// so it is bounded tightly in size, in time and in how many run at once.
+var (
+	quickMaxSize int64         = 4 << 20
+	quickTimeout               = 20 * time.Second
+	quickSlots   chan struct{} // one per concurrent run, nil disables the endpoint
+)
+
+// quickPrefix names the result files of a quick run in its scratch
+// directory.
+const quickPrefix = "quick"
+
+// v1QuickHandler OCRs a single PNG or JPEG image synchronously and answers
+// with its text as text/plain. The image is sent as the "file" multipart
+// field or as the raw request body; "languages" and "mode" (see ocrModes)
+// may be given as form fields or query parameters. The run counts as one
+// page against the caller's plan and is metered like a job.
+func v1QuickHandler(w http.ResponseWriter, r *http.Request) {
+	if quickSlots == nil {
+		writeAPIError(w, http.StatusNotFound, "quick_disabled", "quick OCR is not enabled on this server")
+		return
+	}
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, quickMaxSize+64<<10)
+
+	var data []byte
+	var err error
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		if err := r.ParseMultipartForm(quickMaxSize); err != nil {
+			writeQuickBodyError(w, err)
+			return
+		}
+		file, _, ferr := r.FormFile("file")
+		if ferr != nil {
+			writeAPIError(w, http.StatusBadRequest, "missing_file", "Error retrieving file: "+ferr.Error())
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(file, quickMaxSize+1))
+		file.Close()
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		writeQuickBodyError(w, err)
+		return
+	}
+	text, confidence, ok := quickOCR(w, r, account, plan, data,
+		strings.TrimSpace(r.FormValue("languages")), r.FormValue("mode"))
+	if !ok {
+		return
+	}
+	if confidence != nil {
+		w.Header().Set("X-OCR-Confidence", strconv.FormatFloat(*confidence, 'f', 1, 64))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, text+"\n")
+}
+
+// quickOCR recognizes the PNG or JPEG image in data for account within
+// quickTimeout and returns its text and mean word confidence. It answers
+// every failure itself and then returns false.
+func quickOCR(w http.ResponseWriter, r *http.Request, account string, plan *Plan, data []byte, languages, mode string) (string, *float64, bool) {
+	if quickSlots == nil {
+		writeAPIError(w, http.StatusNotFound, "quick_disabled", "quick OCR is not enabled on this server")
+		return "", nil, false
+	}
+	if int64(len(data)) > quickMaxSize {
+		writeQuickBodyError(w, &http.MaxBytesError{Limit: quickMaxSize})
+		return "", nil, false
+	}
+	if len(data) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "missing_file", "no image was sent")
+		return "", nil, false
+	}
+	if ct := http.DetectContentType(data); ct != "image/png" && ct != "image/jpeg" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_type", "Please send a PNG or JPEG image")
+		return "", nil, false
+	}
+	if perr := plan.checkUpload(int64(len(data)), defaultEngine); perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return "", nil, false
+	}
+	if languages != "" {
+		if err := checkLanguages(languages); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_languages", err.Error())
+			return "", nil, false
+		}
+	}
+	if mode != "" && !slices.Contains(ocrModes, mode) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_mode",
+			fmt.Sprintf("unknown mode %q, use one of: %s", mode, strings.Join(ocrModes, ", ")))
+		return "", nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), quickTimeout)
+	defer cancel()
+	select {
+	case quickSlots <- struct{}{}:
+		defer func() { <-quickSlots }()
+	case <-ctx.Done():
+		w.Header().Set("Retry-After", "5")
+		writeAPIError(w, http.StatusServiceUnavailable, "busy", "all quick OCR slots are in use, try again shortly")
+		return "", nil, false
+	}
+
+	dir, err := newJobTempDir("")
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return "", nil, false
+	}
+	defer os.RemoveAll(dir)
+	inputPath := filepath.Join(dir, "input.pdf")
+	outputDir := filepath.Join(dir, "out")
+	if err := os.WriteFile(inputPath, data, 0644); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", "Error saving image: "+err.Error())
+		return "", nil, false
+	}
+	if err := os.Mkdir(outputDir, 0755); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", "Error creating output directory: "+err.Error())
+		return "", nil, false
+	}
+	if err := imageToPDF(inputPath); err != nil {
+		writePDFError(w, err)
+		return "", nil, false
+	}
+
+	if !limiter.allowSubmission(w, r) {
+		writeAPIError(w, http.StatusTooManyRequests, "quota_exceeded", "Daily submission quota exceeded")
+		return "", nil, false
+	}
+	if perr := plan.chargePages(account, 1); perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return "", nil, false
+	}
+
+	result, err := runOCR(ctx, inputPath, outputDir, quickPrefix, "", ocrOptions{Languages: languages, Mode: mode})
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		writeAPIError(w, http.StatusGatewayTimeout, "ocr_timeout",
+			fmt.Sprintf("OCR did not finish within %s; submit larger images as a job", quickTimeout))
+		return "", nil, false
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "ocr_failed", err.Error())
+		return "", nil, false
+	}
+	text, err := os.ReadFile(result.TextFile)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "ocr_failed", "Error reading text: "+err.Error())
+		return "", nil, false
+	}
+	meter.record(Job{ID: "quick-" + newID(), Engine: defaultEngine, account: account, inputPath: inputPath, outputDir: outputDir}, 1)
+
+	// The text file has the "--- Page 1 ---" header every document gets.
+	out := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(text)), "--- Page 1 ---"))
+	return out, result.MeanConfidence, true
+}
+
+// writeQuickBodyError answers a body that could not be read, with 413 when
+// it is over quickMaxSize.
+func writeQuickBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "file_too_large",
+			fmt.Sprintf("quick OCR takes images up to %d KB; submit larger files as a job", quickMaxSize>>10))
+		return
+	}
+	writeAPIError(w, http.StatusBadRequest, "invalid_body", "Error reading request: "+err.Error())
+}
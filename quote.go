@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A quote tells a client what a document would take before it is
+// submitted: pages, the scan resolution, how long the OCR is likely to run
+// and, for engines billed per page, what it costs.
+
+// defaultPageSeconds is the time per page assumed until an engine has
+// finished enough jobs on this server to measure it.
+const defaultPageSeconds = 6.0
+
+// quoteSampleJobs is how many recent jobs the time per page is measured
+// over, and quoteMinJobs how many are needed before it is trusted.
+const (
+	quoteSampleJobs = 50
+	quoteMinJobs    = 3
+)
+
+// Quote is the answer of POST /quote.
+type Quote struct {
+	Filename       string  `json:"filename"`
+	Pages          int     `json:"pages"`
+	DPI            *int    `json:"dpi,omitempty"` // median resolution of the scanned images, when Poppler can tell
+	Engine         string  `json:"engine"`
+	PageSeconds    float64 `json:"seconds_per_page"`
+	Measured       bool    `json:"measured"`          // PageSeconds comes from recent jobs, not the default
+	OCRSeconds     int     `json:"ocr_seconds"`       // the OCR run itself
+	QueueSeconds   int     `json:"queue_seconds"`     // work queued ahead of it, spread over the workers
+	TotalSeconds   int     `json:"estimated_seconds"` // queue plus OCR
+	Cost           float64 `json:"cost"`              // see engineCosts
+	PagesRemaining *int    `json:"pages_remaining"`   // this month under the caller's plan, null for unlimited
+	WithinPlan     bool    `json:"within_plan"`       // the pages fit what remains
+	ConvertedFrom  string  `json:"converted_from,omitempty"`
+}
+
+// v1QuoteHandler inspects an upload, sent as the "file" multipart field
+// like POST /jobs, and answers with a Quote without running OCR or
+// charging the plan. An "engine" form field prices another engine.
+func v1QuoteHandler(w http.ResponseWriter, r *http.Request) {
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	if err := parseUploadForm(w, r, maxUploadSize); err != nil {
+		writeFormError(w, err, maxUploadSize)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "missing_file", "Error retrieving file: "+err.Error())
+		return
+	}
+	defer file.Close()
+
+	filename := cleanUploadName(header.Filename)
+	if !isUploadType(filename) {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_type", errUnsupportedType.Error())
+		return
+	}
+	engine := r.FormValue("engine")
+	if engine == "" {
+		engine = defaultEngine
+	}
+	if perr := plan.checkUpload(header.Size, engine); perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+
+	spoolPath, _, err := spoolUpload(file)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	defer os.Remove(spoolPath)
+	format := convertedFormat(filename)
+	if format != "" {
+		err = convertToPDF(spoolPath, format, plan.pageLimit())
+	}
+	if err == nil {
+		_, err = checkPDF(spoolPath)
+	}
+	if err != nil {
+		writePDFError(w, err)
+		return
+	}
+
+	q := Quote{Filename: filename, Pages: pdfPageCount(spoolPath), Engine: engine, ConvertedFrom: format, WithinPlan: true}
+	if dpi, ok := pdfImageDPI(spoolPath); ok {
+		q.DPI = &dpi
+	}
+	q.PageSeconds, q.Measured = jobs.pageSeconds(engine)
+	q.OCRSeconds = int(math.Ceil(float64(q.Pages) * q.PageSeconds))
+	q.QueueSeconds = int(math.Ceil(float64(jobs.pagesAhead()) * q.PageSeconds / float64(max(workerCount, 1))))
+	q.TotalSeconds = q.QueueSeconds + q.OCRSeconds
+	q.Cost = math.Round(float64(q.Pages)*engineCosts[engine]*1e6) / 1e6
+	if plan.PagesPerMonth > 0 {
+		left := max(plan.PagesPerMonth-usage.month(account), 0)
+		q.PagesRemaining = &left
+		q.WithinPlan = q.Pages <= left
+	}
+	if checkPages(q.Pages, plan.pageLimit()) != nil {
+		q.WithinPlan = false
+	}
+	writeJSON(w, http.StatusOK, q)
+}
+
+// pageSeconds returns the median time per page of the engine's most recent
+// finished jobs, and whether there were enough of them to go by.
+func (s *JobStore) pageSeconds(engine string) (float64, bool) {
+	recent := s.list(func(j *Job) bool {
+		return j.Status == JobDone && j.Engine == engine && j.StartedAt != nil && j.FinishedAt != nil && j.pages > 0
+	})
+	if len(recent) < quoteMinJobs {
+		return defaultPageSeconds, false
+	}
+	recent = recent[:min(len(recent), quoteSampleJobs)]
+	per := make([]float64, len(recent))
+	for i, j := range recent {
+		per[i] = j.FinishedAt.Sub(*j.StartedAt).Seconds() / float64(j.pages)
+	}
+	slices.Sort(per)
+	return math.Round(per[len(per)/2]*100) / 100, true
+}
+
+// pagesAhead counts the pages still to be recognized in queued and
+// processing jobs.
+func (s *JobStore) pagesAhead() int {
+	n := 0
+	for _, j := range s.list(func(j *Job) bool { return j.Status == JobQueued || j.Status == JobProcessing }) {
+		left := j.pages
+		if j.Status == JobProcessing {
+			left -= checkpointedPages(j.outputDir)
+		}
+		n += max(left, 0)
+	}
+	return n
+}
+
+// pdfImageDPI returns the median horizontal resolution of the images in the
+// PDF at path, as reported by Poppler's pdfimages. It returns false when
+// pdfimages is not installed or finds no images.
+func pdfImageDPI(path string) (int, bool) {
+	out, err := exec.Command("pdfimages", "-list", path).Output()
+	if err != nil {
+		return 0, false
+	}
+	// page num type width height color comp bpc enc interp object ID x-ppi y-ppi size ratio
+	var ppi []int
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 14 || f[2] != "image" {
+			continue // header, or a mask
+		}
+		if v, err := strconv.Atoi(f[12]); err == nil && v > 0 {
+			ppi = append(ppi, v)
+		}
+	}
+	if len(ppi) == 0 {
+		return 0, false
+	}
+	slices.Sort(ppi)
+	return ppi[len(ppi)/2], true
+}
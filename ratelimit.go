@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter enforces a per-minute request budget and a per-day submission
+// quota for each client. Both are fixed windows, which keeps the numbers in
+// the X-RateLimit-* and X-Quota-* headers easy for clients to reason about.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	quota   int
+	key     func(*http.Request) string // who a request is charged to
+	clients map[string]*clientUsage
+}
+
+type clientUsage struct {
+	windowStart time.Time
+	requests    int
+	quotaStart  time.Time
+	submissions int
+}
+
+const (
+	rateWindow  = time.Minute
+	quotaWindow = 24 * time.Hour
+)
+
+func newRateLimiter(limit, quota int, key func(*http.Request) string) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		quota:   quota,
+		key:     key,
+		clients: make(map[string]*clientUsage),
+	}
+}
+
+// usage returns the bookkeeping for a client, rolling any expired window.
+// The caller must hold rl.mu.
+func (rl *rateLimiter) usage(client string, now time.Time) *clientUsage {
+	u, ok := rl.clients[client]
+	if !ok {
+		u = &clientUsage{windowStart: now, quotaStart: now}
+		rl.clients[client] = u
+	}
+	if now.Sub(u.windowStart) >= rateWindow {
+		u.windowStart = now
+		u.requests = 0
+	}
+	if now.Sub(u.quotaStart) >= quotaWindow {
+		u.quotaStart = now
+		u.submissions = 0
+	}
+	return u
+}
+
+// wrap applies the request budget to h. The rate limit and quota headers
+// are written on every response, including the 429 returned once the budget
+// is exhausted, which API routes get in their own error shape.
+func (rl *rateLimiter) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+
+		rl.mu.Lock()
+		u := rl.usage(rl.key(r), now)
+		ok := rl.limit <= 0 || u.requests < rl.limit
+		if ok {
+			u.requests++
+		}
+		rl.setHeaders(w, u)
+		reset := u.windowStart.Add(rateWindow)
+		rl.mu.Unlock()
+
+		if !ok {
+			w.Header().Set("Retry-After", retryAfter(reset))
+			const msg = "Rate limit exceeded, please slow down"
+			switch p := r.URL.Path; {
+			case strings.HasPrefix(p, "/api/documents/"), strings.HasPrefix(p, "/api/tasks/"):
+				paperlessError(w, http.StatusTooManyRequests, "", msg)
+			case strings.HasPrefix(p, "/api/"):
+				writeAPIError(w, http.StatusTooManyRequests, "rate_limited", msg)
+			default:
+				http.Error(w, msg, http.StatusTooManyRequests)
+			}
+			return
+		}
+		h(w, r)
+	}
+}
+
+// allowSubmission charges one document against the client's daily quota and
+// refreshes the quota headers. It returns false, with Retry-After set, when
+// the quota is used up; the caller writes the 429 response in its own format.
+func (rl *rateLimiter) allowSubmission(w http.ResponseWriter, r *http.Request) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	u := rl.usage(rl.key(r), time.Now())
+	if rl.quota > 0 && u.submissions >= rl.quota {
+		w.Header().Set("Retry-After", retryAfter(u.quotaStart.Add(quotaWindow)))
+		return false
+	}
+	u.submissions++
+	rl.setHeaders(w, u)
+	return true
+}
+
+// submissionsLeft returns how many more documents the client may submit
+// today, or -1 without a quota. Nothing is charged.
+func (rl *rateLimiter) submissionsLeft(r *http.Request) int {
+	if rl.quota <= 0 {
+		return -1
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return max(rl.quota-rl.usage(rl.key(r), time.Now()).submissions, 0)
+}
+
+// setHeaders writes the X-RateLimit-* and X-Quota-* headers for u. Reset
+// values are Unix timestamps. The caller must hold rl.mu.
+func (rl *rateLimiter) setHeaders(w http.ResponseWriter, u *clientUsage) {
+	hdr := w.Header()
+	if rl.limit > 0 {
+		hdr.Set("X-RateLimit-Limit", strconv.Itoa(rl.limit))
+		hdr.Set("X-RateLimit-Remaining", strconv.Itoa(max(rl.limit-u.requests, 0)))
+		hdr.Set("X-RateLimit-Reset", strconv.FormatInt(u.windowStart.Add(rateWindow).Unix(), 10))
+	}
+	if rl.quota > 0 {
+		hdr.Set("X-Quota-Limit", strconv.Itoa(rl.quota))
+		hdr.Set("X-Quota-Remaining", strconv.Itoa(max(rl.quota-u.submissions, 0)))
+		hdr.Set("X-Quota-Reset", strconv.FormatInt(u.quotaStart.Add(quotaWindow).Unix(), 10))
+	}
+}
+
+func retryAfter(reset time.Time) string {
+	return strconv.Itoa(int(time.Until(reset).Seconds()) + 1)
+}
+
+// sweep drops clients whose windows have both expired so the map does not
+// grow without bound on a long-running server.
+func (rl *rateLimiter) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		rl.mu.Lock()
+		for k, u := range rl.clients {
+			if now.Sub(u.windowStart) >= rateWindow && now.Sub(u.quotaStart) >= quotaWindow {
+				delete(rl.clients, k)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// accountKey charges a request to the account of its API key or session,
+// which has the same budget from every address it calls from, and
+// anonymous requests and those with a key that is not valid to their
+// client address.
+func accountKey(r *http.Request) string {
+	if account, _, perr := plans.identify(r); perr == nil {
+		return account
+	}
+	return "ip:" + clientKey(r)
+}
+
+// clientKey identifies the caller by its address. For a request from one
+// of -trusted-proxies that is the address the proxies name in
+// X-Forwarded-For: the last entry not itself a trusted proxy, as those in
+// front of it are whatever the client sent.
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		host = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventJobRescan is sent to webhooks when a finished job has pages worth
+// scanning again.
+const EventJobRescan = "job.rescan"
+
+// rescanConfidence is the mean word confidence (0-100) below which a
+// page is listed for re-scanning; 0 lists pages for their scan quality and
+// failures only.
+var rescanConfidence float64
+
+// RescanPage is a page of a finished job that should be scanned again,
+// with why: its scan rated poorly before recognition, its words came back
+// with a low confidence, or it could not be processed at all.
+type RescanPage struct {
+	Page    int      `json:"page"`
+	Reasons []string `json:"reasons"`
+}
+
+// RescanReport is the re-scan list of a job, as downloaded and as posted
+// to webhooks for the scanning operator.
+type RescanReport struct {
+	Event    string            `json:"event,omitempty"`
+	JobID    string            `json:"job_id"`
+	Filename string            `json:"filename"`
+	Pages    []RescanPage      `json:"pages"`
+	JobURL   string            `json:"job_url"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Time     time.Time         `json:"time"`
+}
+
+// rescanPages lists the pages of result to scan again, in page order.
+func rescanPages(result *OCRResult) []RescanPage {
+	reasons := map[int][]string{}
+	for _, f := range result.FailedPages {
+		reasons[f.Page] = append(reasons[f.Page], "could not be processed: "+f.Error)
+	}
+	for _, q := range result.Quality {
+		reasons[q.Page] = append(reasons[q.Page], q.Reasons()...)
+	}
+	for _, c := range result.PageConfidence {
+		if c.Confidence < rescanConfidence {
+			reasons[c.Page] = append(reasons[c.Page], fmt.Sprintf("low recognition confidence (%g%%)", c.Confidence))
+		}
+	}
+	var pages []RescanPage
+	for n, why := range reasons {
+		if len(why) > 0 {
+			pages = append(pages, RescanPage{Page: n, Reasons: why})
+		}
+	}
+	sort.Slice(pages, func(a, b int) bool { return pages[a].Page < pages[b].Page })
+	return pages
+}
+
+func rescanReport(event string, j Job) RescanReport {
+	return RescanReport{
+		Event:    event,
+		JobID:    j.ID,
+		Filename: j.Filename,
+		Pages:    nonNil(j.Rescan),
+		JobURL:   absoluteURL(appPath("/api/v1/jobs/" + j.ID)),
+		Tags:     j.Tags,
+		Time:     time.Now().UTC(),
+	}
+}
+
+// sendRescanReport posts the re-scan list of a finished job to every
+// webhook that takes EventJobRescan.
+func sendRescanReport(j Job) {
+	broadcastWebhooks(EventJobRescan, rescanReport(EventJobRescan, j), "re-scan report for job "+j.ID)
+}
+
+// v1RescanHandler handles GET /jobs/{id}/rescan: the pages of the job to
+// scan again, as JSON or, with format=csv, one row per page for the
+// scanning station.
+func v1RescanHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+r.PathValue("id"))
+		return
+	}
+	if job.Status == JobQueued || job.Status == JobProcessing {
+		w.Header().Set("Retry-After", "5")
+		writeAPIError(w, http.StatusTooEarly, "job_not_finished", "the re-scan list is made when the job finishes")
+		return
+	}
+	report := rescanReport("", job)
+	if !wantsCSV(r) {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	rows := make([][]string, len(report.Pages))
+	for i, p := range report.Pages {
+		rows[i] = []string{job.Filename, strconv.Itoa(p.Page), strings.Join(p.Reasons, "; ")}
+	}
+	writeCSV(w, "rescan-"+job.ID+".csv", []string{"file", "page", "reasons"}, rows)
+}
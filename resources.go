@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renderDPI is the resolution ocr_python.py rasterizes pages at.
+const renderDPI = 300
+
+// autoDPIMax is the highest resolution dpi=auto renders a page at (see
+// dpiModes). It must match AUTO_DPI_MAX in ocr_python.py.
+const autoDPIMax = 600
+
+// pageRasterBytes is the decoded size of one A4 page at renderDPI in RGB.
+// ocr_python.py rasterizes one page at a time and hands it to Tesseract
+// over a pipe, or as a PNG in the temp directory (see pageImages), while
+// the page checkpoints under pages/ grow with the document.
+const pageRasterBytes = int64(8.27*renderDPI) * int64(11.69*renderDPI) * 3
+
+var (
+	diskReserve int64 // free space kept back for everything else on the volume
+	workerCount = 1   // concurrent jobs sharing the available memory
+)
+
+// resourceError is returned when the server cannot take on a document right
+// now. Storage distinguishes a full disk from memory pressure so the API can
+// answer 507 or 503.
+type resourceError struct {
+	Storage bool
+	msg     string
+}
+
+func (e *resourceError) Error() string { return e.msg }
+
+// resourceEstimate is what processing a document is expected to need.
+type resourceEstimate struct {
+	Pages  int
+	Temp   int64 // the current page's PNG in the job's temp directory
+	Output int64 // page checkpoints plus the result files
+	Memory int64 // the decoded page, plus Tesseract's own copy and, piped, the image in transit
+}
+
+// estimateResources sizes the job for the PDF at path, with pages rendered
+// at up to dpi.
+func estimateResources(path string, dpi int) (resourceEstimate, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return resourceEstimate{}, fmt.Errorf("Error reading file: %w", err)
+	}
+	pages := pdfPageCount(path)
+	raster := pageRasterBytes * int64(dpi*dpi) / (renderDPI * renderDPI)
+	est := resourceEstimate{
+		Pages: pages,
+		// PNGs of scans rarely compress below half the raw size. The page
+		// PDFs and the merged searchable PDF each embed the pages again.
+		Temp:   raster / 2,
+		Output: 3 * fi.Size(),
+		Memory: 2 * raster,
+	}
+	if pageImages == "pipe" {
+		// The uncompressed PNM is held while it is written and read.
+		est.Temp, est.Memory = 0, 3*raster
+	}
+	return est, nil
+}
+
+// checkResources rejects a document up front when the disks holding the
+// temp files and results, or the memory one worker can count on, are too
+// small for it. Limits that cannot be measured on this platform are not
+// enforced. The estimate is returned either way so callers can reuse the
+// page count.
+func checkResources(path string) (resourceEstimate, error) {
+	return checkResourcesAt(path, renderDPI)
+}
+
+// checkResourcesAt is checkResources for pages rendered at up to dpi.
+func checkResourcesAt(path string, dpi int) (resourceEstimate, error) {
+	est, err := estimateResources(path, dpi)
+	if err != nil {
+		return est, err
+	}
+	for _, d := range []struct {
+		dir  string
+		need int64
+	}{{jobTempRoot, est.Temp}, {"user_file_searchable", est.Output}} {
+		free, ok := diskFree(d.dir)
+		if avail := free - diskReserve; ok && d.need > avail {
+			return est, &resourceError{Storage: true, msg: fmt.Sprintf(
+				"Not enough disk space to process this %d-page document: about %s is needed but only %s is free",
+				est.Pages, formatBytes(d.need), formatBytes(max(avail, 0)))}
+		}
+	}
+	if avail, ok := memAvailable(); ok {
+		if perWorker := avail / int64(max(workerCount, 1)); est.Memory > perWorker {
+			return est, &resourceError{msg: fmt.Sprintf(
+				"Not enough memory to process this document right now: about %s is needed per page but only %s is available per worker",
+				formatBytes(est.Memory), formatBytes(perWorker))}
+		}
+	}
+	return est, nil
+}
+
+var (
+	pdfPageObject = regexp.MustCompile(`/Type\s*/Page[^s]`)
+	pdfPagesCount = regexp.MustCompile(`/Type\s*/Pages\b[^>]*?/Count\s+(\d+)|/Count\s+(\d+)[^>]*?/Type\s*/Pages\b`)
+)
+
+// pdfPageCount returns the number of pages in the PDF, never less than 1.
+func pdfPageCount(path string) int {
+	return max(countPDFPages(path), 1)
+}
+
+// countPDFPages returns the number of pages in the PDF. It asks pdfinfo
+// (part of Poppler, which the OCR script already needs) and falls back to
+// scanning the file for page objects. It returns -1 if the file cannot be
+// read or no page tree is found in it.
+func countPDFPages(path string) int {
+	if out, err := exec.Command("pdfinfo", path).Output(); err == nil {
+		sc := bufio.NewScanner(bytes.NewReader(out))
+		for sc.Scan() {
+			if v, ok := strings.CutPrefix(sc.Text(), "Pages:"); ok {
+				if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+					return n
+				}
+			}
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	n := len(pdfPageObject.FindAllIndex(data, -1))
+	// Page objects can hide in compressed object streams; the page tree
+	// root's /Count is usually still readable.
+	trees := pdfPagesCount.FindAllSubmatch(data, -1)
+	if n == 0 && len(trees) == 0 {
+		return -1
+	}
+	for _, m := range trees {
+		for _, g := range m[1:] {
+			if c, err := strconv.Atoi(string(g)); err == nil && c > n {
+				n = c
+			}
+		}
+	}
+	return n
+}
+
+// memAvailable reports MemAvailable from /proc/meminfo. It returns false
+// where that file does not exist.
+func memAvailable() (int64, bool) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "MemAvailable:"); ok {
+			kb, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "kB")), 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return kb << 10, true
+		}
+	}
+	return 0, false
+}
+
+func formatBytes(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
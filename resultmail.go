@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A job can be submitted with a "notify_email" address that is mailed the
+// result links once the job finishes, for people who upload a stack of
+// scans and walk away. The links are signed and expire after
+// notifyLinkTTL, so they open without signing in or an API key. A batch
+// is reported in one message, once its last job has finished.
+
+var (
+	notifyLinkTTL = 72 * time.Hour
+	// linkKey signs the download links of result emails. It is kept in the
+	// data directory like sessionKey, so links survive restarts.
+	linkKey []byte
+)
+
+// mailedBatches are the batches whose result email is out, so two jobs
+// finishing at once do not both send it.
+var mailedBatches sync.Map
+
+// parseNotifyEmail checks a "notify_email" field. Empty is no email.
+func parseNotifyEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	if smtpConfig.Addr == "" {
+		return "", errors.New("this server sends no email; -smtp-addr is not set")
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil {
+		return "", fmt.Errorf("notify_email is not an email address: %w", err)
+	}
+	return addr.Address, nil
+}
+
+// linkSignature is the signature of the download links of job id that
+// expire at expires, in Unix seconds.
+func linkSignature(id string, expires int64) string {
+	mac := hmac.New(sha256.New, linkKey)
+	mac.Write([]byte(id + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedLink appends an expiring signature for job j to the download path
+// p and makes it absolute. Links expire after notifyLinkTTL, or when the
+// job is due to be deleted if that is sooner.
+func signedLink(j Job, p string) (string, time.Time) {
+	exp := time.Now().Add(notifyLinkTTL)
+	if del, ok := j.expiresAt(); ok && del.Before(exp) {
+		exp = del
+	}
+	sep := "?"
+	if strings.Contains(p, "?") {
+		sep = "&"
+	}
+	return absoluteURL(p + sep + "expires=" + strconv.FormatInt(exp.Unix(), 10) + "&sig=" + linkSignature(j.ID, exp.Unix())), exp
+}
+
+// validLink reports whether r carries an unexpired signature for the
+// downloads of job id, see signedLink.
+func validLink(r *http.Request, id string) bool {
+	q := r.URL.Query()
+	sig := q.Get("sig")
+	if linkKey == nil || sig == "" {
+		return false
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(linkSignature(id, expires)))
+}
+
+// sendResultMail mails the job's notify address the outcome of j, or of
+// its batch once every job of the batch has finished.
+func sendResultMail(j Job) {
+	list := []Job{j}
+	if j.Batch != "" {
+		list = jobs.list(func(b *Job) bool { return b.Batch == j.Batch })
+		for _, b := range list {
+			if !b.finished() {
+				return
+			}
+		}
+		if _, sent := mailedBatches.LoadOrStore(j.Batch, true); sent {
+			return
+		}
+	}
+
+	var body strings.Builder
+	var expires time.Time
+	done := 0
+	for _, b := range list {
+		fmt.Fprintf(&body, "%s: %s\r\n", b.Filename, b.Status)
+		switch b.Status {
+		case JobDone:
+			done++
+			for _, l := range []struct{ label, path string }{{"PDF: ", b.PDFURL}, {"Text:", b.TextURL}, {"ZIP: ", b.BundleURL}} {
+				if l.path != "" {
+					link, exp := signedLink(b, l.path)
+					expires = exp
+					fmt.Fprintf(&body, "  %s %s\r\n", l.label, link)
+				}
+			}
+		case JobFailed:
+			fmt.Fprintf(&body, "  %s\r\n", b.Error)
+			if b.PartialPDFURL != "" {
+				link, exp := signedLink(b, b.PartialPDFURL)
+				expires = exp
+				fmt.Fprintf(&body, "  Pages finished: %s\r\n", link)
+			}
+		}
+		body.WriteString("\r\n")
+	}
+	if !expires.IsZero() {
+		fmt.Fprintf(&body, "The links work until %s. After that, find the results under %s.\r\n",
+			expires.Format("2006-01-02 15:04 MST"), absoluteURL(appPath("/history")))
+	}
+
+	subject := fmt.Sprintf("OCR finished: %s", j.Filename)
+	if j.Batch != "" {
+		subject = fmt.Sprintf("OCR finished: %d of %d documents done", done, len(list))
+	} else if j.Status != JobDone {
+		subject = fmt.Sprintf("OCR failed: %s", j.Filename)
+	}
+	if err := sendMail(j.notifyEmail, subject, body.String()); err != nil {
+		log.Printf("job %s: result email to %s failed: %v", j.ID, j.notifyEmail, err)
+	}
+}
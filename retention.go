@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EventJobsExpiring is sent to webhooks, once per account, when finished
+// jobs come within the notice period of being deleted.
+const EventJobsExpiring = "jobs.expiring"
+
+var (
+	resultRetention time.Duration // finished jobs are deleted this long after they finish, 0 keeps them
+	expiryNotice    time.Duration // how long before deletion the owners are told
+	smtpConfig      smtpSettings
+)
+
+// smtpSettings is the mail server expiry notices are sent through.
+type smtpSettings struct {
+	Addr     string // host:port, empty disables email
+	From     string
+	Username string
+	Password string
+}
+
+// expiryNotification lists an account's jobs that are about to be deleted.
+type expiryNotification struct {
+	Event   string        `json:"event"`
+	Account string        `json:"account"`
+	Jobs    []expiringJob `json:"jobs"`
+	Time    time.Time     `json:"time"`
+}
+
+type expiringJob struct {
+	JobID     string    `json:"job_id"`
+	Filename  string    `json:"filename"`
+	ExpiresAt time.Time `json:"expires_at"`
+	JobURL    string    `json:"job_url"`
+	TextURL   string    `json:"text_url,omitempty"`
+	PDFURL    string    `json:"pdf_url,omitempty"`
+}
+
+// expiresAt returns when a finished job is deleted under the retention
+// policy, and false when it is kept.
+func (j *Job) expiresAt() (time.Time, bool) {
+	if resultRetention <= 0 || j.FinishedAt == nil || j.Pinned || j.LegalHold != nil {
+		return time.Time{}, false
+	}
+	return j.FinishedAt.Add(resultRetention), true
+}
+
+// enforceRetention deletes finished jobs whose retention has run out and
+// tells the owners of jobs entering the notice period, every interval until
+// the process exits.
+func (s *JobStore) enforceRetention(interval time.Duration) {
+	if resultRetention <= 0 {
+		return
+	}
+	for {
+		s.expire(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+func (s *JobStore) expire(now time.Time) {
+	var doomed []*Job
+	expiring := map[string][]expiringJob{}
+	s.mu.Lock()
+	for id, j := range s.jobs {
+		exp, ok := j.expiresAt()
+		switch {
+		case !ok:
+		case !now.Before(exp):
+			delete(s.jobs, id)
+			doomed = append(doomed, j)
+		case j.Status == JobDone && !j.expiryNotified && exp.Sub(now) <= expiryNotice:
+			ev := jobEvent("", *j)
+			expiring[j.account] = append(expiring[j.account], expiringJob{
+				JobID: j.ID, Filename: j.Filename, ExpiresAt: exp,
+				JobURL: ev.JobURL, TextURL: ev.TextURL, PDFURL: ev.PDFURL,
+			})
+			j.expiryNotified = true
+			s.saveLocked(j)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, j := range doomed {
+		removeJobFiles(j)
+		log.Printf("deleted job %s after the %s retention period", j.ID, resultRetention)
+	}
+	for account, list := range expiring {
+		sort.Slice(list, func(a, b int) bool { return list[a].ExpiresAt.Before(list[b].ExpiresAt) })
+		go sendExpiryNotification(expiryNotification{Event: EventJobsExpiring, Account: account, Jobs: list, Time: now.UTC()})
+	}
+}
+
+// removeJobFiles deletes the workspace and results of a job already taken
+// out of the store, and forgets what the indexes hold of it.
+func removeJobFiles(j *Job) {
+	os.RemoveAll(filepath.Dir(j.inputPath))
+	os.RemoveAll(j.outputDir)
+	semantic.remove(j.ID)
+	duplicates.remove(j.ID)
+}
+
+// sendExpiryNotification mails the account's contact address, if it has
+// one, and posts the notice to every webhook that takes the event.
+func sendExpiryNotification(n expiryNotification) {
+	if to := plans.email(n.Account); to != "" && smtpConfig.Addr != "" {
+		if err := sendExpiryMail(to, n); err != nil {
+			log.Printf("expiry email to %s failed: %v", to, err)
+		}
+	}
+	broadcastWebhooks(EventJobsExpiring, n, "expiry notice for "+n.Account)
+}
+
+// broadcastWebhooks posts payload as event to every webhook that takes the
+// event, retrying as job events are retried, and logs the deliveries of what
+// that failed.
+func broadcastWebhooks(event string, payload any, what string) {
+	for _, w := range webhookByURL {
+		if len(w.ep.Events) > 0 && !slices.Contains(w.ep.Events, event) {
+			continue
+		}
+		var err error
+		delay := webhookBackoff
+		for attempt := 1; attempt <= w.attempts; attempt++ {
+			if err = w.send(event, payload); err == nil {
+				break
+			}
+			if attempt < w.attempts {
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+		if err != nil {
+			log.Printf("%s to webhook %s failed: %v", what, w.ep.URL, err)
+		}
+	}
+}
+
+// sendExpiryMail sends n as a plain-text email.
+func sendExpiryMail(to string, n expiryNotification) error {
+	var body strings.Builder
+	body.WriteString("The OCR results below will be deleted soon. Download them before then if you still need them.\r\n\r\n")
+	for _, j := range n.Jobs {
+		fmt.Fprintf(&body, "%s (deleted %s)\r\n", j.Filename, j.ExpiresAt.Format("2006-01-02 15:04 MST"))
+		if j.PDFURL != "" {
+			fmt.Fprintf(&body, "  PDF:  %s\r\n", j.PDFURL)
+		}
+		if j.TextURL != "" {
+			fmt.Fprintf(&body, "  Text: %s\r\n", j.TextURL)
+		}
+		fmt.Fprintf(&body, "  Job:  %s\r\n\r\n", j.JobURL)
+	}
+	subject := fmt.Sprintf("OCR results expire soon (%d documents)", len(n.Jobs))
+	return sendMail(to, subject, body.String())
+}
+
+// sendMail sends a plain-text email through smtpConfig. The server upgrades
+// to TLS when the mail server offers STARTTLS.
+func sendMail(to, subject, body string) error {
+	msg := "From: " + smtpConfig.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n\r\n" + body
+
+	var auth smtp.Auth
+	if smtpConfig.Username != "" {
+		host, _, _ := net.SplitHostPort(smtpConfig.Addr)
+		auth = smtp.PlainAuth("", smtpConfig.Username, smtpConfig.Password, host)
+	}
+	return smtp.SendMail(smtpConfig.Addr, auth, smtpConfig.From, []string{to}, []byte(msg))
+}
+
+// setPinned pins or unpins job id. Unpinning starts the job's retention
+// again from when it finished, so its owner is notified anew before it is
+// deleted; if that time has already passed it goes at the next check.
+func (s *JobStore) setPinned(id string, pinned bool) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if j.Pinned != pinned {
+		j.Pinned = pinned
+		j.expiryNotified = false
+		s.saveLocked(j)
+	}
+	return *j, nil
+}
+
+// v1PinJobHandler handles PUT and DELETE /jobs/{id}/pin.
+func v1PinJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := jobs.setPinned(r.PathValue("id"), r.Method == http.MethodPut)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "no job with id "+r.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// pinnedUsage is the storage pinned jobs of one account take up.
+type pinnedUsage struct {
+	Account string `json:"account"`
+	Jobs    int    `json:"jobs"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// v1AdminPinnedHandler reports how much storage pinned jobs hold, in total
+// and per account, largest first.
+func v1AdminPinnedHandler(w http.ResponseWriter, r *http.Request) {
+	byAccount := map[string]*pinnedUsage{}
+	var total pinnedUsage
+	for _, j := range jobs.list(func(j *Job) bool { return j.Pinned }) {
+		u := byAccount[j.account]
+		if u == nil {
+			u = &pinnedUsage{Account: j.account}
+			byAccount[j.account] = u
+		}
+		size := jobStorage(j)
+		u.Jobs++
+		u.Bytes += size
+		total.Jobs++
+		total.Bytes += size
+	}
+	accounts := make([]pinnedUsage, 0, len(byAccount))
+	for _, u := range byAccount {
+		accounts = append(accounts, *u)
+	}
+	sort.Slice(accounts, func(a, b int) bool {
+		if accounts[a].Bytes != accounts[b].Bytes {
+			return accounts[a].Bytes > accounts[b].Bytes
+		}
+		return accounts[a].Account < accounts[b].Account
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": total.Jobs, "bytes": total.Bytes, "accounts": accounts})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Roles an account can be given in its user record. Each role may do what
+// the ones before it may.
+const (
+	roleUser     = "user"     // its own jobs
+	roleReviewer = "reviewer" // reads every account's jobs and results
+	roleOperator = "operator" // changes every account's jobs; usage, pinned jobs, webhook dead letters and schedule runs
+	roleAdmin    = "admin"    // every admin endpoint, including API keys and users
+)
+
+var roles = []string{roleUser, roleReviewer, roleOperator, roleAdmin}
+
+// roleAtLeast reports whether role may do what min may.
+func roleAtLeast(role, min string) bool {
+	return slices.Index(roles, effectiveRole(role)) >= slices.Index(roles, min)
+}
+
+// effectiveRole is role, or user for an account without one.
+func effectiveRole(role string) string {
+	if role == "" {
+		return roleUser
+	}
+	return role
+}
+
+func checkRole(role string) error {
+	if role != "" && !slices.Contains(roles, role) {
+		return fmt.Errorf("unknown role %q: use %s", role, strings.Join(roles, ", "))
+	}
+	return nil
+}
+
+// accountRole is the role of account, which r was identified as: the role
+// of its user record, or admin for an API key with the admin scope. A web
+// UI session also has the role its directory groups give it, whichever is
+// higher.
+func accountRole(r *http.Request, account string) string {
+	key := requestAPIKey(r)
+	if _, scopes, ok := keyAccount(key); ok && slices.Contains(scopes, scopeAdmin) {
+		return roleAdmin
+	}
+	role := roleUser
+	if u, ok := users.get(account); ok {
+		role = effectiveRole(u.Role)
+	}
+	if s, ok := currentSession(r); ok && key == "" && roleAtLeast(s.Role, role) {
+		role = effectiveRole(s.Role)
+	}
+	return role
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Routing rules let the server anchor small document workflows: after each
+// job, every rule whose condition matches it runs its actions, such as
+// "invoices tagged finance go to the finance share as a spreadsheet, and
+// the finance channel hears about it". Rules and the channels they notify
+// are kept in -routing-file:
+//
+//	{
+//	  "channels": [{"name": "finance", "url": "https://hooks.slack.com/services/..."}],
+//	  "rules": [{"name": "invoices", "if": "class=invoice&tag=finance",
+//	             "export": {"destination": "finance-share", "path": "invoices", "formats": ["xlsx", "pdf"]},
+//	             "notify": ["finance"]}]
+//	}
+
+// RoutingRule is one rule of the routing file. If is a job filter in the
+// query syntax of the job list, see parseJobFilter; without a status= it
+// matches done jobs only.
+type RoutingRule struct {
+	Name   string      `json:"name"`
+	If     string      `json:"if"`
+	Export *RuleExport `json:"export,omitempty"`
+	Notify []string    `json:"notify,omitempty"` // channel names
+	Stop   bool        `json:"stop,omitempty"`   // later rules are not tried on a job this one matched
+
+	filter jobFilter
+}
+
+// RuleExport pushes a job's results to a destination, whatever the job's
+// own destination is. Destination accounts do not apply: the rules are the
+// administrator's.
+type RuleExport struct {
+	Destination string   `json:"destination"`
+	Path        string   `json:"path,omitempty"`     // folder below the destination
+	Template    string   `json:"template,omitempty"` // file layout, default the destination's, see renderDeliveryPath
+	Formats     []string `json:"formats,omitempty"`  // result extensions such as pdf and txt, or xlsx for a workbook; empty for every result
+}
+
+// Channel is where a rule's notifications go: a Slack or Mattermost
+// incoming webhook, or an email address.
+type Channel struct {
+	Name   string `json:"name"`
+	URL    string `json:"url,omitempty"`
+	Format string `json:"format,omitempty"` // slack (the default) or mattermost
+	Email  string `json:"email,omitempty"`
+}
+
+// RuleRun is what a rule did with a job. The runs of the last time a job
+// finished are kept on the job.
+type RuleRun struct {
+	Rule        string    `json:"rule"`
+	Status      string    `json:"status"` // ok or failed
+	Destination string    `json:"destination,omitempty"`
+	Export      *Delivery `json:"export,omitempty"`
+	Notified    []string  `json:"notified,omitempty"` // channels told
+	Errors      []string  `json:"errors,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+var (
+	routingRules    []*RoutingRule
+	routingChannels = map[string]*Channel{}
+)
+
+// loadRouting reads the routing rules and channels from path. The
+// destinations must be loaded first.
+func loadRouting(path string) ([]*RoutingRule, map[string]*Channel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var file struct {
+		Channels []*Channel     `json:"channels"`
+		Rules    []*RoutingRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	channels := map[string]*Channel{}
+	for i, c := range file.Channels {
+		if err := c.check(); err != nil {
+			return nil, nil, fmt.Errorf("parsing %s: channel %d: %v", path, i, err)
+		}
+		if channels[c.Name] != nil {
+			return nil, nil, fmt.Errorf("parsing %s: channel %q is listed twice", path, c.Name)
+		}
+		channels[c.Name] = c
+	}
+	seen := map[string]bool{}
+	for i, r := range file.Rules {
+		if err := r.check(channels); err != nil {
+			return nil, nil, fmt.Errorf("parsing %s: rule %d: %v", path, i, err)
+		}
+		if seen[r.Name] {
+			return nil, nil, fmt.Errorf("parsing %s: rule %q is listed twice", path, r.Name)
+		}
+		seen[r.Name] = true
+	}
+	return file.Rules, channels, nil
+}
+
+func (c *Channel) check() error {
+	if !validTagKey(c.Name) {
+		return fmt.Errorf("invalid name %q: use letters, digits, '-', '_' or '.'", c.Name)
+	}
+	switch {
+	case (c.URL == "") == (c.Email == ""):
+		return fmt.Errorf("%q: set either url or email", c.Name)
+	case c.URL != "":
+		if u, err := url.Parse(c.URL); err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("%q: invalid url %q", c.Name, c.URL)
+		}
+		if c.Format == "" {
+			c.Format = "slack"
+		}
+		if c.Format != "slack" && c.Format != "mattermost" {
+			return fmt.Errorf("%q: unknown format %q: use slack or mattermost", c.Name, c.Format)
+		}
+	default:
+		addr, err := mail.ParseAddress(c.Email)
+		if err != nil {
+			return fmt.Errorf("%q: email is not an email address: %w", c.Name, err)
+		}
+		c.Email = addr.Address
+	}
+	return nil
+}
+
+// check validates the rule and parses its condition.
+func (r *RoutingRule) check(channels map[string]*Channel) error {
+	if !validTagKey(r.Name) {
+		return fmt.Errorf("invalid name %q: use letters, digits, '-', '_' or '.'", r.Name)
+	}
+	q, err := url.ParseQuery(r.If)
+	if err != nil {
+		return fmt.Errorf("%q: invalid if %q: %v", r.Name, r.If, err)
+	}
+	if r.filter, err = parseJobFilter(q); err != nil {
+		return fmt.Errorf("%q: invalid if %q: %v", r.Name, r.If, err)
+	}
+	if len(r.filter.Statuses) == 0 {
+		r.filter.Statuses = []JobStatus{JobDone}
+	}
+	for _, st := range r.filter.Statuses {
+		if st != JobDone && st != JobFailed {
+			return fmt.Errorf("%q: rules run when a job is done or failed, not %s", r.Name, st)
+		}
+	}
+	if r.Export == nil && len(r.Notify) == 0 {
+		return fmt.Errorf("%q: the rule has neither export nor notify", r.Name)
+	}
+	if e := r.Export; e != nil {
+		if destinations[e.Destination] == nil {
+			return fmt.Errorf("%q: %w %q", r.Name, errUnknownDestination, e.Destination)
+		}
+		if err := checkDestinationPath(e.Path); err != nil {
+			return fmt.Errorf("%q: %v", r.Name, err)
+		}
+		if e.Template != "" {
+			if err := validateDestinationTemplate(e.Template); err != nil {
+				return fmt.Errorf("%q: %v", r.Name, err)
+			}
+		}
+		for i, f := range e.Formats {
+			f = strings.ToLower(strings.TrimPrefix(f, "."))
+			if !validTagKey(f) {
+				return fmt.Errorf("%q: invalid format %q", r.Name, e.Formats[i])
+			}
+			e.Formats[i] = f
+		}
+	}
+	for _, name := range r.Notify {
+		if channels[name] == nil {
+			return fmt.Errorf("%q: unknown channel %q", r.Name, name)
+		}
+	}
+	return nil
+}
+
+// route runs the rules matching finished job j, in order, and records what
+// they did on the job. It runs on its own goroutine, like deliver.
+func (s *JobStore) route(j Job) {
+	var runs []RuleRun
+	for _, r := range routingRules {
+		if !r.filter.match(&j) {
+			continue
+		}
+		run := r.apply(j)
+		runs = append(runs, run)
+		if run.Status == "ok" {
+			log.Printf("job %s: rule %s ran", j.ID, r.Name)
+			recordEvent(&j, TimelineRouted, 0, "rule %s: %s", r.Name, run.summary())
+		} else {
+			log.Printf("job %s: rule %s failed: %s", j.ID, r.Name, strings.Join(run.Errors, "; "))
+			recordEvent(&j, TimelineRouted, 0, "rule %s failed: %s", r.Name, strings.Join(run.Errors, "; "))
+		}
+		if r.Stop {
+			break
+		}
+	}
+	if len(runs) > 0 {
+		s.update(j.ID, func(job *Job) { job.Routing = runs })
+	}
+}
+
+// apply runs the rule's actions on job j: the export first, so the
+// notifications can say where the results went.
+func (r *RoutingRule) apply(j Job) RuleRun {
+	run := RuleRun{Rule: r.Name, Status: "ok"}
+	if e := r.Export; e != nil {
+		run.Destination = e.Destination
+		dir, n, err := e.run(j)
+		if err != nil {
+			run.Export = &Delivery{Status: "failed", Error: err.Error()}
+			run.Errors = append(run.Errors, fmt.Sprintf("exporting to %s: %v", e.Destination, err))
+		} else {
+			now := time.Now().UTC()
+			run.Export = &Delivery{Status: "delivered", Files: n, Path: dir, DeliveredAt: &now}
+		}
+	}
+	for _, name := range r.Notify {
+		if err := routingChannels[name].send(r, j, run); err != nil {
+			run.Errors = append(run.Errors, fmt.Sprintf("notifying %s: %v", name, err))
+		} else {
+			run.Notified = append(run.Notified, name)
+		}
+	}
+	if len(run.Errors) > 0 {
+		run.Status = "failed"
+	}
+	run.Time = time.Now().UTC()
+	return run
+}
+
+func (run RuleRun) summary() string {
+	var parts []string
+	if run.Export != nil {
+		parts = append(parts, fmt.Sprintf("exported %d files to %s", run.Export.Files, destinationFolder(run.Destination, run.Export.Path)))
+	}
+	if len(run.Notified) > 0 {
+		parts = append(parts, "notified "+strings.Join(run.Notified, ", "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// destinationFolder names a folder below a destination.
+func destinationFolder(destination, dir string) string {
+	if dir == "" {
+		return destination
+	}
+	return destination + ":" + dir
+}
+
+// run uploads the job's results in the export's formats and returns the
+// folder they went to and how many files were uploaded.
+func (e *RuleExport) run(j Job) (string, int, error) {
+	d := destinations[e.Destination]
+	if d == nil {
+		return "", 0, fmt.Errorf("destination %q is no longer configured", e.Destination)
+	}
+	files, err := resultFiles(j.outputDir)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(e.Formats) > 0 {
+		var picked []string
+		for _, f := range e.Formats {
+			if f == "xlsx" {
+				dir, err := newJobTempDir(j.ID)
+				if err != nil {
+					return "", 0, err
+				}
+				defer os.RemoveAll(dir)
+				xlsx := filepath.Join(dir, j.prefix+".xlsx")
+				if err := writeJobWorkbook(j, xlsx); err != nil {
+					return "", 0, fmt.Errorf("writing the workbook: %w", err)
+				}
+				picked = append(picked, xlsx)
+				continue
+			}
+			n := len(picked)
+			for _, file := range files {
+				if strings.EqualFold(filepath.Ext(file), "."+f) && !slices.Contains(picked, file) {
+					picked = append(picked, file)
+				}
+			}
+			if len(picked) == n {
+				return "", 0, fmt.Errorf("the job has no .%s results", f)
+			}
+		}
+		files = picked
+	}
+	j.DestinationPath, j.DestinationTemplate = e.Path, e.Template
+	dir, uploads, err := deliveryLayout(j, d, files)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := d.uploadRetrying(j.ID, dir, uploads); err != nil {
+		return "", 0, err
+	}
+	return dir, len(uploads), nil
+}
+
+// send tells the channel that rule r ran on job j.
+func (c *Channel) send(r *RoutingRule, j Job, run RuleRun) error {
+	ev := jobEvent(EventJobDone, j)
+	if c.Email != "" {
+		if smtpConfig.Addr == "" {
+			return fmt.Errorf("no mail server is configured, see -smtp-addr")
+		}
+		return sendMail(c.Email, fmt.Sprintf("%s: %s", r.Name, j.Filename),
+			ruleMessage(r, j, run, ev, func(u, label string) string { return label + ": " + u }, "\r\n", "\r\n"))
+	}
+	chat := &chatNotifier{webhookURL: c.URL, mattermost: c.Format == "mattermost"}
+	return chat.post(ruleMessage(r, j, run, ev, chat.link, "\n", " · "))
+}
+
+// ruleMessage describes what rule r did with job j, with links written by
+// link and separated by sep, and lines ending in nl.
+func ruleMessage(r *RoutingRule, j Job, run RuleRun, ev JobEvent, link func(u, label string) string, nl, sep string) string {
+	var b strings.Builder
+	what := j.Filename
+	if c := j.className(); c != "" {
+		what += " (" + c + ")"
+	}
+	if j.Status == JobFailed {
+		fmt.Fprintf(&b, "❌ OCR failed: %s — rule %s%s%s%s", what, r.Name, nl, truncate(j.Error, 500), nl)
+	} else {
+		fmt.Fprintf(&b, "📄 %s — rule %s%s", what, r.Name, nl)
+	}
+	if run.Export != nil {
+		if run.Export.Status == "delivered" {
+			fmt.Fprintf(&b, "Exported %d files to %s%s", run.Export.Files, destinationFolder(run.Destination, run.Export.Path), nl)
+		} else {
+			fmt.Fprintf(&b, "⚠️ Export to %s failed: %s%s", run.Destination, truncate(run.Export.Error, 500), nl)
+		}
+	}
+	var links []string
+	if ev.PDFURL != "" {
+		links = append(links, link(ev.PDFURL, "Searchable PDF"))
+	}
+	if ev.TextURL != "" {
+		links = append(links, link(ev.TextURL, "Text"))
+	}
+	links = append(links, link(ev.JobURL, "Job details"))
+	b.WriteString(strings.Join(links, sep) + nl)
+	return b.String()
+}
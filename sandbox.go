@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Sandbox modes for the OCR subprocess. PDFs are attacker-controlled and go
+// straight into native parsers (poppler, leptonica), so by default the
+// engine runs with a read-only view of the filesystem, its job workspace as
+// the only writable directory, and no network.
+const (
+	sandboxAuto    = "auto"    // sandbox where supported, warn otherwise
+	sandboxRequire = "require" // refuse to run OCR without a sandbox
+	sandboxOff     = "off"
+)
+
+type sandboxConfig struct {
+	Mode    string
+	User    string // run the engine as this unprivileged user; needs root
+	Network bool   // keep network access inside the sandbox
+
+	uid, gid int // resolved from User by init
+}
+
+var ocrSandbox sandboxConfig
+
+var sandboxWarning sync.Once
+
+// init validates the configuration and resolves the sandbox user.
+func (c *sandboxConfig) init() error {
+	switch c.Mode {
+	case sandboxAuto, sandboxRequire, sandboxOff:
+	default:
+		return fmt.Errorf("invalid sandbox mode %q: use auto, require or off", c.Mode)
+	}
+	if reason := sandboxUnsupported(); reason != "" && c.Mode == sandboxRequire {
+		return fmt.Errorf("OCR sandbox is required but %s", reason)
+	}
+	if c.User == "" {
+		return nil
+	}
+	return c.resolveUser()
+}
+
+// unavailable handles a platform or host without sandbox support: an error
+// in require mode, a one-time warning in auto mode.
+func (c *sandboxConfig) unavailable(reason string) error {
+	if c.Mode == sandboxRequire {
+		return fmt.Errorf("OCR sandbox is required but %s", reason)
+	}
+	sandboxWarning.Do(func() {
+		log.Printf("running OCR without a sandbox: %s", reason)
+	})
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+func (c *sandboxConfig) resolveUser() error {
+	u, err := user.Lookup(c.User)
+	if err != nil {
+		return fmt.Errorf("sandbox user: %w", err)
+	}
+	c.uid, _ = strconv.Atoi(u.Uid)
+	c.gid, _ = strconv.Atoi(u.Gid)
+	if c.uid == 0 {
+		return fmt.Errorf("sandbox user %s is root", c.User)
+	}
+	return nil
+}
+
+// sandboxUnsupported explains why the engine cannot be sandboxed here, or
+// returns "" when it can.
+func sandboxUnsupported() string {
+	if _, err := exec.LookPath("bwrap"); err != nil {
+		return "bubblewrap (bwrap) was not found"
+	}
+	return ""
+}
+
+// ocrCommand builds the OCR subprocess for one job. On Linux the engine is
+// wrapped in bubblewrap: the root filesystem is bound read-only, /tmp is a
+// private tmpfs, outputDir, workDir and the page cache are the only writable
+// paths and all namespaces, including the network, are unshared. With a
+// sandbox user the process also drops to that uid, and the job's files are
+// handed over to it.
+func ocrCommand(ctx context.Context, args []string, inputPath, outputDir, workDir string) (*exec.Cmd, error) {
+	if ocrSandbox.User != "" {
+		if err := shareWorkspace(inputPath, outputDir, workDir); err != nil {
+			return nil, err
+		}
+	}
+	return engineCommand(ctx, "python", args, []string{filepath.Dir(inputPath)}, []string{outputDir, workDir})
+}
+
+// toolCommand builds one tool of the native pipeline for a job, sandboxed
+// like ocrCommand.
+func toolCommand(ctx context.Context, name string, args []string, inputPath, outputDir, workDir string) (*exec.Cmd, error) {
+	return engineCommand(ctx, name, args, []string{filepath.Dir(inputPath)}, []string{outputDir, workDir})
+}
+
+// ocrWorkerCommand builds a warm engine worker, sandboxed like ocrCommand.
+// It serves many jobs, so instead of one job's directories it can write to
+// all result directories and the scratch root; each job's files are still
+// handed to the sandbox user by shareWorkerRun.
+func ocrWorkerCommand(ctx context.Context) (*exec.Cmd, error) {
+	results, err := filepath.Abs("user_file_searchable")
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{results, jobTempRoot} {
+		if err := os.MkdirAll(dir, 0711); err != nil {
+			return nil, fmt.Errorf("Error preparing OCR worker: %w", err)
+		}
+	}
+	return engineCommand(ctx, "python", []string{"ocr_python.py", "--serve"}, nil, []string{results, jobTempRoot})
+}
+
+// shareWorkerRun hands one job's files to the sandbox user before a warm
+// worker or the native pipeline runs it.
+func shareWorkerRun(inputPath, outputDir, workDir string) error {
+	if ocrSandbox.User == "" {
+		return nil
+	}
+	return shareWorkspace(inputPath, outputDir, workDir)
+}
+
+// engineCommand runs program, the Python interpreter or a tool of the
+// native pipeline, with args inside the sandbox, if there is one, with the
+// readable and writable directories bound in besides the server directory
+// and the page cache.
+func engineCommand(ctx context.Context, program string, args, readable, writable []string) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, program, args...)
+	if ocrSandbox.Mode != sandboxOff {
+		if reason := sandboxUnsupported(); reason != "" {
+			if err := ocrSandbox.unavailable(reason); err != nil {
+				return nil, err
+			}
+		} else {
+			bwrap, _ := exec.LookPath("bwrap")
+			cwd, err := os.Getwd()
+			if err != nil {
+				return nil, err
+			}
+			wrapped := []string{
+				"--ro-bind", "/", "/",
+				"--dev", "/dev",
+				"--proc", "/proc",
+				"--tmpfs", "/tmp",
+				// Re-expose the server directory and upload in case
+				// they live under /tmp.
+				"--ro-bind", cwd, cwd,
+			}
+			for _, dir := range readable {
+				wrapped = append(wrapped, "--ro-bind", dir, dir)
+			}
+			for _, dir := range writable {
+				wrapped = append(wrapped, "--bind", dir, dir)
+			}
+			if pageCacheDir != "" {
+				wrapped = append(wrapped, "--bind", pageCacheDir, pageCacheDir)
+			}
+			wrapped = append(wrapped, "--unshare-all")
+			if ocrSandbox.Network {
+				wrapped = append(wrapped, "--share-net")
+			}
+			wrapped = append(wrapped, "--die-with-parent", "--new-session", "--chdir", cwd, "--", program)
+			cmd = exec.CommandContext(ctx, bwrap, append(wrapped, args...)...)
+		}
+	}
+	if ocrSandbox.User != "" {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(ocrSandbox.uid), Gid: uint32(ocrSandbox.gid)},
+		}
+	}
+	return cmd, nil
+}
+
+// shareWorkspace lets the sandbox user read the upload and write results.
+func shareWorkspace(inputPath, outputDir, workDir string) error {
+	if err := os.Chown(inputPath, -1, ocrSandbox.gid); err != nil {
+		return fmt.Errorf("Error preparing sandbox: %w", err)
+	}
+	if err := os.Chmod(inputPath, 0640); err != nil {
+		return fmt.Errorf("Error preparing sandbox: %w", err)
+	}
+	if err := os.Chown(workDir, ocrSandbox.uid, ocrSandbox.gid); err != nil {
+		return fmt.Errorf("Error preparing sandbox: %w", err)
+	}
+	return filepath.WalkDir(outputDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, ocrSandbox.uid, ocrSandbox.gid)
+	})
+}
@@ -0,0 +1,55 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"runtime"
+)
+
+func (c *sandboxConfig) resolveUser() error {
+	return errors.New("a sandbox user is only supported on Linux")
+}
+
+func sandboxUnsupported() string {
+	return "sandboxing is not supported on " + runtime.GOOS
+}
+
+// ocrCommand builds the OCR subprocess for one job. Sandboxing is only
+// implemented on Linux; elsewhere the engine runs with the server's own
+// privileges, limited by procLimits.
+func ocrCommand(ctx context.Context, args []string, inputPath, outputDir, workDir string) (*exec.Cmd, error) {
+	if ocrSandbox.Mode != sandboxOff {
+		if err := ocrSandbox.unavailable(sandboxUnsupported()); err != nil {
+			return nil, err
+		}
+	}
+	return exec.CommandContext(ctx, "python", args...), nil
+}
+
+// toolCommand builds one tool of the native pipeline, unsandboxed like
+// ocrCommand.
+func toolCommand(ctx context.Context, name string, args []string, inputPath, outputDir, workDir string) (*exec.Cmd, error) {
+	if ocrSandbox.Mode != sandboxOff {
+		if err := ocrSandbox.unavailable(sandboxUnsupported()); err != nil {
+			return nil, err
+		}
+	}
+	return exec.CommandContext(ctx, name, args...), nil
+}
+
+// ocrWorkerCommand builds a warm engine worker, unsandboxed like
+// ocrCommand.
+func ocrWorkerCommand(ctx context.Context) (*exec.Cmd, error) {
+	if ocrSandbox.Mode != sandboxOff {
+		if err := ocrSandbox.unavailable(sandboxUnsupported()); err != nil {
+			return nil, err
+		}
+	}
+	return exec.CommandContext(ctx, "python", "ocr_python.py", "--serve"), nil
+}
+
+// shareWorkerRun has nothing to do without a sandbox user.
+func shareWorkerRun(inputPath, outputDir, workDir string) error { return nil }
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule is a recurring task run by the internal scheduler: every Every,
+// or every day at At, the PDFs in Source that are new or have changed since
+// they were last queued are OCRed, and the results exported to Destination
+// when one is set. Schedules come from the -schedules-file or are created
+// over the admin API.
+type Schedule struct {
+	Name     string `json:"name"`
+	Source   string `json:"source"`             // a local directory, or a webdav:// or webdavs:// folder URL
+	Username string `json:"username,omitempty"` // WebDAV sources
+	Password string `json:"password,omitempty"`
+
+	Every string `json:"every,omitempty"` // a duration such as "6h"
+	At    string `json:"at,omitempty"`    // a daily time such as "02:00", in the server's time zone
+
+	Destination         string            `json:"destination,omitempty"` // checked by checkDestination
+	DestinationPath     string            `json:"destination_path,omitempty"`
+	DestinationTemplate string            `json:"destination_template,omitempty"`
+	Languages           string            `json:"languages,omitempty"` // empty for defaultLanguages
+	Tags                map[string]string `json:"tags,omitempty"`
+	AlertEmail          string            `json:"alert_email,omitempty"` // mailed when a run fails
+	Disabled            bool              `json:"disabled,omitempty"`
+
+	every  time.Duration
+	at     time.Duration // after midnight, when At is set
+	folder *url.URL      // WebDAV sources, as an http or https URL
+}
+
+// ScheduleRun is one run of a schedule. A run stays "running" until every
+// job it queued has finished and been delivered, and is "failed" when the
+// source could not be read, a file was rejected, or a job or its delivery
+// failed.
+type ScheduleRun struct {
+	ID         string     `json:"id"`
+	Trigger    string     `json:"trigger"` // "schedule" or "manual"
+	Status     string     `json:"status"`  // running, ok or failed
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Jobs       []string   `json:"jobs"`
+	Done       int        `json:"done"`
+	Errors     []string   `json:"errors,omitempty"`
+}
+
+// EventScheduleFailed is posted to webhooks when a scheduled run fails.
+const EventScheduleFailed = "schedule.failed"
+
+type scheduleAlert struct {
+	Event    string      `json:"event"`
+	Schedule string      `json:"schedule"`
+	Run      ScheduleRun `json:"run"`
+	Time     time.Time   `json:"time"`
+}
+
+const (
+	// scheduleAccount is the account scheduled documents are metered
+	// against, and the one destinations must allow.
+	scheduleAccount = "scheduler"
+	// scheduleTick is how often the scheduler looks for due schedules.
+	scheduleTick = 30 * time.Second
+	// scheduleSettle is how long a local file must be left unchanged
+	// before it is queued, so a scan still being written is not picked up.
+	scheduleSettle = time.Minute
+	// scheduleHistory is the number of runs kept per schedule.
+	scheduleHistory = 50
+	// minScheduleInterval is the shortest "every" accepted.
+	minScheduleInterval = time.Minute
+	// deliveryPoll is how often a run checks on a finished job's delivery.
+	deliveryPoll = 10 * time.Second
+)
+
+var (
+	errScheduleExists   = errors.New("a schedule with that name already exists")
+	errScheduleNotFound = errors.New("no such schedule")
+	errScheduleFile     = errors.New("the schedule is defined in the schedules file")
+	errScheduleRunning  = errors.New("the schedule is already running")
+)
+
+// loadSchedules reads a JSON array of schedules from path.
+func loadSchedules(path string) ([]*Schedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*Schedule
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	for i, sc := range list {
+		if err := sc.check(); err != nil {
+			return nil, fmt.Errorf("parsing %s: schedule %d: %v", path, i, err)
+		}
+		if seen[sc.Name] {
+			return nil, fmt.Errorf("parsing %s: schedule %q is listed twice", path, sc.Name)
+		}
+		seen[sc.Name] = true
+	}
+	return list, nil
+}
+
+// check validates the schedule and fills in its parsed fields.
+func (sc *Schedule) check() error {
+	if !validTagKey(sc.Name) {
+		return fmt.Errorf("invalid name %q: use letters, digits, '-', '_' or '.'", sc.Name)
+	}
+	switch {
+	case strings.HasPrefix(sc.Source, "webdav://"), strings.HasPrefix(sc.Source, "webdavs://"):
+		u, err := url.Parse(strings.TrimSuffix(sc.Source, "/") + "/")
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%q: invalid source %q", sc.Name, sc.Source)
+		}
+		u.Scheme = strings.Replace(u.Scheme, "webdav", "http", 1)
+		sc.folder = u
+	case filepath.IsAbs(sc.Source):
+		sc.Source = filepath.Clean(sc.Source)
+	default:
+		return fmt.Errorf("%q: the source must be an absolute directory or a webdav:// or webdavs:// URL, got %q", sc.Name, sc.Source)
+	}
+	switch {
+	case (sc.Every == "") == (sc.At == ""):
+		return fmt.Errorf("%q: set either every or at", sc.Name)
+	case sc.Every != "":
+		d, err := time.ParseDuration(sc.Every)
+		if err != nil || d < minScheduleInterval {
+			return fmt.Errorf("%q: every must be a duration of at least %s, such as 6h", sc.Name, minScheduleInterval)
+		}
+		sc.every = d
+	default:
+		t, err := time.Parse("15:04", sc.At)
+		if err != nil {
+			return fmt.Errorf("%q: at must be a time of day such as 02:00", sc.Name)
+		}
+		sc.at = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if sc.Destination != "" {
+		if err := checkDestination(sc.Destination, sc.DestinationPath, scheduleAccount); err != nil {
+			return fmt.Errorf("%q: %v", sc.Name, err)
+		}
+	}
+	if sc.DestinationTemplate != "" {
+		if err := validateDestinationTemplate(sc.DestinationTemplate); err != nil {
+			return fmt.Errorf("%q: %v", sc.Name, err)
+		}
+	}
+	if sc.Languages != "" {
+		if err := checkLanguages(sc.Languages); err != nil {
+			return fmt.Errorf("%q: %v", sc.Name, err)
+		}
+	}
+	for k, v := range sc.Tags {
+		if !validTagKey(k) || len(v) > maxTagLength {
+			return fmt.Errorf("%q: invalid tag %q", sc.Name, k)
+		}
+	}
+	if len(sc.Tags) >= maxJobTags {
+		return fmt.Errorf("%q: at most %d tags are allowed", sc.Name, maxJobTags-1)
+	}
+	if sc.AlertEmail != "" {
+		addr, err := mail.ParseAddress(sc.AlertEmail)
+		if err != nil {
+			return fmt.Errorf("%q: alert_email is not an email address: %w", sc.Name, err)
+		}
+		sc.AlertEmail = addr.Address
+	}
+	return nil
+}
+
+// next returns when the schedule is due after its last run started, or
+// after since when it has not run yet.
+func (sc *Schedule) next(last *ScheduleRun, since time.Time) time.Time {
+	if sc.every > 0 {
+		if last == nil {
+			return since
+		}
+		return last.StartedAt.Add(sc.every)
+	}
+	after := since
+	if last != nil {
+		after = last.StartedAt
+	}
+	y, m, d := after.Local().Date()
+	t := time.Date(y, m, d, 0, 0, 0, 0, time.Local).Add(sc.at)
+	if !t.After(after) {
+		t = time.Date(y, m, d+1, 0, 0, 0, 0, time.Local).Add(sc.at)
+	}
+	return t
+}
+
+// redacted is the schedule without its password, for the API.
+func (sc *Schedule) redacted() Schedule {
+	c := *sc
+	if c.Password != "" {
+		c.Password = "********"
+	}
+	return c
+}
+
+// scheduleRecord is what the scheduler keeps about a schedule between
+// restarts.
+type scheduleRecord struct {
+	Schedule *Schedule         `json:"schedule,omitempty"` // set for schedules created over the API
+	Seen     map[string]string `json:"seen"`               // version of every file already queued, by path
+	Runs     []ScheduleRun     `json:"runs"`               // oldest first
+}
+
+// scheduler runs the schedules and keeps their file versions and run
+// history in a JSON file under the data directory.
+type scheduler struct {
+	mu        sync.Mutex
+	path      string
+	started   time.Time
+	schedules map[string]*Schedule
+	fromFile  map[string]bool
+	records   map[string]*scheduleRecord
+	running   map[string]bool
+}
+
+var schedules *scheduler
+
+func openScheduler(path string, fromFile []*Schedule) (*scheduler, error) {
+	s := &scheduler{
+		path:      path,
+		started:   time.Now(),
+		schedules: map[string]*Schedule{},
+		fromFile:  map[string]bool{},
+		records:   map[string]*scheduleRecord{},
+		running:   map[string]bool{},
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.records); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	for _, sc := range fromFile {
+		s.schedules[sc.Name] = sc
+		s.fromFile[sc.Name] = true
+	}
+	for name, rec := range s.records {
+		if rec.Schedule == nil {
+			continue
+		}
+		if s.fromFile[name] {
+			return nil, fmt.Errorf("%s: schedule %q was created over the API and is also in the schedules file", path, name)
+		}
+		if err := rec.Schedule.check(); err != nil {
+			return nil, fmt.Errorf("%s: schedule %v", path, err)
+		}
+		s.schedules[name] = rec.Schedule
+	}
+	return s, nil
+}
+
+// record returns the record of schedule name, creating it. The caller must
+// hold s.mu.
+func (s *scheduler) record(name string) *scheduleRecord {
+	rec := s.records[name]
+	if rec == nil {
+		rec = &scheduleRecord{Seen: map[string]string{}}
+		s.records[name] = rec
+	}
+	return rec
+}
+
+// saveLocked writes the scheduler state. The caller must hold s.mu.
+func (s *scheduler) saveLocked() error {
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		log.Printf("saving scheduler state: %v", err)
+	}
+	return err
+}
+
+// run starts due schedules every scheduleTick until the process exits.
+// Runs still waiting for their jobs when the server stopped are watched
+// again first.
+func (s *scheduler) run() {
+	s.mu.Lock()
+	for name, rec := range s.records {
+		for _, run := range rec.Runs {
+			if run.Status == "running" {
+				s.running[name] = true
+				go s.watch(name, run.ID)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for {
+		now := time.Now()
+		s.mu.Lock()
+		var due []string
+		for name, sc := range s.schedules {
+			rec := s.record(name)
+			var last *ScheduleRun
+			if n := len(rec.Runs); n > 0 {
+				last = &rec.Runs[n-1]
+			}
+			if !sc.Disabled && !s.running[name] && !now.Before(sc.next(last, s.started)) {
+				due = append(due, name)
+			}
+		}
+		s.mu.Unlock()
+		for _, name := range due {
+			if _, err := s.start(name, "schedule"); err != nil {
+				log.Printf("schedule %s: %v", name, err)
+			}
+		}
+		time.Sleep(scheduleTick)
+	}
+}
+
+// start begins a run of schedule name in the background and returns it.
+func (s *scheduler) start(name, trigger string) (ScheduleRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc := s.schedules[name]
+	switch {
+	case sc == nil:
+		return ScheduleRun{}, errScheduleNotFound
+	case s.running[name]:
+		return ScheduleRun{}, errScheduleRunning
+	}
+	run := ScheduleRun{ID: newID(), Trigger: trigger, Status: "running", StartedAt: time.Now().UTC(), Jobs: []string{}}
+	rec := s.record(name)
+	rec.Runs = append(rec.Runs, run)
+	if n := len(rec.Runs) - scheduleHistory; n > 0 {
+		rec.Runs = rec.Runs[n:]
+	}
+	s.running[name] = true
+	s.saveLocked()
+	go s.execute(sc, run.ID)
+	return run, nil
+}
+
+// update applies fn to run id of schedule name and saves the state. It
+// does nothing once the schedule has been removed.
+func (s *scheduler) update(name, id string, fn func(rec *scheduleRecord, run *ScheduleRun)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.records[name]
+	if rec == nil {
+		return
+	}
+	for i := range rec.Runs {
+		if rec.Runs[i].ID == id {
+			fn(rec, &rec.Runs[i])
+			s.saveLocked()
+			return
+		}
+	}
+}
+
+// execute queues the new files of sc's source for run id, then waits for
+// the jobs to finish.
+func (s *scheduler) execute(sc *Schedule, id string) {
+	files, err := sc.list()
+	if err != nil {
+		s.update(sc.Name, id, func(_ *scheduleRecord, run *ScheduleRun) {
+			run.Errors = append(run.Errors, "reading the source: "+err.Error())
+		})
+		s.finish(sc.Name, id)
+		return
+	}
+	names := make([]string, 0, len(files))
+	for p := range files {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	for _, p := range names {
+		s.mu.Lock()
+		seen := s.record(sc.Name).Seen[p] == files[p]
+		s.mu.Unlock()
+		if seen {
+			continue
+		}
+		jobID, err := sc.queue(p)
+		// Rejected documents are not retried until they change.
+		s.update(sc.Name, id, func(rec *scheduleRecord, run *ScheduleRun) {
+			rec.Seen[p] = files[p]
+			if err != nil {
+				run.Errors = append(run.Errors, fmt.Sprintf("%s: %v", p, err))
+				return
+			}
+			run.Jobs = append(run.Jobs, jobID)
+		})
+	}
+	s.watch(sc.Name, id)
+}
+
+// watch waits for the jobs of run id to finish and be delivered, then
+// finishes the run.
+func (s *scheduler) watch(name, id string) {
+	var ids []string
+	s.update(name, id, func(_ *scheduleRecord, run *ScheduleRun) { ids = run.Jobs })
+
+	done, errs := 0, []string{}
+	for _, jobID := range ids {
+		j, ok := jobs.wait(context.Background(), jobID)
+		for ok && j.Delivery != nil && j.Delivery.Status == "pending" {
+			time.Sleep(deliveryPoll)
+			j, ok = jobs.get(jobID)
+		}
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Sprintf("job %s was deleted before it finished", jobID))
+		case j.Status == JobFailed:
+			errs = append(errs, fmt.Sprintf("%s: job %s failed: %s", j.Filename, j.ID, j.Error))
+		case j.Status == JobCanceled:
+			errs = append(errs, fmt.Sprintf("%s: job %s was canceled", j.Filename, j.ID))
+		case j.Delivery != nil && j.Delivery.Status == "failed":
+			errs = append(errs, fmt.Sprintf("%s: exporting job %s to %s failed: %s", j.Filename, j.ID, j.Destination, j.Delivery.Error))
+		default:
+			done++
+		}
+	}
+	s.update(name, id, func(_ *scheduleRecord, run *ScheduleRun) {
+		run.Done = done
+		run.Errors = append(run.Errors, errs...)
+	})
+	s.finish(name, id)
+}
+
+// finish marks run id of schedule name as over and sends the failure
+// alerts if it failed.
+func (s *scheduler) finish(name, id string) {
+	var run ScheduleRun
+	s.update(name, id, func(_ *scheduleRecord, r *ScheduleRun) {
+		now := time.Now().UTC()
+		r.FinishedAt = &now
+		r.Status = "ok"
+		if len(r.Errors) > 0 {
+			r.Status = "failed"
+		}
+		run = *r
+	})
+	s.mu.Lock()
+	delete(s.running, name)
+	sc := s.schedules[name]
+	s.mu.Unlock()
+
+	log.Printf("schedule %s: run %s %s, %d of %d jobs done", name, id, run.Status, run.Done, len(run.Jobs))
+	if run.Status == "failed" {
+		go sendScheduleAlert(sc, name, run)
+	}
+}
+
+// sendScheduleAlert posts the failed run to every webhook that takes the
+// event and mails the schedule's alert address, if it has one.
+func sendScheduleAlert(sc *Schedule, name string, run ScheduleRun) {
+	if sc != nil && sc.AlertEmail != "" && smtpConfig.Addr != "" {
+		var body strings.Builder
+		fmt.Fprintf(&body, "The run of schedule %s started %s failed. %d of %d jobs were done.\r\n\r\n",
+			name, run.StartedAt.Local().Format("2006-01-02 15:04 MST"), run.Done, len(run.Jobs))
+		for _, e := range run.Errors {
+			fmt.Fprintf(&body, "%s\r\n", e)
+		}
+		if err := sendMail(sc.AlertEmail, "Scheduled OCR failed: "+name, body.String()); err != nil {
+			log.Printf("schedule %s: alert email to %s failed: %v", name, sc.AlertEmail, err)
+		}
+	}
+	broadcastWebhooks(EventScheduleFailed, scheduleAlert{Event: EventScheduleFailed, Schedule: name, Run: run, Time: time.Now().UTC()},
+		"failure alert for schedule "+name)
+}
+
+// list returns the PDFs directly in the schedule's source with a version
+// that changes when the file does, keyed by path.
+func (sc *Schedule) list() (map[string]string, error) {
+	if sc.folder != nil {
+		return listDAVFolder(sc.folder, sc.Username, sc.Password)
+	}
+	entries, err := os.ReadDir(sc.Source)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.EqualFold(filepath.Ext(e.Name()), ".pdf") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < scheduleSettle {
+			continue
+		}
+		files[filepath.Join(sc.Source, e.Name())] = fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+	}
+	return files, nil
+}
+
+// queue submits the file at p in the schedule's source as a job.
+func (sc *Schedule) queue(p string) (string, error) {
+	var body io.ReadCloser
+	var err error
+	name := filepath.Base(p)
+	if sc.folder != nil {
+		u := url.URL{Scheme: sc.folder.Scheme, Host: sc.folder.Host, Path: p}
+		body, err = openDAVFile(u.String(), sc.Username, sc.Password)
+		name = path.Base(p)
+	} else {
+		body, err = os.Open(p)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	tags := map[string]string{}
+	for k, v := range sc.Tags {
+		tags[k] = v
+	}
+	tags["schedule"] = sc.Name
+	j, err := queueDocument(body, submission{
+		Client:              scheduleAccount,
+		Filename:            cleanUploadName(name),
+		Tags:                tags,
+		Account:             scheduleAccount,
+		Languages:           sc.Languages,
+		Destination:         sc.Destination,
+		DestinationPath:     sc.DestinationPath,
+		DestinationTemplate: sc.DestinationTemplate,
+	})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("schedule %s: queued %s as job %s", sc.Name, p, j.ID)
+	return j.ID, nil
+}
+
+// add creates a schedule over the API.
+func (s *scheduler) add(sc *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.schedules[sc.Name] != nil {
+		return errScheduleExists
+	}
+	rec := s.record(sc.Name)
+	rec.Schedule = sc
+	if err := s.saveLocked(); err != nil {
+		rec.Schedule = nil
+		return err
+	}
+	s.schedules[sc.Name] = sc
+	return nil
+}
+
+// remove deletes a schedule created over the API with its history. A run
+// in progress carries on, but is not recorded.
+func (s *scheduler) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.schedules[name] == nil:
+		return errScheduleNotFound
+	case s.fromFile[name]:
+		return errScheduleFile
+	}
+	delete(s.schedules, name)
+	delete(s.records, name)
+	return s.saveLocked()
+}
+
+// scheduleStatus is a schedule as the API lists it.
+type scheduleStatus struct {
+	Schedule
+	Origin  string       `json:"origin"` // "file" or "api"
+	Running bool         `json:"running"`
+	NextRun *time.Time   `json:"next_run,omitempty"` // unset while disabled or running
+	LastRun *ScheduleRun `json:"last_run,omitempty"`
+}
+
+func (s *scheduler) status(name string) (scheduleStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc := s.schedules[name]
+	if sc == nil {
+		return scheduleStatus{}, false
+	}
+	st := scheduleStatus{Schedule: sc.redacted(), Origin: "api", Running: s.running[name]}
+	if s.fromFile[name] {
+		st.Origin = "file"
+	}
+	if rec := s.records[name]; rec != nil && len(rec.Runs) > 0 {
+		last := rec.Runs[len(rec.Runs)-1]
+		st.LastRun = &last
+	}
+	if !sc.Disabled && !st.Running {
+		next := sc.next(st.LastRun, s.started).UTC()
+		st.NextRun = &next
+	}
+	return st, true
+}
+
+func (s *scheduler) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runs returns the history of schedule name, newest first.
+func (s *scheduler) runs(name string) ([]ScheduleRun, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.schedules[name] == nil {
+		return nil, false
+	}
+	runs := []ScheduleRun{}
+	if rec := s.records[name]; rec != nil {
+		for i := len(rec.Runs) - 1; i >= 0; i-- {
+			runs = append(runs, rec.Runs[i])
+		}
+	}
+	return runs, true
+}
+
+func v1ListSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	list := []scheduleStatus{}
+	for _, name := range schedules.names() {
+		if st, ok := schedules.status(name); ok {
+			list = append(list, st)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"schedules": list})
+}
+
+func v1CreateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var sc Schedule
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&sc); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+	if err := sc.check(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_schedule", err.Error())
+		return
+	}
+	switch err := schedules.add(&sc); {
+	case errors.Is(err, errScheduleExists):
+		writeAPIError(w, http.StatusConflict, "schedule_exists", err.Error())
+		return
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	if err := audit.record(AuditEntry{Time: time.Now().UTC(), Actor: auditActor(r), Action: AuditScheduleCreated, Target: sc.Name}); err != nil {
+		log.Printf("schedule %s: recording %s in the audit log: %v", sc.Name, AuditScheduleCreated, err)
+	}
+	st, _ := schedules.status(sc.Name)
+	writeJSON(w, http.StatusCreated, st)
+}
+
+func v1DeleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch err := schedules.remove(name); {
+	case errors.Is(err, errScheduleNotFound):
+		writeAPIError(w, http.StatusNotFound, "schedule_not_found", "no schedule named "+name)
+		return
+	case errors.Is(err, errScheduleFile):
+		writeAPIError(w, http.StatusConflict, "defined_in_file", err.Error()+"; remove it there and restart")
+		return
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	if err := audit.record(AuditEntry{Time: time.Now().UTC(), Actor: auditActor(r), Action: AuditScheduleDeleted, Target: name}); err != nil {
+		log.Printf("schedule %s: recording %s in the audit log: %v", name, AuditScheduleDeleted, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func v1ScheduleRunsHandler(w http.ResponseWriter, r *http.Request) {
+	runs, ok := schedules.runs(r.PathValue("name"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "schedule_not_found", "no schedule named "+r.PathValue("name"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"runs": runs})
+}
+
+// v1RunScheduleHandler starts a run of the schedule now, whether or not it
+// is due or disabled.
+func v1RunScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	run, err := schedules.start(r.PathValue("name"), "manual")
+	switch {
+	case errors.Is(err, errScheduleNotFound):
+		writeAPIError(w, http.StatusNotFound, "schedule_not_found", "no schedule named "+r.PathValue("name"))
+		return
+	case errors.Is(err, errScheduleRunning):
+		writeAPIError(w, http.StatusConflict, "already_running", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, run)
+}
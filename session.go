@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sessionTTL is how long a login to the web UI lasts before the user has
+// to sign in again, at the OpenID Connect provider (oidc.go) or with their
+// directory password (ldap.go).
+var sessionTTL = 12 * time.Hour
+
+// sessionKey signs the session and login cookies. It is kept in the data
+// directory so sessions survive restarts and hold on every instance.
+var sessionKey []byte
+
+const sessionCookie = "ocr_session"
+
+// session is what the session cookie holds about a signed-in user.
+type session struct {
+	Subject string `json:"sub"`             // the OpenID Connect subject, or the directory entry's DN
+	Login   string `json:"login,omitempty"` // the directory user name
+	Email   string `json:"email,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Role    string `json:"role,omitempty"` // from the directory groups, see ldapDirectory.role
+	Expires int64  `json:"exp"`
+}
+
+// account is the account the user's jobs are metered against: the email
+// address, so a user record of that name applies to it, or the directory
+// user name, or the subject when the provider has no verified address.
+func (s *session) account() string {
+	switch {
+	case s.Email != "":
+		return s.Email
+	case s.Login != "":
+		return s.Login
+	}
+	return "oidc:" + s.Subject
+}
+
+// display is how the web UI greets the user.
+func (s *session) display() string {
+	for _, v := range []string{s.Name, s.Email, s.Login} {
+		if v != "" {
+			return v
+		}
+	}
+	return s.Subject
+}
+
+// loadSessionKey reads the cookie signing key at path, creating it on the
+// first start. A key created by another instance at the same time wins.
+func loadSessionKey(path string) ([]byte, error) {
+	if key, err := os.ReadFile(path); err == nil && len(key) >= 32 {
+		return key, nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(key)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Link(f.Name(), path); errors.Is(err, os.ErrExist) {
+		return os.ReadFile(path)
+	} else if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// signCookie encodes v as the value of cookie name with an HMAC of it.
+// The name is part of the HMAC, so one cookie cannot be passed off as
+// another: a login cookie's state as a session, say.
+func signCookie(name string, v any) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(cookieMAC(name, payload))
+}
+
+func cookieMAC(name, payload string) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(name + "\x00" + payload))
+	return mac.Sum(nil)
+}
+
+// readCookie decodes a cookie written by signCookie into v, reporting
+// whether it is there and unaltered.
+func readCookie(r *http.Request, name string, v any) bool {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	payload, sig, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	if !hmac.Equal(got, cookieMAC(name, payload)) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	return err == nil && json.Unmarshal(data, v) == nil
+}
+
+// setCookie sets an HttpOnly cookie. SameSite=Lax keeps it out of other
+// sites' form posts and embeds but sends it when a link is followed, which
+// the OpenID Connect callback and links in mail rely on; the forms' tokens
+// (csrf.go) guard against the sites a cookie is still sent from.
+func setCookie(w http.ResponseWriter, r *http.Request, name, path, value string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     appPath(path),
+		MaxAge:   int(ttl / time.Second),
+		Expires:  time.Now().Add(ttl),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(publicURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearCookie(w http.ResponseWriter, name, path string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: appPath(path), MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+}
+
+// loginEnabled reports whether the web UI requires a login.
+func loginEnabled() bool {
+	return oidc != nil || ldapDir != nil
+}
+
+// startSession signs the user in and sends them on to next. A disabled
+// account is refused.
+func startSession(w http.ResponseWriter, r *http.Request, s session, next string) {
+	if u, ok := users.get(s.account()); ok && u.Disabled {
+		w.WriteHeader(http.StatusForbidden)
+		renderError(w, r, errAccountDisabled.Error())
+		return
+	}
+	s.Expires = time.Now().Add(sessionTTL).Unix()
+	setCookie(w, r, sessionCookie, "/", signCookie(sessionCookie, s), sessionTTL)
+	http.Redirect(w, r, appPath(next), http.StatusSeeOther)
+}
+
+// currentSession returns the signed-in user of r, if login is enabled and
+// the session has not expired. A session without a subject is no one's.
+func currentSession(r *http.Request) (*session, bool) {
+	if !loginEnabled() {
+		return nil, false
+	}
+	var s session
+	if !readCookie(r, sessionCookie, &s) || time.Now().Unix() >= s.Expires || s.Subject == "" {
+		return nil, false
+	}
+	return &s, true
+}
+
+// sessionUser is the name the web UI greets the signed-in user with, or ""
+// without login.
+func sessionUser(r *http.Request) string {
+	if s, ok := currentSession(r); ok {
+		return s.display()
+	}
+	return ""
+}
+
+// requireLogin sends visitors of the web UI without a session to the login
+// when login is enabled. Forms posted after the session expired are
+// refused rather than redirected, as their contents would be lost.
+func requireLogin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !loginEnabled() {
+			h(w, r)
+			return
+		}
+		if _, ok := currentSession(r); ok {
+			h(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusUnauthorized)
+			renderError(w, r, "Your session has expired; sign in again and resubmit the form")
+			return
+		}
+		http.Redirect(w, r, appPath("/auth/login")+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	}
+}
+
+// localPath returns next if it is a path on this server, "/" otherwise,
+// so the login cannot be used to redirect elsewhere.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// logoutHandler ends the session, and the OpenID Connect provider's too if
+// it offers an end session endpoint.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusForbidden)
+		renderError(w, r, "The form has expired; reload the page and sign out again")
+		return
+	}
+	clearCookie(w, sessionCookie, "/")
+	if oidc == nil {
+		http.Redirect(w, r, appPath("/"), http.StatusSeeOther)
+		return
+	}
+	meta, err := oidc.metadata(r.Context())
+	if err != nil || meta.EndSessionEndpoint == "" {
+		http.Redirect(w, r, appPath("/"), http.StatusSeeOther)
+		return
+	}
+	q := url.Values{"client_id": {oidc.clientID}, "post_logout_redirect_uri": {absoluteURL(appPath("/"))}}
+	http.Redirect(w, r, meta.EndSessionEndpoint+"?"+q.Encode(), http.StatusSeeOther)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withSessionKey(t *testing.T) {
+	t.Helper()
+	old := sessionKey
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+	t.Cleanup(func() { sessionKey = old })
+}
+
+// cookieRequest is a request carrying cookie name with value.
+func cookieRequest(name, value string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: name, Value: value})
+	return r
+}
+
+func TestCookieRoundTrip(t *testing.T) {
+	withSessionKey(t)
+	want := session{Subject: "user-1", Email: "a@example.com", Expires: 42}
+	var got session
+	if !readCookie(cookieRequest(sessionCookie, signCookie(sessionCookie, want)), sessionCookie, &got) {
+		t.Fatal("readCookie rejected a cookie signCookie wrote")
+	}
+	if got != want {
+		t.Errorf("readCookie = %+v, want %+v", got, want)
+	}
+}
+
+func TestCookieRejected(t *testing.T) {
+	withSessionKey(t)
+	value := signCookie(sessionCookie, session{Subject: "user-1", Expires: 42})
+	payload, sig, _ := strings.Cut(value, ".")
+	for name, value := range map[string]string{
+		"no signature":   payload,
+		"bad signature":  payload + ".AAAA",
+		"other payload":  "eyJzdWIiOiJhZG1pbiJ9." + sig,
+		"other key":      signCookieWith(t, []byte("another key of thirty-two bytes!"), sessionCookie, session{Subject: "user-1"}),
+		"not base64 sig": payload + ".!!",
+	} {
+		var s session
+		if readCookie(cookieRequest(sessionCookie, value), sessionCookie, &s) {
+			t.Errorf("%s: readCookie accepted %q", name, value)
+		}
+	}
+	var s session
+	if readCookie(httptest.NewRequest(http.MethodGet, "/", nil), sessionCookie, &s) {
+		t.Error("readCookie accepted a request without the cookie")
+	}
+}
+
+func signCookieWith(t *testing.T, key []byte, name string, v any) string {
+	t.Helper()
+	old := sessionKey
+	sessionKey = key
+	defer func() { sessionKey = old }()
+	return signCookie(name, v)
+}
+
+// TestLoginCookieNotASession checks that the login cookie's state, signed
+// with the same key, is no session when replayed as one.
+func TestLoginCookieNotASession(t *testing.T) {
+	withSessionKey(t)
+	old := ldapDir
+	ldapDir = &ldapDirectory{}
+	defer func() { ldapDir = old }()
+
+	st := loginState{State: "s", Nonce: "n", Expires: time.Now().Add(time.Hour).Unix()}
+	r := cookieRequest(sessionCookie, signCookie(loginCookie, st))
+	if s, ok := currentSession(r); ok {
+		t.Errorf("currentSession accepted a login cookie: %+v", s)
+	}
+	var got loginState
+	if !readCookie(cookieRequest(loginCookie, signCookie(loginCookie, st)), loginCookie, &got) || got != st {
+		t.Errorf("readCookie = %+v, want %+v", got, st)
+	}
+}
+
+func TestCurrentSession(t *testing.T) {
+	withSessionKey(t)
+	old := ldapDir
+	ldapDir = &ldapDirectory{}
+	defer func() { ldapDir = old }()
+
+	future, past := time.Now().Add(time.Hour).Unix(), time.Now().Add(-time.Second).Unix()
+	for _, tc := range []struct {
+		name string
+		s    session
+		ok   bool
+	}{
+		{"valid", session{Subject: "cn=a,dc=example", Login: "a", Expires: future}, true},
+		{"expired", session{Subject: "cn=a,dc=example", Login: "a", Expires: past}, false},
+		{"no subject", session{Login: "a", Expires: future}, false},
+		{"empty", session{Expires: future}, false},
+	} {
+		_, ok := currentSession(cookieRequest(sessionCookie, signCookie(sessionCookie, tc.s)))
+		if ok != tc.ok {
+			t.Errorf("%s: currentSession ok = %v, want %v", tc.name, ok, tc.ok)
+		}
+	}
+}
@@ -26,5 +26,5 @@ echo.
 echo Server will be available at: http://localhost:8080
 echo Press Ctrl+C to stop the server
 echo.
-go run backend_file.go
+go run . -allow-anonymous-api
 pause
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With -llm-summarize every finished document gets a short Persian summary
+// from the language model, for triaging large archives without opening
+// each document. Long documents are summarized in parts of whole pages,
+// and the parts' summaries summarized again. The summary is written next
+// to the other results as <name>_summary.txt.
+
+// summarizeDocuments is -llm-summarize.
+var summarizeDocuments bool
+
+const (
+	// maxSummaryChunk is the most text summarized in one request.
+	maxSummaryChunk = 12000
+	// maxSummaryChunks bounds the requests for one document; the text
+	// after them is left out of the summary.
+	maxSummaryChunks = 10
+)
+
+// DocumentSummary is the language model's summary of a finished job.
+type DocumentSummary struct {
+	Model string `json:"model"`
+	URL   string `json:"url,omitempty"`   // the summary file
+	Error string `json:"error,omitempty"` // why there is no summary
+}
+
+const summaryPrompt = `You summarize documents recognized by OCR, which are mostly Persian and may contain OCR errors.
+Write a summary in Persian of at most five sentences: what kind of document it is, who and what it is about, and any dates, amounts or decisions it records.
+Answer with only the summary.`
+
+const combinePrompt = `You combine summaries of consecutive parts of one document into a summary of the whole document.
+Write it in Persian, in at most five sentences, keeping the kind of document, who and what it is about, and the most important dates, amounts and decisions.
+Answer with only the summary.`
+
+// summarizeText has the language model summarize the job's text and
+// writes the summary file. It returns nil with summaries turned off.
+func summarizeText(ctx context.Context, j Job, textFile string) *DocumentSummary {
+	if languageModel == nil || !summarizeDocuments || textFile == "" {
+		return nil
+	}
+	s := &DocumentSummary{Model: languageModel.model}
+	data, err := os.ReadFile(textFile)
+	if err != nil {
+		log.Printf("job %s: reading the text to summarize: %v", j.ID, err)
+		s.Error = "the text could not be read"
+		return s
+	}
+	chunks := summaryChunks(string(data))
+	if len(chunks) == 0 {
+		s.Error = "the document has no text"
+		return s
+	}
+	var parts []string
+	for i, c := range chunks {
+		part, err := languageModel.complete(ctx, summaryPrompt, c)
+		if err != nil {
+			log.Printf("job %s: summarizing part %d of %d: %v", j.ID, i+1, len(chunks), err)
+			s.Error = "the language model failed: " + truncate(err.Error(), 200)
+			return s
+		}
+		parts = append(parts, strings.TrimSpace(part))
+	}
+	summary := parts[0]
+	if len(parts) > 1 {
+		var b strings.Builder
+		for i, p := range parts {
+			fmt.Fprintf(&b, "Part %d:\n%s\n\n", i+1, p)
+		}
+		if summary, err = languageModel.complete(ctx, combinePrompt, b.String()); err != nil {
+			log.Printf("job %s: combining its summaries: %v", j.ID, err)
+			s.Error = "the language model failed: " + truncate(err.Error(), 200)
+			return s
+		}
+		summary = strings.TrimSpace(summary)
+	}
+	if summary == "" {
+		s.Error = "the language model gave an empty summary"
+		return s
+	}
+	path := filepath.Join(j.outputDir, j.prefix+"_summary.txt")
+	if err := writeFileAtomic(path, []byte(summary+"\n")); err != nil {
+		log.Printf("job %s: writing its summary: %v", j.ID, err)
+		s.Error = "the summary could not be written"
+		return s
+	}
+	s.URL = downloadURL(path)
+	return s
+}
+
+// summaryChunks splits text into parts of whole pages of up to
+// maxSummaryChunk characters; a longer page is cut off.
+func summaryChunks(text string) []string {
+	var chunks []string
+	var b strings.Builder
+	n := 0
+	for _, sec := range splitPages(text) {
+		page := []rune(strings.TrimSpace(sec.text))
+		if len(page) == 0 {
+			continue
+		}
+		if len(page) > maxSummaryChunk {
+			page = page[:maxSummaryChunk]
+		}
+		if n > 0 && n+len(page) > maxSummaryChunk {
+			chunks = append(chunks, b.String())
+			if len(chunks) == maxSummaryChunks {
+				return chunks
+			}
+			b.Reset()
+			n = 0
+		}
+		if n > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(string(page))
+		n += len(page)
+	}
+	if n > 0 {
+		chunks = append(chunks, b.String())
+	}
+	return chunks
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	maxJobTags   = 20
+	maxTagLength = 100
+)
+
+// parseTags reads job tags from form values. Each value is "key=value" or a
+// bare label, and several may be given comma-separated, e.g.
+// "project=archive-1402,department=legal,urgent".
+func parseTags(values []string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			key, value, _ := strings.Cut(item, "=")
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			if !validTagKey(key) {
+				return nil, fmt.Errorf("invalid tag key %q: use letters, digits, '-', '_' or '.'", key)
+			}
+			if len(value) > maxTagLength {
+				return nil, fmt.Errorf("tag %q: value longer than %d bytes", key, maxTagLength)
+			}
+			tags[key] = value
+		}
+	}
+	if len(tags) > maxJobTags {
+		return nil, fmt.Errorf("at most %d tags are allowed per job", maxJobTags)
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return tags, nil
+}
+
+func validTagKey(key string) bool {
+	if key == "" || len(key) > maxTagLength {
+		return false
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// matchesTags reports whether tags satisfy every filter. A filter that is a
+// bare key only requires the tag to be present.
+func matchesTags(tags, filters map[string]string) bool {
+	for k, want := range filters {
+		got, ok := tags[k]
+		if !ok || (want != "" && got != want) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// jobTempRoot holds one scratch directory per OCR run for the rasterized
+// page images. It is separate from the result directories so intermediate
+// files never end up next to downloads.
+var jobTempRoot = filepath.Join(os.TempDir(), "persianocr")
+
+// newJobTempDir creates the scratch directory for one OCR run. The caller
+// removes it when the run ends, whatever the outcome.
+func newJobTempDir(jobID string) (string, error) {
+	// 0711 lets a sandbox user reach its own directory without listing the
+	// others.
+	if err := os.MkdirAll(jobTempRoot, 0711); err != nil {
+		return "", fmt.Errorf("Error creating temp directory: %w", err)
+	}
+	pattern := "job-*"
+	if jobID != "" {
+		pattern = "job-" + jobID + "-*"
+	}
+	dir, err := os.MkdirTemp(jobTempRoot, pattern)
+	if err != nil {
+		return "", fmt.Errorf("Error creating temp directory: %w", err)
+	}
+	return dir, nil
+}
+
+// anonymousTempAge is how old the scratch directory of a run without a job
+// ID must be before scavengeTempDirs treats it as abandoned.
+const anonymousTempAge = 24 * time.Hour
+
+// scavengeTempDirs removes scratch directories left behind by runs that died
+// with a previous server process. It must run before any job starts. When
+// the temp root is shared with other instances, directories of jobs whose
+// lease is still held are left alone, and runs without a job ID only count
+// as abandoned once they are older than any run could last.
+func scavengeTempDirs() {
+	dirs, _ := filepath.Glob(filepath.Join(jobTempRoot, "job-*"))
+	removed := 0
+	for _, d := range dirs {
+		if !tempDirAbandoned(d) {
+			continue
+		}
+		if err := os.RemoveAll(d); err != nil {
+			log.Printf("removing stale temp directory %s: %v", d, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("removed %d stale OCR temp directories", removed)
+	}
+}
+
+func tempDirAbandoned(dir string) bool {
+	rest := strings.TrimPrefix(filepath.Base(dir), "job-")
+	// Job IDs are 36-character UUIDs followed by MkdirTemp's suffix.
+	if len(rest) > 36 && rest[36] == '-' {
+		return !jobLeaseLive(rest[:36])
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	return time.Since(fi.ModTime()) > max(anonymousTempAge, ocrLimits.Timeout)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Timeline event types. Besides these the engine reports its own, such as
+// "engine" when it picks how pages are rendered, see reportWriter.
+const (
+	TimelineQueued     = "queued"
+	TimelineRequeued   = "requeued" // resumed by hand or after a server restart
+	TimelineWaiting    = "waiting"  // another instance holds the job's lease
+	TimelineStarted    = "started"
+	TimelineProgress   = "progress" // every tenth of the pages, and the first
+	TimelineWarning    = "warning"
+	TimelineDone       = "done"
+	TimelineFailed     = "failed"
+	TimelineCanceled   = "canceled"
+	TimelineCorrected  = "corrected"  // a language model fixed low-confidence lines, see correct.go
+	TimelineSummarized = "summarized" // see summary.go
+	TimelineRouted     = "routed"     // a routing rule ran, see routing.go
+	TimelineDuplicate  = "duplicate"  // the text nearly repeats an earlier document's, see duplicates.go
+	TimelineRescan     = "rescan"     // pages worth scanning again, see rescan.go
+)
+
+// TimelineEvent is one entry of a job's timeline: what happened to the job
+// and when, for support and for progress views. The timeline is kept in
+// timelineName next to the job's record, one JSON event per line, so it
+// survives restarts and every instance sharing the volume adds to the same
+// one.
+type TimelineEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message,omitempty"`
+	Page    int       `json:"page,omitempty"`
+}
+
+const timelineName = "events.jsonl"
+
+// timelineMu serializes appends, so lines of concurrent events never
+// interleave.
+var timelineMu sync.Mutex
+
+func (j *Job) timelinePath() string {
+	return filepath.Join(filepath.Dir(j.inputPath), timelineName)
+}
+
+// recordEvent adds an event to j's timeline. A timeline that cannot be
+// written is logged; it never holds up the job.
+func recordEvent(j *Job, typ string, page int, format string, args ...any) {
+	ev := TimelineEvent{Time: time.Now().UTC(), Type: typ, Page: page, Message: fmt.Sprintf(format, args...)}
+	data, _ := json.Marshal(ev)
+	timelineMu.Lock()
+	defer timelineMu.Unlock()
+	f, err := os.OpenFile(j.timelinePath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		_, err = f.Write(append(data, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Printf("job %s: recording %s event: %v", j.ID, typ, err)
+	}
+}
+
+// readTimeline returns j's timeline, oldest event first. A line cut short
+// by a crash is skipped.
+func readTimeline(j *Job) ([]TimelineEvent, error) {
+	f, err := os.Open(j.timelinePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return []TimelineEvent{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	events := []TimelineEvent{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var ev TimelineEvent
+		if json.Unmarshal(sc.Bytes(), &ev) == nil {
+			events = append(events, ev)
+		}
+	}
+	return events, sc.Err()
+}
+
+// progressMilestone reports whether finishing done of total pages, after
+// prev, is worth a timeline entry: the first page and every tenth.
+func progressMilestone(prev, done, total int) bool {
+	if total <= 0 || done <= prev {
+		return false
+	}
+	return prev == 0 || prev*10/total < done*10/total
+}
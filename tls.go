@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server can serve HTTPS itself, so scanning stations can reach it
+// without a reverse proxy: with a certificate and key from files, which are
+// reloaded when they change (as when certbot renews them), or with a
+// certificate obtained and renewed automatically over ACME by autocert.
+// The plain HTTP listener then redirects to HTTPS, except for the health
+// probes.
+
+const letsEncryptDirectory = acme.LetsEncryptURL
+
+// certReloadInterval is how often the certificate files are checked for
+// changes.
+const certReloadInterval = time.Minute
+
+// fileCertificate serves the certificate in a pair of PEM files.
+type fileCertificate struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newFileCertificate(certFile, keyFile string) (*fileCertificate, error) {
+	f := &fileCertificate{certFile: certFile, keyFile: keyFile}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileCertificate) load() error {
+	c, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading the TLS certificate: %w", err)
+	}
+	f.cert, f.modTime = &c, f.filesModTime()
+	return nil
+}
+
+func (f *fileCertificate) filesModTime() time.Time {
+	var t time.Time
+	for _, p := range []string{f.certFile, f.keyFile} {
+		if info, err := os.Stat(p); err == nil && info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t
+}
+
+// getCertificate is the tls.Config callback. A renewed pair of files is
+// picked up within certReloadInterval; a broken one is logged and the
+// previous certificate kept.
+func (f *fileCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checked) >= certReloadInterval {
+		f.checked = time.Now()
+		if f.filesModTime().After(f.modTime) {
+			if err := f.load(); err != nil {
+				log.Printf("%v; keeping the previous certificate", err)
+			} else {
+				log.Printf("reloaded the TLS certificate from %s", f.certFile)
+			}
+		}
+	}
+	return f.cert, nil
+}
+
+// acmeDomains returns the domains of -acme-domains.
+func acmeDomains(cfg Config) []string {
+	var domains []string
+	for _, d := range strings.Split(cfg.ACMEDomains, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// tlsSettings returns the TLS configuration of the HTTPS listener, nil when
+// no certificate is configured. An ACME certificate is obtained at the
+// first handshake for one of its domains, answering the CA's tls-alpn-01
+// challenge on the HTTPS listener itself, and renewed before it expires;
+// the account key and the certificates are kept in acme/ under the data
+// directory.
+func tlsSettings(cfg Config) (*tls.Config, error) {
+	domains := acmeDomains(cfg)
+	switch {
+	case cfg.TLSCert != "" && len(domains) > 0:
+		return nil, errors.New("-tls-cert and -acme-domains are exclusive")
+	case (cfg.TLSCert == "") != (cfg.TLSKey == ""):
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	case cfg.TLSCert != "":
+		f, err := newFileCertificate(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: f.getCertificate}, nil
+	case len(domains) > 0:
+		for _, d := range domains {
+			if strings.ContainsAny(d, "*/:") || !strings.Contains(d, ".") {
+				return nil, fmt.Errorf("-acme-domains: %q is not a domain name", d)
+			}
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(filepath.Join(cfg.DataDir, "acme")),
+			Email:      cfg.ACMEEmail,
+			Client:     &acme.Client{DirectoryURL: cfg.ACMEDirectory},
+		}
+		c := m.TLSConfig()
+		c.MinVersion = tls.VersionTLS12
+		return c, nil
+	}
+	return nil, nil
+}
+
+// redirectHost returns the host the plain HTTP listener sends browsers to:
+// that of -public-url, or else the first of -acme-domains or of the names
+// the certificate is for. The request's own Host header is never used, so
+// a forged one cannot turn the redirect into one to another site.
+func redirectHost(cfg Config, tlsConfig *tls.Config) (string, error) {
+	if u, err := url.Parse(publicURL); err == nil && u.Scheme == "https" && u.Host != "" {
+		return u.Host, nil
+	}
+	port := ""
+	if _, p, err := net.SplitHostPort(cfg.HTTPSAddr); err == nil && p != "443" {
+		port = p
+	}
+	withPort := func(host string) string {
+		if port == "" {
+			return host
+		}
+		return net.JoinHostPort(host, port)
+	}
+	if domains := acmeDomains(cfg); len(domains) > 0 {
+		return withPort(domains[0]), nil
+	}
+	if c, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{}); err == nil && c.Leaf != nil {
+		for _, name := range c.Leaf.DNSNames {
+			if !strings.Contains(name, "*") {
+				return withPort(name), nil
+			}
+		}
+	}
+	return "", errors.New("-tls-redirect needs -public-url set to the https:// address, as the certificate names no host to redirect to")
+}
+
+// serve runs the listeners until one fails: plain HTTP on -addr, and HTTPS
+// on -https-addr when a certificate is configured. With -tls-redirect the
+// plain listener only redirects to HTTPS.
+func serve(cfg Config, h http.Handler) error {
+	tlsConfig, err := tlsSettings(cfg)
+	if err != nil {
+		return err
+	}
+	if tlsConfig == nil {
+		fmt.Printf("Server starting on http://localhost%s\n", cfg.Addr)
+		return http.ListenAndServe(cfg.Addr, h)
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		srv := &http.Server{Addr: cfg.HTTPSAddr, Handler: h, TLSConfig: tlsConfig}
+		errc <- srv.ListenAndServeTLS("", "")
+	}()
+	plain := h
+	if cfg.TLSRedirect {
+		host, err := redirectHost(cfg, tlsConfig)
+		if err != nil {
+			return err
+		}
+		plain = httpsRedirect(host, h)
+	}
+	if cfg.Addr != "" {
+		go func() { errc <- http.ListenAndServe(cfg.Addr, plain) }()
+	}
+	fmt.Printf("Server starting on https://localhost%s\n", cfg.HTTPSAddr)
+	return <-errc
+}
+
+// httpsRedirect sends requests on to the same path over HTTPS at host. The
+// health probes are answered as they are, so load balancers checking over
+// plain HTTP keep working.
+func httpsRedirect(host string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHealthPath(strings.TrimPrefix(r.URL.Path, basePath)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			// Keep the method and body of uploads.
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scanned books run to hundreds of megabytes, too much for one multipart
+// form: a dropped connection starts the upload over, and the form is capped
+// at maxUploadSize. /api/v1/tus takes files with the tus resumable upload
+// protocol (https://tus.io, version 1.0.0 with the creation, expiration and
+// termination extensions) instead. The client creates an upload, sends it
+// in as many PATCH requests as it takes, asks for the offset to resume from
+// after an interruption, and then submits the finished upload by its ID in
+// the "upload" field of POST /api/v1/jobs or the web form. Uploads are kept
+// on disk, so they survive a restart of the server.
+
+const tusVersion = "1.0.0"
+
+var (
+	tusDir     = filepath.Join("user_file", ".tus")
+	tusMaxSize = int64(2048) << 20
+	tusExpiry  = 24 * time.Hour // after the last PATCH
+)
+
+// tusError refuses a tus request or the submission of an upload. The API
+// answers it with Status and Code.
+type tusError struct {
+	Status int
+	Code   string
+	msg    string
+}
+
+func (e *tusError) Error() string { return e.msg }
+
+var errTusNotFound = &tusError{http.StatusNotFound, "upload_not_found", "no resumable upload with this id; it may have expired"}
+
+// tusUpload is one resumable upload. Its data is appended to <id>.bin; the
+// offset is the size of that file, so an interrupted PATCH keeps what it
+// wrote. The rest is saved in <id>.json when the upload is created.
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"` // from Upload-Metadata; "filename" names the file
+	Account  string            `json:"account"`            // only its creator sees it
+	Created  time.Time         `json:"created"`
+
+	mu sync.Mutex // held by the PATCH writing to it
+}
+
+var (
+	tusMu      sync.Mutex
+	tusUploads = map[string]*tusUpload{} // loaded from tusDir on first use
+)
+
+func (u *tusUpload) dataPath() string { return filepath.Join(tusDir, u.ID+".bin") }
+
+func (u *tusUpload) offset() (int64, time.Time) {
+	fi, err := os.Stat(u.dataPath())
+	if err != nil {
+		return 0, time.Time{}
+	}
+	return fi.Size(), fi.ModTime()
+}
+
+// lookupTusUpload returns upload id if it belongs to account.
+func lookupTusUpload(account, id string) (*tusUpload, *tusError) {
+	if !uploadID.MatchString(id) {
+		return nil, errTusNotFound
+	}
+	tusMu.Lock()
+	defer tusMu.Unlock()
+	u, ok := tusUploads[id]
+	if !ok {
+		data, err := os.ReadFile(filepath.Join(tusDir, id+".json"))
+		if err != nil {
+			return nil, errTusNotFound
+		}
+		u = &tusUpload{}
+		if err := json.Unmarshal(data, u); err != nil {
+			return nil, errTusNotFound
+		}
+		tusUploads[id] = u
+	}
+	if u.Account != account {
+		return nil, errTusNotFound
+	}
+	return u, nil
+}
+
+// remove deletes the upload. The caller holds u.mu or knows no PATCH is
+// writing.
+func (u *tusUpload) remove() {
+	tusMu.Lock()
+	delete(tusUploads, u.ID)
+	tusMu.Unlock()
+	os.Remove(filepath.Join(tusDir, u.ID+".json"))
+	os.Remove(u.dataPath())
+}
+
+// tusUploadFile returns the finished upload id of account as a file to
+// admit like a form upload.
+func tusUploadFile(account, id string) (*tusUpload, batchFile, *tusError) {
+	u, terr := lookupTusUpload(account, id)
+	if terr != nil {
+		return nil, batchFile{}, terr
+	}
+	if off, _ := u.offset(); off != u.Length {
+		return nil, batchFile{}, &tusError{http.StatusConflict, "upload_incomplete",
+			fmt.Sprintf("the upload has %d of its %d bytes; send the rest first", off, u.Length)}
+	}
+	return u, batchFile{
+		Name: cmp.Or(u.Metadata["filename"], "document.pdf"),
+		Size: u.Length,
+		Open: func() (io.ReadCloser, error) { return os.Open(u.dataPath()) },
+	}, nil
+}
+
+// sweepTusUploads deletes uploads nothing was written to for tusExpiry,
+// finished or not, every interval.
+func sweepTusUploads(interval time.Duration) {
+	for range time.Tick(interval) {
+		paths, _ := filepath.Glob(filepath.Join(tusDir, "*.json"))
+		for _, p := range paths {
+			id := strings.TrimSuffix(filepath.Base(p), ".json")
+			fi, err := os.Stat(filepath.Join(tusDir, id+".bin"))
+			if err == nil && time.Since(fi.ModTime()) < tusExpiry {
+				continue
+			}
+			if errors.Is(err, fs.ErrNotExist) || err == nil {
+				log.Printf("resumable upload %s expired", id)
+				(&tusUpload{ID: id}).remove()
+			}
+		}
+	}
+}
+
+// parseTusMetadata reads an Upload-Metadata header: comma-separated keys,
+// each followed by a space and its base64 value, which may be left out.
+func parseTusMetadata(h string) (map[string]string, error) {
+	md := map[string]string{}
+	for _, pair := range strings.Split(h, ",") {
+		key, enc, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		val, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			return nil, fmt.Errorf("the value of %q is not base64", key)
+		}
+		md[key] = string(val)
+	}
+	return md, nil
+}
+
+// tusHeaders adds the headers every tus response carries and refuses
+// clients that speak another version of the protocol.
+func tusHeaders(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			writeAPIError(w, http.StatusPreconditionFailed, "unsupported_tus_version", "send Tus-Resumable: "+tusVersion)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeTusError(w http.ResponseWriter, err *tusError) {
+	writeAPIError(w, err.Status, err.Code, err.Error())
+}
+
+func setUploadExpires(w http.ResponseWriter, modified time.Time) {
+	w.Header().Set("Upload-Expires", modified.Add(tusExpiry).UTC().Format(http.TimeFormat))
+}
+
+// v1TusOptionsHandler describes what the server supports.
+func v1TusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// v1TusCreateHandler creates an upload of Upload-Length bytes. The caller's
+// plan bounds its size, like that of a form upload, and the file name in
+// its metadata must be of a type the server takes.
+func v1TusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_upload_length", "send the size of the file in Upload-Length")
+		return
+	}
+	if length > tusMaxSize {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("the document is larger than %d MB", tusMaxSize>>20))
+		return
+	}
+	if perr := plan.checkUpload(length, defaultEngine); perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	md, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+	if name := md["filename"]; name != "" {
+		if md["filename"] = cleanUploadName(name); !isUploadType(md["filename"]) {
+			writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_type", errUnsupportedType.Error())
+			return
+		}
+	}
+	if free, ok := diskFree("user_file"); ok && length > free-diskReserve {
+		writeAPIError(w, http.StatusInsufficientStorage, "insufficient_storage", fmt.Sprintf(
+			"Not enough disk space for this upload: it is %s but only %s is free", formatBytes(length), formatBytes(max(free-diskReserve, 0))))
+		return
+	}
+
+	u := &tusUpload{ID: newID(), Length: length, Metadata: md, Account: account, Created: time.Now().UTC()}
+	data, _ := json.Marshal(u)
+	if err := os.MkdirAll(tusDir, 0700); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	f, err := os.OpenFile(u.dataPath(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err == nil {
+		f.Close()
+		err = writeFileAtomic(filepath.Join(tusDir, u.ID+".json"), data)
+	}
+	if err != nil {
+		u.remove()
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", "Error creating upload: "+err.Error())
+		return
+	}
+	tusMu.Lock()
+	tusUploads[u.ID] = u
+	tusMu.Unlock()
+
+	setUploadExpires(w, time.Now())
+	w.Header().Set("Location", appPath("/api/v1/tus/"+u.ID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// v1TusHeadHandler reports how much of an upload the server has, which is
+// where an interrupted client resumes.
+func v1TusHeadHandler(w http.ResponseWriter, r *http.Request) {
+	account, _, perr := plans.identify(r)
+	if perr != nil {
+		w.WriteHeader(perr.Status)
+		return
+	}
+	u, terr := lookupTusUpload(account, r.PathValue("id"))
+	if terr != nil {
+		w.WriteHeader(terr.Status)
+		return
+	}
+	off, modified := u.offset()
+	w.Header().Set("Upload-Offset", strconv.FormatInt(off, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	setUploadExpires(w, modified)
+	w.WriteHeader(http.StatusOK)
+}
+
+// v1TusPatchHandler appends the body to an upload at Upload-Offset, which
+// must be where the upload stands. What arrives before the connection
+// drops is kept.
+func v1TusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	account, _, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "invalid_content_type", "send the data as application/offset+octet-stream")
+		return
+	}
+	u, terr := lookupTusUpload(account, r.PathValue("id"))
+	if terr != nil {
+		writeTusError(w, terr)
+		return
+	}
+	if !u.mu.TryLock() {
+		// Typically the client's previous request, which has not noticed
+		// its connection is gone.
+		writeAPIError(w, http.StatusLocked, "upload_busy", "another request is writing to this upload; try again")
+		return
+	}
+	defer u.mu.Unlock()
+	off, _ := u.offset()
+	if got, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || got != off {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(off, 10))
+		writeAPIError(w, http.StatusConflict, "offset_mismatch", fmt.Sprintf("the upload is at offset %d", off))
+		return
+	}
+
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		writeTusError(w, errTusNotFound)
+		return
+	}
+	_, err = io.Copy(f, io.LimitReader(r.Body, u.Length-off))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	off, modified := u.offset()
+	w.Header().Set("Upload-Offset", strconv.FormatInt(off, 10))
+	setUploadExpires(w, modified)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "upload_interrupted", fmt.Sprintf("the upload stopped at offset %d: %v", off, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// v1TusDeleteHandler abandons an upload.
+func v1TusDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	account, _, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	u, terr := lookupTusUpload(account, r.PathValue("id"))
+	if terr != nil {
+		writeTusError(w, terr)
+		return
+	}
+	if !u.mu.TryLock() {
+		writeAPIError(w, http.StatusLocked, "upload_busy", "another request is writing to this upload; try again")
+		return
+	}
+	u.remove()
+	u.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
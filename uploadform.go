@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// The web form's files are streamed to spool files as they arrive instead
+// of parsed with ParseMultipartForm, which keeps the first 32 MB in memory
+// and writes the rest to temporary files that admitUpload then copies
+// again. A scan of several hundred megabytes is thus written to disk once,
+// through a small buffer, which is what a small VPS can take.
+
+// formMaxSize bounds the body of a web form upload, all its files together.
+var formMaxSize = int64(1024) << 20
+
+// maxFormValues bounds the bytes of a form's fields other than files.
+const maxFormValues = 1 << 20
+
+// uploadForm is a web form upload read by readUploadForm.
+type uploadForm struct {
+	Values url.Values
+	Files  []batchFile // already spooled, see batchFile.Spool
+}
+
+// readUploadForm reads the multipart form in r, spooling the files sent in
+// field as they arrive. Files in other fields are skipped. remove must be
+// called once the files have been admitted.
+func readUploadForm(w http.ResponseWriter, r *http.Request, field string) (*uploadForm, error) {
+	if r.ContentLength > formMaxSize {
+		return nil, &http.MaxBytesError{Limit: formMaxSize}
+	}
+	if free, ok := diskFree("user_file"); ok && r.ContentLength > free-diskReserve {
+		return nil, &resourceError{Storage: true, msg: fmt.Sprintf(
+			"Not enough disk space for this upload: it is %s but only %s is free", formatBytes(r.ContentLength), formatBytes(max(free-diskReserve, 0)))}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, formMaxSize)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &uploadForm{Values: url.Values{}}
+	budget := int64(maxFormValues)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			form.remove()
+			return nil, err
+		}
+		name := part.FormName()
+		switch {
+		case part.FileName() == "":
+			// An empty file input is sent as a part without a file name too.
+			value, err := io.ReadAll(io.LimitReader(part, budget+1))
+			if err == nil && int64(len(value)) > budget {
+				err = errors.New("the form's fields are too large")
+			}
+			if err != nil {
+				form.remove()
+				return nil, err
+			}
+			budget -= int64(len(value))
+			form.Values.Add(name, string(value))
+		case name == field:
+			spoolPath, fingerprint, err := spoolUpload(part)
+			if err != nil {
+				form.remove()
+				return nil, err
+			}
+			fi, err := os.Stat(spoolPath)
+			if err != nil {
+				os.Remove(spoolPath)
+				form.remove()
+				return nil, err
+			}
+			form.Files = append(form.Files, batchFile{
+				Name:        part.FileName(),
+				Size:        fi.Size(),
+				Spool:       spoolPath,
+				Fingerprint: fingerprint,
+				Open:        func() (io.ReadCloser, error) { return os.Open(spoolPath) },
+			})
+		}
+		part.Close()
+	}
+}
+
+// remove deletes the spool files that were not admitted; admitUpload moves
+// the ones it takes into their job's workspace.
+func (f *uploadForm) remove() {
+	for _, bf := range f.Files {
+		os.Remove(bf.Spool)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// uploadID matches the client-chosen IDs uploads are tracked under.
+var uploadID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// uploadKeep is how long a finished upload's progress stays available, so a
+// client polling slowly still sees how it ended. maxUploadTime bounds how
+// long an upload may run before its progress is dropped regardless.
+const (
+	uploadKeep    = 10 * time.Minute
+	maxUploadTime = 2 * time.Hour
+)
+
+// Upload states reported by the progress endpoint.
+const (
+	uploadReceiving  = "receiving"  // the request body is being read
+	uploadProcessing = "processing" // received, being checked and queued
+	uploadComplete   = "complete"   // a job was created, see JobID
+	uploadRejected   = "rejected"   // the upload's own response says why
+)
+
+// uploadProgress is the state of one in-flight upload.
+type uploadProgress struct {
+	received atomic.Int64
+	total    int64 // Content-Length, -1 if the client did not send one
+
+	mu     sync.Mutex
+	status string
+	jobID  string
+}
+
+var (
+	uploadsMu sync.Mutex
+	uploads   = map[string]*uploadProgress{}
+)
+
+// trackUpload counts the bytes read from r's body under the ID the client
+// sent in the X-Upload-ID header or the upload_id query parameter, so the
+// progress endpoint can report them while the handler is still parsing the
+// form. It returns nil for requests without an ID; the methods of a nil
+// *uploadProgress do nothing.
+func trackUpload(r *http.Request) *uploadProgress {
+	id := r.Header.Get("X-Upload-ID")
+	if id == "" {
+		id = r.URL.Query().Get("upload_id")
+	}
+	if !uploadID.MatchString(id) {
+		return nil
+	}
+	up := &uploadProgress{total: r.ContentLength, status: uploadReceiving}
+	uploadsMu.Lock()
+	uploads[id] = up
+	uploadsMu.Unlock()
+	r.Body = &countingBody{ReadCloser: r.Body, up: up}
+	time.AfterFunc(uploadKeep+maxUploadTime, func() {
+		uploadsMu.Lock()
+		defer uploadsMu.Unlock()
+		if uploads[id] == up {
+			delete(uploads, id)
+		}
+	})
+	return up
+}
+
+// parsed marks the form as received.
+func (up *uploadProgress) parsed() {
+	if up == nil {
+		return
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.status = uploadProcessing
+}
+
+// finish records how the upload ended: with job jobID, or rejected when it
+// is empty.
+func (up *uploadProgress) finish(jobID string) {
+	if up == nil {
+		return
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.jobID = jobID
+	if jobID != "" {
+		up.status = uploadComplete
+	} else {
+		up.status = uploadRejected
+	}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	up *uploadProgress
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.up.received.Add(int64(n))
+	return n, err
+}
+
+// v1UploadProgressHandler reports the bytes received for an upload tracked
+// by trackUpload, separately from the OCR progress of the job it becomes.
+func v1UploadProgressHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	uploadsMu.Lock()
+	up, ok := uploads[id]
+	uploadsMu.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "upload_not_found", "no upload with id "+id)
+		return
+	}
+	received := up.received.Load()
+	resp := map[string]any{"upload_id": id, "bytes_received": received}
+	if up.total >= 0 {
+		resp["bytes_total"] = up.total
+		if up.total > 0 {
+			resp["percent"] = min(100, float64(received)*100/float64(up.total))
+		}
+	}
+	up.mu.Lock()
+	resp["status"] = up.status
+	if up.jobID != "" {
+		resp["job_id"] = up.jobID
+	}
+	up.mu.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// usageStore counts the pages each account submitted per calendar month
+// (UTC). It is saved under the data directory so allowances survive
+// restarts.
+type usageStore struct {
+	mu    sync.Mutex
+	path  string
+	pages map[string]map[string]int // account -> "2006-01" -> pages
+}
+
+var usage = &usageStore{pages: map[string]map[string]int{}}
+
+func openUsage(path string) (*usageStore, error) {
+	s := &usageStore{path: path, pages: map[string]map[string]int{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.pages); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// charge adds pages to the account's usage for this month. It returns false,
+// and records nothing, when that would go over limit; a limit of 0 means
+// unlimited.
+func (s *usageStore) charge(account string, pages, limit int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	month := usageMonth(time.Now())
+	used := s.pages[account][month]
+	if limit > 0 && used+pages > limit {
+		return false
+	}
+	if s.pages[account] == nil {
+		s.pages[account] = map[string]int{}
+	}
+	s.pages[account][month] = used + pages
+	s.saveLocked()
+	return true
+}
+
+// refund gives back pages charged for a document that was not accepted.
+func (s *usageStore) refund(account string, pages int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	month := usageMonth(time.Now())
+	if m := s.pages[account]; m != nil {
+		m[month] = max(m[month]-pages, 0)
+		s.saveLocked()
+	}
+}
+
+// month returns the account's page count for this month.
+func (s *usageStore) month(account string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pages[account][usageMonth(time.Now())]
+}
+
+func (s *usageStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.pages, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		log.Printf("saving usage: %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User is an account managed through the admin API. The account's API keys,
+// stored ones and those of the plans file alike, are identified by its name;
+// the user record holds what applies to all of them: whether the account may
+// use the service, its plan, its monthly page allowance and its role.
+type User struct {
+	Name          string    `json:"name"`
+	Email         string    `json:"email,omitempty"`
+	Plan          string    `json:"plan,omitempty"`            // overrides the plan of the account's keys
+	PagesPerMonth *int      `json:"pages_per_month,omitempty"` // overrides the plan's allowance, 0 = unlimited
+	Disabled      bool      `json:"disabled,omitempty"`        // every key of the account is refused
+	Role          string    `json:"role,omitempty"`            // see roles, empty is user
+	Created       time.Time `json:"created"`
+}
+
+var errAccountDisabled = &planError{http.StatusForbidden, "account_disabled", "the account is disabled"}
+
+var errUserExists = errors.New("a user with this name already exists")
+
+// userStore keeps the users in a JSON file under the data directory.
+type userStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]*User
+}
+
+var users = &userStore{users: map[string]*User{}}
+
+func openUsers(path string) (*userStore, error) {
+	s := &userStore{path: path, users: map[string]*User{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, u := range list {
+		s.users[u.Name] = u
+	}
+	return s, nil
+}
+
+func (s *userStore) get(name string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return User{}, false
+	}
+	return *u, true
+}
+
+// list returns the users sorted by name.
+func (s *userStore) list() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Name < out[b].Name })
+	return out
+}
+
+func (s *userStore) create(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[u.Name]; ok {
+		return errUserExists
+	}
+	s.users[u.Name] = &u
+	if err := s.saveLocked(); err != nil {
+		delete(s.users, u.Name)
+		return err
+	}
+	return nil
+}
+
+// update applies fn to user name and saves the users. fn may refuse the
+// change by returning an error.
+func (s *userStore) update(name string, fn func(u *User) error) (User, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return User{}, false, nil
+	}
+	changed := *u
+	if err := fn(&changed); err != nil {
+		return User{}, true, err
+	}
+	*u = changed
+	return *u, true, s.saveLocked()
+}
+
+func (s *userStore) saveLocked() error {
+	list := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// forAccount applies the user record of an account, if there is one, to
+// the plan its key gives it.
+func (ps *planSet) forAccount(account string, p *Plan) (string, *Plan, *planError) {
+	u, ok := users.get(account)
+	if !ok {
+		return account, p, nil
+	}
+	if u.Disabled {
+		return "", nil, errAccountDisabled
+	}
+	if u.Plan != "" {
+		up, err := ps.plan(u.Plan)
+		if err != nil {
+			return "", nil, &planError{http.StatusForbidden, "invalid_plan", "the account's " + err.Error()}
+		}
+		p = up
+	}
+	if u.PagesPerMonth != nil {
+		adjusted := *p
+		adjusted.PagesPerMonth = *u.PagesPerMonth
+		p = &adjusted
+	}
+	return account, p, nil
+}
+
+// userView is a user as the admin API shows it, with the plan that applies
+// and what the account has used.
+type userView struct {
+	User
+	EffectivePlan  *Plan       `json:"effective_plan,omitempty"`
+	PagesThisMonth int         `json:"pages_this_month"`
+	Keys           []StoredKey `json:"keys"`
+}
+
+func viewUser(u User) (userView, error) {
+	keys, err := apiKeys.forAccount(u.Name)
+	if err != nil {
+		return userView{}, err
+	}
+	v := userView{User: u, PagesThisMonth: usage.month(u.Name), Keys: keys}
+	if p, err := plans.plan(u.Plan); err == nil {
+		if u.PagesPerMonth != nil {
+			adjusted := *p
+			adjusted.PagesPerMonth = *u.PagesPerMonth
+			p = &adjusted
+		}
+		v.EffectivePlan = p
+	}
+	return v, nil
+}
+
+// checkUserName refuses names that cannot be an account: empty ones and
+// those of anonymous clients, which are metered as "ip:<addr>".
+func checkUserName(name string) error {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return errors.New("a user needs a name")
+	case strings.HasPrefix(name, "ip:"):
+		return errors.New(`user names cannot start with "ip:"`)
+	}
+	return nil
+}
+
+func v1ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	list := []userView{}
+	for _, u := range users.list() {
+		v, err := viewUser(u)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+			return
+		}
+		list = append(list, v)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"users": list})
+}
+
+// v1CreateUserHandler creates a user from a JSON body with its "name" and
+// optional "email", "plan", "pages_per_month", "role" and "scopes", and
+// issues its first API key with those scopes. The key is in the response,
+// the only time it is shown.
+func v1CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		User
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+	u := User{Name: body.Name, Email: body.Email, Plan: body.Plan, PagesPerMonth: body.PagesPerMonth, Role: body.Role, Created: time.Now().UTC()}
+	err := checkUserName(u.Name)
+	if err == nil {
+		err = checkRole(u.Role)
+	}
+	if err == nil && u.PagesPerMonth != nil && *u.PagesPerMonth < 0 {
+		err = errors.New("pages_per_month cannot be negative")
+	}
+	if err == nil && u.Plan != "" {
+		_, err = plans.plan(u.Plan)
+	}
+	if err == nil {
+		err = checkScopes(body.Scopes)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_user", err.Error())
+		return
+	}
+	if err := users.create(u); errors.Is(err, errUserExists) {
+		writeAPIError(w, http.StatusConflict, "user_exists", err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	key, k, err := apiKeys.create(StoredKey{Name: u.Name, Scopes: body.Scopes})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	v, _ := viewUser(u)
+	writeJSON(w, http.StatusCreated, map[string]any{"user": v, "key": key, "api_key": k})
+}
+
+func v1GetUserHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := users.get(r.PathValue("name"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no user named "+r.PathValue("name"))
+		return
+	}
+	v, err := viewUser(u)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// v1UpdateUserHandler changes the fields of a user given in a JSON body:
+// "email", "plan", "pages_per_month" (null removes the override), "role"
+// and "disabled". A disabled account's keys are refused until it is enabled
+// again; its jobs keep running.
+func v1UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var patch struct {
+		Email         *string         `json:"email"`
+		Plan          *string         `json:"plan"`
+		PagesPerMonth json.RawMessage `json:"pages_per_month"`
+		Disabled      *bool           `json:"disabled"`
+		Role          *string         `json:"role"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&patch); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+	var invalid error
+	u, ok, err := users.update(r.PathValue("name"), func(u *User) error {
+		if patch.Email != nil {
+			u.Email = *patch.Email
+		}
+		if patch.Plan != nil {
+			if *patch.Plan != "" {
+				if _, invalid = plans.plan(*patch.Plan); invalid != nil {
+					return invalid
+				}
+			}
+			u.Plan = *patch.Plan
+		}
+		switch s := string(patch.PagesPerMonth); {
+		case s == "":
+		case s == "null":
+			u.PagesPerMonth = nil
+		default:
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				invalid = errors.New("pages_per_month must be a number of pages, 0 for unlimited, or null")
+				return invalid
+			}
+			u.PagesPerMonth = &n
+		}
+		if patch.Disabled != nil {
+			u.Disabled = *patch.Disabled
+		}
+		if patch.Role != nil {
+			if invalid = checkRole(*patch.Role); invalid != nil {
+				return invalid
+			}
+			u.Role = *patch.Role
+		}
+		return nil
+	})
+	switch {
+	case !ok:
+		writeAPIError(w, http.StatusNotFound, "not_found", "no user named "+r.PathValue("name"))
+		return
+	case invalid != nil:
+		writeAPIError(w, http.StatusBadRequest, "invalid_user", invalid.Error())
+		return
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	v, _ := viewUser(u)
+	writeJSON(w, http.StatusOK, v)
+}
+
+// v1ResetUserKeysHandler revokes the user's stored API keys and issues a
+// new one with the scopes of the JSON body's "scopes", or of the newest
+// revoked key. Keys in the plans file are left alone; they can only be
+// removed there.
+func v1ResetUserKeysHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := users.get(name); !ok {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no user named "+name)
+		return
+	}
+	var body struct {
+		Scopes []string `json:"scopes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_json", err.Error())
+			return
+		}
+	}
+	if err := checkScopes(body.Scopes); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_key", err.Error())
+		return
+	}
+	revoked, err := apiKeys.revokeAccount(name)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	scopes := body.Scopes
+	if len(scopes) == 0 && len(revoked) > 0 {
+		scopes = revoked[len(revoked)-1].Scopes
+	}
+	key, k, err := apiKeys.create(StoredKey{Name: name, Scopes: scopes})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "storage_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"key": key, "api_key": k, "revoked": len(revoked)})
+}
+
+// v1UserJobsHandler lists the user's most recent jobs, newest first, up to
+// ?limit= (default 20).
+func v1UserJobsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := users.get(name); !ok {
+		writeAPIError(w, http.StatusNotFound, "not_found", "no user named "+name)
+		return
+	}
+	limit := 20
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_limit", "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+	list := jobs.list(func(j *Job) bool { return j.account == name })
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": list[:min(limit, len(list))], "total": len(list)})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"os"
+)
+
+// uploadProblem is one reason a file would be refused by POST /jobs. Code
+// is the error code the submission would answer with.
+type uploadProblem struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// uploadValidation is the verdict on one file of POST /jobs/validate.
+type uploadValidation struct {
+	Filename string          `json:"filename"`
+	Size     int64           `json:"size"`
+	Pages    int             `json:"pages,omitempty"`
+	Valid    bool            `json:"valid"`
+	Problems []uploadProblem `json:"problems"`
+}
+
+// v1ValidateHandler checks one or more files, each sent as a "file"
+// multipart field, the way POST /jobs would, but queues and charges
+// nothing. Every problem of every file is reported instead of only the
+// first: the file type, the plan's size and page limits, damaged, password-protected
+// or empty PDFs, the disk the job would need, and the monthly pages and
+// daily submissions left. Quotas are counted cumulatively, in the order
+// the files were sent, so a batch learns which of its files would no
+// longer fit. An "engine" form field checks against that engine.
+func v1ValidateHandler(w http.ResponseWriter, r *http.Request) {
+	account, plan, perr := plans.identify(r)
+	if perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+	if err := parseUploadForm(w, r, maxUploadSize); err != nil {
+		writeFormError(w, err, maxUploadSize)
+		return
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "missing_file", "send each file to check as a \"file\" field")
+		return
+	}
+	engine := r.FormValue("engine")
+	if engine == "" {
+		engine = defaultEngine
+	}
+	if perr := plan.checkUpload(0, engine); perr != nil {
+		writeAPIError(w, perr.Status, perr.Code, perr.Error())
+		return
+	}
+
+	pagesLeft := -1 // unlimited
+	if plan.PagesPerMonth > 0 {
+		pagesLeft = max(plan.PagesPerMonth-usage.month(account), 0)
+	}
+	submissionsLeft := limiter.submissionsLeft(r)
+
+	results := make([]uploadValidation, len(files))
+	allValid := true
+	for i, fh := range files {
+		v := validateUpload(fh, plan, engine)
+		if len(v.Problems) == 0 && pagesLeft >= 0 {
+			if v.Pages > pagesLeft {
+				v.Problems = append(v.Problems, uploadProblem{"page_quota_exceeded", fmt.Sprintf(
+					"the %s plan has %d pages left this month; this document has %d", plan.Name, pagesLeft, v.Pages)})
+			} else {
+				pagesLeft -= v.Pages
+			}
+		}
+		if len(v.Problems) == 0 && submissionsLeft >= 0 {
+			if submissionsLeft == 0 {
+				v.Problems = append(v.Problems, uploadProblem{"quota_exceeded", "Daily submission quota exceeded"})
+			} else {
+				submissionsLeft--
+			}
+		}
+		v.Valid = len(v.Problems) == 0
+		allValid = allValid && v.Valid
+		results[i] = v
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"valid": allValid, "files": results})
+}
+
+// validateUpload runs the per-file checks of a submission on fh.
+func validateUpload(fh *multipart.FileHeader, plan *Plan, engine string) uploadValidation {
+	v := uploadValidation{Filename: cleanUploadName(fh.Filename), Size: fh.Size, Problems: []uploadProblem{}}
+	problem := func(code string, err error) {
+		v.Problems = append(v.Problems, uploadProblem{code, err.Error()})
+	}
+	if perr := plan.checkUpload(fh.Size, engine); perr != nil {
+		problem(perr.Code, perr)
+	}
+	if !isUploadType(v.Filename) {
+		problem("unsupported_type", errUnsupportedType)
+		return v
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		problem("storage_error", err)
+		return v
+	}
+	spoolPath, _, err := spoolUpload(f)
+	f.Close()
+	if err != nil {
+		problem("storage_error", err)
+		return v
+	}
+	defer os.Remove(spoolPath)
+
+	if format := convertedFormat(v.Filename); format != "" {
+		err = convertToPDF(spoolPath, format, plan.pageLimit())
+	}
+	if err == nil {
+		_, err = checkPDF(spoolPath)
+	}
+	var pe *pdfError
+	var perr *planError
+	switch {
+	case errors.As(err, &pe):
+		problem(pe.Code, err)
+		return v
+	case errors.As(err, &perr):
+		problem(perr.Code, err)
+		return v
+	case err != nil:
+		problem("storage_error", err)
+		return v
+	}
+
+	est, err := checkResources(spoolPath)
+	v.Pages = est.Pages
+	if perr := checkPages(v.Pages, plan.pageLimit()); perr != nil {
+		problem(perr.Code, perr)
+	}
+	var re *resourceError
+	switch {
+	case errors.As(err, &re) && re.Storage:
+		problem("insufficient_storage", err)
+	case errors.As(err, &re):
+		problem("insufficient_memory", err)
+	case err != nil:
+		problem("storage_error", err)
+	}
+	return v
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// webDAVPrefix is where the read-only WebDAV view of the results is served.
+const webDAVPrefix = "/dav"
+
+// webDAVMethods are the methods a read-only WebDAV client needs to browse
+// and download.
+var webDAVMethods = []string{http.MethodOptions, http.MethodGet, http.MethodHead, "PROPFIND"}
+
+// webDAVHandler serves the finished jobs as a read-only WebDAV share that
+// file managers can mount as a network drive. Every done job is a folder
+// named after its upload with the short job ID appended, holding the
+// job's result files under their original, unsanitized names.
+func webDAVHandler() http.Handler {
+	locks := webdav.NewMemLS()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allow := strings.Join(webDAVMethods, ", ")
+		switch {
+		case r.Method == http.MethodOptions:
+			// The library's answer would advertise locking and writes.
+			w.Header().Set("Allow", allow)
+			w.Header().Set("DAV", "1")
+			return
+		case !slices.Contains(webDAVMethods, r.Method):
+			w.Header().Set("Allow", allow)
+			http.Error(w, "The results share is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		// File managers send the API key as the password, as paperless
+		// clients do.
+		paperlessKey(r)
+		v, perr := requestViewer(r)
+		if perr != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="OCR results"`)
+			http.Error(w, perr.Error(), perr.Status)
+			return
+		}
+		if basePath != "" {
+			// The library writes the hrefs of its answers with the
+			// prefix it strips, so it gets the path below the base path.
+			u := *r.URL
+			u.Path, u.RawPath = appPath(u.Path), ""
+			r = r.WithContext(r.Context())
+			r.URL = &u
+		}
+		h := &webdav.Handler{Prefix: appPath(webDAVPrefix), FileSystem: resultsFS{v}, LockSystem: locks}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// resultsFS is the webdav.FileSystem behind webDAVHandler, with the jobs
+// viewer may see. It is built from the job store on every call, so new
+// results appear immediately.
+type resultsFS struct {
+	viewer viewer
+}
+
+func (resultsFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (resultsFS) RemoveAll(ctx context.Context, name string) error { return os.ErrPermission }
+
+func (resultsFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fsys resultsFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	f, err := fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (fsys resultsFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	folder, file, _ := strings.Cut(strings.Trim(path.Clean("/"+name), "/"), "/")
+	if folder == "" {
+		return rootDir(fsys.viewer), nil
+	}
+	j, ok := jobForFolder(folder, fsys.viewer)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	files, err := jobResultFiles(j)
+	if err != nil {
+		return nil, err
+	}
+	if file == "" {
+		return &dirFile{info: dirInfo(folder, j.FinishedAt), entries: files}, nil
+	}
+	for _, fi := range files {
+		if fi.Name() == file {
+			f, err := openStored(filepath.Join(j.outputDir, fi.(renamedInfo).FileInfo.Name()))
+			if err != nil {
+				return nil, err
+			}
+			return readOnlyFile{f, fi}, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// webDAVFolder is the name of job j's folder: the uploaded file name
+// without its extension, and the short job ID to keep uploads of the same
+// name apart.
+func webDAVFolder(j Job) string {
+	return strings.TrimSuffix(j.Filename, filepath.Ext(j.Filename)) + " (" + j.ID[:8] + ")"
+}
+
+func jobForFolder(name string, v viewer) (Job, bool) {
+	if !strings.HasSuffix(name, ")") || len(name) < len(" (12345678)") {
+		return Job{}, false
+	}
+	id8 := name[len(name)-9 : len(name)-1]
+	found := jobs.list(func(j *Job) bool {
+		return j.Status == JobDone && v.sees(j) && strings.HasPrefix(j.ID, id8) && webDAVFolder(*j) == name
+	})
+	if len(found) == 0 {
+		return Job{}, false
+	}
+	return found[0], true
+}
+
+// rootDir lists the folders of the done jobs v may see. The share as a
+// whole was last modified when the newest of them finished.
+func rootDir(v viewer) *dirFile {
+	d := &dirFile{}
+	var newest *time.Time
+	for _, j := range jobs.list(func(j *Job) bool { return j.Status == JobDone && v.sees(j) }) {
+		d.entries = append(d.entries, dirInfo(webDAVFolder(j), j.FinishedAt))
+		if j.FinishedAt != nil && (newest == nil || j.FinishedAt.After(*newest)) {
+			newest = j.FinishedAt
+		}
+	}
+	d.info = dirInfo("/", newest)
+	return d
+}
+
+// jobResultFiles lists j's result files, named as the user uploaded them.
+func jobResultFiles(j Job) ([]os.FileInfo, error) {
+	paths, err := resultFiles(j.outputDir)
+	if err != nil {
+		return nil, err
+	}
+	var out []os.FileInfo
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		name := fi.Name()
+		if j.prefix != "" && strings.HasPrefix(name, j.prefix) {
+			name = j.displayPrefix + strings.TrimPrefix(name, j.prefix)
+		}
+		if storageCipher != nil {
+			fi = sizedInfo{fi, storedSize(p, fi)}
+		}
+		out = append(out, renamedInfo{fi, name})
+	}
+	return out, nil
+}
+
+// renamedInfo is a file's info under the name the share shows it with.
+type renamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi renamedInfo) Name() string { return fi.name }
+
+// memDir describes a directory of the share, which exists only in memory.
+type memDir struct {
+	name string
+	mod  time.Time
+}
+
+func (d memDir) Name() string       { return d.name }
+func (d memDir) Size() int64        { return 0 }
+func (d memDir) Mode() os.FileMode  { return fs.ModeDir | 0555 }
+func (d memDir) ModTime() time.Time { return d.mod }
+func (d memDir) IsDir() bool        { return true }
+func (d memDir) Sys() any           { return nil }
+
+func dirInfo(name string, mod *time.Time) os.FileInfo {
+	d := memDir{name: name}
+	if mod != nil {
+		d.mod = *mod
+	}
+	return d
+}
+
+// dirFile is an open directory of the share.
+type dirFile struct {
+	info    os.FileInfo
+	entries []os.FileInfo
+	read    int
+}
+
+func (d *dirFile) Close() error                   { return nil }
+func (d *dirFile) Read(p []byte) (int, error)     { return 0, os.ErrInvalid }
+func (d *dirFile) Seek(int64, int) (int64, error) { return 0, os.ErrInvalid }
+func (d *dirFile) Write(p []byte) (int, error)    { return 0, os.ErrPermission }
+func (d *dirFile) Stat() (os.FileInfo, error)     { return d.info, nil }
+
+func (d *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if d.read == 0 {
+		sort.Slice(d.entries, func(a, b int) bool { return d.entries[a].Name() < d.entries[b].Name() })
+	}
+	rest := d.entries[d.read:]
+	if count <= 0 {
+		d.read = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(count, len(rest))]
+	d.read += len(rest)
+	return rest, nil
+}
+
+// readOnlyFile is an open result file.
+type readOnlyFile struct {
+	http.File
+	info os.FileInfo
+}
+
+func (f readOnlyFile) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+func (f readOnlyFile) Stat() (os.FileInfo, error)  { return f.info, nil }
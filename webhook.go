@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// WebhookEndpoint is one entry of the webhooks file.
+type WebhookEndpoint struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"` // empty means every event
+}
+
+// loadWebhooks reads a JSON array of endpoints from path.
+func loadWebhooks(path string) ([]WebhookEndpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var eps []WebhookEndpoint
+	if err := json.Unmarshal(data, &eps); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, ep := range eps {
+		if ep.URL == "" {
+			return nil, fmt.Errorf("parsing %s: webhook %d has no url", path, i)
+		}
+	}
+	return eps, nil
+}
+
+// webhookNotifier POSTs job events as JSON to one endpoint. When the
+// endpoint has a secret the body is signed so receivers can verify it came
+// from this server and reject replays. Failed deliveries are retried with
+// exponential backoff and end up in the dead-letter store once attempts
+// are exhausted.
+type webhookNotifier struct {
+	ep       WebhookEndpoint
+	attempts int
+	client   *http.Client // nil for notifyHTTPClient
+}
+
+// webhookBackoff is the delay before the first retry; it doubles after
+// every further failure.
+const webhookBackoff = 2 * time.Second
+
+var (
+	deadLetters  *deadLetterStore
+	webhookByURL = map[string]*webhookNotifier{}
+)
+
+func addWebhook(ep WebhookEndpoint, attempts int) {
+	n := &webhookNotifier{ep: ep, attempts: max(attempts, 1)}
+	webhookByURL[ep.URL] = n
+	addNotifier(n)
+}
+
+func (n *webhookNotifier) Name() string { return "webhook " + n.ep.URL }
+
+func (n *webhookNotifier) Notify(ev JobEvent) error {
+	if len(n.ep.Events) > 0 && !slices.Contains(n.ep.Events, ev.Event) {
+		return nil
+	}
+
+	var err error
+	delay := webhookBackoff
+	for attempt := 1; attempt <= n.attempts; attempt++ {
+		if err = n.send(ev.Event, ev); err == nil {
+			return nil
+		}
+		if attempt < n.attempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	dl := DeadLetter{
+		ID:        newID(),
+		Endpoint:  n.ep.URL,
+		Event:     ev,
+		Attempts:  n.attempts,
+		LastError: err.Error(),
+		FailedAt:  time.Now().UTC(),
+	}
+	if derr := deadLetters.add(dl); derr != nil {
+		return fmt.Errorf("%v (and saving dead letter failed: %v)", err, derr)
+	}
+	return fmt.Errorf("giving up after %d attempts, moved to dead letters as %s: %w", n.attempts, dl.ID, err)
+}
+
+// send makes a single delivery attempt of payload for event.
+func (n *webhookNotifier) send(event string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event", event)
+	if n.ep.Secret != "" {
+		ts := time.Now().Unix()
+		req.Header.Set("X-Signature-Timestamp", strconv.FormatInt(ts, 10))
+		req.Header.Set("X-Signature", signWebhook(n.ep.Secret, ts, body))
+	}
+
+	client := n.client
+	if client == nil {
+		client = notifyHTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the X-Signature value for body sent at ts:
+// "t=<unix>,v1=<hex HMAC-SHA256 of "<unix>.<body>">". Including the
+// timestamp in the MAC lets receivers refuse stale, replayed deliveries.
+func signWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A job's results can be exported as an Excel workbook, for routing rules
+// that hand documents to spreadsheet users: a Document sheet with the job's
+// metadata, tags and template region fields, and a Text sheet with one row
+// per line of recognized text. The workbook is written by hand with inline
+// strings, the smallest package Excel and LibreOffice open.
+
+// xlsxSheet is one worksheet: rows of string and number cells.
+type xlsxSheet struct {
+	Name string
+	RTL  bool // laid out right to left, for Persian text
+	Rows [][]any
+}
+
+// maxXLSXCell is the most characters Excel keeps in a cell.
+const maxXLSXCell = 32767
+
+var pageHeader = regexp.MustCompile(`^--- Page (\d+) ---$`)
+
+// writeJobWorkbook writes the workbook of done job j to path.
+func writeJobWorkbook(j Job, path string) error {
+	doc := xlsxSheet{Name: "Document", Rows: [][]any{
+		{"field", "value"},
+		{"file", j.Filename},
+		{"job", j.ID},
+		{"created_at", j.CreatedAt.UTC().Format("2006-01-02 15:04:05")},
+	}}
+	if j.Class != nil {
+		doc.Rows = append(doc.Rows, []any{"class", j.Class.Class}, []any{"class_confidence", j.Class.Confidence})
+	}
+	if j.Confidence != nil {
+		doc.Rows = append(doc.Rows, []any{"confidence", *j.Confidence})
+	}
+	for _, k := range sortedKeys(j.Tags) {
+		doc.Rows = append(doc.Rows, []any{"tag:" + k, j.Tags[k]})
+	}
+	fields := regionFields(j)
+	for _, k := range sortedKeys(fields) {
+		doc.Rows = append(doc.Rows, []any{"field:" + k, fields[k]})
+	}
+
+	data, err := readStored(filepath.Join(j.outputDir, j.prefix+".txt"))
+	if err != nil {
+		return err
+	}
+	text := xlsxSheet{Name: "Text", Rows: [][]any{{"page", "line", "text"}}}
+	page, line, rtl := 1, 0, 0
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		s := strings.TrimSpace(sc.Text())
+		if m := pageHeader.FindStringSubmatch(s); m != nil {
+			page, _ = strconv.Atoi(m[1])
+			line = 0
+			continue
+		}
+		if s == "" {
+			continue
+		}
+		line++
+		text.Rows = append(text.Rows, []any{page, line, s})
+		for _, r := range s {
+			switch {
+			case unicode.Is(unicode.Arabic, r):
+				rtl++
+			case unicode.IsLetter(r):
+				rtl--
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	text.RTL, doc.RTL = rtl > 0, rtl > 0
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeXLSX(f, []xlsxSheet{doc, text}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+const (
+	xlsxMainNS = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	xlsxRelNS  = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	xlsxPkgNS  = "http://schemas.openxmlformats.org/package/2006/relationships"
+)
+
+// writeXLSX writes a workbook of the sheets to w.
+func writeXLSX(w io.Writer, sheets []xlsxSheet) error {
+	zw := zip.NewWriter(w)
+	var types, sheetList, rels strings.Builder
+	types.WriteString(xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	for i, s := range sheets {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&sheetList, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(s.Name), n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="%s/worksheet" Target="worksheets/sheet%d.xml"/>`, n, xlsxRelNS, n)
+	}
+	types.WriteString(`</Types>`)
+
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", types.String()},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="` + xlsxPkgNS + `">` +
+			`<Relationship Id="rId1" Type="` + xlsxRelNS + `/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", xml.Header + `<workbook xmlns="` + xlsxMainNS + `" xmlns:r="` + xlsxRelNS + `"><sheets>` +
+			sheetList.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="` + xlsxPkgNS + `">` + rels.String() + `</Relationships>`},
+	}
+	for i, s := range sheets {
+		parts = append(parts, struct{ name, body string }{fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), sheetXML(s)})
+	}
+	for _, p := range parts {
+		fw, err := zw.Create(p.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, p.body); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func sheetXML(s xlsxSheet) string {
+	var b strings.Builder
+	b.WriteString(xml.Header + `<worksheet xmlns="` + xlsxMainNS + `">`)
+	if s.RTL {
+		b.WriteString(`<sheetViews><sheetView rightToLeft="1" workbookViewId="0"/></sheetViews>`)
+	}
+	b.WriteString(`<sheetData>`)
+	for i, row := range s.Rows {
+		fmt.Fprintf(&b, `<row r="%d">`, i+1)
+		for c, v := range row {
+			ref := xlsxColumn(c) + strconv.Itoa(i+1)
+			switch v := v.(type) {
+			case int:
+				fmt.Fprintf(&b, `<c r="%s"><v>%d</v></c>`, ref, v)
+			case float64:
+				fmt.Fprintf(&b, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(v, 'f', -1, 64))
+			default:
+				text := []rune(fmt.Sprint(v))
+				if len(text) > maxXLSXCell {
+					text = text[:maxXLSXCell]
+				}
+				fmt.Fprintf(&b, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, xmlEscape(string(text)))
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.String()
+}
+
+// xlsxColumn returns the letters of column i, counted from 0.
+func xlsxColumn(i int) string {
+	var s string
+	for i++; i > 0; i = (i - 1) / 26 {
+		s = string(rune('A'+(i-1)%26)) + s
+	}
+	return s
+}
+
+// xmlEscape escapes s for XML text and attributes; characters XML cannot
+// hold become U+FFFD.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}